@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"time"
+)
+
+// Settings for SetAdaptiveTTL.
+type AdaptiveTTLOptions struct {
+	// The expirations given to the keys that are never read, and to the
+	// keys read HotHits times or more within Window.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Defaults to 16, and can't be more than 255.
+	HotHits int
+	// How long hits are remembered. Counts are halved every Window. Defaults
+	// to 10 minutes.
+	Window time.Duration
+}
+
+type adaptiveTTL struct {
+	opts AdaptiveTTLOptions
+	hits *frequencySketch
+}
+
+// Makes the items set with DefaultExpiration expire after a duration between
+// MinTTL and MaxTTL, depending on how often their key has recently been read:
+// keys that are hit often are kept longer, and keys that are rarely hit make
+// room sooner. Durations passed explicitly to Set are not changed. Hits are
+// counted approximately, in a fixed amount of memory.
+func (c *cache) SetAdaptiveTTL(o AdaptiveTTLOptions) {
+	if o.HotHits <= 0 {
+		o.HotHits = 16
+	} else if o.HotHits > 255 {
+		o.HotHits = 255
+	}
+	if o.Window <= 0 {
+		o.Window = 10 * time.Minute
+	}
+	if o.MaxTTL < o.MinTTL {
+		o.MaxTTL = o.MinTTL
+	}
+	c.adaptiveTTL.Store(&adaptiveTTL{
+		opts: o,
+		hits: newFrequencySketch(doorkeeperWidth, o.Window),
+	})
+}
+
+// Returns the expiration of an item of k set with DefaultExpiration.
+func (c *cache) defaultExpirationOf(k string) time.Duration {
+	a, ok := c.adaptiveTTL.Load().(*adaptiveTTL)
+	if !ok {
+		return c.defaultExpiration
+	}
+	hits := a.hits.estimate(k)
+	if hits > a.opts.HotHits {
+		hits = a.opts.HotHits
+	}
+	return a.opts.MinTTL + (a.opts.MaxTTL-a.opts.MinTTL)*time.Duration(hits)/time.Duration(a.opts.HotHits)
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"time"
+)
+
+// Decides whether an item is stored when it's set, to keep keys that are only
+// set once from pushing more useful items out of the cache.
+type AdmissionPolicy interface {
+	// Called on every Set of k; returns true if the item should be stored.
+	Admit(k string) bool
+}
+
+// Number of counters per row of a doorkeeper's frequency sketch.
+const doorkeeperWidth = 1 << 16
+
+type doorkeeper struct {
+	sketch *frequencySketch
+	n      int
+}
+
+func (d *doorkeeper) Admit(k string) bool {
+	return d.sketch.add(k) >= d.n
+}
+
+// Returns an admission policy that only stores an item once its key has been
+// set n times within roughly window, e.g. on the second miss of a cache-aside
+// lookup when n is 2. Counts are kept in a fixed size frequency sketch and
+// halved every window, so frequently set keys stay admitted.
+func Doorkeeper(n int, window time.Duration) AdmissionPolicy {
+	return &doorkeeper{
+		sketch: newFrequencySketch(doorkeeperWidth, window),
+		n:      n,
+	}
+}
+
+// Sets an (optional) admission policy deciding whether items are stored when
+// they are set with Set or SetBytes. When an item isn't admitted, any
+// existing item for the key is deleted rather than left stale.
+func (c *cache) SetAdmissionPolicy(p AdmissionPolicy) {
+	c.storage.Lock()
+	c.admission = p
+	c.storage.Unlock()
+}
+
+// Returns false if the admission policy rejects k, in which case any existing
+// item for k has been deleted. Called with the storage lock held.
+func (c *cache) admit(k string) bool {
+	if c.admits(k) {
+		return true
+	}
+	c.delete(k)
+	return false
+}
+
+// Returns whether the admission policy, if any, admits k. Called with the
+// storage lock held.
+func (c *cache) admits(k string) bool {
+	return c.admission == nil || c.admission.Admit(k)
+}
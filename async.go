@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The defaults of AsyncOptions.
+const (
+	DefaultAsyncWorkers   = 4
+	DefaultAsyncQueueSize = 1024
+)
+
+// Returned by SetAsync when the queue of pending writes is full. The write is
+// dropped.
+var ErrAsyncQueueFull = errors.New("async write queue is full")
+
+// Settings for the workers applying the writes queued by SetAsync.
+type AsyncOptions struct {
+	// Number of writes applied concurrently. Defaults to DefaultAsyncWorkers.
+	Workers int
+	// Number of writes that can be pending before SetAsync drops them.
+	// Defaults to DefaultAsyncQueueSize.
+	QueueSize int
+	// Called by the workers with the key of every write that failed. Errors
+	// are logged if it is nil.
+	OnError func(key string, err error)
+}
+
+type asyncWrite struct {
+	key  string
+	item Item
+}
+
+type asyncWriter struct {
+	writes  chan asyncWrite
+	onError func(string, error)
+	pending int64 // updated atomically, as are the counters below
+	failed  int64
+	dropped int64
+}
+
+// Starts the workers applying the writes queued by SetAsync. Has no effect if
+// they are already running; SetAsync starts them with the default options
+// otherwise.
+func (c *cache) StartAsyncWrites(o AsyncOptions) {
+	c.asyncOnce.Do(func() {
+		if o.Workers <= 0 {
+			o.Workers = DefaultAsyncWorkers
+		}
+		if o.QueueSize <= 0 {
+			o.QueueSize = DefaultAsyncQueueSize
+		}
+		w := &asyncWriter{
+			writes:  make(chan asyncWrite, o.QueueSize),
+			onError: o.OnError,
+		}
+		for i := 0; i < o.Workers; i++ {
+			go c.asyncWorker(w)
+		}
+		c.async.Store(w)
+	})
+}
+
+// Like Set, but queues the write and returns without waiting for the storage.
+// The expiration and refresh deadline count from the call, not from the
+// write. Returns ErrAsyncQueueFull, dropping the write, if too many writes are
+// pending; errors from the storage are reported to AsyncOptions.OnError.
+func (c *cache) SetAsync(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	if err := c.validate(k, x); err != nil {
+		return err
+	}
+	c.StartAsyncWrites(AsyncOptions{})
+	w := c.async.Load().(*asyncWriter)
+	atomic.AddInt64(&w.pending, 1)
+	select {
+	case w.writes <- asyncWrite{k, c.newItem(k, x, d, rd)}:
+		return nil
+	default:
+		atomic.AddInt64(&w.pending, -1)
+		atomic.AddInt64(&w.dropped, 1)
+		return ErrAsyncQueueFull
+	}
+}
+
+func (c *cache) asyncWorker(w *asyncWriter) {
+	for write := range w.writes {
+		if err := c.applyAsync(write); err != nil {
+			atomic.AddInt64(&w.failed, 1)
+			if w.onError != nil {
+				w.onError(write.key, err)
+			} else {
+				log.Errorf("error setting %s : %s", write.key, err)
+			}
+		}
+		atomic.AddInt64(&w.pending, -1)
+	}
+}
+
+func (c *cache) applyAsync(write asyncWrite) error {
+	if c.bypassWrites() {
+		c.Delete(write.key)
+		return nil
+	}
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	if !c.admit(write.key) {
+		return nil
+	}
+	if err := trySet(c.storage, write.key, write.item); err != nil {
+		return err
+	}
+	c.written(write.key, write.item)
+	return nil
+}
+
+func (w *asyncWriter) reportStats(st *Stats) {
+	st.AsyncPending = atomic.LoadInt64(&w.pending)
+	st.AsyncFailed = atomic.LoadInt64(&w.failed)
+	st.AsyncDropped = atomic.LoadInt64(&w.dropped)
+}
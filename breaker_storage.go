@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// The breaker is closed: operations go to the storage.
+	BreakerClosed = "closed"
+	// The breaker is open: operations are short-circuited until the cooldown
+	// period is over.
+	BreakerOpen = "open"
+	// The cooldown period is over: the next operation is let through to find
+	// out whether the storage has recovered, and the others short-circuited
+	// until it returns.
+	BreakerHalfOpen = "half-open"
+)
+
+// Returned by the checked operations of a BreakerStorage while it is open.
+var errBreakerOpen error = &kindError{ErrStorageUnavailable, "circuit breaker is open"}
+
+// Settings for BreakerStorage. The zero value gives the defaults.
+type BreakerOptions struct {
+	// Number of consecutive failures after which the breaker opens. Defaults
+	// to 5.
+	Threshold int
+	// How long the breaker stays open before letting an operation through
+	// again. Defaults to 10 seconds.
+	Cooldown time.Duration
+	// If not nil, reads and writes are sent to Fallback while the breaker is
+	// open, e.g. an in-memory storage standing in for Redis. Otherwise reads
+	// are misses and writes are dropped.
+	Fallback Storage
+}
+
+type breakerStorage struct {
+	Storage
+	opts        BreakerOptions
+	mutex       sync.Mutex // guards the fields below
+	state       string
+	failures    int
+	openUntil   time.Time
+	probing     bool // an operation was let through while half-open
+	trips       int64
+	lockMutex   sync.Mutex // serializes Lock holders
+	innerLocked bool
+}
+
+// Reports whether an operation may be sent to the storage. While half-open,
+// only the first operation is, and its outcome must be recorded (see record)
+// or dropped (see release) before another one can be.
+func (s *breakerStorage) allow() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch s.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if timeNow().Before(s.openUntil) {
+			return false
+		}
+		s.state = BreakerHalfOpen
+	}
+	if s.probing {
+		return false
+	}
+	s.probing = true
+	return true
+}
+
+// Reports whether the breaker is closed or the cooldown is over, without
+// letting an operation through.
+func (s *breakerStorage) available() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state != BreakerOpen || !timeNow().Before(s.openUntil)
+}
+
+// Lets another operation through while half-open, after one whose outcome
+// isn't known.
+func (s *breakerStorage) release() {
+	s.mutex.Lock()
+	s.probing = false
+	s.mutex.Unlock()
+}
+
+// Records the outcome of an operation sent to the storage.
+func (s *breakerStorage) record(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.probing = false
+	if err == nil {
+		s.state = BreakerClosed
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.state == BreakerHalfOpen || (s.state == BreakerClosed && s.failures >= s.opts.Threshold) {
+		s.state = BreakerOpen
+		s.openUntil = timeNow().Add(s.opts.Cooldown)
+		s.trips++
+		log.Errorf("circuit breaker opened after %d failures, last error: %s", s.failures, err)
+	}
+}
+
+func (s *breakerStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *breakerStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *breakerStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil && err != errBreakerOpen {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *breakerStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil && err != errBreakerOpen {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *breakerStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+func (s *breakerStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	if !s.allow() {
+		if s.opts.Fallback != nil {
+			s.opts.Fallback.RLock()
+			item, found, err := tryGetObject(s.opts.Fallback, key, o)
+			s.opts.Fallback.RUnlock()
+			return item, found, err
+		}
+		return Item{}, false, errBreakerOpen
+	}
+	item, found, err := tryGetObject(s.Storage, key, o)
+	s.record(err)
+	return item, found, err
+}
+
+func (s *breakerStorage) TrySet(key string, item Item) error {
+	if !s.allow() {
+		if s.opts.Fallback != nil {
+			s.opts.Fallback.Lock()
+			err := trySet(s.opts.Fallback, key, item)
+			s.opts.Fallback.Unlock()
+			return err
+		}
+		return errBreakerOpen
+	}
+	err := trySet(s.Storage, key, item)
+	s.record(err)
+	return err
+}
+
+func (s *breakerStorage) TryDel(key string) error {
+	if !s.allow() {
+		if s.opts.Fallback != nil {
+			s.opts.Fallback.Lock()
+			err := tryDel(s.opts.Fallback, key)
+			s.opts.Fallback.Unlock()
+			return err
+		}
+		return errBreakerOpen
+	}
+	err := tryDel(s.Storage, key)
+	s.record(err)
+	return err
+}
+
+func (s *breakerStorage) Flush() {
+	if s.allow() {
+		s.Storage.Flush()
+		s.release()
+	}
+	if s.opts.Fallback != nil {
+		s.opts.Fallback.Flush()
+	}
+}
+
+// Takes the storage's lock only while the breaker lets operations through,
+// so that callers don't wait for the lock of a storage that is down.
+func (s *breakerStorage) Lock() {
+	s.lockMutex.Lock()
+	if s.available() {
+		s.Storage.Lock()
+		s.innerLocked = true
+	}
+}
+
+func (s *breakerStorage) Unlock() {
+	if s.innerLocked {
+		s.innerLocked = false
+		s.Storage.Unlock()
+	}
+	s.lockMutex.Unlock()
+}
+
+func (s *breakerStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+func (s *breakerStorage) reportStats(st *Stats) {
+	s.mutex.Lock()
+	st.BreakerState = s.state
+	if st.BreakerState == BreakerOpen && !timeNow().Before(s.openUntil) {
+		st.BreakerState = BreakerHalfOpen
+	}
+	st.BreakerTrips = s.trips
+	s.mutex.Unlock()
+}
+
+// Returns a storage that stops sending operations to s after Threshold
+// consecutive failures, for Cooldown. While the breaker is open, operations
+// fail immediately (or are served by the fallback storage) instead of each
+// waiting for s to time out. Once Cooldown is over, a single operation is sent
+// to s, and the breaker closes if it succeeds or opens again if it fails. Only
+// storages that report their errors (see CheckedStorage) can trip the breaker.
+func BreakerStorage(s Storage, o BreakerOptions) *breakerStorage {
+	if o.Threshold <= 0 {
+		o.Threshold = 5
+	}
+	if o.Cooldown <= 0 {
+		o.Cooldown = 10 * time.Second
+	}
+	return &breakerStorage{
+		Storage: s,
+		opts:    o,
+		state:   BreakerClosed,
+	}
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Settings for AutoBypass. The cache is bypassed while any threshold is
+// exceeded, and until none has been for ResumeAfter checks in a row.
+type BypassOptions struct {
+	// Bypass the cache while the Go heap holds more than this many bytes.
+	// Zero means the heap isn't checked.
+	MaxHeapBytes uint64
+	// Once bypassed because of the heap, only resume below this many bytes.
+	// Defaults to 90% of MaxHeapBytes.
+	ResumeHeapBytes uint64
+	// Bypass the cache while this returns true, e.g. when the storage's
+	// circuit breaker is open or its error rate is too high.
+	Overloaded func() bool
+	// How often the thresholds are checked. Defaults to 1 second.
+	CheckInterval time.Duration
+	// The number of checks in a row within the thresholds needed to stop
+	// bypassing the cache. Defaults to 3.
+	ResumeAfter int
+	// While bypassed, still serve the items already in the cache, instead
+	// of missing on every Get.
+	ServeExisting bool
+}
+
+// Turns the cache into a pass-through, or back: while bypassed, Set and
+// SetBytes don't store anything and every Get misses, so that callers go
+// straight to the source of the data. Set and SetBytes still delete the
+// existing item, so that it isn't stale once the cache is used again.
+func (c *cache) SetBypass(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.bypassManual, v)
+}
+
+// Bypasses the cache automatically while the given thresholds are exceeded
+// (see BypassOptions), in addition to SetBypass. Replaces the thresholds set
+// by a previous call; options without any threshold stop the automatic
+// bypass.
+func (c *cache) AutoBypass(o BypassOptions) {
+	c.storage.Lock()
+	if c.stopAutoBypass != nil {
+		close(c.stopAutoBypass)
+		c.stopAutoBypass = nil
+	}
+	atomic.StoreInt32(&c.bypassAuto, 0)
+	if o.MaxHeapBytes == 0 && o.Overloaded == nil {
+		c.storage.Unlock()
+		return
+	}
+	if o.ResumeHeapBytes == 0 {
+		o.ResumeHeapBytes = o.MaxHeapBytes / 10 * 9
+	}
+	if o.CheckInterval <= 0 {
+		o.CheckInterval = time.Second
+	}
+	if o.ResumeAfter < 1 {
+		o.ResumeAfter = 3
+	}
+	var serve int32
+	if o.ServeExisting {
+		serve = 1
+	}
+	atomic.StoreInt32(&c.bypassServeExisting, serve)
+	c.stopAutoBypass = make(chan bool)
+	go c.monitorBypass(o, c.stopAutoBypass)
+	c.storage.Unlock()
+}
+
+func (c *cache) monitorBypass(o BypassOptions, stop chan bool) {
+	ticker := time.NewTicker(o.CheckInterval)
+	defer ticker.Stop()
+	calm := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		bypassed := atomic.LoadInt32(&c.bypassAuto) != 0
+		pressure := o.Overloaded != nil && o.Overloaded()
+		if o.MaxHeapBytes > 0 {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			if bypassed {
+				pressure = pressure || ms.HeapAlloc > o.ResumeHeapBytes
+			} else {
+				pressure = pressure || ms.HeapAlloc > o.MaxHeapBytes
+			}
+		}
+		switch {
+		case pressure:
+			calm = 0
+			atomic.StoreInt32(&c.bypassAuto, 1)
+		case bypassed:
+			if calm++; calm >= o.ResumeAfter {
+				atomic.StoreInt32(&c.bypassAuto, 0)
+			}
+		}
+	}
+}
+
+// Returns true if writes should be dropped.
+func (c *cache) bypassWrites() bool {
+	return atomic.LoadInt32(&c.bypassManual) != 0 || atomic.LoadInt32(&c.bypassAuto) != 0
+}
+
+// Returns true if reads should miss.
+func (c *cache) bypassReads() bool {
+	if atomic.LoadInt32(&c.bypassManual) != 0 {
+		return true
+	}
+	return atomic.LoadInt32(&c.bypassAuto) != 0 && atomic.LoadInt32(&c.bypassServeExisting) == 0
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Implemented by storages that can store []byte values as is, without
+// encoding them or boxing them in an interface.
+type BytesStorage interface {
+	SetBytes(key string, b []byte, expiration, refreshDeadline int64)
+	GetBytes(key string) (b []byte, expiration, refreshDeadline int64, found bool)
+}
+
+// Add a []byte value to the cache, replacing any existing item. Durations are
+// interpreted as for Set. If the storage supports it (see BytesStorage), the
+// value is stored without being encoded; it must then be read with GetBytes.
+func (c *cache) SetBytes(k string, b []byte, d time.Duration, rd time.Duration) {
+	if c.bypassWrites() {
+		c.Delete(k)
+		return
+	}
+	bs, ok := c.storage.(BytesStorage)
+	if !ok {
+		c.Set(k, b, d, rd)
+		return
+	}
+	if err := c.validate(k, b); err != nil {
+		log.Errorf("error setting %s : %s", k, err)
+		return
+	}
+	var e int64
+	var erd int64
+	if d == DefaultExpiration {
+		d = c.defaultExpirationOf(k)
+	}
+	if rd == DefaultRefreshDeadline {
+		rd = c.defaultRefreshDeadline
+	}
+	if d > 0 {
+		e = timeNow().Add(d).UnixNano()
+	}
+	if rd > 0 {
+		erd = timeNow().Add(rd).UnixNano()
+	}
+	c.storage.Lock()
+	if !c.admit(k) {
+		c.storage.Unlock()
+		return
+	}
+	bs.SetBytes(k, b, e, erd)
+	c.written(k, Item{Object: b, Expiration: e, RefreshDeadline: erd})
+	c.storage.Unlock()
+}
+
+// Get a []byte value set with SetBytes. Returns the value or nil, and a bool
+// indicating whether the key was found. Depending on the storage, the
+// returned slice may be shared with the cache and must not be modified.
+func (c *cache) GetBytes(k string) ([]byte, bool) {
+	if c.bypassReads() {
+		return nil, false
+	}
+	bs, ok := c.storage.(BytesStorage)
+	if !ok {
+		x, found := c.Get(k)
+		if !found {
+			return nil, false
+		}
+		b, ok := x.([]byte)
+		if ok {
+			c.countKey(k, MetricBytes, int64(len(b)))
+		}
+		return b, ok
+	}
+	c.storage.RLock()
+	b, e, rd, found := bs.GetBytes(k)
+	if found {
+		if t, ok := c.storage.(accessTracker); ok {
+			t.touch(k)
+		}
+	}
+	c.storage.RUnlock()
+	if !found {
+		c.countKey(k, MetricMisses, 1)
+		return nil, false
+	}
+	now := timeNow().UnixNano()
+	if e > 0 && now > e {
+		c.countKey(k, MetricMisses, 1)
+		return nil, false
+	}
+	if rd > 0 && c.refreshDue(k, rd) {
+		c.queueRefresh(k)
+	}
+	c.countKey(k, MetricHits, 1)
+	c.countKey(k, MetricBytes, int64(len(b)))
+	return b, true
+}
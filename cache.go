@@ -1,16 +1,31 @@
 package cache
 
 import (
-	"fmt"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 type Item struct {
 	Object          interface{}
 	Expiration      int64
 	RefreshDeadline int64
+	// When the item was set, in Unix nanoseconds. Not kept by the Redis
+	// storages.
+	CreatedAt int64
+	// How long producing the value took, as recorded by SetWithCost or Fetch.
+	// Only kept by the memory storages.
+	Cost time.Duration
+	// Set with SetWithMetadata. Only kept by the memory and Redis storages.
+	Metadata map[string]string
+	// When the item was last read, and how many times it has been read, if
+	// the storage tracks access (see MemoryOptions.TrackAccess). Only filled
+	// in by InspectItem.
+	LastAccess int64
+	HitCount   int64
 }
 
 // Returns true if the item has expired.
@@ -18,7 +33,7 @@ func (item Item) Expired() bool {
 	if item.Expiration == 0 {
 		return false
 	}
-	return time.Now().UnixNano() > item.Expiration
+	return timeNow().UnixNano() > item.Expiration
 }
 
 // Returns true if the item has reached its refresh deadline.
@@ -26,7 +41,7 @@ func (item Item) RefreshDeadlineReached() bool {
 	if item.RefreshDeadline == 0 {
 		return false
 	}
-	return time.Now().UnixNano() > item.RefreshDeadline
+	return timeNow().UnixNano() > item.RefreshDeadline
 }
 
 const (
@@ -38,6 +53,10 @@ const (
 	// passing in the same expiration duration as was given to New() or
 	// NewFrom() when the cache was created (e.g. 5 minutes.)
 	DefaultExpiration time.Duration = 0
+	// For use with functions that take a refresh deadline. Equivalent to
+	// passing in the duration given to SetDefaultRefreshDeadline (or
+	// NoRefreshDeadline if it wasn't called).
+	DefaultRefreshDeadline time.Duration = -2
 )
 
 type Cache struct {
@@ -47,70 +66,154 @@ type Cache struct {
 
 type cache struct {
 	defaultExpiration       time.Duration
+	defaultRefreshDeadline  time.Duration
 	storage                 Storage
 	onRefreshNeeded         func(string)
 	refreshConcurrencyMap   map[string]bool
+	refreshWaits            map[string]chan bool // closed when the key's refresh is done
+	refreshWaitsMutex       sync.Mutex
 	refreshConcurrencyMutex sync.Mutex
-	refreshKeys             chan string
+	refreshKeys             chan string // of RefreshPriorityNormal
+	refreshHigh             chan string
+	refreshLow              chan string
+	refreshPriorities       atomic.Value // []refreshPriorityRule
+	refreshPrioritiesMutex  sync.Mutex
+	refresh                 refreshPool
+	refreshCooldown         int64        // a time.Duration, updated atomically
+	refreshErrorHandler     atomic.Value // func(string, error)
+	keyMutexes              [keyMutexStripes]sync.Mutex
+	refreshSkew             atomic.Value // refreshSkew
+	refreshLease            atomic.Value // *refreshLease
+	keyStats                atomic.Value // *keyStats
+	prefixStats             atomic.Value // *prefixStats
+	copyOnRead              atomic.Value // func(interface{}) (interface{}, error)
+	validator               atomic.Value // func(string, interface{}) error
+	mutations               mutationChecker
+	mutationCheck           int32 // a MutationCheck, updated atomically
+	etags                   etags
+	costs                   costs
+	namespaceGens           namespaceGenerations
+	tombstones              tombstones
+	quotaWindows            quotaWindows
+	tokenBuckets            tokenBuckets
+	adaptiveTTL             atomic.Value // *adaptiveTTL
+	admission               AdmissionPolicy
+	expireCallbacks         *expireCallbacks
+	// Set atomically by SetBypass and AutoBypass.
+	bypassManual        int32
+	bypassAuto          int32
+	bypassServeExisting int32
+	stopAutoBypass      chan bool
+	bus                 atomic.Value // *invalidationBus
+	asyncOnce           sync.Once
+	async               atomic.Value // *asyncWriter
+	quotas              atomic.Value // map[string]*namespaceUsage
+	quotasMutex         sync.Mutex
+	pins                pins
+	// Set atomically by SetDeterministic.
+	deterministic          int32
+	deferredRefreshes      []string
+	deferredRefreshesMutex sync.Mutex
+	fetches                map[string]*fetchCall
+	fetchesMutex           sync.Mutex
+	failureTTL             int64 // a time.Duration, updated atomically
 }
 
 // Add an item to the cache, replacing any existing item. If the duration is 0
 // (DefaultExpiration), the cache's default expiration time is used. If it is -1
-// (NoExpiration), the item never expires.
+// (NoExpiration), the item never expires. x may be nil: Get then returns nil
+// and true, whatever the storage.
 func (c *cache) Set(k string, x interface{}, d time.Duration, rd time.Duration) {
+	if err := c.validate(k, x); err != nil {
+		log.Errorf("error setting %s : %s", k, err)
+		return
+	}
+	c.store(k, x, d, rd)
+}
+
+// Set without validating x.
+func (c *cache) store(k string, x interface{}, d time.Duration, rd time.Duration) {
+	if c.bypassWrites() {
+		c.Delete(k)
+		return
+	}
 	// "Inlining" of set
 	var e int64
 	var erd int64
+	now := timeNow()
 	if d == DefaultExpiration {
-		d = c.defaultExpiration
+		d = c.defaultExpirationOf(k)
+	}
+	if rd == DefaultRefreshDeadline {
+		rd = c.defaultRefreshDeadline
 	}
 	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
+		e = now.Add(d).UnixNano()
 	}
 	if rd > 0 {
-		erd = time.Now().Add(rd).UnixNano()
+		erd = now.Add(rd).UnixNano()
 	}
 	c.storage.Lock()
+	if !c.admit(k) {
+		c.storage.Unlock()
+		return
+	}
 	item := Item{
-		Object:     x,
-		Expiration: e,
+		Object:          x,
+		Expiration:      e,
 		RefreshDeadline: erd,
+		CreatedAt:       now.UnixNano(),
 	}
 	c.storage.Set(k, item)
+	c.written(k, item)
 	// TODO: Calls to mu.Unlock are currently not deferred because defer
 	// adds ~200 ns (as of go1.)
 	c.storage.Unlock()
 }
 
 func (c *cache) set(k string, x interface{}, d time.Duration, rd time.Duration) {
+	item := c.newItem(k, x, d, rd)
+	c.storage.Set(k, item)
+	c.written(k, item)
+}
+
+// Returns an item of k holding x that expires after d and should be refreshed
+// after rd, from now.
+func (c *cache) newItem(k string, x interface{}, d time.Duration, rd time.Duration) Item {
 	var e int64
 	var erd int64
+	now := timeNow()
 	if d == DefaultExpiration {
-		d = c.defaultExpiration
+		d = c.defaultExpirationOf(k)
+	}
+	if rd == DefaultRefreshDeadline {
+		rd = c.defaultRefreshDeadline
 	}
 	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
+		e = now.Add(d).UnixNano()
 	}
 	if rd > 0 {
-		erd = time.Now().Add(rd).UnixNano()
+		erd = now.Add(rd).UnixNano()
 	}
-	item := Item{
-		Object:     x,
-		Expiration: e,
+	return Item{
+		Object:          x,
+		Expiration:      e,
 		RefreshDeadline: erd,
+		CreatedAt:       now.UnixNano(),
 	}
-	c.storage.Set(k, item)
-
 }
 
 // Add an item to the cache only if an item doesn't already exist for the given
 // key, or if the existing item has expired. Returns an error otherwise.
 func (c *cache) Add(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	if err := c.validate(k, x); err != nil {
+		return err
+	}
 	c.storage.Lock()
 	_, found := c.get(k)
 	if found {
 		c.storage.Unlock()
-		return fmt.Errorf("Item %s already exists", k)
+		return newError(ErrKeyExists, "Item %s already exists", k)
 	}
 	c.set(k, x, d, rd)
 	c.storage.Unlock()
@@ -120,99 +223,150 @@ func (c *cache) Add(k string, x interface{}, d time.Duration, rd time.Duration)
 // Set a new value for the cache key only if it already exists, and the existing
 // item hasn't expired. Returns an error otherwise.
 func (c *cache) Replace(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	if err := c.validate(k, x); err != nil {
+		return err
+	}
 	c.storage.Lock()
 	_, found := c.get(k)
 	if !found {
 		c.storage.Unlock()
-		return fmt.Errorf("Item %s doesn't exist", k)
+		return newError(ErrNotFound, "Item %s doesn't exist", k)
 	}
 	c.set(k, x, d, rd)
 	c.storage.Unlock()
 	return nil
 }
 
-func (c *cache) refreshWorker(id int, jobs <-chan string) {
-	for k := range jobs {
-		if c.onRefreshNeeded != nil {
-			c.onRefreshNeeded(k)
-		}
-		c.refreshConcurrencyMutex.Lock()
-		delete(c.refreshConcurrencyMap, k)
-		c.refreshConcurrencyMutex.Unlock()
+// Set a new value for the cache key only if pred, called with the existing
+// value (or nil and false if there is no unexpired item), returns true. pred
+// is called with the storage locked, so the value can't change in between.
+// Returns whether the value was set, and the error reading or writing the
+// storage, if it reports errors (see CheckedStorage).
+func (c *cache) SetIf(k string, x interface{}, d time.Duration, rd time.Duration, pred func(old interface{}, exists bool) bool) (bool, error) {
+	if err := c.validate(k, x); err != nil {
+		return false, err
+	}
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	item, found, err := tryGet(c.storage, k)
+	if err != nil {
+		return false, err
+	}
+	if found && item.Expired() {
+		item, found = Item{}, false
+	}
+	if !pred(item.Object, found) {
+		return false, nil
+	}
+	item = c.newItem(k, x, d, rd)
+	if err := trySet(c.storage, k, item); err != nil {
+		return false, err
+	}
+	c.written(k, item)
+	return true, nil
+}
 
+// Queues k for a call to the OnRefreshNeeded function, unless it's already
+// queued or being refreshed.
+func (c *cache) queueRefresh(k string) {
+	c.refreshConcurrencyMutex.Lock()
+	if _, ok := c.refreshConcurrencyMap[k]; !ok {
+		c.refreshConcurrencyMap[k] = true
+		c.refreshConcurrencyMutex.Unlock()
+		c.enqueueRefresh(k)
+	} else {
+		c.refreshConcurrencyMutex.Unlock()
 	}
 }
 
 // Get an item from the cache. Returns the item or nil, and a bool indicating
 // whether the key was found.
 func (c *cache) GetObject(k string, o interface{}) (interface{}, bool) {
+	if c.bypassReads() {
+		return nil, false
+	}
 	c.storage.RLock()
 	// "Inlining" of get and Expired
 
 	item, found := c.storage.GetObject(k, o)
 	if !found {
 		c.storage.RUnlock()
+		c.countKey(k, MetricMisses, 1)
 		return nil, false
 	}
 	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
+		if timeNow().UnixNano() > item.Expiration {
 			c.storage.RUnlock()
+			c.countKey(k, MetricMisses, 1)
 			return nil, false
 		}
 	}
 	if item.RefreshDeadline > 0 {
-		if item.RefreshDeadlineReached() {
+		if c.refreshDue(k, item.RefreshDeadline) {
 			c.refreshConcurrencyMutex.Lock()
 			if _, ok := c.refreshConcurrencyMap[k]; !ok {
 				c.refreshConcurrencyMap[k] = true
 				c.refreshConcurrencyMutex.Unlock()
-				go func() {
-					c.refreshKeys <- k
-				}()
+				c.enqueueRefresh(k)
 			} else {
 				c.refreshConcurrencyMutex.Unlock()
 			}
 
 		}
 	}
+	if t, ok := c.storage.(accessTracker); ok {
+		t.touch(k)
+	}
 	c.storage.RUnlock()
-	return item.Object, true
+	c.countKey(k, MetricHits, 1)
+	return c.readValue(k, item.Object), true
 }
 
-
 // Get an item from the cache. Returns the item or nil, and a bool indicating
 // whether the key was found.
 func (c *cache) Get(k string) (interface{}, bool) {
+	if c.bypassReads() {
+		return nil, false
+	}
 	c.storage.RLock()
 	// "Inlining" of get and Expired
 	item, found := c.storage.Get(k)
 	if !found {
 		c.storage.RUnlock()
+		c.countKey(k, MetricMisses, 1)
 		return nil, false
 	}
 	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
+		if timeNow().UnixNano() > item.Expiration {
 			c.storage.RUnlock()
+			c.countKey(k, MetricMisses, 1)
 			return nil, false
 		}
 	}
 	if item.RefreshDeadline > 0 {
-		if item.RefreshDeadlineReached() {
+		if c.refreshDue(k, item.RefreshDeadline) {
 			c.refreshConcurrencyMutex.Lock()
 			if _, ok := c.refreshConcurrencyMap[k]; !ok {
 				c.refreshConcurrencyMap[k] = true
 				c.refreshConcurrencyMutex.Unlock()
-				go func() {
-					c.refreshKeys <- k
-				}()
+				c.enqueueRefresh(k)
 			} else {
 				c.refreshConcurrencyMutex.Unlock()
 			}
 
 		}
 	}
+	if t, ok := c.storage.(accessTracker); ok {
+		t.touch(k)
+	}
 	c.storage.RUnlock()
-	return item.Object, true
+	c.countKey(k, MetricHits, 1)
+	return c.readValue(k, item.Object), true
+}
+
+// Same as Has.
+func (c *cache) Exists(k string) bool {
+	return c.Has(k)
 }
 
 func (c *cache) get(k string) (interface{}, bool) {
@@ -222,19 +376,17 @@ func (c *cache) get(k string) (interface{}, bool) {
 	}
 	// "Inlining" of Expired
 	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
+		if timeNow().UnixNano() > item.Expiration {
 			return nil, false
 		}
 	}
 	if item.RefreshDeadline > 0 {
-		if item.RefreshDeadlineReached() {
+		if c.refreshDue(k, item.RefreshDeadline) {
 			c.refreshConcurrencyMutex.Lock()
 			if _, ok := c.refreshConcurrencyMap[k]; !ok {
 				c.refreshConcurrencyMap[k] = true
 				c.refreshConcurrencyMutex.Unlock()
-				go func() {
-					c.refreshKeys <- k
-				}()
+				c.enqueueRefresh(k)
 				c.refreshConcurrencyMutex.Lock()
 				delete(c.refreshConcurrencyMap, k)
 				c.refreshConcurrencyMutex.Unlock()
@@ -257,7 +409,7 @@ func (c *cache) Increment(k string, n int64) error {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return fmt.Errorf("Item %s not found", k)
+		return newError(ErrNotFound, "Item %s not found", k)
 	}
 	switch v.Object.(type) {
 	case int:
@@ -288,7 +440,7 @@ func (c *cache) Increment(k string, n int64) error {
 		v.Object = v.Object.(float64) + float64(n)
 	default:
 		c.storage.Unlock()
-		return fmt.Errorf("The value for %s is not an integer", k)
+		return newError(ErrWrongType, "The value for %s is not an integer", k)
 	}
 	c.storage.Set(k, v)
 	c.storage.Unlock()
@@ -305,7 +457,7 @@ func (c *cache) IncrementFloat(k string, n float64) error {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return fmt.Errorf("Item %s not found", k)
+		return newError(ErrNotFound, "Item %s not found", k)
 	}
 	switch v.Object.(type) {
 	case float32:
@@ -314,7 +466,7 @@ func (c *cache) IncrementFloat(k string, n float64) error {
 		v.Object = v.Object.(float64) + n
 	default:
 		c.storage.Unlock()
-		return fmt.Errorf("The value for %s does not have type float32 or float64", k)
+		return newError(ErrWrongType, "The value for %s does not have type float32 or float64", k)
 	}
 	c.storage.Set(k, v)
 	c.storage.Unlock()
@@ -329,12 +481,12 @@ func (c *cache) IncrementInt(k string, n int) (int, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -351,12 +503,12 @@ func (c *cache) IncrementInt8(k string, n int8) (int8, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int8)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int8", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int8", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -373,12 +525,12 @@ func (c *cache) IncrementInt16(k string, n int16) (int16, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int16)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int16", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int16", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -395,12 +547,12 @@ func (c *cache) IncrementInt32(k string, n int32) (int32, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int32)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int32", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int32", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -417,12 +569,12 @@ func (c *cache) IncrementInt64(k string, n int64) (int64, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int64)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int64", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int64", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -439,12 +591,12 @@ func (c *cache) IncrementUint(k string, n uint) (uint, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -461,12 +613,12 @@ func (c *cache) IncrementUintptr(k string, n uintptr) (uintptr, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uintptr)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uintptr", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uintptr", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -483,12 +635,12 @@ func (c *cache) IncrementUint8(k string, n uint8) (uint8, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint8)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint8", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint8", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -505,12 +657,12 @@ func (c *cache) IncrementUint16(k string, n uint16) (uint16, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint16)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint16", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint16", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -527,12 +679,12 @@ func (c *cache) IncrementUint32(k string, n uint32) (uint32, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint32)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint32", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint32", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -549,12 +701,12 @@ func (c *cache) IncrementUint64(k string, n uint64) (uint64, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint64)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint64", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint64", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -571,12 +723,12 @@ func (c *cache) IncrementFloat32(k string, n float32) (float32, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(float32)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an float32", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an float32", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -593,12 +745,12 @@ func (c *cache) IncrementFloat64(k string, n float64) (float64, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(float64)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an float64", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an float64", k)
 	}
 	nv := rv + n
 	v.Object = nv
@@ -619,7 +771,7 @@ func (c *cache) Decrement(k string, n int64) error {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return fmt.Errorf("Item not found")
+		return newError(ErrNotFound, "Item not found")
 	}
 	switch v.Object.(type) {
 	case int:
@@ -650,7 +802,7 @@ func (c *cache) Decrement(k string, n int64) error {
 		v.Object = v.Object.(float64) - float64(n)
 	default:
 		c.storage.Unlock()
-		return fmt.Errorf("The value for %s is not an integer", k)
+		return newError(ErrWrongType, "The value for %s is not an integer", k)
 	}
 	c.storage.Set(k, v)
 	c.storage.Unlock()
@@ -667,7 +819,7 @@ func (c *cache) DecrementFloat(k string, n float64) error {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return fmt.Errorf("Item %s not found", k)
+		return newError(ErrNotFound, "Item %s not found", k)
 	}
 	switch v.Object.(type) {
 	case float32:
@@ -676,7 +828,7 @@ func (c *cache) DecrementFloat(k string, n float64) error {
 		v.Object = v.Object.(float64) - n
 	default:
 		c.storage.Unlock()
-		return fmt.Errorf("The value for %s does not have type float32 or float64", k)
+		return newError(ErrWrongType, "The value for %s does not have type float32 or float64", k)
 	}
 	c.storage.Set(k, v)
 	c.storage.Unlock()
@@ -691,12 +843,12 @@ func (c *cache) DecrementInt(k string, n int) (int, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -713,12 +865,12 @@ func (c *cache) DecrementInt8(k string, n int8) (int8, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int8)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int8", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int8", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -735,12 +887,12 @@ func (c *cache) DecrementInt16(k string, n int16) (int16, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int16)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int16", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int16", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -757,12 +909,12 @@ func (c *cache) DecrementInt32(k string, n int32) (int32, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int32)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int32", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int32", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -779,12 +931,12 @@ func (c *cache) DecrementInt64(k string, n int64) (int64, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(int64)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an int64", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an int64", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -801,12 +953,12 @@ func (c *cache) DecrementUint(k string, n uint) (uint, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -823,12 +975,12 @@ func (c *cache) DecrementUintptr(k string, n uintptr) (uintptr, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uintptr)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uintptr", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uintptr", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -845,12 +997,12 @@ func (c *cache) DecrementUint8(k string, n uint8) (uint8, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint8)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint8", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint8", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -867,12 +1019,12 @@ func (c *cache) DecrementUint16(k string, n uint16) (uint16, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint16)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint16", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint16", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -889,12 +1041,12 @@ func (c *cache) DecrementUint32(k string, n uint32) (uint32, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint32)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint32", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint32", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -911,12 +1063,12 @@ func (c *cache) DecrementUint64(k string, n uint64) (uint64, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(uint64)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an uint64", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an uint64", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -933,12 +1085,12 @@ func (c *cache) DecrementFloat32(k string, n float32) (float32, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(float32)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an float32", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an float32", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -955,12 +1107,12 @@ func (c *cache) DecrementFloat64(k string, n float64) (float64, error) {
 	v, found := c.storage.Get(k)
 	if !found || v.Expired() {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("Item %s not found", k)
+		return 0, newError(ErrNotFound, "Item %s not found", k)
 	}
 	rv, ok := v.Object.(float64)
 	if !ok {
 		c.storage.Unlock()
-		return 0, fmt.Errorf("The value for %s is not an float64", k)
+		return 0, newError(ErrWrongType, "The value for %s is not an float64", k)
 	}
 	nv := rv - n
 	v.Object = nv
@@ -974,10 +1126,62 @@ func (c *cache) Delete(k string) {
 	c.storage.Lock()
 	c.delete(k)
 	c.storage.Unlock()
+	c.invalidate(invalidation{Key: k})
 }
 
 func (c *cache) delete(k string) {
 	c.storage.Del(k)
+	c.removed(k)
+	c.unpin(k)
+}
+
+// Like delete, but returns the error reported by the storage, if it reports
+// errors (see CheckedStorage), in which case the item is still tracked. Must
+// be called with the storage locked.
+func (c *cache) tryDelete(k string) error {
+	if err := tryDel(c.storage, k); err != nil {
+		return err
+	}
+	c.removed(k)
+	c.unpin(k)
+	return nil
+}
+
+// Keeps track of the item just set for k. Must be called with the storage
+// locked.
+func (c *cache) written(k string, item Item) {
+	c.chargeQuota(k, item.Object)
+	c.recordChecksum(k, item.Object)
+	c.recordETag(k, item)
+	c.recordCost(k, item)
+	c.forgetTombstone(k)
+}
+
+// Forgets the item of k just deleted.
+func (c *cache) removed(k string) {
+	c.releaseQuota(k)
+	c.forgetChecksum(k)
+	c.forgetETag(k)
+	c.forgetCost(k)
+	c.recordTombstone(k, timeNow().UnixNano())
+}
+
+// Keeps track of the value a storage changed by itself, e.g. by appending to
+// it in place or renaming its key, by reading it back, since only the storage
+// knows it. Must be called with the storage locked.
+func (c *cache) reread(k string) {
+	if bs, ok := c.storage.(BytesStorage); ok {
+		if b, e, rd, found := bs.GetBytes(k); found {
+			c.written(k, Item{Object: b, Expiration: e, RefreshDeadline: rd})
+			return
+		}
+	}
+	if item, found, err := tryGet(c.storage, k); err == nil && found {
+		c.written(k, item)
+		return
+	}
+	c.forgetChecksum(k)
+	c.forgetETag(k)
 }
 
 type keyAndValue struct {
@@ -985,7 +1189,6 @@ type keyAndValue struct {
 	value interface{}
 }
 
-
 // Sets an (optional) function that is called with the key and value when an
 // item has reached its refresh deadline from the cache.
 func (c *cache) OnRefreshNeeded(f func(string)) {
@@ -994,25 +1197,21 @@ func (c *cache) OnRefreshNeeded(f func(string)) {
 	c.storage.Unlock()
 }
 
-// Delete all items from the cache.
-func (c *cache) Flush() {
-	c.storage.Flush()
-}
-
 func newCache(de time.Duration, s Storage, refreshWorkerCount int) *cache {
 	if de == 0 {
 		de = -1
 	}
 
 	c := &cache{
-		defaultExpiration: de,
-		storage:             s,
-		refreshConcurrencyMap:make(map[string]bool),
-		refreshKeys: make(chan string, 100),
-	}
-	for i := 1; i <= refreshWorkerCount; i++ {
-		go c.refreshWorker(i, c.refreshKeys)
-	}
+		defaultExpiration:     de,
+		storage:               s,
+		refreshConcurrencyMap: make(map[string]bool),
+		refreshKeys:           make(chan string, 100),
+		refreshHigh:           make(chan string, 100),
+		refreshLow:            make(chan string, 100),
+	}
+	c.refresh.min, c.refresh.max = refreshWorkerCount, refreshWorkerCount
+	c.refresh.spawn(c)
 	return c
 }
 
@@ -1022,7 +1221,7 @@ func newCache(de time.Duration, s Storage, refreshWorkerCount int) *cache {
 // manually. If the cleanup interval is less than one, expired items are not
 // deleted from the cache before calling c.DeleteExpired().
 func New(defaultExpiration, cleanupInterval time.Duration, refreshWorkerCount int, storage Storage) *Cache {
-	if storage.Type() == STORAGE_TYPE_MEMORY {
+	if storage.Type() == STORAGE_TYPE_MEMORY || storage.Type() == STORAGE_TYPE_SLAB || storage.Type() == STORAGE_TYPE_REMOTE {
 		c := newCache(defaultExpiration, storage, refreshWorkerCount)
 		// This trick ensures that the janitor goroutine (which--granted it
 		// was enabled--is running DeleteExpired on c forever) does not keep
@@ -1030,9 +1229,14 @@ func New(defaultExpiration, cleanupInterval time.Duration, refreshWorkerCount in
 		// garbage collected, the finalizer stops the janitor goroutine, after
 		// which c can be collected.
 		C := &Cache{c}
-		if cleanupInterval > 0 {
-			runJanitor(storage.(*memoryStorage), cleanupInterval)
-			runtime.SetFinalizer(storage, stopJanitor)
+		if n, ok := expiryNotifierOf(storage); ok {
+			n.setExpireHandler(c.expired)
+		}
+		if cs, ok := cleanableStorageOf(storage); ok && cleanupInterval > 0 {
+			j := runJanitor(cs, cleanupInterval)
+			runtime.SetFinalizer(cs, func(cleanableStorage) {
+				stopJanitor(j)
+			})
 		}
 		return C
 
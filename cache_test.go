@@ -1,10 +1,29 @@
 package cache
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
 	"time"
 )
 
@@ -41,7 +60,7 @@ func TestCache(t *testing.T) {
 	}
 	if x == nil {
 		t.Error("x for a is nil")
-	} else if a2 := x.(int); a2 + 2 != 3 {
+	} else if a2 := x.(int); a2+2 != 3 {
 		t.Error("a2 (which should be 1) plus 2 does not equal 3; value:", a2)
 	}
 
@@ -51,7 +70,7 @@ func TestCache(t *testing.T) {
 	}
 	if x == nil {
 		t.Error("x for b is nil")
-	} else if b2 := x.(string); b2 + "B" != "bB" {
+	} else if b2 := x.(string); b2+"B" != "bB" {
 		t.Error("b2 (which should be b) plus B does not equal bB; value:", b2)
 	}
 
@@ -61,7 +80,7 @@ func TestCache(t *testing.T) {
 	}
 	if x == nil {
 		t.Error("x for c is nil")
-	} else if c2 := x.(float64); c2 + 1.2 != 4.7 {
+	} else if c2 := x.(float64); c2+1.2 != 4.7 {
 		t.Error("c2 (which should be 3.5) plus 1.2 does not equal 4.7; value:", c2)
 	}
 }
@@ -69,11 +88,11 @@ func TestCache(t *testing.T) {
 func TestCacheTimes(t *testing.T) {
 	var found bool
 
-	tc := New(50 * time.Millisecond, 1 * time.Millisecond, 0, MemoryStorage())
+	tc := New(50*time.Millisecond, 1*time.Millisecond, 0, MemoryStorage())
 	tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
 	tc.Set("b", 2, NoExpiration, NoRefreshDeadline)
-	tc.Set("c", 3, 20 * time.Millisecond, NoRefreshDeadline)
-	tc.Set("d", 4, 70 * time.Millisecond, NoRefreshDeadline)
+	tc.Set("c", 3, 20*time.Millisecond, NoRefreshDeadline)
+	tc.Set("d", 4, 70*time.Millisecond, NoRefreshDeadline)
 
 	<-time.After(25 * time.Millisecond)
 	_, found = tc.Get("c")
@@ -1184,8 +1203,4579 @@ func TestDecrementUnderflowUint(t *testing.T) {
 	}
 }
 
+func TestReadOnly(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	ro := tc.ReadOnly()
+	tc.Set("foo", "bar", DefaultExpiration, NoRefreshDeadline)
+	x, found := ro.Get("foo")
+	if !found {
+		t.Fatal("foo was not found through the read-only view")
+	}
+	if x.(string) != "bar" {
+		t.Error("foo is not bar:", x)
+	}
+	if _, ok := ro.(*Cache); ok {
+		t.Error("read-only view can be asserted back to a *Cache")
+	}
+	tc.Set("baz", "qux", time.Minute, NoRefreshDeadline)
+	if m := ro.GetMulti([]string{"foo", "baz", "missing", "foo"}); len(m) != 2 || m["foo"] != "bar" || m["baz"] != "qux" {
+		t.Error("wrong values read through the read-only view:", m)
+	}
+	if ttl, found := ro.TTL("baz"); !found || ttl <= 0 || ttl > time.Minute {
+		t.Error("wrong TTL:", ttl, found)
+	}
+	if ttl, found := ro.TTL("foo"); !found || ttl != NoExpiration {
+		t.Error("wrong TTL of an item that doesn't expire:", ttl, found)
+	}
+	if _, found := ro.TTL("missing"); found {
+		t.Error("TTL of a missing key found")
+	}
+	tc.Delete("foo")
+	if _, found := ro.Get("foo"); found {
+		t.Error("foo was found through the read-only view after being deleted")
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	names := []string{"a:6379", "b:6379", "c:6379"}
+	all := newHashRing(names, []bool{true, true, true})
+	counts := make([]int, len(names))
+	for i := 0; i < 3000; i++ {
+		counts[all.get("key"+strconv.Itoa(i))]++
+	}
+	for i, n := range counts {
+		if n < 500 {
+			t.Errorf("node %s owns only %d of 3000 keys", names[i], n)
+		}
+	}
+
+	// Taking a node off the ring must only move that node's keys.
+	partial := newHashRing(names, []bool{true, false, true})
+	for i := 0; i < 3000; i++ {
+		k := "key" + strconv.Itoa(i)
+		before, after := all.get(k), partial.get(k)
+		if after == 1 {
+			t.Fatalf("%s is owned by a node that isn't live", k)
+		}
+		if before != 1 && before != after {
+			t.Errorf("%s moved from node %d to %d", k, before, after)
+		}
+	}
+
+	none := newHashRing(names, []bool{false, false, false})
+	if i := none.get("key"); i != -1 {
+		t.Error("empty ring returned node", i)
+	}
+}
+
+// A memory storage whose checked operations fail while failures is positive.
+type flakyStorage struct {
+	*memoryStorage
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyStorage) fail() error {
+	s.calls++
+	if s.failures > 0 {
+		s.failures--
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyStorage) TryGet(k string) (Item, bool, error) {
+	if err := s.fail(); err != nil {
+		return Item{}, false, err
+	}
+	item, found := s.Get(k)
+	return item, found, nil
+}
+
+func (s *flakyStorage) TryGetObject(k string, o interface{}) (Item, bool, error) {
+	return s.TryGet(k)
+}
+
+func (s *flakyStorage) TrySet(k string, item Item) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	s.Set(k, item)
+	return nil
+}
+
+func (s *flakyStorage) TryDel(k string) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	s.Del(k)
+	return nil
+}
+
+func TestRetryStorage(t *testing.T) {
+	fs := &flakyStorage{memoryStorage: MemoryStorage(), failures: 2, err: io.EOF}
+	tc := New(DefaultExpiration, 0, 0, RetryStorage(fs, RetryOptions{Backoff: time.Millisecond}))
+	tc.Set("foo", "bar", DefaultExpiration, NoRefreshDeadline)
+	if fs.calls != 3 {
+		t.Error("expected 3 attempts to set foo, got", fs.calls)
+	}
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("foo was not set after a transient failure:", x)
+	}
+
+	fs.failures, fs.calls = 5, 0
+	if _, found := tc.Get("foo"); found {
+		t.Error("found foo even though every attempt failed")
+	}
+	if fs.calls != 3 {
+		t.Error("expected 3 attempts to get foo, got", fs.calls)
+	}
+
+	fs.failures, fs.calls, fs.err = 1, 0, errors.New("WRONGTYPE")
+	if _, found := tc.Get("foo"); found {
+		t.Error("found foo even though the attempt failed")
+	}
+	if fs.calls != 1 {
+		t.Error("retried an error that isn't transient")
+	}
+}
+
+func TestBreakerStorage(t *testing.T) {
+	fs := &flakyStorage{memoryStorage: MemoryStorage(), err: io.EOF}
+	fallback := MemoryStorage()
+	tc := New(DefaultExpiration, 0, 0, BreakerStorage(fs, BreakerOptions{
+		Threshold: 2,
+		Cooldown:  20 * time.Millisecond,
+		Fallback:  fallback,
+	}))
+	if st := tc.Stats().BreakerState; st != BreakerClosed {
+		t.Error("breaker is not closed initially:", st)
+	}
+
+	fs.failures = 2
+	tc.Get("foo")
+	tc.Get("foo")
+	if st := tc.Stats(); st.BreakerState != BreakerOpen || st.BreakerTrips != 1 {
+		t.Error("breaker did not open after 2 failures:", st)
+	}
+
+	fs.calls = 0
+	tc.Set("foo", "bar", DefaultExpiration, NoRefreshDeadline)
+	if fs.calls != 0 {
+		t.Error("open breaker let a Set through to the storage")
+	}
+	if _, found := fallback.Get("foo"); !found {
+		t.Error("open breaker did not send the Set to the fallback")
+	}
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("open breaker did not serve foo from the fallback:", x)
+	}
+
+	<-time.After(25 * time.Millisecond)
+	if st := tc.Stats().BreakerState; st != BreakerHalfOpen {
+		t.Error("breaker is not half-open after the cooldown:", st)
+	}
+	tc.Set("foo", "baz", DefaultExpiration, NoRefreshDeadline)
+	if st := tc.Stats().BreakerState; st != BreakerClosed {
+		t.Error("breaker did not close after a successful operation:", st)
+	}
+	if x, found := fs.memoryStorage.Get("foo"); !found || x.Object.(string) != "baz" {
+		t.Error("closed breaker did not send the Set to the storage:", x)
+	}
+}
+
+func TestFallbackStorage(t *testing.T) {
+	fs := &flakyStorage{memoryStorage: MemoryStorage(), err: io.EOF}
+	secondary := MemoryStorage()
+	s := FallbackStorage(fs, secondary)
+	defer s.Close()
+	tc := New(DefaultExpiration, 0, 0, s)
+
+	fs.failures = 1
+	tc.Set("foo", "bar", DefaultExpiration, NoRefreshDeadline)
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("foo was not read from the secondary after the primary failed:", x)
+	}
+	if n := tc.Stats().FallbackPending; n != 1 {
+		t.Error("expected 1 key pending repair, got", n)
+	}
+
+	s.repair()
+	if x, found := fs.memoryStorage.Get("foo"); !found || x.Object.(string) != "bar" {
+		t.Error("foo was not copied back to the primary:", x)
+	}
+	if _, found := secondary.Get("foo"); found {
+		t.Error("foo was left in the secondary after being repaired")
+	}
+	if n := tc.Stats().FallbackPending; n != 0 {
+		t.Error("expected no keys pending repair, got", n)
+	}
+
+	fs.failures = 1
+	tc.Delete("foo")
+	s.repair()
+	if _, found := fs.memoryStorage.Get("foo"); found {
+		t.Error("deleting foo was not copied back to the primary")
+	}
+
+	tc.Set("foo", "old", DefaultExpiration, NoRefreshDeadline)
+	fs.failures = 1
+	tc.Set("foo", "new", DefaultExpiration, NoRefreshDeadline)
+	if x, found := tc.Get("foo"); !found || x.(string) != "new" {
+		t.Error("stale value read from the recovered primary before the repair:", x)
+	}
+	fs.failures = 1
+	tc.Delete("foo")
+	if x, found := tc.Get("foo"); found {
+		t.Error("deleted value read from the recovered primary before the repair:", x)
+	}
+}
+
+func TestSlabStorage(t *testing.T) {
+	gob.Register(&TestStruct{})
+	ss := SlabStorage(256)
+	tc := New(DefaultExpiration, 0, 0, ss)
+	tc.Set("int", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("string", "foo", DefaultExpiration, NoRefreshDeadline)
+	tc.Set("struct", &TestStruct{Num: 3}, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("expired", 2, time.Nanosecond, NoRefreshDeadline)
+
+	if x, found := tc.Get("int"); !found || x.(int) != 1 {
+		t.Error("int is not 1:", x)
+	}
+	if x, found := tc.Get("string"); !found || x.(string) != "foo" {
+		t.Error("string is not foo:", x)
+	}
+	if x, found := tc.Get("struct"); !found || x.(*TestStruct).Num != 3 {
+		t.Error("struct.Num is not 3:", x)
+	}
+	if _, found := tc.Get("expired"); found {
+		t.Error("found expired item")
+	}
+
+	// Overwriting items leaves garbage in the slabs until they are compacted.
+	for i := 0; i < 100; i++ {
+		tc.Set("string", "foo"+strconv.Itoa(i), DefaultExpiration, NoRefreshDeadline)
+	}
+	if x, found := tc.Get("string"); !found || x.(string) != "foo99" {
+		t.Error("string is not foo99:", x)
+	}
+	if ss.garbage > ss.slabSize {
+		t.Error("slabs were not compacted; garbage:", ss.garbage)
+	}
+
+	ss.DeleteExpired()
+	if ss.count() != 3 {
+		t.Error("expected 3 items after deleting expired items, got", ss.count())
+	}
+	tc.Delete("int")
+	if _, found := tc.Get("int"); found {
+		t.Error("int was found, but it should have been deleted")
+	}
+	if x, found := tc.Get("struct"); !found || x.(*TestStruct).Num != 3 {
+		t.Error("struct.Num is not 3 after compaction:", x)
+	}
+}
+
+func TestSlabStorageCollisions(t *testing.T) {
+	ss := SlabStorage(256)
+	ss.hash = func(string) uint64 { return 1 }
+	tc := New(DefaultExpiration, 0, 0, ss)
+	tc.Set("a", "1", DefaultExpiration, NoRefreshDeadline)
+	tc.Set("b", "2", DefaultExpiration, NoRefreshDeadline)
+	tc.Set("c", "3", time.Nanosecond, NoRefreshDeadline)
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if x, found := tc.Get(k); !found || x != v {
+			t.Errorf("%s is not %s: %v", k, v, x)
+		}
+	}
+	if ss.count() != 3 {
+		t.Error("colliding keys were not all stored:", ss.count())
+	}
+
+	// b stays in collisions once a is deleted, and isn't indexed twice when
+	// it is set again.
+	tc.Delete("a")
+	if _, found := tc.Get("a"); found {
+		t.Error("a was not deleted")
+	}
+	tc.Set("b", "4", DefaultExpiration, NoRefreshDeadline)
+	if x, found := tc.Get("b"); !found || x != "4" {
+		t.Error("b is not 4:", x)
+	}
+	if ss.count() != 2 {
+		t.Error("expected 2 items, got", ss.count())
+	}
+	tc.Set("a", "5", DefaultExpiration, NoRefreshDeadline)
+	time.Sleep(time.Millisecond)
+	ss.DeleteExpired()
+	keys, _, _ := tc.Keys("*", 0, 10)
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Error("wrong keys after deleting expired items:", keys)
+	}
+	tc.Delete("b")
+	if x, found := tc.Get("a"); !found || x != "5" {
+		t.Error("a is not 5:", x)
+	}
+	if _, found := tc.Get("b"); found {
+		t.Error("b was not deleted")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	for _, s := range []Storage{MemoryStorage(), SlabStorage(0)} {
+		tc := New(DefaultExpiration, 0, 0, s)
+		tc.SetBytes("foo", []byte("bar"), DefaultExpiration, NoRefreshDeadline)
+		b, found := tc.GetBytes("foo")
+		if !found || string(b) != "bar" {
+			t.Errorf("foo is not bar in %T: %q", s, b)
+		}
+		tc.SetBytes("expired", []byte("baz"), time.Nanosecond, NoRefreshDeadline)
+		if _, found := tc.GetBytes("expired"); found {
+			t.Errorf("found expired item in %T", s)
+		}
+		tc.Set("string", "bar", DefaultExpiration, NoRefreshDeadline)
+		if _, found := tc.GetBytes("string"); found {
+			t.Errorf("got a string value as bytes from %T", s)
+		}
+	}
+}
+
+// A storage appending in place, as Redis does.
+type appendingStorage struct {
+	*slabStorage
+}
+
+func (s appendingStorage) AppendBytes(key string, b []byte) bool {
+	old, e, rd, found := s.GetBytes(key)
+	if found {
+		s.SetBytes(key, append(append([]byte(nil), old...), b...), e, rd)
+	}
+	return found
+}
+
+func TestStrings(t *testing.T) {
+	for _, s := range []Storage{MemoryStorage(), SlabStorage(0), appendingStorage{SlabStorage(0)}} {
+		tc := New(DefaultExpiration, 0, 0, s)
+		tc.SetETags(true)
+		tc.SetString("foo", "bar", DefaultExpiration, NoRefreshDeadline)
+		if tag, _ := tc.ETag("foo"); tag != computeETag([]byte("bar")) {
+			t.Errorf("wrong ETag for bar in %T: %s", s, tag)
+		}
+		if err := tc.AppendString("foo", "baz"); err != nil {
+			t.Errorf("error appending to foo in %T: %s", s, err)
+		}
+		if x, found := tc.GetString("foo"); !found || x != "barbaz" {
+			t.Errorf("foo is not barbaz in %T: %q", s, x)
+		}
+		if tag, _ := tc.ETag("foo"); tag != computeETag([]byte("barbaz")) {
+			t.Errorf("ETag not updated by AppendString in %T: %s", s, tag)
+		}
+		if err := tc.AppendString("missing", "baz"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v appending to a missing key in %T, want ErrNotFound", err, s)
+		}
+		tc.Set("int", 1, DefaultExpiration, NoRefreshDeadline)
+		if err := tc.AppendString("int", "baz"); !errors.Is(err, ErrWrongType) {
+			t.Errorf("got %v appending to an int in %T, want ErrWrongType", err, s)
+		}
+	}
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetETags(true)
+	tc.Set("plain", "bar", DefaultExpiration, NoRefreshDeadline)
+	if err := tc.AppendString("plain", "baz"); err != nil {
+		t.Error("error appending to a string set with Set:", err)
+	}
+	if tag, _ := tc.ETag("plain"); tag != computeETag([]byte("barbaz")) {
+		t.Error("ETag not updated by AppendString:", tag)
+	}
+	tc.Set("int", 1, DefaultExpiration, NoRefreshDeadline)
+	if err := tc.AppendString("int", "baz"); err == nil {
+		t.Error("appended to an int")
+	}
+	if _, found := tc.GetString("int"); found {
+		t.Error("got an int as a string")
+	}
+}
+
+func TestRedisAppendStringWrongType(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.Close()
+	s := RedisStorageWithOptions(r.addr(), "", 0, "app:", RedisOptions{DisableLock: true})
+	defer s.redisClient.Close()
+	tc := New(DefaultExpiration, 0, 0, s)
+	tc.Set("int", 1, DefaultExpiration, NoRefreshDeadline)
+	r.mutex.Lock()
+	r.scriptReply = ":-1\r\n" // the value isn't bytes
+	r.mutex.Unlock()
+	if err := tc.AppendString("int", "baz"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("got %v appending to an int, want ErrWrongType", err)
+	}
+	if err := tc.AppendString("missing", "baz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v appending to a missing key, want ErrNotFound", err)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	ints := Typed[int](tc, "ints")
+	structs := Typed[*TestStruct](tc, "structs")
+	ints.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+	structs.Set("a", &TestStruct{Num: 2}, DefaultExpiration, NoRefreshDeadline)
+
+	if x, found := ints.Get("a"); !found || x != 1 {
+		t.Error("ints/a is not 1:", x)
+	}
+	if x, found := structs.Get("a"); !found || x.Num != 2 {
+		t.Error("structs/a.Num is not 2:", x)
+	}
+	if _, found := tc.Get("ints:a"); !found {
+		t.Error("ints/a was not stored under ints:a")
+	}
+
+	tc.Set("ints:b", "not an int", DefaultExpiration, NoRefreshDeadline)
+	if _, found := ints.Get("b"); found {
+		t.Error("got a string from a view of ints")
+	}
+	ints.Delete("a")
+	if _, found := ints.Get("a"); found {
+		t.Error("ints/a was found, but it should have been deleted")
+	}
+	if _, found := structs.Get("a"); !found {
+		t.Error("deleting ints/a deleted structs/a")
+	}
+}
+
+func TestInspectItem(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorageWithOptions(MemoryOptions{TrackAccess: true}))
+	before := time.Now().UnixNano()
+	tc.Set("foo", 1, DefaultExpiration, NoRefreshDeadline)
+	item, found := tc.InspectItem("foo")
+	if !found {
+		t.Fatal("foo was not found")
+	}
+	if item.CreatedAt < before {
+		t.Error("foo's creation time is before it was set:", item.CreatedAt)
+	}
+	if item.HitCount != 0 || item.LastAccess != 0 {
+		t.Error("foo has access metadata before being read:", item)
+	}
+
+	tc.Get("foo")
+	tc.Get("foo")
+	tc.Increment("foo", 1)
+	item, _ = tc.InspectItem("foo")
+	if item.HitCount != 2 {
+		t.Error("expected 2 hits on foo, got", item.HitCount)
+	}
+	if item.LastAccess < item.CreatedAt {
+		t.Error("foo's last access is before it was set:", item.LastAccess)
+	}
+
+	tc.Set("foo", 1, DefaultExpiration, NoRefreshDeadline)
+	if item, _ = tc.InspectItem("foo"); item.HitCount != 0 {
+		t.Error("setting foo again didn't reset its hits:", item.HitCount)
+	}
+	if _, found := tc.InspectItem("bar"); found {
+		t.Error("inspected bar, which doesn't exist")
+	}
+}
+
+func TestMaxIdle(t *testing.T) {
+	ms := MemoryStorageWithOptions(MemoryOptions{MaxIdle: 30 * time.Millisecond})
+	tc := New(DefaultExpiration, 0, 0, ms)
+	tc.Set("read", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("unread", 2, DefaultExpiration, NoRefreshDeadline)
+
+	<-time.After(20 * time.Millisecond)
+	if _, found := tc.Get("read"); !found {
+		t.Error("read was evicted before being idle for MaxIdle")
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if _, found := tc.Get("unread"); found {
+		t.Error("found unread even though it has been idle for longer than MaxIdle")
+	}
+	if _, found := tc.Get("read"); !found {
+		t.Error("read was evicted even though it was read within MaxIdle")
+	}
+
+	ms.DeleteExpired()
+	if _, found := ms.items["unread"]; found {
+		t.Error("DeleteExpired did not delete the idle item")
+	}
+	if _, found := ms.items["read"]; !found {
+		t.Error("DeleteExpired deleted an item that isn't idle")
+	}
+}
+
+func TestFrequencySketch(t *testing.T) {
+	s := newFrequencySketch(1024, 0)
+	for i := 0; i < 10; i++ {
+		s.add("hot")
+	}
+	s.add("cold")
+	if n := s.estimate("hot"); n < 10 {
+		t.Error("estimated count of hot is lower than 10:", n)
+	}
+	if n := s.estimate("cold"); n < 1 {
+		t.Error("estimated count of cold is lower than 1:", n)
+	}
+	s.window = time.Nanosecond
+	if n := s.estimate("hot"); n != 5 {
+		t.Error("count of hot was not halved after the window:", n)
+	}
+
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	s = newFrequencySketch(1024, time.Minute)
+	for i := 0; i < 4; i++ {
+		s.add("hot")
+	}
+	clock.Advance(30 * time.Second)
+	if n := s.estimate("hot"); n != 4 {
+		t.Error("count of hot was halved within the window:", n)
+	}
+	clock.Advance(31 * time.Second)
+	if n := s.estimate("hot"); n != 2 {
+		t.Error("count of hot was not halved when the clock passed the window:", n)
+	}
+}
+
+func TestDoorkeeper(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetAdmissionPolicy(Doorkeeper(2, time.Minute))
+	tc.Set("foo", "bar", DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was stored the first time it was set")
+	}
+	tc.Set("foo", "bar", DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.Get("foo"); !found {
+		t.Error("foo was not stored the second time it was set")
+	}
+}
+
+func TestExpiredBookkeeping(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	tagged := func(c *Cache, k string) bool {
+		c.etags.mutex.Lock()
+		defer c.etags.mutex.Unlock()
+		_, found := c.etags.tags[k]
+		return found
+	}
+
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetETags(true)
+	tc.SetString("short", "a", time.Minute, NoRefreshDeadline)
+	tc.SetString("long", "b", DefaultExpiration, NoRefreshDeadline)
+	clock.Advance(2 * time.Minute)
+	tc.storage.(*memoryStorage).DeleteExpired()
+	if tagged(tc, "short") {
+		t.Error("the ETag of an expired item was kept")
+	}
+	// Reported after being set again, e.g. by an eviction's goroutine.
+	tc.expired("long", Item{})
+	if !tagged(tc, "long") {
+		t.Error("the ETag of an item set again after it was deleted was forgotten")
+	}
+
+	ec := New(DefaultExpiration, 0, 0, MemoryStorageWithOptions(MemoryOptions{MaxItems: 2}))
+	ec.SetETags(true)
+	for _, k := range []string{"a", "b", "c"} {
+		ec.SetString(k, k, DefaultExpiration, NoRefreshDeadline)
+	}
+	for i := 0; i < 100 && tagged(ec, "a"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if tagged(ec, "a") {
+		t.Error("the ETag of an evicted item was kept")
+	}
+}
+
+func TestSegmentedLRU(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorageWithOptions(MemoryOptions{MaxItems: 10}))
+	for i := 0; i < 5; i++ {
+		k := "hot" + strconv.Itoa(i)
+		tc.Set(k, i, DefaultExpiration, NoRefreshDeadline)
+		tc.Get(k)
+	}
+	// A scan setting and reading many keys once must not evict the hot keys.
+	for i := 0; i < 100; i++ {
+		k := "scan" + strconv.Itoa(i)
+		tc.Set(k, i, DefaultExpiration, NoRefreshDeadline)
+	}
+	for i := 0; i < 5; i++ {
+		if _, found := tc.Get("hot" + strconv.Itoa(i)); !found {
+			t.Error("hot item was evicted by the scan:", i)
+		}
+	}
+	if _, found := tc.Get("scan0"); found {
+		t.Error("scan0 was not evicted")
+	}
+	if n := len(tc.storage.(*memoryStorage).items); n != 10 {
+		t.Error("storage holds more items than MaxItems:", n)
+	}
+	if st := tc.Stats(); st.Evictions != 95 {
+		t.Error("Evictions is not 95:", st.Evictions)
+	}
+}
+
+func TestSampledEviction(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorageWithOptions(MemoryOptions{
+		MaxItems:        10,
+		Eviction:        EvictionSampled,
+		EvictionSamples: 20,
+	}))
+	tc.Set("forever", 0, NoExpiration, NoRefreshDeadline)
+	for i := 0; i < 20; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Duration(i+1)*time.Minute, NoRefreshDeadline)
+	}
+	if n := len(tc.storage.(*memoryStorage).items); n != 10 {
+		t.Error("storage holds more items than MaxItems:", n)
+	}
+	// With every item sampled, the ones expiring soonest are evicted first.
+	if _, found := tc.Get("forever"); !found {
+		t.Error("the item that never expires was evicted")
+	}
+	if _, found := tc.Get("19"); !found {
+		t.Error("the item expiring last was evicted")
+	}
+	if _, found := tc.Get("0"); found {
+		t.Error("the item expiring first was not evicted")
+	}
+}
+
+func TestJanitorMetrics(t *testing.T) {
+	s := MemoryStorageWithOptions(MemoryOptions{JanitorMaxScan: 10})
+	tc := New(DefaultExpiration, 0, 0, s)
+	for i := 0; i < 25; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Nanosecond, NoRefreshDeadline)
+	}
+	time.Sleep(time.Millisecond)
+	s.DeleteExpired()
+	st := tc.Stats()
+	if st.JanitorRuns != 1 || st.JanitorDeleted != 10 {
+		t.Error("janitor run was not capped at 10 items:", st.JanitorRuns, st.JanitorDeleted)
+	}
+	if st.JanitorMaxLockHold != st.JanitorLastLockHold || st.JanitorLastDuration < st.JanitorLastLockHold {
+		t.Error("inconsistent janitor durations:", st)
+	}
+	s.DeleteExpired()
+	s.DeleteExpired()
+	if st := tc.Stats(); st.JanitorRuns != 3 || st.JanitorDeleted != 25 {
+		t.Error("janitor did not delete every expired item:", st.JanitorRuns, st.JanitorDeleted)
+	}
+}
+
+func TestChunkedJanitor(t *testing.T) {
+	s := MemoryStorageWithOptions(MemoryOptions{JanitorMaxLockHold: time.Nanosecond})
+	tc := New(DefaultExpiration, 0, 0, s)
+	for i := 0; i < 1000; i++ {
+		tc.Set(strconv.Itoa(i), i, time.Nanosecond, NoRefreshDeadline)
+	}
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 10 && len(s.items) > 0; i++ {
+		s.DeleteExpired()
+	}
+	if n := len(s.items); n != 0 {
+		t.Error("expired items left after chunked janitor runs:", n)
+	}
+	if st := tc.Stats(); st.JanitorLastLockHold > st.JanitorLastDuration {
+		t.Error("lock hold is longer than the run:", st)
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	s := MemoryStorage()
+	tc := New(DefaultExpiration, 0, 0, s)
+	var expired []string
+	if err := tc.OnExpire("session:*", func(k string, v interface{}) {
+		expired = append(expired, k+"="+v.(string))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.OnExpire("other", func(k string, v interface{}) {
+		expired = append(expired, k)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("session:1", "a", time.Nanosecond, NoRefreshDeadline)
+	tc.Set("session:2", "b", NoExpiration, NoRefreshDeadline)
+	tc.Set("other", "c", time.Nanosecond, NoRefreshDeadline)
+	tc.Set("unmatched", "d", time.Nanosecond, NoRefreshDeadline)
+	time.Sleep(time.Millisecond)
+	s.DeleteExpired()
+	if len(expired) != 2 {
+		t.Fatal("callbacks were not called for exactly 2 items:", expired)
+	}
+	if !(expired[0] == "session:1=a" && expired[1] == "other") && !(expired[0] == "other" && expired[1] == "session:1=a") {
+		t.Error("callbacks were called for the wrong items:", expired)
+	}
+
+	other := New(DefaultExpiration, 0, 0, SlabStorage(256))
+	if err := other.OnExpire("*", func(string, interface{}) {}); !errors.Is(err, ErrNotSupported) {
+		t.Error("OnExpire didn't fail for a storage that doesn't report deleted items:", err)
+	}
+}
+
+func TestFetchMulti(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+	var loads [][]string
+	loader := func(missing []string) (map[string]interface{}, error) {
+		loads = append(loads, missing)
+		return map[string]interface{}{"b": 2}, nil
+	}
+	values, err := tc.FetchMulti([]string{"a", "b", "c", "b"}, loader, DefaultExpiration, NoRefreshDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values["a"] != 1 || values["b"] != 2 {
+		t.Error("wrong values:", values)
+	}
+	if len(loads) != 1 || len(loads[0]) != 2 || loads[0][0] != "b" || loads[0][1] != "c" {
+		t.Error("loader was not called once with the missing keys:", loads)
+	}
+	if v, found := tc.Get("b"); !found || v != 2 {
+		t.Error("loaded value was not cached:", v)
+	}
+	values, err = tc.FetchMulti([]string{"a", "c"}, func([]string) (map[string]interface{}, error) {
+		return nil, errors.New("failed")
+	}, DefaultExpiration, NoRefreshDeadline)
+	if err == nil || len(values) != 1 || values["a"] != 1 {
+		t.Error("cached values and error were not returned when the loader failed:", values, err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("b", 2, DefaultExpiration, NoRefreshDeadline)
+	err := tc.Txn(func(tx Txn) error {
+		a, _ := tx.Get("a")
+		tx.Set("a", a.(int)+10, DefaultExpiration, NoRefreshDeadline)
+		tx.Delete("b")
+		if v, found := tx.Get("a"); !found || v != 11 {
+			t.Error("transaction did not see its own write:", v)
+		}
+		if _, found := tx.Get("b"); found {
+			t.Error("transaction did not see its own delete")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := tc.Get("a"); v != 11 {
+		t.Error("a was not set by the transaction:", v)
+	}
+	if _, found := tc.Get("b"); found {
+		t.Error("b was not deleted by the transaction")
+	}
+	err = tc.Txn(func(tx Txn) error {
+		tx.Set("a", 0, DefaultExpiration, NoRefreshDeadline)
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Error("error returned by the transaction was not returned")
+	}
+	if v, _ := tc.Get("a"); v != 11 {
+		t.Error("aborted transaction was applied:", v)
+	}
+}
+
+func TestTxnBookkeeping(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("pinned", 1, DefaultExpiration, NoRefreshDeadline)
+	if err := tc.Pin("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Txn(func(tx Txn) error {
+		tx.Delete("pinned")
+		return nil
+	})
+	if tc.pinned("pinned") {
+		t.Error("key deleted in a transaction is still pinned")
+	}
+
+	tc.Set("rejected", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.SetAdmissionPolicy(admitNothing{})
+	tc.Txn(func(tx Txn) error {
+		tx.Set("rejected", 2, DefaultExpiration, NoRefreshDeadline)
+		return nil
+	})
+	if _, found := tc.Get("rejected"); found {
+		t.Error("value rejected by the admission policy was set, or the old one kept")
+	}
+	tc.SetAdmissionPolicy(nil)
+
+	tc.Set("bypassed", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.SetBypass(true)
+	tc.Txn(func(tx Txn) error {
+		tx.Set("bypassed", 2, DefaultExpiration, NoRefreshDeadline)
+		return nil
+	})
+	tc.SetBypass(false)
+	if _, found := tc.Get("bypassed"); found {
+		t.Error("value set in a transaction while bypassing writes was stored")
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	newer := func(ts int) func(interface{}, bool) bool {
+		return func(old interface{}, exists bool) bool {
+			return !exists || old.(int) < ts
+		}
+	}
+	if ok, err := tc.SetIf("ts", 5, DefaultExpiration, NoRefreshDeadline, newer(5)); !ok || err != nil {
+		t.Error("missing item was not set:", ok, err)
+	}
+	if ok, _ := tc.SetIf("ts", 3, DefaultExpiration, NoRefreshDeadline, newer(3)); ok {
+		t.Error("older value was set")
+	}
+	if ok, _ := tc.SetIf("ts", 7, DefaultExpiration, NoRefreshDeadline, newer(7)); !ok {
+		t.Error("newer value was not set")
+	}
+	if v, _ := tc.Get("ts"); v != 7 {
+		t.Error("ts is not 7:", v)
+	}
+}
+
+func TestHashedKeysStorage(t *testing.T) {
+	mem := MemoryStorage()
+	s := HashedKeysStorage(mem, HashKeysOptions{MaxKeyLen: 10, KeepOriginal: true})
+	tc := New(DefaultExpiration, 0, 0, s)
+	long := "https://example.com/search?q=go-cache"
+	tc.Set("short", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set(long, 2, DefaultExpiration, NoRefreshDeadline)
+	if v, found := tc.Get(long); !found || v != 2 {
+		t.Error("item with a long key was not found:", v)
+	}
+	if _, found := mem.items["short"]; !found {
+		t.Error("short key was hashed")
+	}
+	if _, found := mem.items[long]; found {
+		t.Error("long key was not hashed")
+	}
+	h := s.hashKey(long)
+	if k, found := s.OriginalKey(h); !found || k != long {
+		t.Error("original key was not kept:", k)
+	}
+	tc.Delete(long)
+	if len(mem.items) != 1 {
+		t.Error("long key or its original were not deleted:", len(mem.items))
+	}
+}
+
+func TestHashedKeysStorageOriginalKeys(t *testing.T) {
+	long := func(i int) string {
+		return "https://example.com/search?q=" + strconv.Itoa(i)
+	}
+	mem := MemoryStorageWithOptions(MemoryOptions{MaxItems: 5, Eviction: EvictionSegmentedLRU})
+	s := HashedKeysStorage(mem, HashKeysOptions{MaxKeyLen: 20, KeepOriginal: true})
+	tc := New(DefaultExpiration, 0, 0, s)
+	tc.SetWithMetadata(long(0), 0, DefaultExpiration, NoRefreshDeadline, map[string]string{"a": "b"})
+	for i := 1; i < 4; i++ {
+		tc.Set(long(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	if n, _ := tc.EstimatedSize(); n != 4 {
+		t.Error("original keys are counted as items:", n)
+	}
+	for i := 0; i < 4; i++ {
+		if _, found := tc.Get(long(i)); !found {
+			t.Error("item evicted by the original keys:", long(i))
+		}
+	}
+	if item, _ := tc.InspectItem(long(0)); !reflect.DeepEqual(item.Metadata, map[string]string{"a": "b"}) {
+		t.Error("wrong metadata:", item.Metadata)
+	}
+	tc.Set("short", 4, DefaultExpiration, NoRefreshDeadline)
+	keys, _, err := tc.Keys("https://*", 0, 10)
+	sort.Strings(keys)
+	if err != nil || len(keys) != 4 || keys[0] != long(0) {
+		t.Errorf("Keys returned %q, %v, want the original keys", keys, err)
+	}
+	if n, err := tc.DeletePrefix("https://"); err != nil || n != 4 {
+		t.Error("wrong number of keys deleted:", n, err)
+	}
+	if _, found := tc.Get("short"); !found {
+		t.Error("DeletePrefix deleted a key without the prefix")
+	}
+
+	// Pins and expirations are passed on under the hashed keys, and
+	// reported under the original ones.
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	mem = MemoryStorageWithOptions(MemoryOptions{MaxItems: 5, Eviction: EvictionSegmentedLRU})
+	tc = New(DefaultExpiration, 0, 0, HashedKeysStorage(mem, HashKeysOptions{MaxKeyLen: 20, KeepOriginal: true}))
+	var expired []string
+	if err := tc.OnExpire("https://*", func(k string, v interface{}) {
+		expired = append(expired, k)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set(long(0), 0, time.Minute, NoRefreshDeadline)
+	if err := tc.Pin(long(0)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 100; i++ {
+		tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	if _, found := tc.Get(long(0)); !found {
+		t.Error("pinned item was evicted")
+	}
+	clock.Advance(2 * time.Minute)
+	mem.DeleteExpired()
+	if len(expired) != 1 || expired[0] != long(0) {
+		t.Error("callbacks were called for the wrong keys:", expired)
+	}
+	if tc.pinned(long(0)) {
+		t.Error("expired item still pinned")
+	}
+}
+
+func TestKeyBuilder(t *testing.T) {
+	if k := K("user", 42, "profile").String(); k != "user:42:profile" {
+		t.Error("wrong key:", k)
+	}
+	if a, b := K("a:b", "c").String(), K("a", "b:c").String(); a == b {
+		t.Error("keys with different parts collide:", a)
+	}
+	user := K("user", 42)
+	if k := user.With("settings").String(); k != "user:42:settings" {
+		t.Error("wrong key:", k)
+	}
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set(user.With("profile").String(), 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set(user.With("settings").String(), 2, DefaultExpiration, NoRefreshDeadline)
+	tc.Set(K("user", 420, "profile").String(), 3, DefaultExpiration, NoRefreshDeadline)
+	n, err := tc.DeletePrefix(user.Prefix())
+	if err != nil || n != 2 {
+		t.Error("DeletePrefix did not delete 2 items:", n, err)
+	}
+	if _, found := tc.Get(K("user", 420, "profile").String()); !found {
+		t.Error("item of another user was deleted")
+	}
+}
+
+func TestBypass(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("b", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.SetBypass(true)
+	if _, found := tc.Get("a"); found {
+		t.Error("Get did not miss while bypassed")
+	}
+	tc.Set("b", 2, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("c", 2, DefaultExpiration, NoRefreshDeadline)
+	if !tc.Stats().Bypassed {
+		t.Error("Stats does not report the bypass")
+	}
+	tc.SetBypass(false)
+	if v, found := tc.Get("a"); !found || v != 1 {
+		t.Error("a was lost while bypassed:", v)
+	}
+	if _, found := tc.Get("b"); found {
+		t.Error("b was set while bypassed, or its old value kept")
+	}
+	if _, found := tc.Get("c"); found {
+		t.Error("c was set while bypassed")
+	}
+}
+
+func TestAutoBypass(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+	var overloaded int32 = 1
+	tc.AutoBypass(BypassOptions{
+		Overloaded:    func() bool { return atomic.LoadInt32(&overloaded) != 0 },
+		CheckInterval: time.Millisecond,
+		ResumeAfter:   2,
+		ServeExisting: true,
+	})
+	defer tc.AutoBypass(BypassOptions{})
+	time.Sleep(20 * time.Millisecond)
+	tc.Set("b", 1, DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.Get("b"); found {
+		t.Error("b was set while bypassed")
+	}
+	if _, found := tc.Get("a"); !found {
+		t.Error("existing item was not served while bypassed")
+	}
+	atomic.StoreInt32(&overloaded, 0)
+	time.Sleep(20 * time.Millisecond)
+	tc.Set("b", 1, DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.Get("b"); !found {
+		t.Error("bypass did not stop once no longer overloaded")
+	}
+}
+
+func TestFlushWhere(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("old1", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("old2", 2, DefaultExpiration, NoRefreshDeadline)
+	deploy := time.Now().UnixNano()
+	time.Sleep(time.Millisecond)
+	tc.Set("new", 3, DefaultExpiration, NoRefreshDeadline)
+	before := func(k string, item Item) bool {
+		return item.CreatedAt < deploy
+	}
+	if n, err := tc.FlushWhere(before, true); n != 2 || err != nil {
+		t.Error("dry run did not match 2 items:", n, err)
+	}
+	if _, found := tc.Get("old1"); !found {
+		t.Error("dry run deleted an item")
+	}
+	if n, err := tc.FlushWhere(before, false); n != 2 || err != nil {
+		t.Error("FlushWhere did not delete 2 items:", n, err)
+	}
+	if _, found := tc.Get("old1"); found {
+		t.Error("old1 was not deleted")
+	}
+	if _, found := tc.Get("new"); !found {
+		t.Error("new was deleted")
+	}
+}
+
+func TestHTTPStorage(t *testing.T) {
+	type stored struct {
+		body   []byte
+		header http.Header
+	}
+	var mu sync.Mutex
+	items := map[string]stored{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		k := strings.TrimPrefix(r.URL.Path, "/keys/")
+		switch r.Method {
+		case "GET":
+			it, found := items[k]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set(HTTPExpirationHeader, it.header.Get(HTTPExpirationHeader))
+			w.Write(it.body)
+		case "PUT":
+			b, _ := io.ReadAll(r.Body)
+			items[k] = stored{b, r.Header}
+		case "DELETE":
+			delete(items, k)
+		}
+	}))
+	defer srv.Close()
+
+	tc := New(DefaultExpiration, 0, 0, HTTPStorage(srv.URL, HTTPOptions{Authorize: BearerToken("secret")}))
+	tc.Set("a/b", "c", time.Minute, NoRefreshDeadline)
+	var v string
+	x, found := tc.GetObject("a/b", &v)
+	if !found || *x.(*string) != "c" {
+		t.Error("a/b was not found:", x)
+	}
+	tc.Delete("a/b")
+	if _, found := tc.Get("a/b"); found {
+		t.Error("a/b was not deleted")
+	}
+	unauthorized := HTTPStorage(srv.URL, HTTPOptions{})
+	if _, _, err := unauthorized.TryGet("a/b"); err == nil {
+		t.Error("unauthorized request did not fail")
+	}
+}
+
+// An in-memory ObjectStore.
+type memObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	meta    map[string]map[string]string
+	stats   int
+}
+
+func (m *memObjectStore) Put(name string, body []byte, meta map[string]string) error {
+	m.mu.Lock()
+	m.objects[name] = append([]byte(nil), body...)
+	m.meta[name] = meta
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memObjectStore) Get(name string) ([]byte, map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, found := m.objects[name]
+	if !found {
+		return nil, nil, ErrObjectNotFound
+	}
+	return b, m.meta[name], nil
+}
+
+func (m *memObjectStore) Stat(name string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.objects[name]; !found {
+		return nil, ErrObjectNotFound
+	}
+	m.stats++
+	return m.meta[name], nil
+}
+
+func (m *memObjectStore) Delete(name string) error {
+	m.mu.Lock()
+	delete(m.objects, name)
+	delete(m.meta, name)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memObjectStore) List(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for n := range m.objects {
+		if strings.HasPrefix(n, prefix) {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
+func TestObjectStorage(t *testing.T) {
+	store := &memObjectStore{objects: map[string][]byte{}, meta: map[string]map[string]string{}}
+	tc := New(DefaultExpiration, 0, 0, ObjectStorage(store, "reports/"))
+	tc.SetBytes("big", []byte("report"), time.Hour, NoRefreshDeadline)
+	tc.Set("obj", map[string]int{"a": 1}, time.Hour, NoRefreshDeadline)
+	tc.Set("old", "x", time.Nanosecond, NoRefreshDeadline)
+	if b, found := tc.GetBytes("big"); !found || string(b) != "report" {
+		t.Error("big was not found:", b)
+	}
+	var m map[string]int
+	if x, found := tc.GetObject("obj", &m); !found || (*x.(*map[string]int))["a"] != 1 {
+		t.Error("obj was not decoded:", x)
+	}
+	time.Sleep(time.Millisecond)
+	if _, found := tc.Get("old"); found {
+		t.Error("expired object was found")
+	}
+	if _, found := store.objects["reports/old"]; !found {
+		t.Error("expired object was deleted when read")
+	}
+	if _, found := tc.GetBytes("obj"); found {
+		t.Error("JSON object was returned as bytes")
+	}
+	objects := tc.storage.(*objectStorage)
+	if _, _, _, _, err := objects.tryGetBytes("obj"); !errors.Is(err, ErrWrongType) {
+		t.Error("wrong error reading JSON object as bytes:", err)
+	}
+	objects.DeleteExpired()
+	if _, found := store.objects["reports/old"]; found {
+		t.Error("expired object was not deleted by DeleteExpired")
+	}
+	if _, found := store.objects["reports/big"]; !found || store.stats != 3 {
+		t.Error("objects not checked with Stat:", found, store.stats)
+	}
+	tc.Flush()
+	if len(store.objects) != 0 {
+		t.Error("objects left after Flush:", len(store.objects))
+	}
+}
+
+// An in-memory EtcdKV that records leases instead of expiring them.
+type memEtcd struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	leases map[string]int64
+	ttls   map[int64]int64
+	events chan EtcdEvent
+}
+
+func (m *memEtcd) Grant(ctx context.Context, ttl int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := int64(len(m.ttls) + 1)
+	m.ttls[id] = ttl
+	return id, nil
+}
+
+func (m *memEtcd) Put(ctx context.Context, key string, value []byte, lease int64) error {
+	m.mu.Lock()
+	m.values[key] = value
+	m.leases[key] = lease
+	m.mu.Unlock()
+	m.events <- EtcdEvent{Key: key}
+	return nil
+}
+
+func (m *memEtcd) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, found := m.values[key]
+	return b, found, nil
+}
+
+func (m *memEtcd) Delete(ctx context.Context, key string, prefix bool) error {
+	m.mu.Lock()
+	var deleted []string
+	for k := range m.values {
+		if k == key || (prefix && strings.HasPrefix(k, key)) {
+			delete(m.values, k)
+			deleted = append(deleted, k)
+		}
+	}
+	m.mu.Unlock()
+	for _, k := range deleted {
+		m.events <- EtcdEvent{Key: k, Deleted: true}
+	}
+	return nil
+}
+
+func (m *memEtcd) Watch(ctx context.Context, prefix string) <-chan EtcdEvent {
+	return m.events
+}
+
+func TestEtcdStorage(t *testing.T) {
+	kv := &memEtcd{
+		values: map[string][]byte{},
+		leases: map[string]int64{},
+		ttls:   map[int64]int64{},
+		events: make(chan EtcdEvent, 10),
+	}
+	SetClock(NewManualClock(time.Unix(1000, 0)))
+	defer SetClock(nil)
+	s := EtcdStorage(kv, "config/", time.Second)
+	changes := make(chan string, 10)
+	s.OnChange(func(k string, deleted bool) {
+		changes <- k + " " + strconv.FormatBool(deleted)
+	})
+	tc := New(DefaultExpiration, 0, 0, s)
+	tc.Set("flag", true, 1500*time.Millisecond, NoRefreshDeadline)
+	if x, found := tc.Get("flag"); !found || x != true {
+		t.Error("flag was not found:", x)
+	}
+	if ttl := kv.ttls[kv.leases["config/flag"]]; ttl != 2 {
+		t.Error("lease TTL was not rounded up to 2 seconds:", ttl)
+	}
+	tc.Set("flag", true, 1500*time.Millisecond, NoRefreshDeadline)
+	tc.Set("other", true, 1800*time.Millisecond, NoRefreshDeadline)
+	if len(kv.ttls) != 1 || kv.leases["config/other"] != kv.leases["config/flag"] {
+		t.Error("items expiring in the same second didn't share a lease:", kv.ttls, kv.leases)
+	}
+	tc.Delete("flag")
+	for _, want := range []string{"flag false", "flag false", "other false", "flag true"} {
+		if got := <-changes; got != want {
+			t.Errorf("change %q, want %q", got, want)
+		}
+	}
+	s.OnChange(nil)
+}
+
+// An in-process invalidation bus connecting several caches.
+type localBus struct {
+	mu       sync.Mutex
+	handlers []func([]byte)
+}
+
+func (b *localBus) Publish(msg []byte) error {
+	b.mu.Lock()
+	handlers := b.handlers
+	b.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (b *localBus) Subscribe(handler func([]byte)) error {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *localBus) Close() error {
+	return nil
+}
+
+func TestInvalidationBus(t *testing.T) {
+	bus := &localBus{}
+	a := New(DefaultExpiration, 0, 0, MemoryStorage())
+	b := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for _, c := range []*Cache{a, b} {
+		if err := c.UseInvalidationBus(bus); err != nil {
+			t.Fatal(err)
+		}
+		c.Set("foo", 1, DefaultExpiration, NoRefreshDeadline)
+		c.Set("bar", 1, DefaultExpiration, NoRefreshDeadline)
+	}
+	a.Delete("foo")
+	if _, found := b.Get("foo"); found {
+		t.Error("Delete was not broadcast")
+	}
+	if _, found := b.Get("bar"); !found {
+		t.Error("bar was deleted")
+	}
+	a.SetETags(true)
+	a.SetBytes("page", []byte("x"), DefaultExpiration, NoRefreshDeadline)
+	a.SetBytes("gone", []byte("x"), DefaultExpiration, NoRefreshDeadline)
+	b.Delete("gone")
+	if tag, found := a.ETag("gone"); found {
+		t.Error("ETag kept after a broadcast Delete:", tag)
+	}
+	b.Flush()
+	if _, found := a.Get("bar"); found {
+		t.Error("Flush was not broadcast")
+	}
+	if tag, found := a.ETag("page"); found {
+		t.Error("ETag kept after a broadcast Flush:", tag)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	var mu sync.Mutex
+	loads := map[string]int{}
+	loader := func(name string) func(string) ([]byte, error) {
+		return func(k string) ([]byte, error) {
+			mu.Lock()
+			loads[name+" "+k]++
+			mu.Unlock()
+			return []byte("v-" + k), nil
+		}
+	}
+	var groups []*peerGroup
+	var urls []string
+	for _, name := range []string{"a", "b"} {
+		mux := http.NewServeMux()
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+		g := Peers(New(DefaultExpiration, 0, 0, MemoryStorage()), loader(name), PeerOptions{
+			Self:             srv.URL,
+			HotKeyThreshold:  2,
+			HotKeyExpiration: time.Minute,
+		})
+		mux.Handle(DefaultPeerBasePath, g)
+		groups = append(groups, g)
+		urls = append(urls, srv.URL)
+	}
+	for _, g := range groups {
+		g.SetPeers(urls...)
+	}
+	for i := 0; i < 20; i++ {
+		k := "key" + strconv.Itoa(i)
+		for _, g := range groups {
+			b, err := g.Get(k)
+			if err != nil || string(b) != "v-"+k {
+				t.Fatal("wrong value for", k, string(b), err)
+			}
+		}
+	}
+	for k, n := range loads {
+		if n != 1 {
+			t.Error("key was loaded more than once:", k, n)
+		}
+	}
+	if len(loads) != 20 {
+		t.Error("keys were not each loaded by one peer:", len(loads))
+	}
+}
+
+type hungStorage struct {
+	*memoryStorage
+	release chan bool
+}
+
+func (s *hungStorage) Get(k string) (Item, bool) {
+	<-s.release
+	return s.memoryStorage.Get(k)
+}
+
+func TestTimeoutStorage(t *testing.T) {
+	hs := &hungStorage{memoryStorage: MemoryStorage(), release: make(chan bool)}
+	defer close(hs.release)
+	hs.memoryStorage.Set("a", Item{Object: 1})
+	s := TimeoutStorage(hs, TimeoutOptions{Get: 10 * time.Millisecond})
+	if _, _, err := s.TryGet("a"); err != ErrTimeout {
+		t.Error("hung get didn't time out:", err)
+	}
+	if !IsTransientError(ErrTimeout) {
+		t.Error("ErrTimeout is not transient")
+	}
+	tc := New(DefaultExpiration, 0, 0, s)
+	start := time.Now()
+	if _, found := tc.Get("a"); found {
+		t.Error("hung get found an item")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("get wasn't bounded by the timeout")
+	}
+	tc.Set("b", 2, DefaultExpiration, NoRefreshDeadline)
+	if err := tc.DeleteWithTimeout("b", time.Second); err != nil {
+		t.Error("delete timed out:", err)
+	}
+	if _, _, err := tc.GetWithTimeout("a", time.Millisecond); err != ErrTimeout {
+		t.Error("per-call timeout wasn't applied:", err)
+	}
+}
+
+func TestSetAsync(t *testing.T) {
+	fs := &flakyStorage{memoryStorage: MemoryStorage(), failures: 1, err: io.EOF}
+	tc := New(DefaultExpiration, 0, 0, fs)
+	failed := make(chan string, 1)
+	tc.StartAsyncWrites(AsyncOptions{Workers: 1, OnError: func(k string, err error) {
+		failed <- k
+	}})
+	if err := tc.SetAsync("a", 1, DefaultExpiration, NoRefreshDeadline); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case k := <-failed:
+		if k != "a" {
+			t.Error("wrong key reported:", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed write wasn't reported")
+	}
+	if err := tc.SetAsync("b", 2, DefaultExpiration, NoRefreshDeadline); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && tc.Stats().AsyncPending > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if x, found := tc.Get("b"); !found || x.(int) != 2 {
+		t.Error("async write wasn't applied:", x, found)
+	}
+	if st := tc.Stats(); st.AsyncFailed != 1 || st.AsyncPending != 0 {
+		t.Error("wrong async stats:", st.AsyncFailed, st.AsyncPending)
+	}
+}
+
+type countingStorage struct {
+	*memoryStorage
+	sets int32
+}
+
+func (s *countingStorage) Set(k string, item Item) {
+	atomic.AddInt32(&s.sets, 1)
+	s.memoryStorage.Set(k, item)
+}
+
+func TestCoalescingStorage(t *testing.T) {
+	inner := &countingStorage{memoryStorage: MemoryStorage()}
+	s := CoalescingStorage(inner, time.Hour)
+	tc := New(DefaultExpiration, 0, 0, s)
+	for i := 0; i < 100; i++ {
+		tc.Set("a", i, DefaultExpiration, NoRefreshDeadline)
+	}
+	if x, found := tc.Get("a"); !found || x.(int) != 99 {
+		t.Error("pending write wasn't read:", x, found)
+	}
+	tc.Set("b", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Delete("b")
+	s.Close()
+	if n := atomic.LoadInt32(&inner.sets); n != 1 {
+		t.Error("writes weren't coalesced:", n)
+	}
+	if item, found := inner.Get("a"); !found || item.Object.(int) != 99 {
+		t.Error("last write wasn't applied:", item.Object)
+	}
+	if _, found := inner.Get("b"); found {
+		t.Error("deleted key was written")
+	}
+	if n := tc.Stats().CoalescedWrites; n != 99 {
+		t.Error("wrong coalesced count:", n)
+	}
+}
+
+func TestSetWithTTLs(t *testing.T) {
+	tc := New(time.Minute, 0, 0, MemoryStorage())
+	if err := tc.SetWithTTLs("a", 1, time.Second, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	item, _ := tc.storage.Get("a")
+	if item.RefreshDeadline == 0 || item.RefreshDeadline >= item.Expiration {
+		t.Error("wrong deadlines:", item.RefreshDeadline, item.Expiration)
+	}
+	if err := tc.SetWithTTLs("b", 1, time.Hour, DefaultExpiration); !errors.Is(err, ErrInvalidDuration) {
+		t.Error("soft TTL after the default hard TTL was accepted:", err)
+	}
+	if err := tc.SetWithTTLs("b", 1, -5, time.Hour); err == nil {
+		t.Error("negative soft TTL was accepted")
+	}
+	if _, found := tc.Get("b"); found {
+		t.Error("invalid TTLs set an item")
+	}
+	if err := tc.SetWithTTLs("c", 1, time.Hour, NoExpiration); err != nil {
+		t.Error("soft TTL without a hard TTL was rejected:", err)
+	}
+}
+
+func TestCheckedSets(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for _, d := range [][2]time.Duration{
+		{time.Second, time.Minute},
+		{-5, NoRefreshDeadline},
+		{time.Minute, -3},
+		{DefaultExpiration, time.Second},
+	} {
+		if err := tc.SetChecked("a", 1, d[0], d[1]); err == nil {
+			t.Error("durations were accepted:", d)
+		}
+	}
+	if _, found := tc.Get("a"); found {
+		t.Error("invalid durations set an item")
+	}
+	if err := tc.SetChecked("a", 1, time.Minute, time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := tc.AddChecked("b", 1, time.Second, time.Minute); err == nil {
+		t.Error("AddChecked accepted a refresh deadline after the expiration")
+	}
+	if err := tc.ReplaceChecked("a", 2, NoExpiration, NoRefreshDeadline); err != nil {
+		t.Error(err)
+	}
+	fs := &flakyStorage{memoryStorage: MemoryStorage(), failures: 1, err: io.EOF}
+	if err := New(DefaultExpiration, 0, 0, fs).SetChecked("a", 1, DefaultExpiration, NoRefreshDeadline); err != io.EOF {
+		t.Error("storage error wasn't returned:", err)
+	}
+}
+
+func TestDefaultRefreshDeadline(t *testing.T) {
+	tc := New(time.Hour, 0, 0, MemoryStorage())
+	tc.Set("a", 1, DefaultExpiration, DefaultRefreshDeadline)
+	if item, _ := tc.storage.Get("a"); item.RefreshDeadline != 0 {
+		t.Error("refresh deadline set without a default:", item.RefreshDeadline)
+	}
+	tc.SetDefaultRefreshDeadline(time.Minute)
+	tc.Set("a", 1, DefaultExpiration, DefaultRefreshDeadline)
+	tc.SetBytes("b", []byte("b"), DefaultExpiration, DefaultRefreshDeadline)
+	for _, k := range []string{"a", "b"} {
+		item, _ := tc.storage.Get(k)
+		if left := time.Duration(item.RefreshDeadline - time.Now().UnixNano()); left <= 0 || left > time.Minute {
+			t.Error("default refresh deadline wasn't used for", k, left)
+		}
+	}
+	if err := tc.SetWithTTLs("c", 1, DefaultRefreshDeadline, time.Second); err == nil {
+		t.Error("default refresh deadline after the expiration was accepted")
+	}
+}
+
+func TestRefreshPool(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	release := make(chan bool)
+	var refreshed int32
+	tc.OnRefreshNeeded(func(k string) {
+		<-release
+		atomic.AddInt32(&refreshed, 1)
+	})
+	tc.SetRefreshPool(RefreshPoolOptions{MinWorkers: 1, MaxWorkers: 4, IdleTimeout: 10 * time.Millisecond})
+	for i := 0; i < 8; i++ {
+		k := "k" + strconv.Itoa(i)
+		tc.Set(k, i, DefaultExpiration, time.Nanosecond)
+	}
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 8; i++ {
+		tc.Get("k" + strconv.Itoa(i))
+	}
+	time.Sleep(10 * time.Millisecond)
+	st := tc.Stats()
+	if st.RefreshWorkers != 4 || st.RefreshBusyWorkers != 4 || st.RefreshQueueDepth != 4 {
+		t.Error("pool didn't grow:", st.RefreshWorkers, st.RefreshBusyWorkers, st.RefreshQueueDepth)
+	}
+	close(release)
+	for i := 0; i < 100 && tc.Stats().RefreshWorkers > 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if st := tc.Stats(); st.RefreshWorkers != 1 || st.RefreshQueueDepth != 0 {
+		t.Error("pool didn't shrink:", st.RefreshWorkers, st.RefreshQueueDepth)
+	}
+	if n := atomic.LoadInt32(&refreshed); n != 8 {
+		t.Error("wrong number of refreshes:", n)
+	}
+}
+
+func TestRefreshCooldown(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 1, MemoryStorage())
+	var refreshed int32
+	tc.OnRefreshNeeded(func(k string) {
+		atomic.AddInt32(&refreshed, 1)
+	})
+	tc.SetRefreshCooldown(time.Hour)
+	tc.Set("a", 1, DefaultExpiration, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		tc.Get("a")
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&refreshed); n != 1 {
+		t.Error("key was refreshed during its cooldown:", n)
+	}
+}
+
+func TestRefreshPriority(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetRefreshPriority("pricing:*", RefreshPriorityHigh)
+	tc.SetRefreshPriority("recs:*", RefreshPriorityLow)
+	release := make(chan bool)
+	var mu sync.Mutex
+	var order []string
+	tc.OnRefreshNeeded(func(k string) {
+		if k == "block" {
+			<-release
+			return
+		}
+		mu.Lock()
+		order = append(order, k)
+		mu.Unlock()
+	})
+	tc.SetRefreshPool(RefreshPoolOptions{MinWorkers: 1, MaxWorkers: 1})
+	for _, k := range []string{"block", "recs:1", "other", "pricing:1"} {
+		tc.Set(k, 1, DefaultExpiration, time.Nanosecond)
+	}
+	time.Sleep(time.Millisecond)
+	tc.Get("block")
+	time.Sleep(5 * time.Millisecond)
+	for _, k := range []string{"recs:1", "other", "pricing:1"} {
+		tc.Get(k)
+	}
+	time.Sleep(5 * time.Millisecond)
+	close(release)
+	for i := 0; i < 100 && tc.Stats().RefreshQueueDepth > 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(order, " ") != "pricing:1 other recs:1" {
+		t.Error("keys weren't refreshed by priority:", order)
+	}
+}
+
+func TestRefreshPanic(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 1, MemoryStorage())
+	errs := make(chan string, 2)
+	tc.OnRefreshError(func(k string, err error) {
+		errs <- k + ": " + err.Error()
+	})
+	tc.OnRefreshNeeded(func(k string) {
+		panic("refresh of " + k + " failed")
+	})
+	for _, k := range []string{"a", "b"} {
+		tc.Set(k, 1, DefaultExpiration, time.Nanosecond)
+		time.Sleep(time.Millisecond)
+		tc.Get(k)
+		select {
+		case msg := <-errs:
+			if msg != k+": refresh of "+k+" failed" {
+				t.Error("wrong error reported:", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("panic of", k, "wasn't reported")
+		}
+	}
+	if st := tc.Stats(); st.RefreshPanics != 2 || st.RefreshWorkers != 1 {
+		t.Error("wrong stats after panics:", st.RefreshPanics, st.RefreshWorkers)
+	}
+}
+
+func TestKeyMutex(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	if tc.KeyMutex("a") != tc.KeyMutex("a") {
+		t.Error("different mutexes for the same key")
+	}
+	var computed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu := tc.KeyMutex("a")
+			mu.Lock()
+			defer mu.Unlock()
+			if _, found := tc.Get("a"); !found {
+				atomic.AddInt32(&computed, 1)
+				tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+			}
+		}()
+	}
+	wg.Wait()
+	if computed != 1 {
+		t.Error("value was computed more than once:", computed)
+	}
+}
+
+func TestRefreshSkew(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	rd := time.Now().Add(-time.Millisecond).UnixNano()
+	if !tc.refreshDue("a", rd) {
+		t.Error("refresh not due without a skew")
+	}
+	tc.SetRefreshSkew("host-1", time.Hour)
+	due := 0
+	for i := 0; i < 100; i++ {
+		if tc.refreshDue("k"+strconv.Itoa(i), rd) {
+			due++
+		}
+	}
+	if due > 5 {
+		t.Error("refreshes weren't delayed:", due)
+	}
+	late := time.Now().Add(-time.Hour).UnixNano()
+	if !tc.refreshDue("a", late) {
+		t.Error("refresh not due after the longest delay")
+	}
+	other := New(DefaultExpiration, 0, 0, MemoryStorage())
+	other.SetRefreshSkew("host-2", time.Hour)
+	different := false
+	for i := 0; i < 10 && !different; i++ {
+		k := "k" + strconv.Itoa(i)
+		at := time.Now().Add(-30 * time.Minute).UnixNano()
+		different = tc.refreshDue(k, at) != other.refreshDue(k, at)
+	}
+	if !different {
+		t.Error("instances have the same delays")
+	}
+}
+
+// A memory storage granting leases like a shared storage would.
+type leasingStorage struct {
+	*memoryStorage
+	mu     sync.Mutex
+	leases map[string]string
+}
+
+func (s *leasingStorage) leaseRefresh(name, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, found := s.leases[name]; found && o != owner {
+		return false, nil
+	}
+	s.leases[name] = owner
+	return true, nil
+}
+
+func TestRefreshLease(t *testing.T) {
+	if err := New(DefaultExpiration, 0, 1, MemoryStorage()).SetRefreshLease(RefreshLeaseOptions{TTL: time.Second}); err == nil {
+		t.Error("lease accepted for a storage that can't grant them")
+	}
+	shared := &leasingStorage{memoryStorage: MemoryStorage(), leases: map[string]string{}}
+	var refreshed int32
+	var caches []*Cache
+	for i := 0; i < 3; i++ {
+		tc := New(DefaultExpiration, 0, 1, shared)
+		if err := tc.SetRefreshLease(RefreshLeaseOptions{TTL: time.Minute, Global: true}); err != nil {
+			t.Fatal(err)
+		}
+		tc.OnRefreshNeeded(func(k string) {
+			atomic.AddInt32(&refreshed, 1)
+		})
+		caches = append(caches, tc)
+	}
+	caches[0].Set("a", 1, DefaultExpiration, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	for _, tc := range caches {
+		tc.Get("a")
+		for i := 0; i < 100 && tc.Stats().RefreshQueueDepth > 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&refreshed); n != 1 {
+		t.Error("key wasn't refreshed by a single process:", n)
+	}
+	if skipped := caches[1].Stats().RefreshSkipped + caches[2].Stats().RefreshSkipped; skipped != 2 {
+		t.Error("wrong number of skipped refreshes:", skipped)
+	}
+}
+
+func TestCodecMetrics(t *testing.T) {
+	c := newJSONCodec()
+	b, err := c.Marshal(strings.Repeat("x", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := c.Decode(b, &v); err != nil || len(v) != 100 {
+		t.Fatal("wrong decoded value:", v, err)
+	}
+	var st Stats
+	c.reportStats(&st)
+	c.reportStats(&st)
+	if st.Encodes != 2 || st.Decodes != 2 || st.EncodedBytes != 204 || st.MaxEncodedSize != 102 {
+		t.Error("wrong codec stats:", st.Encodes, st.Decodes, st.EncodedBytes, st.MaxEncodedSize)
+	}
+	if st.EncodedSizes[1] != 2 {
+		t.Error("value counted in the wrong size bucket:", st.EncodedSizes)
+	}
+}
+
+func TestPartitioners(t *testing.T) {
+	tags := HashTagPartitioner(nil)
+	if tags.Hash("{user:1}:profile") != tags.Hash("{user:1}:cart") {
+		t.Error("keys with the same hash tag have different hashes")
+	}
+	if tags.Hash("user:1") != DefaultPartitioner.Hash("user:1") {
+		t.Error("key without a tag wasn't hashed whole")
+	}
+	prefix := PrefixPartitioner(":", 2, nil)
+	if prefix.Hash("user:123:profile") != prefix.Hash("user:123:cart:items") {
+		t.Error("keys with the same prefix have different hashes")
+	}
+	if prefix.Hash("user:123:profile") != DefaultPartitioner.Hash("user:123") {
+		t.Error("wrong prefix hashed")
+	}
+	if prefix.Hash("user:123") != DefaultPartitioner.Hash("user:123") || prefix.Hash("user") != DefaultPartitioner.Hash("user") {
+		t.Error("short keys weren't hashed whole")
+	}
+	if prefix.Hash("user:123:a") == prefix.Hash("user:124:a") {
+		t.Error("keys with different prefixes have the same hash")
+	}
+}
+
+func TestTopKeys(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	if tc.TopKeys(10, MetricHits) != nil {
+		t.Error("top keys returned without tracking")
+	}
+	tc.TrackKeyStats(5)
+	for i := 0; i < 20; i++ {
+		k := "k" + strconv.Itoa(i)
+		tc.Set(k, i, DefaultExpiration, NoRefreshDeadline)
+		for j := 0; j <= i; j++ {
+			tc.Get(k)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		tc.Get("missing")
+	}
+	tc.SetBytes("big", make([]byte, 1000), DefaultExpiration, NoRefreshDeadline)
+	tc.GetBytes("big")
+	top := tc.TopKeys(3, MetricHits)
+	if len(top) != 3 || top[0].Key != "k19" || top[1].Key != "k18" || top[2].Key != "k17" {
+		t.Fatal("wrong top keys by hits:", top)
+	}
+	if top[0].Hits < 20 {
+		t.Error("hits underestimated:", top[0].Hits)
+	}
+	if misses := tc.TopKeys(1, MetricMisses); len(misses) != 1 || misses[0].Key != "missing" || misses[0].Misses < 3 {
+		t.Error("wrong top keys by misses:", misses)
+	}
+	if bytes := tc.TopKeys(1, MetricBytes); len(bytes) != 1 || bytes[0].Key != "big" || bytes[0].Bytes < 1000 {
+		t.Error("wrong top keys by bytes:", bytes)
+	}
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	tc := New(time.Hour, 0, 0, MemoryStorage())
+	tc.SetAdaptiveTTL(AdaptiveTTLOptions{MinTTL: time.Minute, MaxTTL: 11 * time.Minute, HotHits: 10})
+	tc.Set("hot", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("cold", 1, DefaultExpiration, NoRefreshDeadline)
+	for i := 0; i < 5; i++ {
+		tc.Get("hot")
+	}
+	tc.Set("hot", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("cold", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("explicit", 1, time.Hour, NoRefreshDeadline)
+	ttl := func(k string) time.Duration {
+		item, _ := tc.storage.Get(k)
+		return time.Duration(item.Expiration - time.Now().UnixNano()).Round(time.Minute)
+	}
+	if d := ttl("hot"); d != 6*time.Minute {
+		t.Error("wrong TTL for a hot key:", d)
+	}
+	if d := ttl("cold"); d != time.Minute {
+		t.Error("wrong TTL for a cold key:", d)
+	}
+	if d := ttl("explicit"); d != time.Hour {
+		t.Error("explicit TTL was changed:", d)
+	}
+}
+
+func TestTieredStorage(t *testing.T) {
+	remote := &countingStorage{memoryStorage: MemoryStorage()}
+	for i := 0; i < 10; i++ {
+		remote.memoryStorage.Set("user:"+strconv.Itoa(i), Item{Object: i})
+	}
+	remote.memoryStorage.Set("other", Item{Object: "x"})
+	ts := TieredStorage(remote, TieredOptions{L1TTL: time.Minute})
+	n, err := ts.WarmL1FromL2("user:*", 5)
+	if err != nil || n != 5 {
+		t.Fatal("wrong number of items warmed:", n, err)
+	}
+	if _, err := ts.WarmL1FromL2("u?er:*", 0); err == nil {
+		t.Error("glob pattern accepted without bulk loading")
+	}
+	tc := New(DefaultExpiration, 0, 0, ts)
+	tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+	if atomic.LoadInt32(&remote.sets) != 1 {
+		t.Error("write didn't go to the remote tier")
+	}
+	remote.memoryStorage.Set("a", Item{Object: 2})
+	if x, _ := tc.Get("a"); x.(int) != 1 {
+		t.Error("read wasn't served from memory:", x)
+	}
+	if x, found := tc.Get("other"); !found || x.(string) != "x" {
+		t.Error("miss in memory wasn't read from the remote tier:", x)
+	}
+	item, found := ts.l1.Get("other")
+	if !found || item.Expiration == 0 || item.Expiration > time.Now().Add(time.Minute).UnixNano() {
+		t.Error("remote item wasn't copied to memory with L1TTL:", found, item.Expiration)
+	}
+	tc.Delete("a")
+	if _, found := tc.Get("a"); found {
+		t.Error("deleted key found")
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	old := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for i := 0; i < 300; i++ {
+		old.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	old.Set("expired", 1, time.Nanosecond, NoRefreshDeadline)
+	old.Set("ns:a", 1, DefaultExpiration, NoRefreshDeadline)
+	old.Set("ns:b", 2, DefaultExpiration, NoRefreshDeadline)
+	path := t.TempDir() + "/handoff.sock"
+	l, err := old.HandoffListener(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetValidator(func(k string, v interface{}) error {
+		if k == "k7" {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	tc.SetNamespaceQuota("ns", NamespaceQuota{MaxItems: 1})
+	n, err := tc.ConnectHandoff(path, time.Second)
+	if err != nil || n != 301 {
+		t.Fatal("wrong number of items handed off:", n, err)
+	}
+	if x, found := tc.Get("k42"); !found || x.(int) != 42 {
+		t.Error("wrong value handed off:", x, found)
+	}
+	if _, found := tc.Get("k7"); found {
+		t.Error("invalid item handed off")
+	}
+	if items, _, _ := tc.NamespaceUsage("ns"); items != 1 {
+		t.Error("quota not applied to the items handed off:", items)
+	}
+	sent, _ := old.InspectItem("k42")
+	if got, _ := tc.InspectItem("k42"); got.CreatedAt != sent.CreatedAt {
+		t.Error("creation time not kept:", got.CreatedAt, sent.CreatedAt)
+	}
+	if _, found := tc.Get("expired"); found {
+		t.Error("expired item handed off")
+	}
+}
+
+func TestEstimatedSize(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	if n, b := tc.EstimatedSize(); n != 0 || b != 0 {
+		t.Error("empty cache has a size:", n, b)
+	}
+	for i := 0; i < 100; i++ {
+		tc.Set("k"+strconv.Itoa(i), strings.Repeat("x", 1000), DefaultExpiration, NoRefreshDeadline)
+	}
+	n, b := tc.EstimatedSize()
+	if n != 100 || b < 100*1000 || b > 100*1500 {
+		t.Error("wrong size estimate:", n, b)
+	}
+	type value struct {
+		Name  string
+		Items []int64
+		Next  *value
+	}
+	v := &value{Name: "a", Items: make([]int64, 100)}
+	v.Next = v
+	if size := valueSize(reflect.ValueOf(v), 0, map[uintptr]bool{}); size < 800 || size > 1000 {
+		t.Error("wrong value size:", size)
+	}
+	sc := New(DefaultExpiration, 0, 0, SlabStorage(1<<10))
+	sc.SetBytes("a", make([]byte, 100), DefaultExpiration, NoRefreshDeadline)
+	if n, b := sc.EstimatedSize(); n != 1 || b < 1<<10 {
+		t.Error("wrong slab size estimate:", n, b)
+	}
+}
+
+func TestNamespaceQuotas(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetNamespaceQuota("a", NamespaceQuota{MaxItems: 3})
+	tc.SetNamespaceQuota("b", NamespaceQuota{MaxBytes: 4000})
+	for i := 0; i < 10; i++ {
+		tc.Set("a:"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+		tc.Set("b:"+strconv.Itoa(i), strings.Repeat("x", 1000), DefaultExpiration, NoRefreshDeadline)
+		tc.Set("c:"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	for i := 0; i < 10; i++ {
+		if _, found := tc.Get("a:" + strconv.Itoa(i)); found != (i >= 7) {
+			t.Errorf("a:%d found: %v", i, found)
+		}
+		if _, found := tc.Get("c:" + strconv.Itoa(i)); !found {
+			t.Errorf("c:%d was evicted", i)
+		}
+	}
+	if items, bytes, evicted := tc.NamespaceUsage("b"); items < 1 || items > 3 || bytes > 4000 || evicted != int64(10-items) {
+		t.Error("wrong usage of b:", items, bytes, evicted)
+	}
+	tc.Delete("a:9")
+	tc.Set("a:10", 10, DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.Get("a:7"); !found {
+		t.Error("a:7 was evicted after a:9 was deleted")
+	}
+	tc.Flush()
+	if items, _, _ := tc.NamespaceUsage("a"); items != 0 {
+		t.Error("items are counted after Flush:", items)
+	}
+}
+
+func TestPin(t *testing.T) {
+	for _, eviction := range []EvictionPolicy{EvictionSegmentedLRU, EvictionSampled} {
+		tc := New(DefaultExpiration, 0, 0, MemoryStorageWithOptions(MemoryOptions{MaxItems: 5, Eviction: eviction}))
+		if err := tc.Pin("config"); err == nil {
+			t.Error("pinned a missing item")
+		}
+		tc.Set("config", "value", DefaultExpiration, NoRefreshDeadline)
+		if err := tc.Pin("config"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+		}
+		if _, found := tc.Get("config"); !found {
+			t.Error("pinned item was evicted")
+		}
+		tc.Unpin("config")
+		for i := 100; i < 200; i++ {
+			tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+		}
+		if _, found := tc.Get("config"); found {
+			t.Error("unpinned item wasn't evicted")
+		}
+	}
+
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetMaxPinnedBytes(2000)
+	tc.Set("a", strings.Repeat("x", 1000), DefaultExpiration, NoRefreshDeadline)
+	tc.Set("b", strings.Repeat("x", 1000), DefaultExpiration, NoRefreshDeadline)
+	if err := tc.Pin("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Pin("b"); err != ErrPinLimit {
+		t.Error("pinned over the limit:", err)
+	}
+	tc.Delete("a")
+	if err := tc.Pin("b"); err != nil {
+		t.Error("deleting didn't unpin:", err)
+	}
+	if st := tc.Stats(); st.PinnedItems != 1 || st.PinnedBytes < 1000 {
+		t.Error("wrong pinned stats:", st.PinnedItems, st.PinnedBytes)
+	}
+
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	ms := MemoryStorage()
+	tc = New(DefaultExpiration, 0, 0, ms)
+	tc.Set("short", "x", time.Minute, NoRefreshDeadline)
+	tc.Set("long", "x", time.Hour, NoRefreshDeadline)
+	tc.Pin("short")
+	tc.Pin("long")
+	clock.Advance(2 * time.Minute)
+	ms.DeleteExpired()
+	if st := tc.Stats(); st.PinnedItems != 1 || tc.pinned("short") || !tc.pinned("long") {
+		t.Error("expired item still pinned:", st.PinnedItems)
+	}
+}
+
+func TestKeepFresh(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 1, MemoryStorage())
+	var mutex sync.Mutex
+	refreshes := map[string]int{}
+	tc.OnRefreshNeeded(func(k string) {
+		mutex.Lock()
+		refreshes[k]++
+		mutex.Unlock()
+	})
+	stop := tc.KeepFresh([]string{"a", "b"}, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	stop()
+	time.Sleep(20 * time.Millisecond)
+	mutex.Lock()
+	a, b := refreshes["a"], refreshes["b"]
+	mutex.Unlock()
+	if a < 3 || b < 3 {
+		t.Error("keys weren't kept fresh:", a, b)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if refreshes["a"] != a {
+		t.Error("keys were refreshed after stop")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	tc := New(DefaultExpiration, 0, 1, MemoryStorage())
+	tc.SetDeterministic(true)
+	var refreshed []string
+	tc.OnRefreshNeeded(func(k string) {
+		refreshed = append(refreshed, k)
+	})
+	for _, k := range []string{"c", "a", "d", "b"} {
+		tc.Set(k, k, time.Hour, time.Minute)
+	}
+	tc.Set("e", "e", time.Second, NoRefreshDeadline)
+	var keys []string
+	tc.Range(func(k string, x interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if strings.Join(keys, ",") != "a,b,c,d,e" {
+		t.Error("keys not in order:", keys)
+	}
+	tc.Advance(2 * time.Second)
+	if _, found := tc.Get("e"); found {
+		t.Error("expired item was found")
+	}
+	if _, found := tc.Get("a"); !found {
+		t.Error("item expired early")
+	}
+	tc.Advance(time.Minute)
+	tc.Get("b")
+	tc.Get("a")
+	if len(refreshed) != 0 {
+		t.Error("refreshed before Advance:", refreshed)
+	}
+	tc.Advance(0)
+	if strings.Join(refreshed, ",") != "b,a" {
+		t.Error("wrong refreshes:", refreshed)
+	}
+}
+
+func TestInitialCapacity(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorageWithOptions(MemoryOptions{InitialCapacity: 1000}))
+	for i := 0; i < 1000; i++ {
+		tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	if n := tc.Stats().MapGrowths; n != 0 {
+		t.Error("preallocated map grew:", n)
+	}
+	tc.Set("k1000", 1000, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("k1000", 1000, DefaultExpiration, NoRefreshDeadline)
+	if n := tc.Stats().MapGrowths; n != 1 {
+		t.Error("wrong number of growths:", n)
+	}
+	tc.Flush()
+	for i := 0; i < 1000; i++ {
+		tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	if n := tc.Stats().MapGrowths; n != 1 {
+		t.Error("map grew after Flush:", n)
+	}
+	dc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for i := 0; i < 100; i++ {
+		dc.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	if n := dc.Stats().MapGrowths; n != 5 {
+		t.Error("wrong number of growths:", n)
+	}
+}
+
+func TestGetFresh(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	var loads int32
+	release := make(chan bool)
+	loader := func() (interface{}, error) {
+		n := atomic.AddInt32(&loads, 1)
+		<-release
+		return int(n), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := tc.Fetch("a", loader, DefaultExpiration, NoRefreshDeadline); err != nil || v != 1 {
+				t.Error("wrong fetched value:", v, err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&loads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Error("concurrent fetches loaded", n, "times")
+	}
+	if v, err := tc.Fetch("a", loader, DefaultExpiration, NoRefreshDeadline); err != nil || v != 1 {
+		t.Error("cached value not returned:", v, err)
+	}
+	if v, err := tc.GetFresh("a", loader, DefaultExpiration, NoRefreshDeadline); err != nil || v != 2 {
+		t.Error("value not reloaded:", v, err)
+	}
+	if v, _ := tc.Get("a"); v != 2 {
+		t.Error("reloaded value not cached:", v)
+	}
+	failed := errors.New("failed")
+	if _, err := tc.GetFresh("a", func() (interface{}, error) { return nil, failed }, DefaultExpiration, NoRefreshDeadline); err != failed {
+		t.Error("loader error not returned:", err)
+	}
+	if v, _ := tc.Get("a"); v != 2 {
+		t.Error("failed reload replaced the value:", v)
+	}
+}
+
+func TestCachedFailure(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetFailureTTL(50 * time.Millisecond)
+	failed := errors.New("failed")
+	loads := 0
+	loader := func() (interface{}, error) {
+		loads++
+		if loads == 1 {
+			return nil, failed
+		}
+		return "ok", nil
+	}
+	if _, err := tc.Fetch("a", loader, DefaultExpiration, NoRefreshDeadline); err != failed {
+		t.Error("loader error not returned:", err)
+	}
+	_, err := tc.Fetch("a", loader, DefaultExpiration, NoRefreshDeadline)
+	if !errors.Is(err, ErrCachedFailure) || !errors.Is(err, failed) || loads != 1 {
+		t.Error("failure not cached:", err, loads)
+	}
+	if v, found := tc.Get("a"); !found || !errors.Is(v.(error), failed) {
+		t.Error("Get didn't return the cached failure:", v, found)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if v, err := tc.Fetch("a", loader, DefaultExpiration, NoRefreshDeadline); err != nil || v != "ok" {
+		t.Error("cached failure didn't expire:", v, err)
+	}
+
+	store := &memObjectStore{objects: map[string][]byte{}, meta: map[string]map[string]string{}}
+	tc = New(DefaultExpiration, 0, 0, ObjectStorage(store, "failures/"))
+	tc.SetFailureTTL(time.Minute)
+	loads = 0
+	if _, err := tc.Fetch("a", loader, DefaultExpiration, NoRefreshDeadline); err != failed {
+		t.Error("loader error not returned by a JSON storage:", err)
+	}
+	if v, found := tc.Get("a"); found {
+		t.Error("failure cached by a JSON storage:", v)
+	}
+	if v, err := tc.Fetch("a", loader, DefaultExpiration, NoRefreshDeadline); err != nil || v != "ok" {
+		t.Error("JSON storage didn't call the loader again:", v, err)
+	}
+}
+
+func TestGetDetailed(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	tc := New(DefaultExpiration, 0, 1, MemoryStorage())
+	tc.SetDeterministic(true)
+	tc.OnRefreshNeeded(func(string) {})
+	tc.Set("a", 1, time.Minute, 10*time.Second)
+	tc.Set("b", 2, NoExpiration, NoRefreshDeadline)
+	clock.Advance(12 * time.Second)
+	v, meta, found := tc.GetDetailed("a")
+	if !found || v != 1 || meta.Age != 12*time.Second || meta.TTL != 48*time.Second || !meta.RefreshDue || !meta.Refreshing || meta.Source != SourceStorage {
+		t.Errorf("wrong metadata: %v %+v %v", v, meta, found)
+	}
+	if _, meta, _ := tc.GetDetailed("b"); meta.TTL != NoExpiration || meta.RefreshDue || meta.Refreshing {
+		t.Errorf("wrong metadata: %+v", meta)
+	}
+	if _, _, found := tc.GetDetailed("c"); found {
+		t.Error("missing key found")
+	}
+
+	remote := MemoryStorage()
+	tiered := New(DefaultExpiration, 0, 0, TieredStorage(remote, TieredOptions{}))
+	remote.Set("a", Item{Object: 1})
+	if _, meta, _ := tiered.GetDetailed("a"); meta.Source != SourceL2 {
+		t.Error("wrong source:", meta.Source)
+	}
+	if _, meta, _ := tiered.GetDetailed("a"); meta.Source != SourceL1 {
+		t.Error("wrong source:", meta.Source)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("a", "x", DefaultExpiration, NoRefreshDeadline)
+	if err := tc.Add("a", 1, DefaultExpiration, NoRefreshDeadline); !errors.Is(err, ErrKeyExists) || err.Error() != "Item a already exists" {
+		t.Error("wrong Add error:", err)
+	}
+	if err := tc.Replace("b", 1, DefaultExpiration, NoRefreshDeadline); !errors.Is(err, ErrNotFound) {
+		t.Error("wrong Replace error:", err)
+	}
+	if _, err := tc.IncrementInt("b", 1); !errors.Is(err, ErrNotFound) {
+		t.Error("wrong Increment error:", err)
+	}
+	if _, err := tc.IncrementInt("a", 1); !errors.Is(err, ErrWrongType) {
+		t.Error("wrong Increment error:", err)
+	}
+	if !errors.Is(ErrTimeout, ErrStorageUnavailable) || !errors.Is(errBreakerOpen, ErrStorageUnavailable) {
+		t.Error("unavailability errors don't match ErrStorageUnavailable")
+	}
+	if err := tc.SetRefreshLease(RefreshLeaseOptions{TTL: time.Second}); !errors.Is(err, ErrNotSupported) {
+		t.Error("wrong SetRefreshLease error:", err)
+	}
+}
+
+func TestNilValues(t *testing.T) {
+	store := &memObjectStore{objects: map[string][]byte{}, meta: map[string]map[string]string{}}
+	for _, s := range []Storage{MemoryStorage(), SlabStorage(0), ObjectStorage(store, "nil/")} {
+		tc := New(DefaultExpiration, 0, 0, s)
+		tc.Set("nil", nil, DefaultExpiration, NoRefreshDeadline)
+		if x, found := tc.Get("nil"); !found || x != nil {
+			t.Errorf("%T: nil value not found: %v %v", s, x, found)
+		}
+		var m map[string]int
+		if x, found := tc.GetObject("nil", &m); !found || x != nil {
+			t.Errorf("%T: nil object not found: %v %v", s, x, found)
+		}
+		if !tc.Exists("nil") {
+			t.Errorf("%T: nil value doesn't exist", s)
+		}
+		if tc.Exists("missing") {
+			t.Errorf("%T: missing key exists", s)
+		}
+	}
+}
+
+func TestHas(t *testing.T) {
+	tiered := TieredStorage(SlabStorage(0), TieredOptions{})
+	for _, s := range []Storage{MemoryStorage(), SlabStorage(0), tiered} {
+		tc := New(DefaultExpiration, 0, 0, s)
+		tc.Set("a", 1, DefaultExpiration, NoRefreshDeadline)
+		tc.Set("old", 1, time.Nanosecond, NoRefreshDeadline)
+		time.Sleep(time.Millisecond)
+		if !tc.Has("a") || tc.Has("old") || tc.Has("missing") {
+			t.Errorf("%T: wrong presence: %v %v %v", s, tc.Has("a"), tc.Has("old"), tc.Has("missing"))
+		}
+	}
+	tiered.l1.Flush()
+	if !New(DefaultExpiration, 0, 0, tiered).Has("a") {
+		t.Error("item of the remote tier not found")
+	}
+}
+
+func TestRename(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("a", 1, time.Hour, NoRefreshDeadline)
+	before, _ := tc.InspectItem("a")
+	if err := tc.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	after, found := tc.InspectItem("b")
+	if !found || after.Object != 1 || after.Expiration != before.Expiration {
+		t.Error("item not moved with its expiration:", after, found)
+	}
+	if tc.Has("a") {
+		t.Error("old key still has an item")
+	}
+	if err := tc.Rename("a", "c"); !errors.Is(err, ErrNotFound) {
+		t.Error("wrong error renaming a missing key:", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		tc.Set("v1:"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	tc.Set("other", 0, DefaultExpiration, NoRefreshDeadline)
+	if n, err := tc.Migrate("v1:", "v2:user:"); n != 5 || err != nil {
+		t.Error("wrong migration:", n, err)
+	}
+	for i := 0; i < 5; i++ {
+		if x, found := tc.Get("v2:user:" + strconv.Itoa(i)); !found || x != i {
+			t.Error("item not migrated:", i, x, found)
+		}
+	}
+	if !tc.Has("other") {
+		t.Error("unrelated key was migrated")
+	}
+}
+
+// A storage renaming keys in place, as Redis does.
+type renamingStorage struct {
+	*slabStorage
+}
+
+func (s renamingStorage) rename(oldKey, newKey string) (bool, error) {
+	b, e, rd, found := s.GetBytes(oldKey)
+	if !found {
+		return false, nil
+	}
+	s.SetBytes(newKey, b, e, rd)
+	s.Del(oldKey)
+	return true, nil
+}
+
+func TestRenameInPlace(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, renamingStorage{SlabStorage(0)})
+	tc.SetETags(true)
+	tc.SetBytes("a", []byte("x"), time.Hour, NoRefreshDeadline)
+	if err := tc.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if tag, found := tc.ETag("b"); !found || tag != computeETag([]byte("x")) {
+		t.Error("renamed item not tracked under its new key:", tag, found)
+	}
+	if _, found := tc.ETag("a"); found {
+		t.Error("ETag kept for the old key")
+	}
+}
+
+func TestPrefixStats(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.TrackPrefixStats("user:", "user:admin:", "feed:")
+	tc.Set("user:1", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Get("user:1")
+	tc.Get("user:1")
+	tc.Get("user:2")
+	tc.Get("user:admin:1")
+	tc.SetBytes("feed:1", []byte("abcd"), DefaultExpiration, NoRefreshDeadline)
+	tc.GetBytes("feed:1")
+	tc.Get("other")
+	st := tc.Stats()
+	if len(st.Prefixes) != 3 {
+		t.Fatal("wrong prefixes:", st.Prefixes)
+	}
+	if s := st.Prefixes["user:"]; s.Hits != 2 || s.Misses != 1 {
+		t.Error("wrong user: stats:", s)
+	}
+	if s := st.Prefixes["user:admin:"]; s.Hits != 0 || s.Misses != 1 {
+		t.Error("wrong user:admin: stats:", s)
+	}
+	if s := st.Prefixes["feed:"]; s.Hits != 1 || s.Bytes != 4 {
+		t.Error("wrong feed: stats:", s)
+	}
+	tc.TrackPrefixStats()
+	if st := tc.Stats(); st.Prefixes != nil {
+		t.Error("prefixes still tracked:", st.Prefixes)
+	}
+}
+
+func TestCopyOnRead(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetCopyOnRead(GobCopy)
+	tc.Set("foo", &TestStruct{Num: 1, Children: []*TestStruct{{Num: 2}}}, DefaultExpiration, NoRefreshDeadline)
+	x, _ := tc.Get("foo")
+	foo := x.(*TestStruct)
+	foo.Num++
+	foo.Children[0].Num++
+	y, _ := tc.Get("foo")
+	if bar := y.(*TestStruct); bar.Num != 1 || bar.Children[0].Num != 2 {
+		t.Error("cached value was modified:", bar.Num, bar.Children[0].Num)
+	}
+	tc.Set("m", map[string]int{"a": 1}, DefaultExpiration, NoRefreshDeadline)
+	m, _ := tc.Get("m")
+	m.(map[string]int)["a"] = 2
+	if m, _ := tc.Get("m"); m.(map[string]int)["a"] != 1 {
+		t.Error("cached map was modified")
+	}
+	tc.SetCopyOnRead(nil)
+	x, _ = tc.Get("foo")
+	y, _ = tc.Get("foo")
+	if x != y {
+		t.Error("value copied after SetCopyOnRead(nil)")
+	}
+}
+
+func TestMutationCheck(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetMutationCheck(MutationCheckPanic)
+	tc.Set("foo", &TestStruct{Num: 1, Children: []*TestStruct{{Num: 2}}}, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("m", map[string]int{"a": 1, "b": 2}, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("s", "bar", DefaultExpiration, NoRefreshDeadline)
+	for i := 0; i < 3; i++ {
+		tc.Get("foo")
+		tc.Get("m")
+		tc.Get("s")
+	}
+	x, _ := tc.Get("foo")
+	x.(*TestStruct).Children[0].Num++
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("modified value not detected")
+			}
+		}()
+		tc.Get("foo")
+	}()
+	// The new contents are checked from then on.
+	tc.Get("foo")
+	tc.Set("foo", &TestStruct{Num: 3}, DefaultExpiration, NoRefreshDeadline)
+	tc.Get("foo")
+	tc.SetMutationCheck(MutationCheckOff)
+	m, _ := tc.Get("m")
+	m.(map[string]int)["a"] = 3
+	tc.Get("m")
+}
+
+func TestSetValidator(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetValidator(func(k string, v interface{}) error {
+		if ts, ok := v.(*TestStruct); ok && ts.Num == 0 {
+			return errors.New("Num is required")
+		}
+		return nil
+	})
+	good := &TestStruct{Num: 1}
+	tc.Set("foo", good, DefaultExpiration, NoRefreshDeadline)
+	tc.Set("foo", &TestStruct{}, DefaultExpiration, NoRefreshDeadline)
+	if x, _ := tc.Get("foo"); x != good {
+		t.Error("invalid value replaced the existing one:", x)
+	}
+	if err := tc.Add("bar", &TestStruct{}, DefaultExpiration, NoRefreshDeadline); !errors.Is(err, ErrInvalidValue) {
+		t.Error("expected ErrInvalidValue from Add, got", err)
+	}
+	if err := tc.SetChecked("bar", &TestStruct{}, DefaultExpiration, NoRefreshDeadline); !errors.Is(err, ErrInvalidValue) {
+		t.Error("expected ErrInvalidValue from SetChecked, got", err)
+	}
+	err := tc.Txn(func(tx Txn) error {
+		tx.Set("baz", good, DefaultExpiration, NoRefreshDeadline)
+		tx.Set("bar", &TestStruct{}, DefaultExpiration, NoRefreshDeadline)
+		return nil
+	})
+	if !errors.Is(err, ErrInvalidValue) {
+		t.Error("expected ErrInvalidValue from Txn, got", err)
+	}
+	if tc.Has("bar") || tc.Has("baz") {
+		t.Error("transaction with an invalid value was applied")
+	}
+	tc.SetValidator(nil)
+	tc.Set("bar", &TestStruct{}, DefaultExpiration, NoRefreshDeadline)
+	if !tc.Has("bar") {
+		t.Error("value not set after SetValidator(nil)")
+	}
+}
+
+type registeredStruct struct {
+	Name string
+	Num  int
+}
+
+func TestRegisterType(t *testing.T) {
+	RegisterType("registered", func() interface{} { return &registeredStruct{} })
+	RegisterType("registered-value", func() interface{} { return TestStruct{} })
+	s := &redisStorage{marshaller: newJSONCodec()}
+	item := s.UnMarshal(s.Marshal(Item{Object: &registeredStruct{"foo", 1}, Expiration: 5}), nil)
+	if v, ok := item.Object.(*registeredStruct); !ok || v.Name != "foo" || v.Num != 1 || item.Expiration != 5 {
+		t.Errorf("registered type not decoded: %#v", item)
+	}
+	item = s.UnMarshal(s.Marshal(Item{Object: TestStruct{Num: 2}}), nil)
+	if v, ok := item.Object.(TestStruct); !ok || v.Num != 2 {
+		t.Errorf("registered value type not decoded: %#v", item.Object)
+	}
+	var o registeredStruct
+	item = s.UnMarshal(s.Marshal(Item{Object: &registeredStruct{"bar", 2}}), &o)
+	if item.Object != &o || o.Name != "bar" {
+		t.Errorf("not decoded into the given value: %#v", item.Object)
+	}
+	if item := s.UnMarshal(s.Marshal(Item{Object: (*registeredStruct)(nil)}), nil); item.Object != nil {
+		t.Errorf("nil value decoded as %#v", item.Object)
+	}
+	// Values stored before the type was registered, or by processes that
+	// don't register it, have no tag.
+	if item := s.UnMarshal("0|0|{\"Name\":\"baz\"}", nil); item.Object.(map[string]interface{})["Name"] != "baz" {
+		t.Errorf("untagged value decoded as %#v", item.Object)
+	}
+	if item := s.UnMarshal("0|0|#unknown|{\"Name\":\"baz\"}", nil); item.Object.(map[string]interface{})["Name"] != "baz" {
+		t.Errorf("value of an unknown type decoded as %#v", item.Object)
+	}
+}
+
+func TestSetReader(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	if err := tc.SetReader("pdf", strings.NewReader("%PDF-1.4 and more"), 8, DefaultExpiration, NoRefreshDeadline); err != nil {
+		t.Fatal(err)
+	}
+	rc, found := tc.GetReader("pdf")
+	if !found {
+		t.Fatal("pdf was not found")
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "%PDF-1.4" {
+		t.Errorf("read %q", b)
+	}
+	tc.SetValidator(func(k string, v interface{}) error {
+		if len(v.([]byte)) == 0 {
+			return errors.New("empty")
+		}
+		return nil
+	})
+	if err := tc.SetReader("pdf", strings.NewReader(""), -1, DefaultExpiration, NoRefreshDeadline); !errors.Is(err, ErrInvalidValue) {
+		t.Error("invalid value not rejected:", err)
+	}
+	if _, found := tc.GetReader("pdf"); !found {
+		t.Error("existing item replaced by an invalid value")
+	}
+
+	var mu sync.Mutex
+	bodies := map[string][]byte{}
+	var contentLength int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		k := strings.TrimPrefix(r.URL.Path, "/keys/")
+		switch r.Method {
+		case "GET":
+			b, found := bodies[k]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(b)
+		case "PUT":
+			contentLength = r.ContentLength
+			bodies[k], _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer srv.Close()
+	tc = New(DefaultExpiration, 0, 0, HTTPStorage(srv.URL, HTTPOptions{}))
+	if err := tc.SetReader("pdf", strings.NewReader("%PDF-1.4"), 8, DefaultExpiration, NoRefreshDeadline); err != nil {
+		t.Fatal(err)
+	}
+	if contentLength != 8 {
+		t.Error("request sent with content length", contentLength)
+	}
+	rc, found = tc.GetReader("pdf")
+	if !found {
+		t.Fatal("pdf was not found")
+	}
+	b, _ = io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "%PDF-1.4" {
+		t.Errorf("read %q", b)
+	}
+	if _, found := tc.GetReader("missing"); found {
+		t.Error("missing key was found")
+	}
+	tc.SetAdmissionPolicy(admitNothing{})
+	if err := tc.SetReader("report", strings.NewReader("report"), 6, DefaultExpiration, NoRefreshDeadline); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := bodies["report"]; found {
+		t.Error("value not admitted was streamed")
+	}
+}
+
+// An admission policy admitting no key.
+type admitNothing struct{}
+
+func (admitNothing) Admit(k string) bool {
+	return false
+}
+
+func TestContentAddressedStorage(t *testing.T) {
+	ms := MemoryStorage()
+	tc := New(DefaultExpiration, 0, 0, ContentAddressedStorage(ms))
+	tc.SetBytes("a", []byte("<p>fragment</p>"), time.Minute, NoRefreshDeadline)
+	tc.SetBytes("b", []byte("<p>fragment</p>"), time.Hour, NoRefreshDeadline)
+	tc.Set("c", "<p>fragment</p>", time.Minute, NoRefreshDeadline)
+	tc.Set("d", map[string]int{"x": 1, "y": 2}, time.Minute, NoRefreshDeadline)
+	tc.Set("e", map[string]int{"y": 2, "x": 1}, time.Minute, NoRefreshDeadline)
+	if len(ms.items) != 5+3 {
+		t.Error("values not deduplicated:", len(ms.items))
+	}
+	if b, found := tc.GetBytes("a"); !found || string(b) != "<p>fragment</p>" {
+		t.Errorf("a was not found: %q", b)
+	}
+	if s, found := tc.Get("c"); !found || s != "<p>fragment</p>" {
+		t.Errorf("c was not found: %v", s)
+	}
+	if m, found := tc.Get("e"); !found || m.(map[string]int)["x"] != 1 {
+		t.Errorf("e was not found: %v", m)
+	}
+	ref, _ := contentKey([]byte("<p>fragment</p>"))
+	if content, _ := ms.Get(ref); content.Expiration < timeNow().Add(time.Hour-time.Second).UnixNano() {
+		t.Error("shared value expires before the last item sharing it")
+	}
+	tc.Delete("a")
+	if _, found := tc.Get("a"); found {
+		t.Error("a was not deleted")
+	}
+	if _, found := tc.GetBytes("b"); !found {
+		t.Error("b was deleted with a")
+	}
+}
+
+func TestContentAddressedStorageKeys(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	cs := ContentAddressedStorage(MemoryStorage())
+	tc := New(DefaultExpiration, 0, 0, cs)
+	var expired []string
+	if err := tc.OnExpire("*", func(k string, v interface{}) {
+		expired = append(expired, fmt.Sprint(k, "=", v))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("a", "shared", time.Minute, NoRefreshDeadline)
+	tc.Set("b", "shared", time.Hour, NoRefreshDeadline)
+	tc.Set("c", "own", time.Minute, NoRefreshDeadline)
+	tc.Set("d", "pinned", time.Minute, NoRefreshDeadline)
+	if err := tc.Pin("d"); err != nil {
+		t.Fatal(err)
+	}
+	keys, _, err := tc.Keys("*", 0, 10)
+	sort.Strings(keys)
+	if err != nil || !reflect.DeepEqual(keys, []string{"a", "b", "c", "d"}) {
+		t.Errorf("Keys returned %q, %v, want the items' keys", keys, err)
+	}
+	clock.Advance(2 * time.Minute)
+	cs.DeleteExpired()
+	sort.Strings(expired)
+	if !reflect.DeepEqual(expired, []string{"a=shared", "c=own", "d=pinned"}) {
+		t.Errorf("callbacks were called with %q, want the items' keys and values", expired)
+	}
+	if tc.pinned("d") {
+		t.Error("expired item still pinned")
+	}
+	if n, err := tc.DeletePrefix(""); err != nil || n != 1 {
+		t.Error("DeletePrefix deleted content keys:", n, err)
+	}
+}
+
+func TestETag(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetBytes("a", []byte("body"), DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.ETag("a"); found {
+		t.Error("ETag found before SetETags")
+	}
+	tc.SetETags(true)
+	tc.SetBytes("a", []byte("body"), DefaultExpiration, NoRefreshDeadline)
+	tc.SetString("b", "body", DefaultExpiration, NoRefreshDeadline)
+	tc.Set("c", 1, DefaultExpiration, NoRefreshDeadline)
+	a, found := tc.ETag("a")
+	if !found || len(a) != 34 || a[0] != '"' {
+		t.Errorf("unexpected ETag %q", a)
+	}
+	if b, _ := tc.ETag("b"); b != a {
+		t.Errorf("ETags of the same contents differ: %q, %q", a, b)
+	}
+	if _, found := tc.ETag("c"); found {
+		t.Error("ETag found for an int")
+	}
+	tc.SetBytes("a", []byte("new body"), DefaultExpiration, NoRefreshDeadline)
+	if tag, _ := tc.ETag("a"); tag == a {
+		t.Error("ETag not recomputed on Set")
+	}
+	tc.Set("b", 2, DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.ETag("b"); found {
+		t.Error("ETag kept after the value changed type")
+	}
+	tc.Delete("a")
+	if _, found := tc.ETag("a"); found {
+		t.Error("ETag kept after Delete")
+	}
+	tc.Set("d", "x", time.Nanosecond, NoRefreshDeadline)
+	time.Sleep(time.Millisecond)
+	if _, found := tc.ETag("d"); found {
+		t.Error("ETag of an expired item found")
+	}
+}
+
+func TestMemoize(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	var calls int32
+	release := make(chan bool)
+	square := Memoize(tc, func(n int) string { return "square:" + strconv.Itoa(n) }, time.Minute, func(n int) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		if n < 0 {
+			return 0, errors.New("negative")
+		}
+		return n * n, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := square(3); err != nil || v != 9 {
+				t.Error("unexpected result:", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if v, err := square(3); err != nil || v != 9 {
+		t.Error("unexpected result:", v, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("function called", n, "times")
+	}
+	if _, err := square(-1); err == nil {
+		t.Error("error not returned")
+	}
+	if _, err := square(-1); err == nil || atomic.LoadInt32(&calls) != 3 {
+		t.Error("error cached without SetFailureTTL")
+	}
+}
+
+func TestSetWithCost(t *testing.T) {
+	ms := MemoryStorageWithOptions(MemoryOptions{MaxItems: 2, Eviction: EvictionSampled, EvictionSamples: 10, CostWeight: 1})
+	tc := New(DefaultExpiration, 0, 0, ms)
+	tc.SetWithCost("expensive", 1, time.Minute, NoRefreshDeadline, time.Hour)
+	tc.Set("cheap", 2, 2*time.Minute, NoRefreshDeadline)
+	tc.Set("new", 3, 3*time.Minute, NoRefreshDeadline)
+	if _, found := tc.Get("expensive"); !found {
+		t.Error("expensive item evicted before a cheap one")
+	}
+	if _, found := tc.Get("cheap"); found {
+		t.Error("cheap item not evicted")
+	}
+	if item, _ := ms.Get("expensive"); item.Cost != time.Hour {
+		t.Error("cost not stored:", item.Cost)
+	}
+
+	tc = New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetRefreshCostThreshold(time.Second)
+	tc.SetWithCost("slow", 1, DefaultExpiration, NoRefreshDeadline, 2*time.Second)
+	tc.SetWithCost("fast", 1, DefaultExpiration, NoRefreshDeadline, time.Millisecond)
+	tc.SetRefreshPriority("slow-low", RefreshPriorityLow)
+	tc.SetWithCost("slow-low", 1, DefaultExpiration, NoRefreshDeadline, 2*time.Second)
+	if p := tc.refreshPriority("slow"); p != RefreshPriorityHigh {
+		t.Error("expensive key has priority", p)
+	}
+	if p := tc.refreshPriority("fast"); p != RefreshPriorityNormal {
+		t.Error("cheap key has priority", p)
+	}
+	if p := tc.refreshPriority("slow-low"); p != RefreshPriorityLow {
+		t.Error("pattern priority overridden:", p)
+	}
+	tc.Fetch("loaded", func() (interface{}, error) {
+		time.Sleep(2 * time.Millisecond)
+		return 1, nil
+	}, DefaultExpiration, NoRefreshDeadline)
+	if item, _ := tc.storage.Get("loaded"); item.Cost < 2*time.Millisecond {
+		t.Error("loader duration not recorded:", item.Cost)
+	}
+}
+
+func TestFetchWithDeadline(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("k", "stale", DefaultExpiration, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	release := make(chan bool)
+	loader := func() (interface{}, error) {
+		<-release
+		return "fresh", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if v, err := tc.FetchWithDeadline(ctx, "k", loader, DefaultExpiration, NoRefreshDeadline); err != nil || v != "stale" {
+		t.Error("stale value not returned:", v, err)
+	}
+	close(release)
+	for i := 0; i < 100; i++ {
+		if v, _ := tc.Get("k"); v == "fresh" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, _ := tc.Get("k"); v != "fresh" {
+		t.Error("value not set in the background:", v)
+	}
+	if v, err := tc.FetchWithDeadline(context.Background(), "k", nil, DefaultExpiration, NoRefreshDeadline); err != nil || v != "fresh" {
+		t.Error("fresh value not returned:", v, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	block := make(chan bool)
+	defer close(block)
+	_, err := tc.FetchWithDeadline(ctx, "missing", func() (interface{}, error) {
+		<-block
+		return 1, nil
+	}, DefaultExpiration, NoRefreshDeadline)
+	if err != context.DeadlineExceeded {
+		t.Error("expected the context's error, got", err)
+	}
+}
+
+func TestGetWaitFresh(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 1, MemoryStorage())
+	release := make(chan bool)
+	tc.OnRefreshNeeded(func(k string) {
+		<-release
+		tc.Set(k, "fresh", DefaultExpiration, NoRefreshDeadline)
+	})
+	tc.Set("k", "stale", DefaultExpiration, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if v, found := tc.GetWaitFresh(ctx, "k"); !found || v != "stale" {
+		t.Error("stale value not returned after the context was done:", v)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(release)
+	}()
+	if v, found := tc.GetWaitFresh(context.Background(), "k"); !found || v != "fresh" {
+		t.Error("fresh value not returned:", v)
+	}
+	if v, found := tc.GetWaitFresh(context.Background(), "k"); !found || v != "fresh" {
+		t.Error("value not returned without a refresh:", v)
+	}
+}
+
+func TestInvalidateNamespace(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	users := Typed[string](tc, "users")
+	posts := Typed[string](tc, "posts")
+	users.Set("1", "alice", time.Minute, NoRefreshDeadline)
+	posts.Set("1", "hello", time.Minute, NoRefreshDeadline)
+	if err := tc.InvalidateNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+	if v, found := users.Get("1"); found {
+		t.Error("item of an invalidated namespace found:", v)
+	}
+	if v, found := posts.Get("1"); !found || v != "hello" {
+		t.Error("item of another namespace invalidated:", v)
+	}
+	users.Set("1", "bob", time.Minute, NoRefreshDeadline)
+	if v, found := users.Get("1"); !found || v != "bob" {
+		t.Error("item set after the invalidation not found:", v)
+	}
+	// The generation isn't an item of the namespace.
+	users.Set("~generation", "carol", time.Minute, NoRefreshDeadline)
+	if v, found := users.Get("1"); !found || v != "bob" {
+		t.Error("item lost to a key colliding with the generation:", v)
+	}
+	// Another instance sharing the storage and a bus gets the generation
+	// from the bus.
+	bus := &localBus{}
+	other := New(DefaultExpiration, 0, 0, tc.storage)
+	tc.UseInvalidationBus(bus)
+	other.UseInvalidationBus(bus)
+	tc.InvalidateNamespace("users")
+	users.Set("1", "dave", time.Minute, NoRefreshDeadline)
+	if v, found := Typed[string](other, "users").Get("1"); !found || v != "dave" {
+		t.Error("item not found by another instance:", v)
+	}
+	tc.InvalidateNamespace("users")
+	if v, found := users.Get("1"); found {
+		t.Error("item found after another invalidation:", v)
+	}
+	if v, found := Typed[string](other, "users").Get("1"); found {
+		t.Error("item found by another instance after another invalidation:", v)
+	}
+}
+
+func TestExpirationForecast(t *testing.T) {
+	for _, s := range []Storage{MemoryStorage(), SlabStorage(0), HashedKeysStorage(MemoryStorage(), HashKeysOptions{})} {
+		clock := NewManualClock(time.Unix(1000, 0))
+		SetClock(clock)
+		tc := New(DefaultExpiration, 0, 0, s)
+		tc.Set("a", 1, 30*time.Second, NoRefreshDeadline)
+		tc.Set("b", 1, 90*time.Second, 30*time.Second)
+		tc.Set("c", 1, 100*time.Second, NoRefreshDeadline)
+		tc.Set("d", 1, time.Hour, NoRefreshDeadline)
+		tc.Set("e", 1, NoExpiration, NoRefreshDeadline)
+		tc.Set("f", 1, time.Second, NoRefreshDeadline)
+		clock.Advance(2 * time.Second)
+		f, err := tc.ExpirationForecast(2*time.Minute, 2)
+		SetClock(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.BucketWidth != time.Minute || !reflect.DeepEqual(f.Expirations, []int{1, 2}) || !reflect.DeepEqual(f.Refreshes, []int{1, 0}) || f.Later != 1 || f.Never != 1 {
+			t.Errorf("unexpected forecast for %T: %+v", s, f)
+		}
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorageWithOptions(MemoryOptions{TrackAccess: true}))
+	tc.Set("foo", map[string]int{"a": 1}, time.Hour, time.Minute)
+	tc.Get("foo")
+	tc.Get("foo")
+	tc.Pin("foo")
+	tc.Set("ch", make(chan int), DefaultExpiration, NoRefreshDeadline)
+	b, err := tc.DebugDump("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d map[string]interface{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d["key"] != "foo" || d["value"].(map[string]interface{})["a"] != 1.0 || d["hit_count"] != 2.0 || d["pinned"] != true || d["source"] != "storage" || d["expiration"] == nil || d["refresh_deadline"] == nil {
+		t.Errorf("unexpected dump: %s", b)
+	}
+	if b, err := tc.DebugDump("ch"); err != nil || !strings.Contains(string(b), "chan int") {
+		t.Errorf("unexpected dump of a channel: %s, %v", b, err)
+	}
+	if _, err := tc.DebugDump("missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound, got", err)
+	}
+}
+
+func TestCoarseClock(t *testing.T) {
+	c := NewCoarseClock(time.Millisecond)
+	defer c.Stop()
+	start := c.Now()
+	if d := time.Since(start); d < 0 || d > time.Second {
+		t.Error("coarse clock is off by", d)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !c.Now().After(start) {
+		t.Error("coarse clock didn't move")
+	}
+	c.Stop()
+	c.Stop()
+	stopped := c.Now()
+	time.Sleep(5 * time.Millisecond)
+	if !c.Now().Equal(stopped) {
+		t.Error("coarse clock moved after Stop")
+	}
+
+	SetClockPrecision(time.Millisecond)
+	defer SetClockPrecision(0)
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("foo", "bar", 5*time.Millisecond, NoRefreshDeadline)
+	if _, found := tc.Get("foo"); !found {
+		t.Error("foo was not found")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo did not expire")
+	}
+}
+
+func BenchmarkCacheGetCoarseClock(b *testing.B) {
+	SetClockPrecision(time.Millisecond)
+	defer SetClockPrecision(0)
+	benchmarkCacheGet(b, 5*time.Minute)
+}
+
+func TestDeleteMulti(t *testing.T) {
+	bus := &localBus{}
+	a := New(DefaultExpiration, 0, 0, MemoryStorage())
+	b := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for _, c := range []*Cache{a, b} {
+		if err := c.UseInvalidationBus(bus); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			c.Set(k, 1, DefaultExpiration, NoRefreshDeadline)
+		}
+	}
+	if err := a.DeleteMulti([]string{"a", "b", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Cache{a, b} {
+		if c.Has("a") || c.Has("b") {
+			t.Error("keys not deleted")
+		}
+		if !c.Has("c") {
+			t.Error("c was deleted")
+		}
+	}
+}
+
+// A storage that fails to delete one key.
+type delFailingStorage struct {
+	*flakyStorage
+	key string
+}
+
+func (s *delFailingStorage) TryDel(k string) error {
+	if k == s.key {
+		return io.EOF
+	}
+	return s.flakyStorage.TryDel(k)
+}
+
+func TestDeleteMultiPartialFailure(t *testing.T) {
+	bus := &localBus{}
+	fs := &delFailingStorage{flakyStorage: &flakyStorage{memoryStorage: MemoryStorage()}, key: "b"}
+	a := New(DefaultExpiration, 0, 0, fs)
+	b := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for _, c := range []*Cache{a, b} {
+		if err := c.UseInvalidationBus(bus); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			c.Set(k, 1, DefaultExpiration, NoRefreshDeadline)
+		}
+	}
+	if err := a.DeleteMulti([]string{"a", "b", "c"}); err != io.EOF {
+		t.Fatalf("DeleteMulti returned %v, want io.EOF", err)
+	}
+	if b.Has("a") {
+		t.Error("the deletion of a wasn't broadcast")
+	}
+	if !b.Has("b") || !b.Has("c") {
+		t.Error("keys that weren't deleted were invalidated")
+	}
+	if !a.Has("b") || !a.Has("c") {
+		t.Error("keys that weren't deleted are gone")
+	}
+}
+
+func TestFlushCount(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.Set("a", 1, DefaultExpiration, 0)
+	tc.Set("b", 2, DefaultExpiration, 0)
+	if n := tc.Flush(); n != 2 {
+		t.Errorf("Flush returned %d, want 2", n)
+	}
+	if n := tc.Flush(); n != 0 {
+		t.Errorf("second Flush returned %d, want 0", n)
+	}
+}
+
+func TestFlushAsync(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for i := 0; i < 100; i++ {
+		tc.Set(strconv.Itoa(i), i, DefaultExpiration, 0)
+	}
+	done := tc.FlushAsync()
+	if _, found := tc.Get("1"); found {
+		t.Error("item found right after FlushAsync")
+	}
+	tc.Set("new", 1, DefaultExpiration, 0)
+	if n := <-done; n != 100 {
+		t.Errorf("FlushAsync deleted %d items, want 100", n)
+	}
+	if _, found := tc.Get("new"); !found {
+		t.Error("item set after FlushAsync was deleted")
+	}
+
+	sc := New(DefaultExpiration, 0, 0, SlabStorage(0))
+	sc.Set("a", 1, DefaultExpiration, 0)
+	if n := <-sc.FlushAsync(); n != 1 {
+		t.Errorf("FlushAsync of a slab storage deleted %d items, want 1", n)
+	}
+}
+
+func TestKeysPaging(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for i := 0; i < 250; i++ {
+		tc.Set("user:"+strconv.Itoa(i), i, DefaultExpiration, 0)
+	}
+	tc.Set("other", 1, DefaultExpiration, 0)
+	seen := map[string]bool{}
+	var cursor uint64
+	pages := 0
+	for {
+		keys, next, err := tc.Keys("user:*", cursor, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if seen[k] {
+				t.Errorf("%s listed twice", k)
+			}
+			seen[k] = true
+		}
+		pages++
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 250 || seen["other"] {
+		t.Errorf("listed %d keys, want the 250 user keys", len(seen))
+	}
+	if pages != 3 {
+		t.Errorf("listed the keys in %d pages, want 3", pages)
+	}
+}
+
+// Lists the keys it's given, counting how many times it went through them.
+type scanCountingKeys struct {
+	keys  []string
+	scans int
+}
+
+func (s *scanCountingKeys) scanKeys(prefix string, fn func(string)) error {
+	s.scans++
+	for _, k := range s.keys {
+		if strings.HasPrefix(k, prefix) {
+			fn(k)
+		}
+	}
+	return nil
+}
+
+func TestKeysPagingScansOnce(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	ks := &scanCountingKeys{}
+	for i := 0; i < 250; i++ {
+		ks.keys = append(ks.keys, "user:"+strconv.Itoa(i))
+	}
+	var cursor uint64
+	listed := 0
+	for {
+		keys, next, err := pageScannedKeys(ks, "user:*", cursor, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed += len(keys)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if listed != 250 || ks.scans != 1 {
+		t.Errorf("listed %d keys in %d scans, want 250 in 1", listed, ks.scans)
+	}
+
+	// A cursor whose keys were dropped starts over from a new listing.
+	_, cursor, _ = pageScannedKeys(ks, "user:*", 0, 100)
+	clock.Advance(keySnapshotTTL + time.Second)
+	keys, _, _ := pageScannedKeys(ks, "user:*", cursor, 100)
+	if len(keys) != 100 || ks.scans != 3 {
+		t.Errorf("listed %d keys in %d scans after the snapshot expired, want 100 in 3", len(keys), ks.scans)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1/profile", true},
+		{"user:?", "user:12", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*:end", "a:b:end", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.match {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.match)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetTombstones(time.Minute)
+	tc.Set("foo", 1, DefaultExpiration, NoRefreshDeadline)
+	tc.Delete("foo")
+	if _, found := tc.Tombstone("foo"); !found {
+		t.Error("no tombstone for a deleted key")
+	}
+	if _, found := tc.Tombstone("never"); found {
+		t.Error("tombstone for a key that never existed")
+	}
+	tc.Set("foo", 2, DefaultExpiration, NoRefreshDeadline)
+	if _, found := tc.Tombstone("foo"); found {
+		t.Error("tombstone kept after the key was set again")
+	}
+
+	// A deletion delivered after the key was set again doesn't delete the
+	// newer value, but one published after it does.
+	bus := &localBus{}
+	if err := tc.UseInvalidationBus(bus); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := json.Marshal(invalidation{Origin: "other", Key: "foo", Time: time.Now().Add(-time.Second).UnixNano()})
+	bus.Publish(stale)
+	if _, found := tc.Get("foo"); !found {
+		t.Error("late deletion deleted the newer value")
+	}
+	at := time.Now().Add(time.Second)
+	fresh, _ := json.Marshal(invalidation{Origin: "other", Key: "foo", Time: at.UnixNano()})
+	bus.Publish(fresh)
+	if _, found := tc.Get("foo"); found {
+		t.Error("deletion was not applied")
+	}
+	if deleted, found := tc.Tombstone("foo"); !found || !deleted.Equal(at) {
+		t.Errorf("tombstone is at %v, want the time of the deletion %v", deleted, at)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var hits int32
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		switch r.URL.Path {
+		case "/cached":
+			w.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		io.WriteString(w, "body of "+r.URL.Path)
+	}))
+	defer srv.Close()
+	clock := NewManualClock(time.Now())
+	SetClock(clock)
+	defer SetClock(nil)
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	client := &http.Client{Transport: Transport(tc)}
+	get := func(path string) (string, *http.Response) {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if body, _ := get("/cached"); body != "body of /cached" {
+			t.Errorf("got %q", body)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("server got %d requests for a cacheable response, want 1", n)
+	}
+	get("/private")
+	get("/private")
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Errorf("server got %d requests, want private responses not cached", n)
+	}
+
+	// Once the response is stale, it's served when the server fails.
+	clock.Advance(2 * time.Minute)
+	atomic.StoreInt32(&failing, 1)
+	body, resp := get("/cached")
+	if body != "body of /cached" || resp.Header.Get("Warning") == "" {
+		t.Errorf("got %q with warning %q, want the stale response", body, resp.Header.Get("Warning"))
+	}
+}
+
+// A database/sql driver answering every query with the same two rows, and
+// counting the queries.
+type fakeSQLDriver struct {
+	queries int32
+}
+
+func (d *fakeSQLDriver) Open(string) (driver.Conn, error)             { return fakeSQLConn{d}, nil }
+func (d *fakeSQLDriver) Connect(context.Context) (driver.Conn, error) { return fakeSQLConn{d}, nil }
+func (d *fakeSQLDriver) Driver() driver.Driver                        { return d }
+
+type fakeSQLConn struct {
+	d *fakeSQLDriver
+}
+
+func (c fakeSQLConn) Prepare(string) (driver.Stmt, error) { return fakeSQLStmt(c), nil }
+func (c fakeSQLConn) Close() error                        { return nil }
+func (c fakeSQLConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+type fakeSQLStmt struct {
+	d *fakeSQLDriver
+}
+
+func (s fakeSQLStmt) Close() error  { return nil }
+func (s fakeSQLStmt) NumInput() int { return -1 }
+func (s fakeSQLStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s fakeSQLStmt) Query([]driver.Value) (driver.Rows, error) {
+	atomic.AddInt32(&s.d.queries, 1)
+	return &fakeSQLRows{}, nil
+}
+
+type fakeSQLRows struct {
+	n int
+}
+
+func (r *fakeSQLRows) Columns() []string { return []string{"user_id", "name", "extra"} }
+func (r *fakeSQLRows) Close() error      { return nil }
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.n == 2 {
+		return io.EOF
+	}
+	r.n++
+	dest[0] = int64(r.n)
+	dest[1] = []byte("user" + strconv.Itoa(r.n))
+	dest[2] = nil
+	return nil
+}
+
+func TestQueryCache(t *testing.T) {
+	d := &fakeSQLDriver{}
+	db := sql.OpenDB(d)
+	defer db.Close()
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	type user struct {
+		UserID int64
+		Label  string `db:"name"`
+	}
+	for i := 0; i < 2; i++ {
+		users, err := QueryStructs[user](tc, db, []string{"users"}, time.Minute, "SELECT * FROM users WHERE id > ?", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 2 || users[1] != (user{2, "user2"}) {
+			t.Errorf("got %v", users)
+		}
+	}
+	if n := atomic.LoadInt32(&d.queries); n != 1 {
+		t.Errorf("ran %d queries, want 1", n)
+	}
+	rows, err := QueryMaps(tc, db, []string{"users"}, time.Minute, "SELECT * FROM users WHERE id > ?", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["name"] != "user1" {
+		t.Errorf("got %v", rows)
+	}
+	if n := atomic.LoadInt32(&d.queries); n != 2 {
+		t.Errorf("ran %d queries, want another one for different args", n)
+	}
+	if err := tc.InvalidateTable("users"); err != nil {
+		t.Fatal(err)
+	}
+	QueryStructs[user](tc, db, []string{"users"}, time.Minute, "SELECT * FROM users WHERE id > ?", 0)
+	if n := atomic.LoadInt32(&d.queries); n != 3 {
+		t.Errorf("ran %d queries, want the query run again once the table is invalidated", n)
+	}
+}
+
+func TestServeFragment(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetETags(true)
+	renders := 0
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"count": func() string { renders++; return "" },
+	}).Parse(`{{define "greeting"}}{{count}}Hello {{.Name}}{{end}}`))
+	data := struct{ Name string }{"Ann"}
+
+	rec := httptest.NewRecorder()
+	if err := tc.ServeFragment(rec, httptest.NewRequest("GET", "/", nil), tmpl, "greeting", data, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	tag := rec.Header().Get("ETag")
+	if rec.Body.String() != "Hello Ann" || tag == "" {
+		t.Fatalf("got %q with ETag %q", rec.Body.String(), tag)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", tag)
+	rec = httptest.NewRecorder()
+	tc.ServeFragment(rec, req, tmpl, "greeting", data, time.Minute)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("got status %d, want 304 for a matching If-None-Match", rec.Code)
+	}
+	b, _, _ := tc.RenderFragment(tmpl, "greeting", data, time.Minute)
+	if string(b) != "Hello Ann" || renders != 1 {
+		t.Errorf("got %q after %d renders, want the cached fragment", b, renders)
+	}
+	tc.RenderFragment(tmpl, "greeting", struct{ Name string }{"Bob"}, time.Minute)
+	if renders != 2 {
+		t.Errorf("fragment rendered %d times, want another render for different data", renders)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	var calls int32
+	release := make(chan bool)
+	h := Deduplicate(tc, time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo", string(b))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	}))
+	serve := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/orders", strings.NewReader(body)))
+		return rec
+	}
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 5)
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = serve("order 1")
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler called %d times for identical concurrent requests, want 1", n)
+	}
+	for _, rec := range recs {
+		if rec.Code != http.StatusCreated || rec.Body.String() != "done" || rec.Header().Get("X-Echo") != "order 1" {
+			t.Errorf("got %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("X-Echo"))
+		}
+	}
+	serve("order 1")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler called again for a retry")
+	}
+	if rec := serve("order 2"); rec.Header().Get("X-Echo") != "order 2" {
+		t.Errorf("request with a different body got %q", rec.Header().Get("X-Echo"))
+	}
+}
+
+func TestDeduplicateCachedFailure(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	tc.SetFailureTTL(time.Minute)
+	var calls int32
+	h := Deduplicate(tc, time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("down"))
+	}))
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "down" {
+			t.Errorf("request %d got %d %q, want the handler's 503", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handler called %d times with the failure cached, want 1", n)
+	}
+}
+
+func TestConsumeQuota(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	if remaining, ok := tc.ConsumeQuota("partner", 6, 10, time.Minute); !ok || remaining != 4 {
+		t.Errorf("got %d, %v, want 4, true", remaining, ok)
+	}
+	if remaining, ok := tc.ConsumeQuota("partner", 5, 10, time.Minute); ok || remaining != 4 {
+		t.Errorf("got %d, %v, want 4, false for more than is left", remaining, ok)
+	}
+	if remaining, ok := tc.ConsumeQuota("partner", 4, 10, time.Minute); !ok || remaining != 0 {
+		t.Errorf("got %d, %v, want 0, true", remaining, ok)
+	}
+	if _, ok := tc.ConsumeQuota("other", 1, 10, time.Minute); !ok {
+		t.Error("quotas of different keys are shared")
+	}
+	if keys, _, _ := tc.Keys("*", 0, 10); len(keys) != 0 {
+		t.Errorf("quotas listed as items: %v", keys)
+	}
+	tc.Flush()
+	if _, ok := tc.ConsumeQuota("partner", 1, 10, time.Minute); ok {
+		t.Error("Flush restored a quota")
+	}
+	clock.Advance(time.Minute + time.Second)
+	if remaining, ok := tc.ConsumeQuota("partner", 1, 10, time.Minute); !ok || remaining != 9 {
+		t.Errorf("got %d, %v after the window, want 9, true", remaining, ok)
+	}
+}
+
+func TestRedisUnMarshalNotAnItem(t *testing.T) {
+	s := &redisStorage{marshaller: newJSONCodec()}
+	if _, err := s.unmarshal("5", nil); !errors.Is(err, ErrWrongType) {
+		t.Errorf("got %v for a value that isn't an item, want ErrWrongType", err)
+	}
+	if item := s.UnMarshal("5|0", nil); item.Object != nil {
+		t.Errorf("got %#v for a value that isn't an item", item)
+	}
+	var n int
+	if _, err := s.unmarshal(s.Marshal(Item{Object: "text"}), &n); !errors.Is(err, ErrWrongType) {
+		t.Errorf("got %v for a value that can't be decoded, want ErrWrongType", err)
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	for i := 0; i < 3; i++ {
+		if ok, _ := tc.TakeToken("partner", 2, 3); !ok {
+			t.Fatalf("token %d of a burst of 3 refused", i)
+		}
+	}
+	ok, wait := tc.TakeToken("partner", 2, 3)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("got %v, %v from an empty bucket, want false, 500ms", ok, wait)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if ok, _ := tc.TakeToken("partner", 2, 3); !ok {
+		t.Error("bucket not refilled")
+	}
+	if ok, _ := tc.TakeToken("partner", 2, 3); ok {
+		t.Error("bucket refilled too fast")
+	}
+	if keys, _, _ := tc.Keys("*", 0, 10); len(keys) != 0 {
+		t.Errorf("buckets listed as items: %v", keys)
+	}
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := tc.TakeToken("partner", 2, 3); !ok {
+			t.Fatalf("token %d refused after the bucket refilled", i)
+		}
+	}
+	if ok, _ := tc.TakeToken("partner", 2, 3); ok {
+		t.Error("bucket holds more than its burst")
+	}
+}
+
+func TestRedisEvalNotSupported(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	if _, err := tc.RedisEval(`return 1`, nil); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("got %v, want ErrNotSupported from a memory storage", err)
+	}
+}
+
+func TestRedisEval(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.Close()
+	s := RedisStorageWithOptions(r.addr(), "", 0, "app:", RedisOptions{DisableLock: true})
+	defer s.redisClient.Close()
+	tc := New(DefaultExpiration, 0, 0, s)
+	r.mutex.Lock()
+	r.scriptReply = ":42\r\n"
+	r.mutex.Unlock()
+	evals := func() [][]string {
+		var cmds [][]string
+		for _, cmd := range r.received() {
+			if name := strings.ToUpper(cmd[0]); name == "EVAL" || name == "EVALSHA" {
+				cmds = append(cmds, cmd)
+			}
+		}
+		return cmds
+	}
+	const script = `return redis.call("incrby", KEYS[1], ARGV[1])`
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+
+	res, err := tc.RedisEval(script, []string{"counter"}, 2)
+	if err != nil || res != int64(42) {
+		t.Fatalf("got %v, %v, want 42", res, err)
+	}
+	want := [][]string{{"evalsha", sha, "1", "app:counter", "2"}}
+	if got := evals(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	// A server that doesn't have the script gets it with EVAL.
+	r.mutex.Lock()
+	r.noScripts = true
+	r.commands = nil
+	r.mutex.Unlock()
+	res, err = tc.RedisEval(script, []string{"counter"}, 2)
+	if err != nil || res != int64(42) {
+		t.Fatalf("got %v, %v after NOSCRIPT, want 42", res, err)
+	}
+	want = [][]string{
+		{"evalsha", sha, "1", "app:counter", "2"},
+		{"eval", script, "1", "app:counter", "2"},
+	}
+	if got := evals(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestSetWithMetadata(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	meta := map[string]string{"source": "billing", "trace": "abc|123"}
+	tc.SetWithMetadata("foo", 1, DefaultExpiration, 0, meta)
+	if item, _ := tc.InspectItem("foo"); !reflect.DeepEqual(item.Metadata, meta) {
+		t.Errorf("InspectItem returned metadata %v, want %v", item.Metadata, meta)
+	}
+	b, err := tc.DebugDump("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d struct{ Metadata map[string]string }
+	if err := json.Unmarshal(b, &d); err != nil || !reflect.DeepEqual(d.Metadata, meta) {
+		t.Errorf("DebugDump returned metadata %v, want %v", d.Metadata, meta)
+	}
+	tc.Set("foo", 2, DefaultExpiration, 0)
+	if item, _ := tc.InspectItem("foo"); item.Metadata != nil {
+		t.Errorf("metadata %v kept after Set", item.Metadata)
+	}
+
+	s := &redisStorage{marshaller: newJSONCodec()}
+	item := s.UnMarshal(s.Marshal(Item{Object: &registeredStruct{"foo", 1}, Metadata: meta}), nil)
+	if !reflect.DeepEqual(item.Metadata, meta) {
+		t.Errorf("Redis storage decoded metadata %v, want %v", item.Metadata, meta)
+	}
+	if v, ok := item.Object.(*registeredStruct); !ok || v.Name != "foo" {
+		t.Errorf("Redis storage decoded %#v with metadata", item.Object)
+	}
+	if item := s.UnMarshal(s.Marshal(Item{Object: 3}), nil); item.Metadata != nil || item.Object != float64(3) {
+		t.Errorf("Redis storage decoded %#v, %v without metadata", item.Object, item.Metadata)
+	}
+}
+
+func TestVersionedKeysStorage(t *testing.T) {
+	ms := MemoryStorage()
+	v1 := New(DefaultExpiration, 0, 0, VersionedKeysStorage(ms, "1.0"))
+	v1.Set("user:1", "old", DefaultExpiration, 0)
+	if _, found := ms.Get("~v1.0:user:1"); !found {
+		t.Error("item not stored under its versioned key")
+	}
+	v2 := New(DefaultExpiration, 0, 0, VersionedKeysStorage(ms, "2.0"))
+	if _, found := v2.Get("user:1"); found {
+		t.Error("item of the previous version read")
+	}
+	v2.Set("user:1", "new", DefaultExpiration, 0)
+	v2.Set("user:2", "new", DefaultExpiration, 0)
+	if x, _ := v1.Get("user:1"); x != "old" {
+		t.Errorf("previous version reads %v, want its own item", x)
+	}
+	keys, _, err := v2.Keys("user:*", 0, 10)
+	sort.Strings(keys)
+	if err != nil || !reflect.DeepEqual(keys, []string{"user:1", "user:2"}) {
+		t.Errorf("Keys returned %v, %v, want the current version's keys", keys, err)
+	}
+	if n, _ := v2.DeletePrefix("user:"); n != 2 {
+		t.Errorf("DeletePrefix deleted %d items, want 2", n)
+	}
+	if _, found := v1.Get("user:1"); !found {
+		t.Error("DeletePrefix deleted the previous version's item")
+	}
+}
+
+func TestVersionedKeysStoragePinAndExpire(t *testing.T) {
+	ms := MemoryStorageWithOptions(MemoryOptions{MaxItems: 5, Eviction: EvictionSegmentedLRU})
+	tc := New(DefaultExpiration, 0, 0, VersionedKeysStorage(ms, "1.0"))
+	tc.Set("config", "value", DefaultExpiration, NoRefreshDeadline)
+	if err := tc.Pin("config"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	if _, found := tc.Get("config"); !found {
+		t.Error("pinned item was evicted")
+	}
+
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	ms = MemoryStorage()
+	v1 := New(DefaultExpiration, 0, 0, VersionedKeysStorage(ms, "1.0"))
+	v2 := New(DefaultExpiration, 0, 0, VersionedKeysStorage(ms, "2.0"))
+	var expired []string
+	if err := v2.OnExpire("session:*", func(k string, v interface{}) {
+		expired = append(expired, k+"="+v.(string))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	v1.Set("session:1", "old", time.Minute, NoRefreshDeadline)
+	v2.Set("session:1", "new", time.Minute, NoRefreshDeadline)
+	v2.Set("user:1", "new", time.Minute, NoRefreshDeadline)
+	v2.Set("long", "x", time.Hour, NoRefreshDeadline)
+	v2.Pin("long")
+	v2.Set("pinned", "x", time.Minute, NoRefreshDeadline)
+	v2.Pin("pinned")
+	clock.Advance(2 * time.Minute)
+	ms.DeleteExpired()
+	if len(expired) != 1 || expired[0] != "session:1=new" {
+		t.Error("callbacks were called for the wrong items:", expired)
+	}
+	if v2.pinned("pinned") || !v2.pinned("long") {
+		t.Error("expired item still pinned")
+	}
+
+	if err := New(DefaultExpiration, 0, 0, VersionedKeysStorage(SlabStorage(256), "1.0")).OnExpire("*", func(string, interface{}) {}); !errors.Is(err, ErrNotSupported) {
+		t.Error("OnExpire didn't fail for a storage that doesn't report deleted items:", err)
+	}
+}
+
+func TestDeletePrefixForgetsItems(t *testing.T) {
+	for _, name := range []string{"DeletePrefix", "FlushWhere"} {
+		tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+		tc.SetETags(true)
+		tc.SetNamespaceQuota("user", NamespaceQuota{MaxItems: 10})
+		tc.SetWithCost("user:1", "a", DefaultExpiration, 0, time.Second)
+		tc.Set("user:2", "b", DefaultExpiration, 0)
+		if name == "DeletePrefix" {
+			tc.DeletePrefix("user:")
+		} else {
+			tc.FlushWhere(func(string, Item) bool { return true }, false)
+		}
+		if items, _, _ := tc.NamespaceUsage("user"); items != 0 {
+			t.Errorf("%s: quota still counts %d items", name, items)
+		}
+		if _, found := tc.ETag("user:2"); found {
+			t.Errorf("%s: ETag kept for a deleted item", name)
+		}
+		tc.SetRefreshCostThreshold(time.Millisecond)
+		if tc.expensive("user:1") {
+			t.Errorf("%s: cost kept for a deleted item", name)
+		}
+	}
+}
+
+func TestRedisScanPattern(t *testing.T) {
+	s := &redisStorage{prefix: "app[1]:"}
+	if p := s.scanPattern(""); p != `app\[1\]:*` {
+		t.Errorf("got %s for the keys to flush, want the prefix escaped", p)
+	}
+	if p := s.scanPattern("user*"); p != `app\[1\]:user\**` {
+		t.Errorf("got %s for the keys under user*", p)
+	}
+}
+
+// A storage reading many items at once, as Redis does.
+type bulkLoadingStorage struct {
+	*memoryStorage
+}
+
+func (s bulkLoadingStorage) loadMatching(pattern string, limit int, fn func(key string, item Item)) error {
+	return s.scanKeys("", func(k string) {
+		if globMatch(pattern, k) {
+			item, _ := s.Get(k)
+			fn(k, item)
+		}
+	})
+}
+
+func TestTieredStorageCopies(t *testing.T) {
+	store := &memObjectStore{objects: map[string][]byte{}, meta: map[string]map[string]string{}}
+	remote := ObjectStorage(store, "tiered/")
+	remote.Set("a", Item{Object: TestStruct{Num: 1}})
+	ts := TieredStorage(remote, TieredOptions{})
+	var o TestStruct
+	if _, found := ts.GetObject("a", &o); !found || o.Num != 1 {
+		t.Fatal("item not decoded:", o)
+	}
+	o.Num = 2
+	if item, _ := ts.Get("a"); item.Object.(*TestStruct).Num != 1 {
+		t.Error("memory tier shares the caller's value")
+	}
+
+	ts.Del("a")
+	if _, found := ts.Get("a"); found {
+		t.Error("deleted item found")
+	}
+
+	loader := VersionedKeysStorage(bulkLoadingStorage{MemoryStorage()}, "1")
+	loader.Set("user:1", Item{Object: 1})
+	ts = TieredStorage(RetryStorage(loader, RetryOptions{}), TieredOptions{})
+	if n, err := ts.WarmL1FromL2("u?er:*", 0); err != nil || n != 1 {
+		t.Fatal("wrapped bulk loader not used:", n, err)
+	}
+	ts.l1.RLock()
+	_, found := ts.l1.Get("user:1")
+	ts.l1.RUnlock()
+	if !found {
+		t.Error("item warmed under the wrong key")
+	}
+	if _, err := TieredStorage(HashedKeysStorage(bulkLoadingStorage{MemoryStorage()}, HashKeysOptions{MaxKeyLen: 8}), TieredOptions{}).WarmL1FromL2("*", 0); !errors.Is(err, ErrNotSupported) {
+		t.Error("warmed from hashed keys:", err)
+	}
+}
+
+func TestRefreshPoolWithoutMinWorkers(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	var refreshed int32
+	tc.OnRefreshNeeded(func(k string) {
+		atomic.AddInt32(&refreshed, 1)
+	})
+	tc.SetRefreshPool(RefreshPoolOptions{MinWorkers: 0, MaxWorkers: 1, IdleTimeout: time.Microsecond})
+	for i := 0; i < 200; i++ {
+		k := "k" + strconv.Itoa(i)
+		tc.Set(k, i, DefaultExpiration, time.Nanosecond)
+		time.Sleep(time.Microsecond)
+		tc.Get(k)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&refreshed) < 200; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&refreshed); n != 200 {
+		t.Error("keys left queued without a worker:", 200-n)
+	}
+}
+
+func TestRedisBytesNotAnItem(t *testing.T) {
+	s := &redisStorage{marshaller: newJSONCodec()}
+	if _, err := s.unmarshal("0|0|"+redisBytesMarker+"raw", nil); !errors.Is(err, ErrWrongType) {
+		t.Errorf("got %v for a value set as bytes, want ErrWrongType", err)
+	}
+	if _, err := s.unmarshal(s.Marshal(Item{Object: "=x"}), nil); err != nil {
+		t.Error("string item starting with the bytes marker rejected:", err)
+	}
+}
+
+// A storage whose reads wait to be released.
+type slowStorage struct {
+	*memoryStorage
+	entered chan bool
+	release chan bool
+}
+
+func (s *slowStorage) TryGet(k string) (Item, bool, error) {
+	s.entered <- true
+	<-s.release
+	item, found := s.Get(k)
+	return item, found, nil
+}
+
+func (s *slowStorage) TryGetObject(k string, o interface{}) (Item, bool, error) {
+	return s.TryGet(k)
+}
+
+func (s *slowStorage) TrySet(k string, item Item) error {
+	s.Set(k, item)
+	return nil
+}
+
+func (s *slowStorage) TryDel(k string) error {
+	s.Del(k)
+	return nil
+}
+
+func TestBreakerStorageSingleProbe(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	SetClock(clock)
+	defer SetClock(nil)
+	ss := &slowStorage{memoryStorage: MemoryStorage(), entered: make(chan bool, 10), release: make(chan bool)}
+	bs := BreakerStorage(ss, BreakerOptions{Threshold: 1, Cooldown: time.Minute})
+	bs.record(io.EOF)
+	if _, _, err := bs.TryGet("a"); err != errBreakerOpen {
+		t.Error("open breaker let a read through:", err)
+	}
+	clock.Advance(2 * time.Minute)
+	done := make(chan error)
+	go func() {
+		_, _, err := bs.TryGet("a")
+		done <- err
+	}()
+	<-ss.entered
+	if _, _, err := bs.TryGet("a"); err != errBreakerOpen {
+		t.Error("half-open breaker let a second read through:", err)
+	}
+	close(ss.release)
+	if err := <-done; err != nil {
+		t.Error("probe failed:", err)
+	}
+	if _, _, err := bs.TryGet("a"); err != nil {
+		t.Error("breaker didn't close after the probe succeeded:", err)
+	}
+}
+
+// A storage whose second Get of "slow", and every Set of it, wait for release,
+// and whose locks don't exclude anything, like the Redis storage's.
+type blockingStorage struct {
+	*memoryStorage
+	mutex   sync.Mutex
+	gets    int32
+	entered chan bool
+	release chan bool
+}
+
+func (s *blockingStorage) wait() {
+	s.entered <- true
+	<-s.release
+}
+
+func (s *blockingStorage) Get(k string) (Item, bool) {
+	if k == "slow" && atomic.AddInt32(&s.gets, 1) == 2 {
+		s.wait()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.memoryStorage.Get(k)
+}
+
+func (s *blockingStorage) GetObject(k string, o interface{}) (Item, bool) {
+	return s.Get(k)
+}
+
+func (s *blockingStorage) Set(k string, item Item) {
+	if k == "slow" {
+		s.wait()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.memoryStorage.Set(k, item)
+}
+
+func (s *blockingStorage) Lock()    {}
+func (s *blockingStorage) Unlock()  {}
+func (s *blockingStorage) RLock()   {}
+func (s *blockingStorage) RUnlock() {}
+
+func TestFetchStorageIOUnlocked(t *testing.T) {
+	s := &blockingStorage{memoryStorage: MemoryStorage(), entered: make(chan bool), release: make(chan bool)}
+	tc := New(DefaultExpiration, 0, 0, s)
+	done := make(chan bool)
+	go func() {
+		tc.Fetch("slow", func() (interface{}, error) { return 1, nil }, DefaultExpiration, NoRefreshDeadline)
+		close(done)
+	}()
+	for _, k := range []string{"fast1", "fast2"} {
+		// Waiting in the Get of Fetch, then in the Set of the loaded value.
+		<-s.entered
+		fetched := make(chan interface{})
+		go func() {
+			v, _ := tc.Fetch(k, func() (interface{}, error) { return 2, nil }, DefaultExpiration, NoRefreshDeadline)
+			fetched <- v
+		}()
+		select {
+		case v := <-fetched:
+			if v != 2 {
+				t.Error("wrong value fetched:", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Fetch of", k, "waited for the storage to return another key")
+		}
+		s.release <- true
+	}
+	<-done
+	if v, found := tc.Get("slow"); !found || v != 1 {
+		t.Error("slow was not set:", v)
+	}
+}
+
+func TestFetchLoaderPanic(t *testing.T) {
+	tc := New(DefaultExpiration, 0, 0, MemoryStorage())
+	started := make(chan bool)
+	release := make(chan bool)
+	panicked := make(chan interface{})
+	go func() {
+		defer func() {
+			panicked <- recover()
+		}()
+		tc.Fetch("a", func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		}, DefaultExpiration, NoRefreshDeadline)
+	}()
+	<-started
+	waited := make(chan error)
+	go func() {
+		_, err := tc.Fetch("a", func() (interface{}, error) { return 1, nil }, DefaultExpiration, NoRefreshDeadline)
+		waited <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if r := <-panicked; r != "boom" {
+		t.Error("panic not passed on to the loading caller:", r)
+	}
+	if err := <-waited; err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Error("waiting caller didn't get the panic as an error:", err)
+	}
+	if v, err := tc.Fetch("a", func() (interface{}, error) { return 2, nil }, DefaultExpiration, NoRefreshDeadline); err != nil || v != 2 {
+		t.Error("key not loaded again after a panic:", v, err)
+	}
+}
+
+func TestPeersLoaderPanic(t *testing.T) {
+	g := Peers(New(DefaultExpiration, 0, 0, MemoryStorage()), nil, PeerOptions{})
+	started := make(chan bool)
+	release := make(chan bool)
+	go func() {
+		defer func() {
+			recover()
+		}()
+		g.do("a", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	waited := make(chan error)
+	go func() {
+		_, err := g.do("a", func() ([]byte, error) { return []byte("x"), nil })
+		waited <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if err := <-waited; err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Error("waiting caller didn't get the panic as an error:", err)
+	}
+	if b, err := g.do("a", func() ([]byte, error) { return []byte("y"), nil }); err != nil || string(b) != "y" {
+		t.Error("key not loaded again after a panic:", string(b), err)
+	}
+}
+
+// A storage decoding 5 into the value it's given after delay.
+type decodingStorage struct {
+	*memoryStorage
+	delay time.Duration
+}
+
+func (s *decodingStorage) TryGet(k string) (Item, bool, error) {
+	return s.TryGetObject(k, nil)
+}
+
+func (s *decodingStorage) TryGetObject(k string, o interface{}) (Item, bool, error) {
+	time.Sleep(s.delay)
+	if p, ok := o.(*int); ok {
+		*p = 5
+	}
+	return Item{Object: o}, true, nil
+}
+
+func (s *decodingStorage) TrySet(k string, item Item) error {
+	return nil
+}
+
+func (s *decodingStorage) TryDel(k string) error {
+	return nil
+}
+
+func TestTimeoutStorageLateDecode(t *testing.T) {
+	s := TimeoutStorage(&decodingStorage{memoryStorage: MemoryStorage(), delay: 50 * time.Millisecond}, TimeoutOptions{Get: 10 * time.Millisecond})
+	var x int
+	if _, _, err := s.TryGetObject("a", &x); err != ErrTimeout {
+		t.Fatal("slow get didn't time out:", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if x != 0 {
+		t.Error("read finishing after its timeout wrote to the caller's value:", x)
+	}
+	s = TimeoutStorage(&decodingStorage{memoryStorage: MemoryStorage()}, TimeoutOptions{Get: time.Second})
+	if item, _, err := s.TryGetObject("a", &x); err != nil || x != 5 || item.Object != &x {
+		t.Error("value not decoded into the caller's value:", x, item.Object, err)
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	for _, c := range []struct {
+		prefix, end string
+		ok          bool
+	}{
+		{"", "", false},
+		{"a", "b", true},
+		{"user:", "user;", true},
+		{"a\xff", "b", true},
+		{"a\xff\xff", "b", true},
+		{"\xff", "", false},
+	} {
+		if end, ok := prefixSuccessor(c.prefix); end != c.end || ok != c.ok {
+			t.Errorf("prefixSuccessor(%q) = %q %v, want %q %v", c.prefix, end, ok, c.end, c.ok)
+		}
+	}
+}
+
+// A memory storage whose writes wait to be released.
+type gatedStorage struct {
+	*memoryStorage
+	entered chan string
+	release chan bool
+}
+
+func (s *gatedStorage) Set(k string, item Item) {
+	s.entered <- k
+	<-s.release
+	s.memoryStorage.Set(k, item)
+}
+
+func TestCoalescingStorageFlushUnlocked(t *testing.T) {
+	inner := &gatedStorage{memoryStorage: MemoryStorage(), entered: make(chan string), release: make(chan bool)}
+	s := CoalescingStorage(inner, time.Hour)
+	s.Set("a", Item{Object: 1})
+	s.Set("b", Item{Object: 2})
+	go s.flush()
+	first := <-inner.entered
+	other := "a"
+	if first == "a" {
+		other = "b"
+	}
+	// The storage isn't locked while the batch is applied.
+	s.Lock()
+	s.Unlock()
+	s.Del(other)
+	deleted := make(chan bool)
+	go func() {
+		s.Del(first)
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+		t.Fatal("Del didn't wait for the write of its key")
+	case <-time.After(20 * time.Millisecond):
+	}
+	inner.release <- true
+	<-deleted
+	for _, k := range []string{"a", "b"} {
+		if _, found := inner.Get(k); found {
+			t.Error(k, "written after it was deleted")
+		}
+	}
+	s.flush()
+	s.Close()
+}
+
+// Holds the lock as long as fail isn't set.
+type fakeDistributedLock struct {
+	mutex   sync.Mutex
+	fail    bool
+	locked  bool
+	locks   int
+	unlocks int
+}
+
+func (l *fakeDistributedLock) Lock() (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.locks++
+	l.locked = !l.fail
+	return l.locked, nil
+}
+
+func (l *fakeDistributedLock) Unlock() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.unlocks++
+	l.locked = false
+	return nil
+}
+
+func (l *fakeDistributedLock) IsLocked() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.locked
+}
+
+func (l *fakeDistributedLock) counts() (int, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.locks, l.unlocks
+}
+
+func TestRedisLock(t *testing.T) {
+	var mutex sync.Mutex
+	var errs []error
+	onError := func(err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	}
+	errCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(errs)
+	}
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for", what)
+			}
+		}
+	}
+
+	l := newRedisLock(nil, "go_cache_lock", 20*time.Millisecond, 0, onError)
+	fake := &fakeDistributedLock{}
+	l.lock = fake
+	l.Lock()
+	waitFor("the lock to be renewed", func() bool {
+		locks, _ := fake.counts()
+		return locks >= 3
+	})
+	if n := errCount(); n != 0 {
+		t.Error("errors reported while the lock was held:", errs)
+	}
+
+	// Other goroutines wait for the lock in this process too.
+	obtained := make(chan bool)
+	go func() {
+		l.Lock()
+		close(obtained)
+	}()
+	select {
+	case <-obtained:
+		t.Fatal("the lock was obtained twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// A lost lock is reported, and reacquired on the next renewal.
+	fake.mutex.Lock()
+	fake.fail = true
+	fake.mutex.Unlock()
+	waitFor("the lost lock to be reported", func() bool { return errCount() > 0 })
+	fake.mutex.Lock()
+	fake.fail = false
+	fake.mutex.Unlock()
+	waitFor("the lock to be reacquired", fake.IsLocked)
+	mutex.Lock()
+	if !strings.Contains(errs[0].Error(), "lost lock go_cache_lock") {
+		t.Error("wrong error reported:", errs[0])
+	}
+	mutex.Unlock()
+	l.Unlock()
+	if _, unlocks := fake.counts(); unlocks != 1 {
+		t.Error("the lock was not released once:", unlocks)
+	}
+	<-obtained
+	l.Unlock()
+
+	// A lock that can't be obtained is reported, and not released.
+	fake = &fakeDistributedLock{fail: true}
+	l.lock = fake
+	n := errCount()
+	l.Lock()
+	if errCount() != n+1 {
+		t.Error("the lock not being obtained was not reported")
+	}
+	l.Unlock()
+	if _, unlocks := fake.counts(); unlocks != 0 {
+		t.Error("a lock that wasn't obtained was released")
+	}
+}
+
+// A Redis server speaking just enough of the protocol for the tests: GET, SET
+// and DEL on a map, PING, SUBSCRIBE, and +OK for every other command. Records
+// the commands it receives; messages are sent to subscribers with publish.
+type fakeRedis struct {
+	l           net.Listener
+	mutex       sync.Mutex
+	values      map[string]string
+	commands    [][]string
+	subscribers []net.Conn
+	scriptReply string // the reply to EVAL and EVALSHA, if set
+	noScripts   bool   // whether EVALSHA fails as if the script wasn't loaded
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{l: l, values: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.l.Addr().String()
+}
+
+func (r *fakeRedis) Close() {
+	r.l.Close()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		cmd, err := readRESPCommand(rd)
+		if err != nil {
+			return
+		}
+		r.mutex.Lock()
+		r.commands = append(r.commands, cmd)
+		reply := "+OK\r\n"
+		switch strings.ToUpper(cmd[0]) {
+		case "PING":
+			reply = "+PONG\r\n"
+		case "GET":
+			if v, ok := r.values[cmd[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case "SET":
+			r.values[cmd[1]] = cmd[2]
+		case "DEL":
+			n := 0
+			for _, k := range cmd[1:] {
+				if _, ok := r.values[k]; ok {
+					delete(r.values, k)
+					n++
+				}
+			}
+			reply = fmt.Sprintf(":%d\r\n", n)
+		case "SUBSCRIBE":
+			reply = ""
+			for i, ch := range cmd[1:] {
+				reply += fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, i+1)
+			}
+			r.subscribers = append(r.subscribers, conn)
+		case "EVAL", "EVALSHA":
+			if r.scriptReply != "" {
+				reply = r.scriptReply
+			}
+			if r.noScripts && strings.ToUpper(cmd[0]) == "EVALSHA" {
+				reply = "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+			}
+		}
+		conn.Write([]byte(reply))
+		r.mutex.Unlock()
+	}
+}
+
+// Sends payload to the connections subscribed to a channel, whichever it is.
+func (r *fakeRedis) publish(channel, payload string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, conn := range r.subscribers {
+		fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+	}
+}
+
+func (r *fakeRedis) subscribed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.subscribers) > 0
+}
+
+func (r *fakeRedis) received() [][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([][]string(nil), r.commands...)
+}
+
+func readRESPCommand(rd *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		var l int
+		if _, err := fmt.Fscanf(rd, "$%d\r\n", &l); err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(b[:l])
+	}
+	return cmd, nil
+}
+
+func TestRedisStorageDisableLock(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.Close()
+	var lockErrors int64
+	s := RedisStorageWithOptions(r.addr(), "", 0, "app:", RedisOptions{
+		DisableLock: true,
+		OnLockError: func(error) { atomic.AddInt64(&lockErrors, 1) },
+	})
+	defer s.redisClient.Close()
+	if s.lock != nil {
+		t.Fatal("the storage takes the distributed lock")
+	}
+	tc := New(DefaultExpiration, 0, 0, s)
+	if err := tc.Add("a", "1", DefaultExpiration, NoRefreshDeadline); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Add("a", "2", DefaultExpiration, NoRefreshDeadline); !errors.Is(err, ErrKeyExists) {
+		t.Error("a was added twice:", err)
+	}
+	if x, found := tc.Get("a"); !found || x != "1" {
+		t.Error("a is not 1:", x)
+	}
+	for _, cmd := range r.received() {
+		for _, arg := range cmd[1:] {
+			if strings.HasPrefix(arg, redisInternalKeyPrefix) {
+				t.Error("the distributed lock was used:", cmd)
+			}
+		}
+	}
+
+	// Lock still excludes the other goroutines of this process.
+	s.Lock()
+	obtained := make(chan bool)
+	go func() {
+		s.Lock()
+		close(obtained)
+		s.Unlock()
+	}()
+	select {
+	case <-obtained:
+		t.Error("the storage was locked twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.Unlock()
+	<-obtained
+	if n := atomic.LoadInt64(&lockErrors); n != 0 {
+		t.Error("lock errors were reported:", n)
+	}
+
+	locked := RedisStorage(r.addr(), "", 0, "app:")
+	defer locked.redisClient.Close()
+	if locked.lock == nil {
+		t.Error("the storage doesn't take the distributed lock by default")
+	}
+}
+
+func TestRedisExpireNotifications(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.Close()
+	s := RedisStorageWithOptions(r.addr(), "", 0, "app:", RedisOptions{DisableLock: true})
+	defer s.redisClient.Close()
+	defer s.closeNotifications()
+	tc := New(DefaultExpiration, 0, 0, s)
+	expired := make(chan string, 10)
+	if err := tc.OnExpire("session:*", func(k string, v interface{}) {
+		if v != nil {
+			t.Error("expired value is not nil:", v)
+		}
+		expired <- k
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); !r.subscribed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the storage to subscribe")
+		}
+	}
+	r.publish("__keyevent@0__:expired", "app:session:1")
+	r.publish("__keyevent@0__:expired", "other:session:2")
+	r.publish("__keyevent@0__:expired", "app:user:1")
+	r.publish("__keyevent@0__:evicted", "app:session:3")
+	for _, want := range []string{"session:1", "session:3"} {
+		select {
+		case k := <-expired:
+			if k != want {
+				t.Errorf("callback called for %s, want %s", k, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("callback not called for", want)
+		}
+	}
+	var subscribe []string
+	for _, cmd := range r.received() {
+		if strings.ToUpper(cmd[0]) == "SUBSCRIBE" {
+			subscribe = cmd[1:]
+		}
+	}
+	if len(subscribe) != 2 || subscribe[0] != "__keyevent@0__:expired" || subscribe[1] != "__keyevent@0__:evicted" {
+		t.Error("wrong channels subscribed to:", subscribe)
+	}
+}
+
 func BenchmarkCacheGetExpiring(b *testing.B) {
-	benchmarkCacheGet(b, 5 * time.Minute)
+	benchmarkCacheGet(b, 5*time.Minute)
 }
 
 func BenchmarkCacheGetNotExpiring(b *testing.B) {
@@ -1246,7 +5836,7 @@ func BenchmarkRWMutexInterfaceMapGetString(b *testing.B) {
 }
 
 func BenchmarkCacheGetConcurrentExpiring(b *testing.B) {
-	benchmarkCacheGetConcurrent(b, 5 * time.Minute)
+	benchmarkCacheGetConcurrent(b, 5*time.Minute)
 }
 
 func BenchmarkCacheGetConcurrentNotExpiring(b *testing.B) {
@@ -1298,7 +5888,7 @@ func BenchmarkRWMutexMapGetConcurrent(b *testing.B) {
 }
 
 func BenchmarkCacheGetManyConcurrentExpiring(b *testing.B) {
-	benchmarkCacheGetManyConcurrent(b, 5 * time.Minute)
+	benchmarkCacheGetManyConcurrent(b, 5*time.Minute)
 }
 
 func BenchmarkCacheGetManyConcurrentNotExpiring(b *testing.B) {
@@ -1334,7 +5924,7 @@ func benchmarkCacheGetManyConcurrent(b *testing.B, exp time.Duration) {
 }
 
 func BenchmarkCacheSetExpiring(b *testing.B) {
-	benchmarkCacheSet(b, 5 * time.Minute)
+	benchmarkCacheSet(b, 5*time.Minute)
 }
 
 func BenchmarkCacheSetNotExpiring(b *testing.B) {
@@ -1421,3 +6011,16 @@ func BenchmarkIncrementInt(b *testing.B) {
 		tc.IncrementInt("foo", 1)
 	}
 }
+
+func BenchmarkDeleteExpired(b *testing.B) {
+	b.StopTimer()
+	s := MemoryStorage()
+	tc := New(DefaultExpiration, 0, 0, s)
+	for i := 0; i < 100000; i++ {
+		tc.Set(strconv.Itoa(i), i, NoExpiration, NoRefreshDeadline)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		s.DeleteExpired()
+	}
+}
@@ -0,0 +1,148 @@
+package cachegrpc
+
+// The messages of cache.proto, written in the struct tag form the protobuf
+// runtime accepts in place of generated descriptors.
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+type GetRequest struct {
+	Key string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+}
+
+func (m *GetRequest) Reset()         { *m = GetRequest{} }
+func (m *GetRequest) String() string { return proto.CompactTextString(m) }
+func (*GetRequest) ProtoMessage()    {}
+
+type GetResponse struct {
+	Found           bool   `protobuf:"varint,1,opt,name=found,proto3" json:"found,omitempty"`
+	Value           []byte `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Expiration      int64  `protobuf:"varint,3,opt,name=expiration,proto3" json:"expiration,omitempty"`
+	RefreshDeadline int64  `protobuf:"varint,4,opt,name=refresh_deadline,json=refreshDeadline,proto3" json:"refresh_deadline,omitempty"`
+}
+
+func (m *GetResponse) Reset()         { *m = GetResponse{} }
+func (m *GetResponse) String() string { return proto.CompactTextString(m) }
+func (*GetResponse) ProtoMessage()    {}
+
+type SetRequest struct {
+	Key             string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value           []byte `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Expiration      int64  `protobuf:"varint,3,opt,name=expiration,proto3" json:"expiration,omitempty"`
+	RefreshDeadline int64  `protobuf:"varint,4,opt,name=refresh_deadline,json=refreshDeadline,proto3" json:"refresh_deadline,omitempty"`
+}
+
+func (m *SetRequest) Reset()         { *m = SetRequest{} }
+func (m *SetRequest) String() string { return proto.CompactTextString(m) }
+func (*SetRequest) ProtoMessage()    {}
+
+type SetResponse struct {
+}
+
+func (m *SetResponse) Reset()         { *m = SetResponse{} }
+func (m *SetResponse) String() string { return proto.CompactTextString(m) }
+func (*SetResponse) ProtoMessage()    {}
+
+type DeleteRequest struct {
+	Key string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+}
+
+func (m *DeleteRequest) Reset()         { *m = DeleteRequest{} }
+func (m *DeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*DeleteRequest) ProtoMessage()    {}
+
+type DeleteResponse struct {
+}
+
+func (m *DeleteResponse) Reset()         { *m = DeleteResponse{} }
+func (m *DeleteResponse) String() string { return proto.CompactTextString(m) }
+func (*DeleteResponse) ProtoMessage()    {}
+
+type IncrementRequest struct {
+	Key   string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Delta int64  `protobuf:"varint,2,opt,name=delta,proto3" json:"delta,omitempty"`
+}
+
+func (m *IncrementRequest) Reset()         { *m = IncrementRequest{} }
+func (m *IncrementRequest) String() string { return proto.CompactTextString(m) }
+func (*IncrementRequest) ProtoMessage()    {}
+
+type IncrementResponse struct {
+	Value int64 `protobuf:"varint,1,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *IncrementResponse) Reset()         { *m = IncrementResponse{} }
+func (m *IncrementResponse) String() string { return proto.CompactTextString(m) }
+func (*IncrementResponse) ProtoMessage()    {}
+
+type FlushRequest struct {
+}
+
+func (m *FlushRequest) Reset()         { *m = FlushRequest{} }
+func (m *FlushRequest) String() string { return proto.CompactTextString(m) }
+func (*FlushRequest) ProtoMessage()    {}
+
+type FlushResponse struct {
+}
+
+func (m *FlushResponse) Reset()         { *m = FlushResponse{} }
+func (m *FlushResponse) String() string { return proto.CompactTextString(m) }
+func (*FlushResponse) ProtoMessage()    {}
+
+type StatsRequest struct {
+}
+
+func (m *StatsRequest) Reset()         { *m = StatsRequest{} }
+func (m *StatsRequest) String() string { return proto.CompactTextString(m) }
+func (*StatsRequest) ProtoMessage()    {}
+
+type StatsResponse struct {
+	BreakerState        string                 `protobuf:"bytes,1,opt,name=breaker_state,json=breakerState,proto3" json:"breaker_state,omitempty"`
+	BreakerTrips        int64                  `protobuf:"varint,2,opt,name=breaker_trips,json=breakerTrips,proto3" json:"breaker_trips,omitempty"`
+	FallbackPending     int64                  `protobuf:"varint,3,opt,name=fallback_pending,json=fallbackPending,proto3" json:"fallback_pending,omitempty"`
+	Evictions           int64                  `protobuf:"varint,4,opt,name=evictions,proto3" json:"evictions,omitempty"`
+	JanitorRuns         int64                  `protobuf:"varint,5,opt,name=janitor_runs,json=janitorRuns,proto3" json:"janitor_runs,omitempty"`
+	JanitorDeleted      int64                  `protobuf:"varint,6,opt,name=janitor_deleted,json=janitorDeleted,proto3" json:"janitor_deleted,omitempty"`
+	JanitorLastDuration int64                  `protobuf:"varint,7,opt,name=janitor_last_duration,json=janitorLastDuration,proto3" json:"janitor_last_duration,omitempty"`
+	JanitorLastLockHold int64                  `protobuf:"varint,8,opt,name=janitor_last_lock_hold,json=janitorLastLockHold,proto3" json:"janitor_last_lock_hold,omitempty"`
+	JanitorMaxLockHold  int64                  `protobuf:"varint,9,opt,name=janitor_max_lock_hold,json=janitorMaxLockHold,proto3" json:"janitor_max_lock_hold,omitempty"`
+	Bypassed            bool                   `protobuf:"varint,10,opt,name=bypassed,proto3" json:"bypassed,omitempty"`
+	MapGrowths          int64                  `protobuf:"varint,11,opt,name=map_growths,json=mapGrowths,proto3" json:"map_growths,omitempty"`
+	MapGrowthMaxPause   int64                  `protobuf:"varint,12,opt,name=map_growth_max_pause,json=mapGrowthMaxPause,proto3" json:"map_growth_max_pause,omitempty"`
+	AsyncPending        int64                  `protobuf:"varint,13,opt,name=async_pending,json=asyncPending,proto3" json:"async_pending,omitempty"`
+	AsyncFailed         int64                  `protobuf:"varint,14,opt,name=async_failed,json=asyncFailed,proto3" json:"async_failed,omitempty"`
+	AsyncDropped        int64                  `protobuf:"varint,15,opt,name=async_dropped,json=asyncDropped,proto3" json:"async_dropped,omitempty"`
+	CoalescedWrites     int64                  `protobuf:"varint,16,opt,name=coalesced_writes,json=coalescedWrites,proto3" json:"coalesced_writes,omitempty"`
+	RefreshQueueDepth   int64                  `protobuf:"varint,17,opt,name=refresh_queue_depth,json=refreshQueueDepth,proto3" json:"refresh_queue_depth,omitempty"`
+	RefreshWorkers      int64                  `protobuf:"varint,18,opt,name=refresh_workers,json=refreshWorkers,proto3" json:"refresh_workers,omitempty"`
+	RefreshBusyWorkers  int64                  `protobuf:"varint,19,opt,name=refresh_busy_workers,json=refreshBusyWorkers,proto3" json:"refresh_busy_workers,omitempty"`
+	RefreshPanics       int64                  `protobuf:"varint,20,opt,name=refresh_panics,json=refreshPanics,proto3" json:"refresh_panics,omitempty"`
+	RefreshSkipped      int64                  `protobuf:"varint,21,opt,name=refresh_skipped,json=refreshSkipped,proto3" json:"refresh_skipped,omitempty"`
+	Encodes             int64                  `protobuf:"varint,22,opt,name=encodes,proto3" json:"encodes,omitempty"`
+	EncodedBytes        int64                  `protobuf:"varint,23,opt,name=encoded_bytes,json=encodedBytes,proto3" json:"encoded_bytes,omitempty"`
+	EncodeTime          int64                  `protobuf:"varint,24,opt,name=encode_time,json=encodeTime,proto3" json:"encode_time,omitempty"`
+	Decodes             int64                  `protobuf:"varint,25,opt,name=decodes,proto3" json:"decodes,omitempty"`
+	DecodedBytes        int64                  `protobuf:"varint,26,opt,name=decoded_bytes,json=decodedBytes,proto3" json:"decoded_bytes,omitempty"`
+	DecodeTime          int64                  `protobuf:"varint,27,opt,name=decode_time,json=decodeTime,proto3" json:"decode_time,omitempty"`
+	MaxEncodedSize      int64                  `protobuf:"varint,28,opt,name=max_encoded_size,json=maxEncodedSize,proto3" json:"max_encoded_size,omitempty"`
+	EncodedSizes        []int64                `protobuf:"varint,29,rep,packed,name=encoded_sizes,json=encodedSizes,proto3" json:"encoded_sizes,omitempty"`
+	PinnedItems         int64                  `protobuf:"varint,30,opt,name=pinned_items,json=pinnedItems,proto3" json:"pinned_items,omitempty"`
+	PinnedBytes         int64                  `protobuf:"varint,31,opt,name=pinned_bytes,json=pinnedBytes,proto3" json:"pinned_bytes,omitempty"`
+	Prefixes            map[string]*PrefixStat `protobuf:"bytes,32,rep,name=prefixes,proto3" json:"prefixes,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *StatsResponse) Reset()         { *m = StatsResponse{} }
+func (m *StatsResponse) String() string { return proto.CompactTextString(m) }
+func (*StatsResponse) ProtoMessage()    {}
+
+type PrefixStat struct {
+	Hits      int64 `protobuf:"varint,1,opt,name=hits,proto3" json:"hits,omitempty"`
+	Misses    int64 `protobuf:"varint,2,opt,name=misses,proto3" json:"misses,omitempty"`
+	Refreshes int64 `protobuf:"varint,3,opt,name=refreshes,proto3" json:"refreshes,omitempty"`
+	Bytes     int64 `protobuf:"varint,4,opt,name=bytes,proto3" json:"bytes,omitempty"`
+}
+
+func (m *PrefixStat) Reset()         { *m = PrefixStat{} }
+func (m *PrefixStat) String() string { return proto.CompactTextString(m) }
+func (*PrefixStat) ProtoMessage()    {}
@@ -0,0 +1,264 @@
+// Package cachegrpc serves a cache over gRPC (see cache.proto), and provides
+// a storage that uses such a service as its backend, so that one process's
+// cache can be shared by others.
+package cachegrpc
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cache "github.com/rooholam/go-cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC service of cache.proto.
+type CacheServer interface {
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	Set(context.Context, *SetRequest) (*SetResponse, error)
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	Increment(context.Context, *IncrementRequest) (*IncrementResponse, error)
+	Flush(context.Context, *FlushRequest) (*FlushResponse, error)
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+}
+
+// Returns a handler for the methods of CacheServer.
+func unaryHandler(method string, newReq func() interface{}, call func(CacheServer, context.Context, interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := newReq()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(CacheServer), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/gocache.Cache/" + method,
+			}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(CacheServer), ctx, req)
+			})
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "gocache.Cache",
+	HandlerType: (*CacheServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("Get", func() interface{} { return new(GetRequest) }, func(s CacheServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return s.Get(ctx, in.(*GetRequest))
+		}),
+		unaryHandler("Set", func() interface{} { return new(SetRequest) }, func(s CacheServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return s.Set(ctx, in.(*SetRequest))
+		}),
+		unaryHandler("Delete", func() interface{} { return new(DeleteRequest) }, func(s CacheServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return s.Delete(ctx, in.(*DeleteRequest))
+		}),
+		unaryHandler("Increment", func() interface{} { return new(IncrementRequest) }, func(s CacheServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return s.Increment(ctx, in.(*IncrementRequest))
+		}),
+		unaryHandler("Flush", func() interface{} { return new(FlushRequest) }, func(s CacheServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return s.Flush(ctx, in.(*FlushRequest))
+		}),
+		unaryHandler("Stats", func() interface{} { return new(StatsRequest) }, func(s CacheServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return s.Stats(ctx, in.(*StatsRequest))
+		}),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "cache.proto",
+}
+
+// Registers srv with the gRPC server s.
+func RegisterCacheServer(s *grpc.Server, srv CacheServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+type server struct {
+	c     *cache.Cache
+	mutex sync.Mutex // makes Increment of JSON numbers atomic
+}
+
+// Returns a server for c. Values set through it are stored as their JSON
+// bytes; other values are JSON encoded when they are read.
+func NewServer(c *cache.Cache) CacheServer {
+	return &server{c: c}
+}
+
+// Converts a Unix time in nanoseconds to the duration from now the cache
+// takes, where 0 is never.
+func durationUntil(t int64, never time.Duration) time.Duration {
+	if t == 0 {
+		return never
+	}
+	if d := time.Unix(0, t).Sub(time.Now()); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
+
+// Reads the item as Get does, so that it counts as a hit or a miss and is
+// queued for a refresh once it reaches its refresh deadline.
+func (s *server) Get(ctx context.Context, in *GetRequest) (*GetResponse, error) {
+	x, meta, found := s.c.GetDetailed(in.Key)
+	if !found {
+		return &GetResponse{}, nil
+	}
+	b, ok := x.([]byte)
+	if !ok {
+		var err error
+		if b, err = json.Marshal(x); err != nil {
+			return nil, status.Errorf(codes.Internal, "error marshaling %s : %s", in.Key, err)
+		}
+	}
+	res := &GetResponse{
+		Found:           true,
+		Value:           b,
+		RefreshDeadline: meta.RefreshDeadline,
+	}
+	if meta.TTL != cache.NoExpiration {
+		res.Expiration = time.Now().Add(meta.TTL).UnixNano()
+	}
+	return res, nil
+}
+
+func (s *server) Set(ctx context.Context, in *SetRequest) (*SetResponse, error) {
+	s.c.SetBytes(in.Key, in.Value, durationUntil(in.Expiration, cache.NoExpiration), durationUntil(in.RefreshDeadline, cache.NoRefreshDeadline))
+	return &SetResponse{}, nil
+}
+
+func (s *server) Delete(ctx context.Context, in *DeleteRequest) (*DeleteResponse, error) {
+	s.c.Delete(in.Key)
+	return &DeleteResponse{}, nil
+}
+
+// Increments values set by Go code with the cache's Increment functions, and
+// JSON numbers set through the service.
+func (s *server) Increment(ctx context.Context, in *IncrementRequest) (*IncrementResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, found := s.c.InspectItem(in.Key)
+	if !found || item.Expired() {
+		return nil, status.Errorf(codes.NotFound, "Item %s not found", in.Key)
+	}
+	b, ok := item.Object.([]byte)
+	if !ok {
+		if v, err := s.c.IncrementInt64(in.Key, in.Delta); err == nil {
+			return &IncrementResponse{Value: v}, nil
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "The value for %s is not an int64", in.Key)
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "The value for %s is not an integer", in.Key)
+	}
+	v += in.Delta
+	s.c.SetBytes(in.Key, []byte(strconv.FormatInt(v, 10)), durationUntil(item.Expiration, cache.NoExpiration), durationUntil(item.RefreshDeadline, cache.NoRefreshDeadline))
+	return &IncrementResponse{Value: v}, nil
+}
+
+func (s *server) Flush(ctx context.Context, in *FlushRequest) (*FlushResponse, error) {
+	s.c.Flush()
+	return &FlushResponse{}, nil
+}
+
+func (s *server) Stats(ctx context.Context, in *StatsRequest) (*StatsResponse, error) {
+	st := s.c.Stats()
+	res := &StatsResponse{
+		BreakerState:        st.BreakerState,
+		BreakerTrips:        st.BreakerTrips,
+		FallbackPending:     int64(st.FallbackPending),
+		Evictions:           st.Evictions,
+		JanitorRuns:         st.JanitorRuns,
+		JanitorDeleted:      st.JanitorDeleted,
+		JanitorLastDuration: int64(st.JanitorLastDuration),
+		JanitorLastLockHold: int64(st.JanitorLastLockHold),
+		JanitorMaxLockHold:  int64(st.JanitorMaxLockHold),
+		Bypassed:            st.Bypassed,
+		MapGrowths:          st.MapGrowths,
+		MapGrowthMaxPause:   int64(st.MapGrowthMaxPause),
+		AsyncPending:        st.AsyncPending,
+		AsyncFailed:         st.AsyncFailed,
+		AsyncDropped:        st.AsyncDropped,
+		CoalescedWrites:     st.CoalescedWrites,
+		RefreshQueueDepth:   st.RefreshQueueDepth,
+		RefreshWorkers:      int64(st.RefreshWorkers),
+		RefreshBusyWorkers:  int64(st.RefreshBusyWorkers),
+		RefreshPanics:       st.RefreshPanics,
+		RefreshSkipped:      st.RefreshSkipped,
+		Encodes:             st.Encodes,
+		EncodedBytes:        st.EncodedBytes,
+		EncodeTime:          int64(st.EncodeTime),
+		Decodes:             st.Decodes,
+		DecodedBytes:        st.DecodedBytes,
+		DecodeTime:          int64(st.DecodeTime),
+		MaxEncodedSize:      st.MaxEncodedSize,
+		EncodedSizes:        st.EncodedSizes,
+		PinnedItems:         int64(st.PinnedItems),
+		PinnedBytes:         st.PinnedBytes,
+	}
+	if len(st.Prefixes) > 0 {
+		res.Prefixes = make(map[string]*PrefixStat, len(st.Prefixes))
+		for p, ps := range st.Prefixes {
+			res.Prefixes[p] = &PrefixStat{Hits: ps.Hits, Misses: ps.Misses, Refreshes: ps.Refreshes, Bytes: ps.Bytes}
+		}
+	}
+	return res, nil
+}
+
+// A client of the gRPC service of cache.proto.
+type CacheClient interface {
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*IncrementResponse, error)
+	Flush(ctx context.Context, in *FlushRequest, opts ...grpc.CallOption) (*FlushResponse, error)
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+}
+
+type client struct {
+	cc grpc.ClientConnInterface
+}
+
+// Returns a client calling the service over cc.
+func NewCacheClient(cc grpc.ClientConnInterface) CacheClient {
+	return &client{cc}
+}
+
+func (c *client) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	return out, c.cc.Invoke(ctx, "/gocache.Cache/Get", in, out, opts...)
+}
+
+func (c *client) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
+	return out, c.cc.Invoke(ctx, "/gocache.Cache/Set", in, out, opts...)
+}
+
+func (c *client) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	return out, c.cc.Invoke(ctx, "/gocache.Cache/Delete", in, out, opts...)
+}
+
+func (c *client) Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*IncrementResponse, error) {
+	out := new(IncrementResponse)
+	return out, c.cc.Invoke(ctx, "/gocache.Cache/Increment", in, out, opts...)
+}
+
+func (c *client) Flush(ctx context.Context, in *FlushRequest, opts ...grpc.CallOption) (*FlushResponse, error) {
+	out := new(FlushResponse)
+	return out, c.cc.Invoke(ctx, "/gocache.Cache/Flush", in, out, opts...)
+}
+
+func (c *client) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	return out, c.cc.Invoke(ctx, "/gocache.Cache/Stats", in, out, opts...)
+}
@@ -0,0 +1,59 @@
+package cachegrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	cache "github.com/rooholam/go-cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestRemoteStorage(t *testing.T) {
+	backend := cache.New(cache.DefaultExpiration, 0, 0, cache.MemoryStorage())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	RegisterCacheServer(s, NewServer(backend))
+	go s.Serve(l)
+	defer s.Stop()
+
+	cc, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	backend.TrackPrefixStats("foo")
+	tc := cache.New(cache.DefaultExpiration, 0, 0, RemoteStorage(cc, time.Second))
+	tc.Set("foo", "bar", time.Minute, cache.NoRefreshDeadline)
+	var v string
+	if x, found := tc.GetObject("foo", &v); !found || *x.(*string) != "bar" {
+		t.Error("foo was not found through the remote storage:", x)
+	}
+	if _, found := backend.Get("foo"); !found {
+		t.Error("foo was not set in the backend")
+	}
+	tc.Set("n", 1, cache.DefaultExpiration, cache.NoRefreshDeadline)
+	res, err := NewCacheClient(cc).Increment(context.Background(), &IncrementRequest{Key: "n", Delta: 2})
+	if err != nil || res.Value != 3 {
+		t.Error("n was not incremented to 3:", res, err)
+	}
+	st, err := NewCacheClient(cc).Stats(context.Background(), &StatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps := st.Prefixes["foo"]; ps == nil || ps.Hits != 2 { // the remote read and backend.Get
+		t.Error("the remote read was not counted as a hit:", st.Prefixes)
+	}
+	if len(st.EncodedSizes) != len(backend.Stats().EncodedSizes) {
+		t.Error("wrong encoded sizes:", st.EncodedSizes)
+	}
+	tc.Delete("foo")
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was not deleted")
+	}
+}
@@ -0,0 +1,147 @@
+package cachegrpc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	cache "github.com/rooholam/go-cache"
+	"google.golang.org/grpc"
+)
+
+// How long a remote storage waits for each call, unless told otherwise.
+const DefaultTimeout = time.Second
+
+type remoteStorage struct {
+	client  CacheClient
+	timeout time.Duration
+	mutex   sync.Mutex
+}
+
+func (s *remoteStorage) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *remoteStorage) Get(key string) (cache.Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *remoteStorage) GetObject(key string, o interface{}) (cache.Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *remoteStorage) Set(key string, item cache.Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *remoteStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *remoteStorage) TryGet(key string) (cache.Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+// Decodes the JSON value into o, or, if o is nil, into maps, slices, strings,
+// float64s and bools.
+func (s *remoteStorage) TryGetObject(key string, o interface{}) (cache.Item, bool, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	res, err := s.client.Get(ctx, &GetRequest{Key: key})
+	if err != nil {
+		return cache.Item{}, false, err
+	}
+	if !res.Found {
+		return cache.Item{}, false, nil
+	}
+	var v interface{}
+	if o == nil {
+		o = &v
+	}
+	if err := json.Unmarshal(res.Value, o); err != nil {
+		return cache.Item{}, false, err
+	}
+	item := cache.Item{
+		Object:          o,
+		Expiration:      res.Expiration,
+		RefreshDeadline: res.RefreshDeadline,
+	}
+	if o == &v {
+		item.Object = v
+	}
+	return item, true, nil
+}
+
+func (s *remoteStorage) TrySet(key string, item cache.Item) error {
+	b, err := json.Marshal(item.Object)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err = s.client.Set(ctx, &SetRequest{
+		Key:             key,
+		Value:           b,
+		Expiration:      item.Expiration,
+		RefreshDeadline: item.RefreshDeadline,
+	})
+	return err
+}
+
+func (s *remoteStorage) TryDel(key string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err := s.client.Delete(ctx, &DeleteRequest{Key: key})
+	return err
+}
+
+func (s *remoteStorage) Flush() {
+	ctx, cancel := s.context()
+	defer cancel()
+	if _, err := s.client.Flush(ctx, &FlushRequest{}); err != nil {
+		log.Errorf("error flushing : %s", err)
+	}
+}
+
+// Lock only excludes other goroutines in this process; operations that read
+// and then write, like Add, are not atomic across processes.
+func (s *remoteStorage) Lock() {
+	s.mutex.Lock()
+}
+
+func (s *remoteStorage) Unlock() {
+	s.mutex.Unlock()
+}
+
+func (s *remoteStorage) RLock() {
+	// nothing to do
+}
+
+func (s *remoteStorage) RUnlock() {
+	// nothing to do
+}
+
+func (s *remoteStorage) Type() int {
+	return cache.STORAGE_TYPE_REMOTE
+}
+
+// Returns a storage that keeps its items in the cache served over cc (see
+// NewServer), waiting up to timeout (or DefaultTimeout, if it's 0) for each
+// call. Values are JSON encoded, as in Redis storages.
+func RemoteStorage(cc grpc.ClientConnInterface, timeout time.Duration) *remoteStorage {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &remoteStorage{
+		client:  NewCacheClient(cc),
+		timeout: timeout,
+	}
+}
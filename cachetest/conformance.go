@@ -0,0 +1,138 @@
+package cachetest
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	cache "github.com/rooholam/go-cache"
+)
+
+// Checks that storages returned by newStorage behave as the cache expects:
+// items, including nil values, are read back as they were set, overwritten,
+// deleted, expired and flushed, and, for storages that can list their keys,
+// DeletePrefix deletes exactly the keys starting with the prefix. Each check
+// gets a storage of its own. Storage implementations can run it from their
+// tests, e.g.
+//
+//	func TestMyStorage(t *testing.T) {
+//		cachetest.TestStorageConformance(t, func() cache.Storage { return NewMyStorage() })
+//	}
+//
+// Expirations are reached with a manual clock (see ManualClock), so storages
+// that expire items on their own, such as Redis, only have to keep them
+// until then.
+func TestStorageConformance(t *testing.T, newStorage func() cache.Storage) {
+	newCache := func(t *testing.T) *cache.Cache {
+		return cache.New(cache.DefaultExpiration, 0, 0, newStorage())
+	}
+
+	t.Run("SetGet", func(t *testing.T) {
+		c := newCache(t)
+		if x, found := c.Get("missing"); found {
+			t.Error("missing key found:", x)
+		}
+		c.Set("a", "1", cache.DefaultExpiration, cache.NoRefreshDeadline)
+		if x, found := c.Get("a"); !found || x != "1" {
+			t.Error("a not found:", x, found)
+		}
+		c.Set("a", "2", cache.DefaultExpiration, cache.NoRefreshDeadline)
+		if x, found := c.Get("a"); !found || x != "2" {
+			t.Error("a not overwritten:", x, found)
+		}
+	})
+
+	t.Run("Bytes", func(t *testing.T) {
+		c := newCache(t)
+		c.SetBytes("b", []byte{0, 1, 0xff}, cache.DefaultExpiration, cache.NoRefreshDeadline)
+		if b, found := c.GetBytes("b"); !found || string(b) != "\x00\x01\xff" {
+			t.Errorf("b not read back: %q %v", b, found)
+		}
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		c := newCache(t)
+		c.Set("nil", nil, cache.DefaultExpiration, cache.NoRefreshDeadline)
+		if x, found := c.Get("nil"); !found || x != nil {
+			t.Error("nil value not read back:", x, found)
+		}
+		c.SetBytes("empty", nil, cache.DefaultExpiration, cache.NoRefreshDeadline)
+		if b, found := c.GetBytes("empty"); !found || len(b) != 0 {
+			t.Errorf("nil bytes not read back: %q %v", b, found)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		c := newCache(t)
+		c.Set("a", "1", cache.DefaultExpiration, cache.NoRefreshDeadline)
+		c.Set("b", "2", cache.DefaultExpiration, cache.NoRefreshDeadline)
+		c.Delete("a")
+		if _, found := c.Get("a"); found {
+			t.Error("a not deleted")
+		}
+		if x, found := c.Get("b"); !found || x != "2" {
+			t.Error("b deleted too:", x, found)
+		}
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		clock := ManualClock(t, time.Now())
+		c := newCache(t)
+		c.Set("short", "1", time.Minute, cache.NoRefreshDeadline)
+		c.Set("long", "2", time.Hour, cache.NoRefreshDeadline)
+		clock.Advance(2 * time.Minute)
+		if _, found := c.Get("short"); found {
+			t.Error("short didn't expire")
+		}
+		if x, found := c.Get("long"); !found || x != "2" {
+			t.Error("long expired:", x, found)
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		c := newCache(t)
+		c.Set("a", "1", cache.DefaultExpiration, cache.NoRefreshDeadline)
+		c.Set("b", "2", cache.DefaultExpiration, cache.NoRefreshDeadline)
+		c.Flush()
+		for _, k := range []string{"a", "b"} {
+			if _, found := c.Get(k); found {
+				t.Error(k, "not flushed")
+			}
+		}
+	})
+
+	t.Run("DeletePrefix", func(t *testing.T) {
+		c := newCache(t)
+		deleted := []string{"p:", "p:a", "p:b:c", "p:é", "p:\u00ff"}
+		kept := []string{"p", "p;", "p9", "q:a", "ap:a", "P:a"}
+		for _, k := range append(append([]string(nil), deleted...), kept...) {
+			c.Set(k, k, cache.DefaultExpiration, cache.NoRefreshDeadline)
+		}
+		n, err := c.DeletePrefix("p:")
+		if errors.Is(err, cache.ErrNotSupported) {
+			t.Skip("the storage can't list its keys")
+		}
+		if err != nil || n != len(deleted) {
+			t.Error("wrong number of keys deleted:", n, err)
+		}
+		var left []string
+		for _, k := range append(deleted, kept...) {
+			if _, found := c.Get(k); found {
+				left = append(left, k)
+			}
+		}
+		sort.Strings(left)
+		sort.Strings(kept)
+		if len(left) != len(kept) {
+			t.Errorf("wrong keys left: %q, want %q", left, kept)
+			return
+		}
+		for i := range left {
+			if left[i] != kept[i] {
+				t.Errorf("wrong keys left: %q, want %q", left, kept)
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,23 @@
+//go:build sqlite
+
+package cachetest
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	cache "github.com/rooholam/go-cache"
+)
+
+// Only built with the "sqlite" build tag, so that the cache module doesn't
+// depend on a SQLite driver.
+func TestStorageConformanceSQLite(t *testing.T) {
+	dir := t.TempDir()
+	n := 0
+	TestStorageConformance(t, func() cache.Storage {
+		n++
+		return cache.SQLiteStorage(filepath.Join(dir, strconv.Itoa(n)+".db"))
+	})
+}
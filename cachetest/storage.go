@@ -0,0 +1,215 @@
+// Package cachetest provides a fake cache.Storage for testing code that uses a
+// cache, e.g. how it handles a storage that fails or is slow, without running
+// Redis.
+package cachetest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	cache "github.com/rooholam/go-cache"
+)
+
+// A storage operation.
+type Op string
+
+const (
+	OpGet   Op = "get"
+	OpSet   Op = "set"
+	OpDel   Op = "del"
+	OpFlush Op = "flush"
+)
+
+// A call made to a Storage. Item is the item set, for OpSet, or the item
+// found, for OpGet.
+type Call struct {
+	Op    Op
+	Key   string
+	Item  cache.Item
+	Found bool
+	Err   error
+}
+
+// A fake storage keeping its items in memory, that records the calls made to
+// it and can be told to fail or to be slow. It reports its errors (see
+// cache.CheckedStorage), so the cache's error handling can be tested with it.
+// Safe for concurrent use.
+type Storage struct {
+	cache.Storage
+	mutex   sync.Mutex // guards the fields below
+	calls   []Call
+	errors  map[Op]error
+	keyErrs map[Op]map[string]error
+	latency time.Duration
+}
+
+// Returns an empty fake storage.
+func NewStorage() *Storage {
+	return &Storage{
+		Storage: cache.MemoryStorage(),
+		errors:  make(map[Op]error),
+		keyErrs: make(map[Op]map[string]error),
+	}
+}
+
+// Makes every call of op fail with err, until SetError is called with a nil
+// err.
+func (s *Storage) SetError(op Op, err error) {
+	s.mutex.Lock()
+	s.errors[op] = err
+	s.mutex.Unlock()
+}
+
+// Makes the calls of op for key fail with err, until SetKeyError is called
+// with a nil err.
+func (s *Storage) SetKeyError(op Op, key string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil {
+		delete(s.keyErrs[op], key)
+		return
+	}
+	if s.keyErrs[op] == nil {
+		s.keyErrs[op] = make(map[string]error)
+	}
+	s.keyErrs[op][key] = err
+}
+
+// Makes every call sleep for d before returning.
+func (s *Storage) SetLatency(d time.Duration) {
+	s.mutex.Lock()
+	s.latency = d
+	s.mutex.Unlock()
+}
+
+// Returns the calls made so far, oldest first.
+func (s *Storage) Calls() []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Returns the number of calls of op made so far.
+func (s *Storage) Count(op Op) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for _, c := range s.calls {
+		if c.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// Forgets the calls made so far. The items, errors and latency are kept.
+func (s *Storage) ResetCalls() {
+	s.mutex.Lock()
+	s.calls = nil
+	s.mutex.Unlock()
+}
+
+// Waits for the latency, and returns the error the call of op for key should
+// fail with, if any.
+func (s *Storage) begin(op Op, key string) error {
+	s.mutex.Lock()
+	latency := s.latency
+	err := s.errors[op]
+	if kerr, ok := s.keyErrs[op][key]; ok {
+		err = kerr
+	}
+	s.mutex.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return err
+}
+
+func (s *Storage) record(c Call) {
+	s.mutex.Lock()
+	s.calls = append(s.calls, c)
+	s.mutex.Unlock()
+}
+
+func (s *Storage) Get(key string) (cache.Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *Storage) GetObject(key string, o interface{}) (cache.Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *Storage) Set(key string, item cache.Item) {
+	s.TrySet(key, item)
+}
+
+func (s *Storage) Del(key string) {
+	s.TryDel(key)
+}
+
+func (s *Storage) TryGet(key string) (cache.Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+func (s *Storage) TryGetObject(key string, o interface{}) (cache.Item, bool, error) {
+	if err := s.begin(OpGet, key); err != nil {
+		s.record(Call{Op: OpGet, Key: key, Err: err})
+		return cache.Item{}, false, err
+	}
+	item, found := s.Storage.Get(key)
+	s.record(Call{Op: OpGet, Key: key, Item: item, Found: found})
+	return item, found, nil
+}
+
+func (s *Storage) TrySet(key string, item cache.Item) error {
+	err := s.begin(OpSet, key)
+	if err == nil {
+		s.Storage.Set(key, item)
+	}
+	s.record(Call{Op: OpSet, Key: key, Item: item, Err: err})
+	return err
+}
+
+func (s *Storage) TryDel(key string) error {
+	err := s.begin(OpDel, key)
+	if err == nil {
+		s.Storage.Del(key)
+	}
+	s.record(Call{Op: OpDel, Key: key, Err: err})
+	return err
+}
+
+// Flush can't report an error, so an error set for OpFlush keeps the items.
+func (s *Storage) Flush() {
+	err := s.begin(OpFlush, "")
+	if err == nil {
+		s.Storage.Flush()
+	}
+	s.record(Call{Op: OpFlush, Err: err})
+}
+
+// Deletes the expired items, as the janitor does.
+func (s *Storage) DeleteExpired() {
+	s.Storage.(interface {
+		DeleteExpired()
+	}).DeleteExpired()
+}
+
+func (s *Storage) Unwrap() cache.Storage {
+	return s.Storage
+}
+
+// Replaces the clock of every cache with a manual clock set to t until the
+// test ends, so that expirations and refresh deadlines are reached by
+// advancing it (see cache.Cache.Advance) rather than by sleeping.
+func ManualClock(tb testing.TB, t time.Time) *cache.ManualClock {
+	clock := cache.NewManualClock(t)
+	cache.SetClock(clock)
+	tb.Cleanup(func() {
+		cache.SetClock(nil)
+	})
+	return clock
+}
@@ -0,0 +1,68 @@
+package cachetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cache "github.com/rooholam/go-cache"
+)
+
+func TestStorage(t *testing.T) {
+	s := NewStorage()
+	c := cache.New(cache.DefaultExpiration, 0, 0, s)
+	c.Set("a", 1, cache.DefaultExpiration, cache.NoRefreshDeadline)
+	if x, found := c.Get("a"); !found || x != 1 {
+		t.Error("a not found:", x, found)
+	}
+	if s.Count(OpSet) != 1 || s.Count(OpGet) != 1 {
+		t.Error("wrong calls:", s.Calls())
+	}
+
+	down := errors.New("down")
+	s.SetError(OpSet, down)
+	if err := c.SetChecked("b", 2, cache.DefaultExpiration, cache.NoRefreshDeadline); err != down {
+		t.Error("error not returned:", err)
+	}
+	s.SetError(OpSet, nil)
+	s.SetKeyError(OpGet, "a", down)
+	if _, found := c.Get("a"); found {
+		t.Error("failed get found a")
+	}
+	calls := s.Calls()
+	if last := calls[len(calls)-1]; last.Op != OpGet || last.Key != "a" || last.Err != down {
+		t.Error("wrong last call:", last)
+	}
+	s.SetKeyError(OpGet, "a", nil)
+
+	s.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	c.Get("a")
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("latency not applied")
+	}
+	s.SetLatency(0)
+
+	clock := ManualClock(t, time.Unix(1000, 0))
+	c.Set("c", 3, time.Minute, cache.NoRefreshDeadline)
+	clock.Advance(2 * time.Minute)
+	if _, found := c.Get("c"); found {
+		t.Error("c didn't expire")
+	}
+	s.ResetCalls()
+	if len(s.Calls()) != 0 {
+		t.Error("calls not reset")
+	}
+}
+
+func TestStorageConformanceMemory(t *testing.T) {
+	TestStorageConformance(t, func() cache.Storage { return cache.MemoryStorage() })
+}
+
+func TestStorageConformanceSlab(t *testing.T) {
+	TestStorageConformance(t, func() cache.Storage { return cache.SlabStorage(1 << 16) })
+}
+
+func TestStorageConformanceFake(t *testing.T) {
+	TestStorageConformance(t, func() cache.Storage { return NewStorage() })
+}
@@ -0,0 +1,70 @@
+package cache
+
+// CheckedStorage is implemented by storages whose operations can fail, such as
+// remote backends. The plain Storage methods report a failed read as a miss
+// and drop a failed write; these variants return the error instead, and are
+// what storage decorators like RetryStorage build on.
+type CheckedStorage interface {
+	Storage
+	TryGet(string) (Item, bool, error)
+	TryGetObject(string, interface{}) (Item, bool, error)
+	TrySet(string, Item) error
+	TryDel(string) error
+}
+
+// Implemented by storage decorators to give access to the storage they wrap.
+type wrappedStorage interface {
+	Unwrap() Storage
+}
+
+// Returns the storage s is or wraps that implements T, if any.
+func storageAs[T any](s Storage) (T, bool) {
+	for {
+		if t, ok := s.(T); ok {
+			return t, true
+		}
+		w, ok := s.(wrappedStorage)
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		s = w.Unwrap()
+	}
+}
+
+// Returns the storage s is or wraps that needs a janitor, if any.
+func cleanableStorageOf(s Storage) (cleanableStorage, bool) {
+	return storageAs[cleanableStorage](s)
+}
+
+func tryGet(s Storage, k string) (Item, bool, error) {
+	if cs, ok := s.(CheckedStorage); ok {
+		return cs.TryGet(k)
+	}
+	item, found := s.Get(k)
+	return item, found, nil
+}
+
+func tryGetObject(s Storage, k string, o interface{}) (Item, bool, error) {
+	if cs, ok := s.(CheckedStorage); ok {
+		return cs.TryGetObject(k, o)
+	}
+	item, found := s.GetObject(k, o)
+	return item, found, nil
+}
+
+func trySet(s Storage, k string, item Item) error {
+	if cs, ok := s.(CheckedStorage); ok {
+		return cs.TrySet(k, item)
+	}
+	s.Set(k, item)
+	return nil
+}
+
+func tryDel(s Storage, k string) error {
+	if cs, ok := s.(CheckedStorage); ok {
+		return cs.TryDel(k)
+	}
+	s.Del(k)
+	return nil
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The source of the current time used for expirations and refresh deadlines.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Holds the Clock, so that the atomic.Value always stores the same type.
+type clockHolder struct {
+	Clock
+}
+
+var clock atomic.Value // clockHolder
+
+// Replaces the clock of every cache, e.g. with a ManualClock in tests; nil
+// restores the system clock. Only the times kept in the process are affected:
+// remote storages such as Redis still expire items on their own clock.
+func SetClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	clock.Store(clockHolder{c})
+}
+
+func currentClock() Clock {
+	if h, ok := clock.Load().(clockHolder); ok {
+		return h.Clock
+	}
+	return systemClock{}
+}
+
+// Returns the current time according to the clock set with SetClock.
+func timeNow() time.Time {
+	return currentClock().Now()
+}
+
+// A Clock that only moves when told to, so that tests can expire items and
+// reach refresh deadlines without sleeping.
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// Returns a manual clock set to t.
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{now: t}
+}
+
+func (m *ManualClock) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+// Moves the clock forward by d.
+func (m *ManualClock) Advance(d time.Duration) {
+	m.mutex.Lock()
+	m.now = m.now.Add(d)
+	m.mutex.Unlock()
+}
+
+// A Clock that reads the system clock only once per precision, from a
+// ticker, so that reading it costs an atomic load instead of a call to
+// time.Now, e.g. on every Get. The times it returns are behind the system
+// clock by up to precision, so items expire up to precision late.
+type CoarseClock struct {
+	now  int64 // Unix nanoseconds, updated atomically
+	stop chan bool
+	done chan bool
+	once sync.Once
+}
+
+// Returns a coarse clock updated every precision, until Stop is called.
+func NewCoarseClock(precision time.Duration) *CoarseClock {
+	c := &CoarseClock{
+		now:  time.Now().UnixNano(),
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+	go c.run(precision)
+	return c
+}
+
+func (c *CoarseClock) run(precision time.Duration) {
+	ticker := time.NewTicker(precision)
+	defer ticker.Stop()
+	defer close(c.done)
+	for {
+		select {
+		case t := <-ticker.C:
+			atomic.StoreInt64(&c.now, t.UnixNano())
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *CoarseClock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.now))
+}
+
+// Stops the ticker updating the clock, which then stays at the last time
+// read.
+func (c *CoarseClock) Stop() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
+
+var precisionClock struct {
+	mutex sync.Mutex
+	clock *CoarseClock
+}
+
+// Makes every cache use a CoarseClock updated every d (see SetClock), a
+// millisecond being precise enough for most expirations, or the system clock
+// again if d is 0. Replaces any clock set with SetClock.
+func SetClockPrecision(d time.Duration) {
+	precisionClock.mutex.Lock()
+	defer precisionClock.mutex.Unlock()
+	if precisionClock.clock != nil {
+		precisionClock.clock.Stop()
+		precisionClock.clock = nil
+	}
+	if d <= 0 {
+		SetClock(nil)
+		return
+	}
+	precisionClock.clock = NewCoarseClock(d)
+	SetClock(precisionClock.clock)
+}
@@ -0,0 +1,153 @@
+// Command gocachectl inspects and modifies the items a cache keeps in Redis,
+// decoding the expiration, refresh deadline and JSON value of each item.
+// Memory caches live in their process, so they can't be reached by it.
+//
+// Usage:
+//
+//	gocachectl [flags] get KEY
+//	gocachectl [flags] set KEY JSON [TTL]
+//	gocachectl [flags] del KEY
+//	gocachectl [flags] ttl KEY
+//	gocachectl [flags] dump KEY
+//	gocachectl [flags] keys PATTERN
+//	gocachectl [flags] stats
+//	gocachectl [flags] flush-prefix PREFIX
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	cache "github.com/rooholam/go-cache"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gocachectl [flags] get|set|del|ttl|dump|keys|stats|flush-prefix [args]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "gocachectl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// Returns how long is left until the Unix nanosecond time t, or "none" if t
+// is 0.
+func remaining(t int64) string {
+	if t == 0 {
+		return "none"
+	}
+	return time.Unix(0, t).Sub(time.Now()).String()
+}
+
+// Writes the number of items of c, an estimate of the memory they take (see
+// cache.EstimatedSize) and c's stats, as JSON.
+func printStats(w io.Writer, c *cache.Cache) error {
+	n, size := c.EstimatedSize()
+	b, err := json.MarshalIndent(struct {
+		Keys           int
+		EstimatedBytes int64
+		Stats          cache.Stats
+	}{n, size, c.Stats()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:6379", "address of the Redis server")
+	pass := flag.String("password", "", "password of the Redis server")
+	db := flag.Int("db", 0, "Redis database")
+	prefix := flag.String("prefix", "", "key prefix of the cache (required)")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 || *prefix == "" {
+		usage()
+	}
+
+	storage := cache.RedisStorage(*addr, *pass, *db, *prefix)
+	c := cache.New(cache.NoExpiration, 0, 0, storage)
+
+	switch cmd := args[0]; {
+	case cmd == "get" && len(args) == 2:
+		var v interface{}
+		item, found, err := storage.TryGetObject(args[1], &v)
+		if err != nil {
+			fail("%s", err)
+		}
+		if !found {
+			fail("%s not found", args[1])
+		}
+		b, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Printf("expires in: %s\nrefresh in: %s\n%s\n", remaining(item.Expiration), remaining(item.RefreshDeadline), b)
+	case cmd == "set" && (len(args) == 3 || len(args) == 4):
+		var v interface{}
+		if err := json.Unmarshal([]byte(args[2]), &v); err != nil {
+			fail("invalid JSON value: %s", err)
+		}
+		ttl := cache.NoExpiration
+		if len(args) == 4 {
+			d, err := time.ParseDuration(args[3])
+			if err != nil {
+				fail("invalid TTL: %s", err)
+			}
+			ttl = d
+		}
+		c.Set(args[1], v, ttl, cache.NoRefreshDeadline)
+	case cmd == "del" && len(args) == 2:
+		if err := storage.TryDel(args[1]); err != nil {
+			fail("%s", err)
+		}
+	case cmd == "ttl" && len(args) == 2:
+		var v interface{}
+		item, found, err := storage.TryGetObject(args[1], &v)
+		if err != nil {
+			fail("%s", err)
+		}
+		if !found {
+			fail("%s not found", args[1])
+		}
+		fmt.Println(remaining(item.Expiration))
+	case cmd == "dump" && len(args) == 2:
+		b, err := c.DebugDump(args[1])
+		if err != nil {
+			fail("%s", err)
+		}
+		fmt.Println(string(b))
+	case cmd == "keys" && len(args) == 2:
+		var cursor uint64
+		for {
+			keys, next, err := c.Keys(args[1], cursor, 1000)
+			if err != nil {
+				fail("%s", err)
+			}
+			for _, k := range keys {
+				fmt.Println(k)
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	case cmd == "stats" && len(args) == 1:
+		if err := printStats(os.Stdout, c); err != nil {
+			fail("%s", err)
+		}
+	case cmd == "flush-prefix" && len(args) == 2:
+		n, err := c.DeletePrefix(args[1])
+		if err != nil {
+			fail("%s", err)
+		}
+		fmt.Printf("deleted %d items\n", n)
+	default:
+		usage()
+	}
+}
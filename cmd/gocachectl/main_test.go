@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	cache "github.com/rooholam/go-cache"
+)
+
+func TestPrintStats(t *testing.T) {
+	c := cache.New(cache.NoExpiration, 0, 0, cache.MemoryStorage())
+	for i := 0; i < 3; i++ {
+		c.Set("k"+strconv.Itoa(i), "value", cache.DefaultExpiration, cache.NoRefreshDeadline)
+	}
+	var buf bytes.Buffer
+	if err := printStats(&buf, c); err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Keys           int
+		EstimatedBytes int64
+		Stats          cache.Stats
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if out.Keys != 3 || out.EstimatedBytes <= 0 {
+		t.Error("wrong size:", out.Keys, out.EstimatedBytes)
+	}
+	if _, found := c.Get("k0"); !found {
+		t.Error("items changed by stats")
+	}
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long a coalescing storage holds writes, unless another window is given.
+const DefaultCoalesceWindow = 100 * time.Millisecond
+
+type coalescingStorage struct {
+	Storage
+	mutex     sync.Mutex // guards pending, flushing and writing
+	pending   map[string]Item
+	flushing  map[string]Item // the writes being applied
+	writing   *string         // the key being written to the storage, if any
+	written   *sync.Cond      // broadcast on mutex when a write is done
+	coalesced int64           // updated atomically
+	stop      chan bool
+	done      chan bool
+}
+
+func (s *coalescingStorage) Get(key string) (Item, bool) {
+	if item, found := s.buffered(key); found {
+		return item, true
+	}
+	return s.Storage.Get(key)
+}
+
+func (s *coalescingStorage) GetObject(key string, o interface{}) (Item, bool) {
+	if item, found := s.buffered(key); found {
+		return item, true
+	}
+	return s.Storage.GetObject(key, o)
+}
+
+// Returns the pending write for key, so that the cache reads its own writes
+// before they reach the storage.
+func (s *coalescingStorage) buffered(key string) (Item, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if item, found := s.pending[key]; found {
+		return item, true
+	}
+	item, found := s.flushing[key]
+	return item, found
+}
+
+func (s *coalescingStorage) Set(key string, item Item) {
+	s.mutex.Lock()
+	if _, found := s.pending[key]; found {
+		atomic.AddInt64(&s.coalesced, 1)
+	}
+	s.pending[key] = item
+	s.mutex.Unlock()
+}
+
+// Drops the pending writes of key, and waits for the one being applied, if
+// any, so that it can't overtake the delete.
+func (s *coalescingStorage) Del(key string) {
+	s.mutex.Lock()
+	delete(s.pending, key)
+	delete(s.flushing, key)
+	for s.writing != nil && *s.writing == key {
+		s.written.Wait()
+	}
+	s.mutex.Unlock()
+	s.Storage.Del(key)
+}
+
+func (s *coalescingStorage) Flush() {
+	s.mutex.Lock()
+	s.pending = make(map[string]Item)
+	s.flushing = nil
+	for s.writing != nil {
+		s.written.Wait()
+	}
+	s.mutex.Unlock()
+	s.Storage.Flush()
+}
+
+// Applies the pending writes one at a time, without holding the storage's
+// lock, so that the cache isn't blocked for the whole batch. Writes dropped by
+// Del or Flush in the meantime are skipped.
+func (s *coalescingStorage) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) == 0 {
+		return
+	}
+	s.flushing, s.pending = s.pending, make(map[string]Item)
+	keys := make([]string, 0, len(s.flushing))
+	for k := range s.flushing {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		item, found := s.flushing[k]
+		if !found {
+			continue
+		}
+		key := k
+		s.writing = &key
+		s.mutex.Unlock()
+		if err := trySet(s.Storage, k, item); err != nil {
+			log.Errorf("error setting %s : %s", k, err)
+		}
+		s.mutex.Lock()
+		s.writing = nil
+		s.written.Broadcast()
+	}
+	s.flushing = nil
+}
+
+func (s *coalescingStorage) run(window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer close(s.done)
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			ticker.Stop()
+			s.flush()
+			return
+		}
+	}
+}
+
+// Applies the pending writes and stops coalescing.
+func (s *coalescingStorage) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+// Drops the buffered writes to the keys, as Del does, before deleting them
+// from the wrapped storage in one operation if it can.
+func (s *coalescingStorage) delMulti(keys []string) ([]string, error) {
+	s.mutex.Lock()
+	for _, k := range keys {
+		delete(s.pending, k)
+		delete(s.flushing, k)
+		for s.writing != nil && *s.writing == k {
+			s.written.Wait()
+		}
+	}
+	s.mutex.Unlock()
+	return delMultiAs(s.Storage, keys, nil)
+}
+
+func (s *coalescingStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+func (s *coalescingStorage) reportStats(st *Stats) {
+	st.CoalescedWrites = atomic.LoadInt64(&s.coalesced)
+}
+
+// Returns a storage that holds the writes to s for window (or
+// DefaultCoalesceWindow if it is less than one) and then applies them at
+// once, so that a key set many times within the window is only written to s
+// with its last value. Reads see the pending writes; deletes are applied
+// immediately. Writes that are still pending are lost if the process exits
+// without calling Close.
+func CoalescingStorage(s Storage, window time.Duration) *coalescingStorage {
+	if window < 1 {
+		window = DefaultCoalesceWindow
+	}
+	cs := &coalescingStorage{
+		Storage: s,
+		pending: make(map[string]Item),
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
+	cs.written = sync.NewCond(&cs.mutex)
+	go cs.run(window)
+	return cs
+}
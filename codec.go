@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+)
+
+// The upper bounds, in bytes, of the buckets of Stats.EncodedSizes. Values
+// bigger than the last bound are counted in an extra last bucket.
+var EncodedSizeBounds = []int{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// Encodes values as JSON for the storages that keep them in another service,
+// counting the values encoded and decoded, their sizes, and the time it
+// takes.
+type jsonCodec struct {
+	// Updated atomically, so kept first for 64-bit alignment.
+	encodes     int64
+	encodeBytes int64
+	encodeNanos int64
+	decodes     int64
+	decodeBytes int64
+	decodeNanos int64
+	maxSize     int64
+	sizes       []int64 // len(EncodedSizeBounds)+1 buckets
+	marshaller  *runtime.JSONPb
+}
+
+func newJSONCodec() *jsonCodec {
+	return &jsonCodec{
+		marshaller: &runtime.JSONPb{OrigName: true},
+		sizes:      make([]int64, len(EncodedSizeBounds)+1),
+	}
+}
+
+// The encoding of a nil value.
+var jsonNull = []byte("null")
+
+func (m *jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if v == nil {
+		m.encoded(len(jsonNull), 0)
+		return jsonNull, nil
+	}
+	start := time.Now()
+	b, err := m.marshaller.Marshal(v)
+	if err == nil {
+		m.encoded(len(b), time.Since(start))
+	}
+	return b, err
+}
+
+// Decodes b into o, which must be a pointer.
+func (m *jsonCodec) Decode(b []byte, o interface{}) error {
+	start := time.Now()
+	err := m.marshaller.NewDecoder(bytes.NewReader(b)).Decode(o)
+	m.decoded(len(b), time.Since(start))
+	return err
+}
+
+// Returns the value encoded in b: nil if it is null, so that nil values read
+// back as nil whatever o is, and otherwise o with b decoded into it or, if o is
+// nil, the value decoded into maps, slices, strings, float64s and bools.
+func (m *jsonCodec) DecodeValue(b []byte, o interface{}) (interface{}, error) {
+	if bytes.Equal(bytes.TrimSpace(b), jsonNull) {
+		m.decoded(len(b), 0)
+		return nil, nil
+	}
+	if o != nil {
+		return o, m.Decode(b, o)
+	}
+	var v interface{}
+	err := m.Decode(b, &v)
+	return v, err
+}
+
+func (m *jsonCodec) encoded(size int, d time.Duration) {
+	atomic.AddInt64(&m.encodes, 1)
+	atomic.AddInt64(&m.encodeBytes, int64(size))
+	atomic.AddInt64(&m.encodeNanos, int64(d))
+	for {
+		max := atomic.LoadInt64(&m.maxSize)
+		if int64(size) <= max || atomic.CompareAndSwapInt64(&m.maxSize, max, int64(size)) {
+			break
+		}
+	}
+	i := 0
+	for i < len(EncodedSizeBounds) && size > EncodedSizeBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&m.sizes[i], 1)
+}
+
+func (m *jsonCodec) decoded(size int, d time.Duration) {
+	atomic.AddInt64(&m.decodes, 1)
+	atomic.AddInt64(&m.decodeBytes, int64(size))
+	atomic.AddInt64(&m.decodeNanos, int64(d))
+}
+
+// Adds the counters to st, so that the metrics of several storages (e.g. the
+// nodes of a sharded storage) add up.
+func (m *jsonCodec) reportStats(st *Stats) {
+	st.Encodes += atomic.LoadInt64(&m.encodes)
+	st.EncodedBytes += atomic.LoadInt64(&m.encodeBytes)
+	st.EncodeTime += time.Duration(atomic.LoadInt64(&m.encodeNanos))
+	st.Decodes += atomic.LoadInt64(&m.decodes)
+	st.DecodedBytes += atomic.LoadInt64(&m.decodeBytes)
+	st.DecodeTime += time.Duration(atomic.LoadInt64(&m.decodeNanos))
+	if max := atomic.LoadInt64(&m.maxSize); max > st.MaxEncodedSize {
+		st.MaxEncodedSize = max
+	}
+	if st.EncodedSizes == nil {
+		st.EncodedSizes = make([]int64, len(m.sizes))
+	}
+	for i := range m.sizes {
+		st.EncodedSizes[i] += atomic.LoadInt64(&m.sizes[i])
+	}
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	redis "gopkg.in/redis.v4"
+)
+
+// Implemented by storages shared by several processes that can count quota
+// usage atomically on the server, e.g. the Redis storages.
+type quotaCounter interface {
+	consumeQuota(key string, amount, limit int64, window time.Duration) (int64, bool, error)
+}
+
+// Returns the storage s is or wraps that can count quota usage, if any.
+func quotaCounterOf(s Storage) (quotaCounter, bool) {
+	return storageAs[quotaCounter](s)
+}
+
+// Consumes amount of the quota of key, which allows limit per window, and
+// returns what is left of it and true, or what is left and false without
+// consuming anything if amount is more than that. The window starts with the
+// first consumption and the quota is restored in full when it ends. On Redis
+// the count is kept in a key of its own outside the items' keys, updated
+// atomically by a script, so that every process sharing the server enforces
+// the same quota; with other storages each process counts in memory. Quotas
+// aren't items: Flush, Keys and the item counts leave them alone. Storage
+// errors are logged and reported as a quota with nothing left.
+func (c *cache) ConsumeQuota(key string, amount, limit int64, window time.Duration) (int64, bool) {
+	var remaining int64
+	var ok bool
+	var err error
+	if qc, found := quotaCounterOf(c.storage); found {
+		remaining, ok, err = qc.consumeQuota(key, amount, limit, window)
+	} else {
+		remaining, ok, err = c.consumeQuota(key, amount, limit, window)
+	}
+	if err != nil {
+		log.Errorf("error consuming quota %s : %s", key, err)
+		return 0, false
+	}
+	return remaining, ok
+}
+
+// The quota windows of a cache whose storage can't count them, by key.
+type quotaWindows struct {
+	mutex   sync.Mutex
+	windows map[string]quotaWindow
+	swept   int // the number of windows after the last sweep
+}
+
+// The usage of a quota in a window ending at end, in Unix nanoseconds.
+type quotaWindow struct {
+	used int64
+	end  int64
+}
+
+// Ended windows are swept whenever their number has doubled since the last
+// sweep, as tombstones are.
+func (c *cache) consumeQuota(key string, amount, limit int64, window time.Duration) (int64, bool, error) {
+	q := &c.quotaWindows
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := timeNow().UnixNano()
+	w, found := q.windows[key]
+	if !found || now >= w.end {
+		w = quotaWindow{end: now + int64(window)}
+	}
+	if w.used+amount > limit {
+		return limit - w.used, false, nil
+	}
+	w.used += amount
+	if q.windows == nil {
+		q.windows = make(map[string]quotaWindow)
+	}
+	q.windows[key] = w
+	if len(q.windows) > 2*q.swept+64 {
+		for k, w := range q.windows {
+			if now >= w.end {
+				delete(q.windows, k)
+			}
+		}
+		q.swept = len(q.windows)
+	}
+	return limit - w.used, true, nil
+}
+
+// Adds ARGV[1] to the count of KEYS[1] unless that takes it over the limit
+// ARGV[2], starting a window of ARGV[3] milliseconds if the count has none.
+// Returns whether the quota was consumed and what is left of it.
+var redisQuotaScript = redis.NewScript(`
+local used = tonumber(redis.call("GET", KEYS[1]) or "0")
+local amount, limit = tonumber(ARGV[1]), tonumber(ARGV[2])
+if used + amount > limit then
+	return {0, limit - used}
+end
+used = redis.call("INCRBY", KEYS[1], amount)
+if redis.call("PTTL", KEYS[1]) < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return {1, limit - used}
+`)
+
+func (s *redisStorage) consumeQuota(key string, amount, limit int64, window time.Duration) (int64, bool, error) {
+	res, err := redisQuotaScript.Run(s.redisClient, []string{s.internalKey("quota", key)}, amount, limit, int64(window/time.Millisecond)).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return 0, false, newError(ErrWrongType, "Unexpected reply %v for quota %s", res, key)
+	}
+	ok, _ := values[0].(int64)
+	remaining, _ := values[1].(int64)
+	return remaining, ok == 1, nil
+}
+
+func (s *shardedRedisStorage) consumeQuota(key string, amount, limit int64, window time.Duration) (int64, bool, error) {
+	node := s.node(key)
+	if node == nil {
+		return 0, false, errNoHealthyNode
+	}
+	return node.consumeQuota(key, amount, limit, window)
+}
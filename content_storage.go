@@ -0,0 +1,273 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Values stored by ContentAddressedStorage are stored under this prefix,
+// followed by the hex encoded SHA-256 of their type and contents.
+const ContentKeyPrefix = "content:sha256:"
+
+type contentAddressedStorage struct {
+	Storage
+	// While DeleteExpired runs, the values of the content keys it deleted,
+	// and the deleted items waiting for the value they refer to, by content
+	// key, so that items expiring with their value are reported with it
+	// whichever is reported first.
+	expiredMutex   sync.Mutex
+	deleting       int
+	expiredContent map[string]interface{}
+	waiting        map[string][]expiredItem
+	onExpire       func(string, Item)
+}
+
+// Returns the key the content of x is stored under. []byte and string values
+// are hashed as is, and others as JSON.
+func contentKey(x interface{}) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%T|", x)
+	switch v := x.(type) {
+	case []byte:
+		h.Write(v)
+	case string:
+		h.Write([]byte(v))
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+	}
+	return ContentKeyPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the key of the content the item of key refers to, and the item.
+func (s *contentAddressedStorage) ref(key string) (string, Item, bool) {
+	var ref string
+	item, found := s.Storage.GetObject(key, &ref)
+	if !found {
+		return "", Item{}, false
+	}
+	switch o := item.Object.(type) {
+	case string:
+		return o, item, true
+	case *string:
+		return *o, item, true
+	}
+	return "", Item{}, false
+}
+
+func (s *contentAddressedStorage) Get(key string) (Item, bool) {
+	return s.GetObject(key, nil)
+}
+
+func (s *contentAddressedStorage) GetObject(key string, o interface{}) (Item, bool) {
+	ref, item, found := s.ref(key)
+	if !found {
+		return Item{}, false
+	}
+	content, found := s.Storage.GetObject(ref, o)
+	if !found {
+		return Item{}, false
+	}
+	item.Object = content.Object
+	return item, true
+}
+
+// Stores the value under its content key, unless it's already stored there
+// for at least as long, and a reference to it under key.
+func (s *contentAddressedStorage) Set(key string, item Item) {
+	ref, err := contentKey(item.Object)
+	if err != nil {
+		log.Errorf("error hashing %s : %s", key, err)
+		return
+	}
+	content, found := s.Storage.Get(ref)
+	if !found || content.Expired() || outlives(item.Expiration, content.Expiration) {
+		s.Storage.Set(ref, Item{Object: item.Object, Expiration: item.Expiration, CreatedAt: item.CreatedAt})
+	}
+	item.Object = ref
+	s.Storage.Set(key, item)
+}
+
+// Returns whether expiration a is after b, where 0 means never.
+func outlives(a, b int64) bool {
+	return b > 0 && (a == 0 || a > b)
+}
+
+// The wrapped storage holds references in place of values, so warming a tier
+// from it isn't supported.
+func (s *contentAddressedStorage) loadMatching(pattern string, limit int, fn func(key string, item Item)) error {
+	return newError(ErrNotSupported, "Warming with pattern %s is not supported by this storage", pattern)
+}
+
+// Lists the keys items are set with, leaving out the content keys.
+func (s *contentAddressedStorage) scanKeys(prefix string, fn func(string)) error {
+	ks, ok := keyScannerOf(s.Storage)
+	if !ok {
+		return newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	return ks.scanKeys(prefix, func(k string) {
+		if !strings.HasPrefix(k, ContentKeyPrefix) {
+			fn(k)
+		}
+	})
+}
+
+func (s *contentAddressedStorage) pageKeys(pattern string, cursor uint64, count int) ([]string, uint64, error) {
+	return pageScannedKeys(s, pattern, cursor, count)
+}
+
+// Pins the reference stored under key. The value it refers to can still be
+// evicted, like any value shared by other keys.
+func (s *contentAddressedStorage) pin(key string) {
+	if ps, ok := pinnableStorageOf(s.Storage); ok {
+		ps.pin(key)
+	}
+}
+
+func (s *contentAddressedStorage) unpin(key string) {
+	if ps, ok := pinnableStorageOf(s.Storage); ok {
+		ps.unpin(key)
+	}
+}
+
+func (s *contentAddressedStorage) setUnpinHandler(fn func([]string)) {
+	if ps, ok := pinnableStorageOf(s.Storage); ok {
+		ps.setUnpinHandler(func(keys []string) {
+			var own []string
+			for _, k := range keys {
+				if !strings.HasPrefix(k, ContentKeyPrefix) {
+					own = append(own, k)
+				}
+			}
+			if len(own) > 0 {
+				fn(own)
+			}
+		})
+	}
+}
+
+// Reports deleted items with the value they referred to, or a nil value if
+// it was deleted before them (or by a Redis storage, which doesn't report
+// values). Content keys aren't reported.
+func (s *contentAddressedStorage) setExpireHandler(fn func(string, Item)) {
+	n, ok := expiryNotifierOf(s.Storage)
+	if !ok {
+		return
+	}
+	s.expiredMutex.Lock()
+	s.onExpire = fn
+	s.expiredMutex.Unlock()
+	n.setExpireHandler(func(k string, item Item) {
+		if strings.HasPrefix(k, ContentKeyPrefix) {
+			s.contentExpired(k, item.Object)
+		} else {
+			s.itemExpired(k, item)
+		}
+	})
+}
+
+func (s *contentAddressedStorage) itemExpired(k string, item Item) {
+	ref, ok := item.Object.(string)
+	if !ok {
+		s.onExpire(k, item)
+		return
+	}
+	s.RLock()
+	content, found := s.Storage.Get(ref)
+	s.RUnlock()
+	if found {
+		item.Object = content.Object
+		s.onExpire(k, item)
+		return
+	}
+	s.expiredMutex.Lock()
+	v, found := s.expiredContent[ref]
+	if !found && s.deleting > 0 {
+		s.waiting[ref] = append(s.waiting[ref], expiredItem{k, item})
+		s.expiredMutex.Unlock()
+		return
+	}
+	s.expiredMutex.Unlock()
+	item.Object = v
+	s.onExpire(k, item)
+}
+
+func (s *contentAddressedStorage) contentExpired(ref string, v interface{}) {
+	s.expiredMutex.Lock()
+	if s.deleting == 0 {
+		s.expiredMutex.Unlock()
+		return
+	}
+	s.expiredContent[ref] = v
+	waiting := s.waiting[ref]
+	delete(s.waiting, ref)
+	s.expiredMutex.Unlock()
+	for _, e := range waiting {
+		e.item.Object = v
+		s.onExpire(e.key, e.item)
+	}
+}
+
+// Deletes the expired items of the wrapped storage, if it has a janitor.
+// Items still waiting for their value when it returns had it deleted before.
+func (s *contentAddressedStorage) DeleteExpired() {
+	cs, ok := cleanableStorageOf(s.Storage)
+	if !ok {
+		return
+	}
+	s.expiredMutex.Lock()
+	if s.deleting == 0 {
+		s.expiredContent = make(map[string]interface{})
+		s.waiting = make(map[string][]expiredItem)
+	}
+	s.deleting++
+	s.expiredMutex.Unlock()
+	cs.DeleteExpired()
+	s.expiredMutex.Lock()
+	s.deleting--
+	var waiting map[string][]expiredItem
+	if s.deleting == 0 {
+		waiting = s.waiting
+		s.expiredContent, s.waiting = nil, nil
+	}
+	s.expiredMutex.Unlock()
+	for _, items := range waiting {
+		for _, e := range items {
+			e.item.Object = nil
+			s.onExpire(e.key, e.item)
+		}
+	}
+}
+
+// Deletes the keys one at a time, so that the values they share are released
+// as Del releases them.
+func (s *contentAddressedStorage) delMulti(keys []string) ([]string, error) {
+	return delEach(s, keys)
+}
+
+func (s *contentAddressedStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// Returns a storage that stores every value of s once, however many keys it's
+// set for: the value is stored under ContentKeyPrefix followed by the hash of
+// its type and contents (as JSON, for values other than []byte and string),
+// and each key only holds the content key. This saves the memory of values
+// shared by many keys, like HTML fragments rendered from a template, at the
+// cost of a second read for every Get, and of hashing every value set. A
+// value stays stored until the last of the items sharing it expires, even if
+// they are all deleted before, so values set without an expiration stay until
+// the storage is flushed. Content keys are left out of Keys, DeletePrefix and
+// OnExpire, which reports the values of expired items.
+func ContentAddressedStorage(s Storage) *contentAddressedStorage {
+	return &contentAddressedStorage{Storage: s}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Returns a deep copy of x made by encoding it with gob and decoding the
+// result into a new value of the same type, for SetCopyOnRead. Only exported
+// fields are copied, and the concrete types of values held in interfaces
+// must have been registered with gob.Register.
+func GobCopy(x interface{}) (interface{}, error) {
+	v := reflect.ValueOf(x)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).EncodeValue(v); err != nil {
+		return nil, err
+	}
+	p := reflect.New(v.Type())
+	if err := gob.NewDecoder(&buf).DecodeValue(p); err != nil {
+		return nil, err
+	}
+	return p.Elem().Interface(), nil
+}
+
+// Makes Get, GetObject, GetDetailed and Range return a copy of the value the
+// storage holds, made by clone (e.g. GobCopy), so that callers modifying the
+// values they get don't modify the cached ones or race with each other.
+// Values of types that can't be modified in place, like numbers and strings,
+// aren't copied. Values clone fails to copy are returned as is, and the error
+// is logged. Storages that decode values on every read, like Redis, don't
+// need it. nil stops copying.
+func (c *cache) SetCopyOnRead(clone func(x interface{}) (interface{}, error)) {
+	c.copyOnRead.Store(clone)
+}
+
+// Returns the value of k to give to the caller.
+func (c *cache) readValue(k string, x interface{}) interface{} {
+	c.checkMutation(k, x)
+	clone, _ := c.copyOnRead.Load().(func(interface{}) (interface{}, error))
+	if clone == nil || x == nil {
+		return x
+	}
+	switch reflect.TypeOf(x).Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Struct, reflect.Array, reflect.Interface:
+	default:
+		return x
+	}
+	y, err := clone(x)
+	if err != nil {
+		log.Errorf("error copying %s : %s", k, err)
+		return x
+	}
+	return y
+}
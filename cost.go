@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The costs of the items set with a cost, for the refresh priority of
+// expensive items (see SetRefreshCostThreshold).
+type costs struct {
+	mutex     sync.Mutex
+	keys      map[string]time.Duration
+	threshold int64 // a time.Duration, updated atomically
+}
+
+// Like Set, but records cost, how long producing x took, so that expensive
+// items are kept over cheap ones when the storage evicts items (see
+// MemoryOptions.CostWeight) and refreshed first when the refresh workers
+// can't keep up (see SetRefreshCostThreshold). Fetch records the duration of
+// its loader this way.
+func (c *cache) SetWithCost(k string, x interface{}, d time.Duration, rd time.Duration, cost time.Duration) {
+	if err := c.validate(k, x); err != nil {
+		log.Errorf("error setting %s : %s", k, err)
+		return
+	}
+	if c.bypassWrites() {
+		c.Delete(k)
+		return
+	}
+	item := c.newItem(k, x, d, rd)
+	item.Cost = cost
+	c.storage.Lock()
+	if !c.admit(k) {
+		c.storage.Unlock()
+		return
+	}
+	c.storage.Set(k, item)
+	c.written(k, item)
+	c.storage.Unlock()
+}
+
+// Makes the keys whose item cost at least d to produce (see SetWithCost)
+// refreshed with RefreshPriorityHigh, unless they match a pattern given to
+// SetRefreshPriority. Zero, the default, disables it. Costs are recorded when
+// items are set through the cache, so the costs of items set by other
+// processes sharing the storage aren't known.
+func (c *cache) SetRefreshCostThreshold(d time.Duration) {
+	atomic.StoreInt64(&c.costs.threshold, int64(d))
+}
+
+// Returns whether the item of k cost at least the refresh cost threshold.
+func (c *cache) expensive(k string) bool {
+	threshold := time.Duration(atomic.LoadInt64(&c.costs.threshold))
+	if threshold <= 0 {
+		return false
+	}
+	c.costs.mutex.Lock()
+	cost := c.costs.keys[k]
+	c.costs.mutex.Unlock()
+	return cost >= threshold
+}
+
+func (c *cache) recordCost(k string, item Item) {
+	c.costs.mutex.Lock()
+	if item.Cost > 0 {
+		if c.costs.keys == nil {
+			c.costs.keys = make(map[string]time.Duration)
+		}
+		c.costs.keys[k] = item.Cost
+	} else {
+		delete(c.costs.keys, k)
+	}
+	c.costs.mutex.Unlock()
+}
+
+func (c *cache) forgetCost(k string) {
+	c.costs.mutex.Lock()
+	delete(c.costs.keys, k)
+	c.costs.mutex.Unlock()
+}
+
+func (c *cache) resetCosts() {
+	c.costs.mutex.Lock()
+	c.costs.keys = nil
+	c.costs.mutex.Unlock()
+}
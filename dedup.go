@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// The prefix of the keys Deduplicate caches responses under.
+	DedupKeyPrefix = "dedup"
+	// Requests with a bigger body are passed to the handler as they are.
+	DedupMaxBodySize = 1 << 20
+)
+
+// A response recorded by Deduplicate.
+type dedupResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// A 5xx response, shared by the concurrent requests that waited for it as a
+// Fetch error so that it isn't cached.
+type dedupFailure struct {
+	resp *dedupResponse
+}
+
+func (f dedupFailure) Error() string {
+	return http.StatusText(f.resp.Status)
+}
+
+// Returns a handler that serves identical concurrent requests with a single
+// call to next: requests with the same method, URL, Authorization and Cookie
+// headers and body share the response of the first one, which is then cached
+// in c for ttl (which is interpreted as the expiration of Set) so that retries
+// of the request get it too. Responses with a 5xx status are only shared with
+// the requests that waited for them, unless SetFailureTTL was called.
+// Requests with a body bigger than DedupMaxBodySize are passed to next as they
+// are. Handlers whose responses depend on other headers, or on anything but
+// the request, must not be deduplicated.
+func Deduplicate(c *Cache, ttl time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, DedupMaxBodySize+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(body) > DedupMaxBodySize {
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		h := sha256.New()
+		for _, s := range []string{r.Method, r.URL.RequestURI(), r.Header.Get("Authorization"), r.Header.Get("Cookie")} {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+		h.Write(body)
+		k := K(DedupKeyPrefix, hex.EncodeToString(h.Sum(nil))).String()
+
+		resp, err := fetchAs(c, k, ttl, func() (dedupResponse, error) {
+			rec := &dedupRecorder{resp: dedupResponse{Status: http.StatusOK, Header: make(http.Header)}}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(rec, r)
+			rec.resp.Body = rec.body.Bytes()
+			if rec.resp.Status >= 500 {
+				return dedupResponse{}, dedupFailure{&rec.resp}
+			}
+			return rec.resp, nil
+		})
+		var f dedupFailure
+		if errors.As(err, &f) {
+			resp = *f.resp
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for name, values := range resp.Header {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Body)
+	})
+}
+
+// Records the response of the handler called for the first of identical
+// requests.
+type dedupRecorder struct {
+	resp        dedupResponse
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (r *dedupRecorder) Header() http.Header {
+	return r.resp.Header
+}
+
+func (r *dedupRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.resp.Status = status
+		r.wroteHeader = true
+	}
+}
+
+func (r *dedupRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(b)
+}
@@ -0,0 +1,118 @@
+package cache
+
+// Implemented by storages that can delete several keys in one operation.
+// Returns the keys that were deleted, or weren't there, even when it fails
+// partway.
+type multiDeleter interface {
+	delMulti(keys []string) ([]string, error)
+}
+
+// Returns the storage s is or wraps that can delete several keys at once, if
+// any.
+func multiDeleterOf(s Storage) (multiDeleter, bool) {
+	return storageAs[multiDeleter](s)
+}
+
+// Delete the items of keys from the cache, taking the storage's lock once
+// rather than once per key as a loop of Deletes would, and with a single DEL
+// per batch of keys on Redis. Keys that aren't in the cache are ignored. If
+// the cache uses an invalidation bus, the deletions are broadcast in a single
+// message. Returns the error reported by the storage, if it reports errors
+// (see CheckedStorage), in which case some of the items may not have been
+// deleted; only those that were are forgotten and invalidated.
+func (c *cache) DeleteMulti(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	c.storage.Lock()
+	deleted, err := delMultiAs(c.storage, keys, nil)
+	for _, k := range deleted {
+		c.removed(k)
+		c.unpin(k)
+	}
+	c.storage.Unlock()
+	if len(deleted) > 0 {
+		c.invalidate(invalidation{Keys: deleted})
+	}
+	return err
+}
+
+// Deletes keys from s, which stores each key k under key(k) (or k itself if
+// key is nil), with delMulti if s can, and with delEach otherwise. Returns
+// the keys that were deleted, as given.
+func delMultiAs(s Storage, keys []string, key func(string) string) ([]string, error) {
+	stored := keys
+	var given map[string]string
+	if key != nil {
+		stored = make([]string, len(keys))
+		given = make(map[string]string, len(keys))
+		for i, k := range keys {
+			stored[i] = key(k)
+			given[stored[i]] = k
+		}
+	}
+	var deleted []string
+	var err error
+	if md, ok := multiDeleterOf(s); ok {
+		deleted, err = md.delMulti(stored)
+	} else {
+		deleted, err = delEach(s, stored)
+	}
+	if key != nil {
+		for i, k := range deleted {
+			deleted[i] = given[k]
+		}
+	}
+	return deleted, err
+}
+
+// Deletes keys from s one at a time, stopping at the first error. Returns the
+// keys that were deleted.
+func delEach(s Storage, keys []string) ([]string, error) {
+	for i, k := range keys {
+		if err := tryDel(s, k); err != nil {
+			return keys[:i], err
+		}
+	}
+	return keys, nil
+}
+
+func (s *redisStorage) delMulti(keys []string) ([]string, error) {
+	done := 0
+	for done < len(keys) {
+		n := len(keys) - done
+		if n > redisFlushBatchSize {
+			n = redisFlushBatchSize
+		}
+		batch := make([]string, n)
+		for i, k := range keys[done : done+n] {
+			batch[i] = s.key(k)
+		}
+		if err := s.redisClient.Del(batch...).Err(); err != nil {
+			return keys[:done], err
+		}
+		done += n
+	}
+	return keys, nil
+}
+
+// Deletes the keys of each node with a single DEL per batch.
+func (s *shardedRedisStorage) delMulti(keys []string) ([]string, error) {
+	byNode := make(map[*redisStorage][]string)
+	for _, k := range keys {
+		n := s.node(k)
+		if n == nil {
+			return nil, errNoHealthyNode
+		}
+		byNode[n] = append(byNode[n], k)
+	}
+	var deleted []string
+	for n, keys := range byNode {
+		d, err := n.delMulti(keys)
+		deleted = append(deleted, d...)
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
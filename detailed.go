@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"time"
+)
+
+// Where GetDetailed found an item.
+type Source int
+
+const (
+	// The cache's storage, when it isn't tiered.
+	SourceStorage Source = iota
+	// The memory tier of a TieredStorage.
+	SourceL1
+	// The remote tier of a TieredStorage.
+	SourceL2
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceL1:
+		return "L1"
+	case SourceL2:
+		return "L2"
+	}
+	return "storage"
+}
+
+// How fresh an item returned by GetDetailed is.
+type Meta struct {
+	// How long ago the item was set, or 0 if the storage doesn't keep it
+	// (see Item.CreatedAt).
+	Age time.Duration
+	// How long until the item expires, or NoExpiration.
+	TTL time.Duration
+	// Whether the item has reached its refresh deadline, and whether it's
+	// queued for a refresh or being refreshed.
+	RefreshDue bool
+	Refreshing bool
+	Source     Source
+	// The item's refresh deadline, as a Unix time in nanoseconds, or 0 if it
+	// has none (as in Item).
+	RefreshDeadline int64
+}
+
+// Implemented by storages that can tell where they found an item.
+type sourceReader interface {
+	getWithSource(key string) (Item, bool, Source, error)
+}
+
+// Like Get, but also returns how fresh the value is, e.g. for an
+// "X-Cache: HIT; age=12" header.
+func (c *cache) GetDetailed(k string) (interface{}, Meta, bool) {
+	if c.bypassReads() {
+		return nil, Meta{}, false
+	}
+	var meta Meta
+	c.storage.RLock()
+	var item Item
+	var found bool
+	if sr, ok := c.storage.(sourceReader); ok {
+		item, found, meta.Source, _ = sr.getWithSource(k)
+	} else {
+		item, found = c.storage.Get(k)
+	}
+	now := timeNow().UnixNano()
+	if !found || (item.Expiration > 0 && now > item.Expiration) {
+		c.storage.RUnlock()
+		c.countKey(k, MetricMisses, 1)
+		return nil, Meta{}, false
+	}
+	if t, ok := c.storage.(accessTracker); ok {
+		t.touch(k)
+	}
+	c.storage.RUnlock()
+	c.countKey(k, MetricHits, 1)
+	if item.CreatedAt > 0 {
+		meta.Age = time.Duration(now - item.CreatedAt)
+	}
+	meta.TTL = NoExpiration
+	if item.Expiration > 0 {
+		meta.TTL = time.Duration(item.Expiration - now)
+	}
+	meta.RefreshDeadline = item.RefreshDeadline
+	if item.RefreshDeadline > 0 && c.refreshDue(k, item.RefreshDeadline) {
+		meta.RefreshDue = true
+		c.queueRefresh(k)
+	}
+	c.refreshConcurrencyMutex.Lock()
+	meta.Refreshing = c.refreshConcurrencyMap[k]
+	c.refreshConcurrencyMutex.Unlock()
+	return c.readValue(k, item.Object), meta, true
+}
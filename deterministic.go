@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Makes the cache behave predictably in tests, or back: while on, Range
+// lists the items in key order, and the keys queued for a refresh aren't
+// refreshed by the refresh workers but by the next call to Advance. Create
+// the cache with a cleanup interval of 0 so that no janitor runs either.
+func (c *cache) SetDeterministic(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.deterministic, v)
+}
+
+func (c *cache) isDeterministic() bool {
+	return atomic.LoadInt32(&c.deterministic) != 0
+}
+
+// Queues k for the next call to Advance. Returns false if the cache isn't
+// deterministic.
+func (c *cache) deferRefresh(k string) bool {
+	if !c.isDeterministic() {
+		return false
+	}
+	c.deferredRefreshesMutex.Lock()
+	c.deferredRefreshes = append(c.deferredRefreshes, k)
+	c.deferredRefreshesMutex.Unlock()
+	return true
+}
+
+// Moves the clock forward by d, if it is a ManualClock (see SetClock), and
+// then does the work the background goroutines would have done in the
+// meantime: deletes the expired items, as the janitor does, and refreshes the
+// keys queued for a refresh, in the order they were queued. Refreshes run
+// before Advance returns, whether or not the cache is deterministic; keys
+// queued while they run are refreshed by the next call.
+func (c *cache) Advance(d time.Duration) {
+	if m, ok := currentClock().(*ManualClock); ok {
+		m.Advance(d)
+	}
+	if cs, ok := cleanableStorageOf(c.storage); ok {
+		cs.DeleteExpired()
+	}
+	c.deferredRefreshesMutex.Lock()
+	keys := c.deferredRefreshes
+	c.deferredRefreshes = nil
+	c.deferredRefreshesMutex.Unlock()
+	for _, k := range keys {
+		atomic.AddInt64(&c.refresh.queued, -1)
+		c.refreshKey(k)
+	}
+}
+
+// Calls fn with the key and value of every item that hasn't expired, until it
+// returns false. The items are read first, so fn can modify the cache. The
+// order is the storage's, or the order of the keys if the cache is
+// deterministic (see SetDeterministic).
+func (c *cache) Range(fn func(k string, x interface{}) bool) error {
+	ks, ok := keyScannerOf(c.storage)
+	if !ok {
+		return newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	c.storage.RLock()
+	var keys []string
+	if err := ks.scanKeys("", func(k string) {
+		keys = append(keys, k)
+	}); err != nil {
+		c.storage.RUnlock()
+		return err
+	}
+	if c.isDeterministic() {
+		sort.Strings(keys)
+	}
+	items := make([]keyAndValue, 0, len(keys))
+	for _, k := range keys {
+		item, found, err := tryGet(c.storage, k)
+		if err != nil {
+			c.storage.RUnlock()
+			return err
+		}
+		if found && !item.Expired() {
+			items = append(items, keyAndValue{k, c.readValue(k, item.Object)})
+		}
+	}
+	c.storage.RUnlock()
+	for _, kv := range items {
+		if !fn(kv.key, kv.value) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of errors returned by the cache. The errors returned wrap one of
+// them, so that callers can check for it with errors.Is rather than by
+// matching the message.
+var (
+	// The key has no item, or its item has expired.
+	ErrNotFound = errors.New("item not found")
+	// The key already has an item, e.g. for Add.
+	ErrKeyExists = errors.New("item already exists")
+	// The item's value doesn't have the type the operation needs, e.g. for
+	// Increment.
+	ErrWrongType = errors.New("wrong value type")
+	// The storage can't be used at the moment: its circuit breaker is open,
+	// none of its nodes is healthy, or an operation timed out.
+	ErrStorageUnavailable = errors.New("storage unavailable")
+	// The storage doesn't support the operation, e.g. listing keys.
+	ErrNotSupported = errors.New("not supported by this storage")
+	// The value was rejected by the validator set with SetValidator.
+	ErrInvalidValue = errors.New("invalid value")
+	// The expiration or refresh deadline doesn't make sense, e.g. a refresh
+	// deadline after the expiration (see SetWithTTLs).
+	ErrInvalidDuration = errors.New("invalid duration")
+)
+
+// An error with its own message that wraps one of the kinds of errors above.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// Returns an error of the given kind, with the message formatted like
+// fmt.Errorf's.
+func newError(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// The ETags of the []byte and string values set, once enabled with SetETags.
+type etags struct {
+	mutex sync.Mutex
+	tags  map[string]etag // nil when disabled
+}
+
+type etag struct {
+	tag        string
+	expiration int64
+}
+
+// Makes the cache compute a strong ETag for every []byte and string value set
+// through it (with SetBytes, SetString, Set and the like), for ETag to return,
+// or stop it and forget the ETags computed.
+func (c *cache) SetETags(on bool) {
+	c.etags.mutex.Lock()
+	if on && c.etags.tags == nil {
+		c.etags.tags = make(map[string]etag)
+	} else if !on {
+		c.etags.tags = nil
+	}
+	c.etags.mutex.Unlock()
+}
+
+// Returns the ETag of the value last set for k, quoted as in an ETag header,
+// for conditional responses that don't have to read the value. Returns false
+// if ETags aren't enabled (see SetETags), if the value isn't a []byte or a
+// string, or if the item was set by another process, deleted, evicted or has
+// expired.
+func (c *cache) ETag(k string) (string, bool) {
+	c.etags.mutex.Lock()
+	t, found := c.etags.tags[k]
+	c.etags.mutex.Unlock()
+	if !found || (t.expiration > 0 && timeNow().UnixNano() > t.expiration) {
+		return "", false
+	}
+	return t.tag, true
+}
+
+// Returns the strong ETag of b: the quoted hex of the first 16 bytes of its
+// SHA-256.
+func computeETag(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func (c *cache) recordETag(k string, item Item) {
+	c.etags.mutex.Lock()
+	defer c.etags.mutex.Unlock()
+	if c.etags.tags == nil {
+		return
+	}
+	switch v := item.Object.(type) {
+	case []byte:
+		c.etags.tags[k] = etag{computeETag(v), item.Expiration}
+	case string:
+		c.etags.tags[k] = etag{computeETag([]byte(v)), item.Expiration}
+	default:
+		delete(c.etags.tags, k)
+	}
+}
+
+func (c *cache) forgetETag(k string) {
+	c.etags.mutex.Lock()
+	delete(c.etags.tags, k)
+	c.etags.mutex.Unlock()
+}
+
+func (c *cache) resetETags() {
+	c.etags.mutex.Lock()
+	if c.etags.tags != nil {
+		c.etags.tags = make(map[string]etag)
+	}
+	c.etags.mutex.Unlock()
+}
@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A change to a key under an EtcdStorage's prefix, as seen by a watch.
+type EtcdEvent struct {
+	Key     string // without the prefix
+	Deleted bool   // deleted, or its lease expired, rather than put
+}
+
+// The operations of an etcd client used by EtcdStorage, e.g. a small adapter
+// around go.etcd.io/etcd/client/v3 (Grant, Put with WithLease, Get, Delete
+// with WithPrefix, and Watch with WithPrefix).
+type EtcdKV interface {
+	// Grants a lease expiring after ttl seconds and returns its ID.
+	Grant(ctx context.Context, ttl int64) (int64, error)
+	// Puts value at key, attached to the lease if it isn't 0.
+	Put(ctx context.Context, key string, value []byte, lease int64) error
+	// Returns the value at key, and whether there is one.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Deletes key, or every key starting with it if prefix is true.
+	Delete(ctx context.Context, key string, prefix bool) error
+	// Sends the changes to the keys starting with prefix until ctx is done.
+	Watch(ctx context.Context, prefix string) <-chan EtcdEvent
+}
+
+type etcdStorage struct {
+	kv         EtcdKV
+	prefix     string
+	timeout    time.Duration
+	marshaller *jsonCodec
+	mutex      sync.Mutex
+	// Stops the watch started by OnChange.
+	watchMutex sync.Mutex
+	stopWatch  context.CancelFunc
+	// The leases of the items expiring in each second, by Unix time.
+	leaseMutex sync.Mutex
+	leases     map[int64]int64
+}
+
+func (s *etcdStorage) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *etcdStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *etcdStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *etcdStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *etcdStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *etcdStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+// Values are stored as "exp|rd|json", as in Redis storages, and decoded into
+// o, or, if o is nil, into maps, slices, strings, float64s and bools.
+func (s *etcdStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	b, found, err := s.kv.Get(ctx, s.prefix+key)
+	if !found || err != nil {
+		return Item{}, false, err
+	}
+	parts := bytes.SplitN(b, []byte("|"), 3)
+	if len(parts) != 3 {
+		return Item{}, false, fmt.Errorf("Invalid value for %s", key)
+	}
+	var item Item
+	item.Expiration, _ = strconv.ParseInt(string(parts[0]), 10, 64)
+	item.RefreshDeadline, _ = strconv.ParseInt(string(parts[1]), 10, 64)
+	if item.Object, err = s.marshaller.DecodeValue(parts[2], o); err != nil {
+		return Item{}, false, err
+	}
+	return item, true, nil
+}
+
+// Items that expire are attached to a lease, so that etcd deletes them. Lease
+// TTLs are whole seconds, rounded up, and items expiring in the same second
+// share a lease, so that writing a key again doesn't leave a lease behind.
+func (s *etcdStorage) TrySet(key string, item Item) error {
+	b, err := s.marshaller.Marshal(item.Object)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%d|%d|", item.Expiration, item.RefreshDeadline))
+	buf.Write(b)
+	ctx, cancel := s.context()
+	defer cancel()
+	var lease int64
+	if item.Expiration > 0 {
+		d := time.Unix(0, item.Expiration).Sub(timeNow())
+		if d <= 0 {
+			return s.kv.Delete(ctx, s.prefix+key, false)
+		}
+		if lease, err = s.lease(ctx, item.Expiration); err != nil {
+			return err
+		}
+	}
+	return s.kv.Put(ctx, s.prefix+key, buf.Bytes(), lease)
+}
+
+// Returns the lease of the items expiring at e, rounded up to the second,
+// granting it if there isn't one yet. The leases of the seconds gone by are
+// forgotten, since etcd has revoked them.
+func (s *etcdStorage) lease(ctx context.Context, e int64) (int64, error) {
+	sec := (e + int64(time.Second) - 1) / int64(time.Second)
+	s.leaseMutex.Lock()
+	defer s.leaseMutex.Unlock()
+	if id, found := s.leases[sec]; found {
+		return id, nil
+	}
+	now := timeNow().Unix()
+	for t := range s.leases {
+		if t <= now {
+			delete(s.leases, t)
+		}
+	}
+	id, err := s.kv.Grant(ctx, sec-now)
+	if err != nil {
+		return 0, err
+	}
+	s.leases[sec] = id
+	return id, nil
+}
+
+func (s *etcdStorage) TryDel(key string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.kv.Delete(ctx, s.prefix+key, false)
+}
+
+// Deletes every key under the storage's prefix.
+func (s *etcdStorage) Flush() {
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.kv.Delete(ctx, s.prefix, true); err != nil {
+		log.Errorf("error flushing : %s", err)
+	}
+}
+
+// Calls fn, in a goroutine of its own, with every key under the storage's
+// prefix that is put or deleted by any process, including when its lease
+// expires, e.g. to invalidate copies of the items cached in memory. Replaces
+// the function set by a previous call; a nil fn stops the watch.
+func (s *etcdStorage) OnChange(fn func(key string, deleted bool)) {
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
+	}
+	if fn == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWatch = cancel
+	events := s.kv.Watch(ctx, s.prefix)
+	go func() {
+		for e := range events {
+			fn(strings.TrimPrefix(e.Key, s.prefix), e.Deleted)
+		}
+	}()
+}
+
+// Lock only excludes other goroutines in this process.
+func (s *etcdStorage) Lock() {
+	s.mutex.Lock()
+}
+
+func (s *etcdStorage) Unlock() {
+	s.mutex.Unlock()
+}
+
+func (s *etcdStorage) RLock() {
+	// nothing to do
+}
+
+func (s *etcdStorage) RUnlock() {
+	// nothing to do
+}
+
+func (s *etcdStorage) Type() int {
+	return STORAGE_TYPE_REMOTE
+}
+
+func (s *etcdStorage) reportStats(st *Stats) {
+	s.marshaller.reportStats(st)
+}
+
+// Returns a storage that keeps items in etcd under prefix, waiting up to
+// timeout (or 1 second, if it's 0) for each request. Items that expire are
+// attached to leases, so etcd deletes them itself; etcd is meant for small
+// values, such as configuration.
+func EtcdStorage(kv EtcdKV, prefix string, timeout time.Duration) *etcdStorage {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &etcdStorage{
+		kv:         kv,
+		prefix:     prefix,
+		timeout:    timeout,
+		marshaller: newJSONCodec(),
+		leases:     make(map[int64]int64),
+	}
+}
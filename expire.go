@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+)
+
+// Implemented by storages that report the items they delete because they
+// expired or were evicted.
+type expiryNotifier interface {
+	// Sets the function called with each such item. Called with the lock
+	// held.
+	setExpireHandler(func(key string, item Item))
+}
+
+type expireCallback struct {
+	pattern string
+	fn      func(string, interface{})
+}
+
+// The callbacks registered with OnExpire.
+type expireCallbacks struct {
+	mutex     sync.RWMutex
+	callbacks []expireCallback
+}
+
+// Returns true if k is pattern, or starts with pattern without its trailing
+// "*" if it has one.
+func matchKeyPattern(pattern, k string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(k, pattern[:len(pattern)-1])
+	}
+	return k == pattern
+}
+
+func (e *expireCallbacks) expired(k string, item Item) {
+	e.mutex.RLock()
+	callbacks := e.callbacks
+	e.mutex.RUnlock()
+	for _, cb := range callbacks {
+		if matchKeyPattern(cb.pattern, k) {
+			cb.fn(k, item.Object)
+		}
+	}
+}
+
+// Registers a function called with the key and value of the items matching
+// pattern when they expire or are evicted: pattern is either a key, or a
+// prefix followed by "*", e.g. "session:*". In memory storages, expired items
+// are deleted, and fn called, by the janitor, so the cache must have a cleanup
+// interval; Redis storages use keyspace notifications instead. fn is
+// never called while the cache is locked, so it can use the cache. Only
+// storages that report deleted items support it; the others return an
+// ErrNotSupported error.
+func (c *cache) OnExpire(pattern string, fn func(string, interface{})) error {
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	if c.expireCallbacks == nil {
+		n, ok := expiryNotifierOf(c.storage)
+		if !ok {
+			return newError(ErrNotSupported, "Expiration callbacks are not supported by this storage")
+		}
+		c.expireCallbacks = &expireCallbacks{}
+		n.setExpireHandler(c.expired)
+	}
+	e := c.expireCallbacks
+	e.mutex.Lock()
+	// Copied, so that expired can range over the old slice without the lock.
+	e.callbacks = append(e.callbacks[:len(e.callbacks):len(e.callbacks)], expireCallback{pattern, fn})
+	e.mutex.Unlock()
+	return nil
+}
+
+// Called by the storage, without the lock held, with each item it deleted
+// because it expired or was evicted. Forgets what the cache kept track of for
+// the item (see removed), unless k has been set again since, and calls the
+// OnExpire callbacks. New installs it for the storages that report deleted
+// items by themselves, and OnExpire for Redis storages, which have to
+// subscribe to keyspace notifications.
+func (c *cache) expired(k string, item Item) {
+	c.storage.Lock()
+	if _, found := c.storage.Get(k); !found {
+		c.releaseQuota(k)
+		c.forgetChecksum(k)
+		c.forgetETag(k)
+		c.forgetCost(k)
+	}
+	e := c.expireCallbacks
+	c.storage.Unlock()
+	if e != nil {
+		e.expired(k, item)
+	}
+}
+
+// Returns the storage s is or wraps that reports deleted items, if any.
+// Decorators that store items under other keys than their own translate the
+// keys reported by the storage they wrap, so they only count if it reports
+// them.
+func expiryNotifierOf(s Storage) (expiryNotifier, bool) {
+	n, ok := storageAs[expiryNotifier](s)
+	if w, wraps := n.(wrappedStorage); ok && wraps {
+		if _, ok := expiryNotifierOf(w.Unwrap()); !ok {
+			return nil, false
+		}
+	}
+	return n, ok
+}
@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How often a fallback storage tries to copy the writes it has sent to the
+// secondary storage back to the primary.
+const fallbackRepairInterval = time.Second
+
+type fallbackStorage struct {
+	Storage   // the primary
+	secondary Storage
+	mutex     sync.Mutex // guards pending
+	pending   map[string]bool
+	stop      chan bool
+}
+
+func (s *fallbackStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *fallbackStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *fallbackStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *fallbackStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *fallbackStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+// Keys written to the secondary are read from it until they are repaired,
+// even once the primary is back, since the primary has their older value.
+func (s *fallbackStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	s.mutex.Lock()
+	pending := s.pending[key]
+	s.mutex.Unlock()
+	if !pending {
+		item, found, err := tryGetObject(s.Storage, key, o)
+		if err == nil {
+			return item, found, nil
+		}
+	}
+	s.secondary.RLock()
+	item, found, err := tryGetObject(s.secondary, key, o)
+	s.secondary.RUnlock()
+	return item, found, err
+}
+
+func (s *fallbackStorage) TrySet(key string, item Item) error {
+	if err := trySet(s.Storage, key, item); err != nil {
+		return s.fallBack(key, func() error {
+			return trySet(s.secondary, key, item)
+		})
+	}
+	s.repaired(key)
+	return nil
+}
+
+func (s *fallbackStorage) TryDel(key string) error {
+	if err := tryDel(s.Storage, key); err != nil {
+		return s.fallBack(key, func() error {
+			return tryDel(s.secondary, key)
+		})
+	}
+	s.repaired(key)
+	return nil
+}
+
+// Applies a write that failed on the primary to the secondary, and marks the
+// key for repair.
+func (s *fallbackStorage) fallBack(key string, write func() error) error {
+	s.secondary.Lock()
+	err := write()
+	s.secondary.Unlock()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.pending[key] = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// Forgets a key marked for repair once the primary has been written to
+// directly, so that a stale copy isn't served from the secondary or copied
+// back later.
+func (s *fallbackStorage) repaired(key string) {
+	s.mutex.Lock()
+	pending := s.pending[key]
+	delete(s.pending, key)
+	s.mutex.Unlock()
+	if pending {
+		s.secondary.Lock()
+		tryDel(s.secondary, key)
+		s.secondary.Unlock()
+	}
+}
+
+// Copies the keys written to the secondary back to the primary: the items
+// still in the secondary are set, and the others (deleted while the primary
+// was failing) are deleted. Stops at the first failure, since the primary is
+// then probably still unavailable.
+func (s *fallbackStorage) repair() {
+	s.mutex.Lock()
+	keys := make([]string, 0, len(s.pending))
+	for k := range s.pending {
+		keys = append(keys, k)
+	}
+	s.mutex.Unlock()
+	for _, k := range keys {
+		s.Storage.Lock()
+		s.secondary.Lock()
+		item, found, err := tryGet(s.secondary, k)
+		if err == nil {
+			if found {
+				err = trySet(s.Storage, k, item)
+			} else {
+				err = tryDel(s.Storage, k)
+			}
+		}
+		if err == nil {
+			tryDel(s.secondary, k)
+			s.mutex.Lock()
+			delete(s.pending, k)
+			s.mutex.Unlock()
+		}
+		s.secondary.Unlock()
+		s.Storage.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *fallbackStorage) runRepairs() {
+	ticker := time.NewTicker(fallbackRepairInterval)
+	for {
+		select {
+		case <-ticker.C:
+			s.repair()
+		case <-s.stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (s *fallbackStorage) Flush() {
+	s.Storage.Flush()
+	s.secondary.Flush()
+	s.mutex.Lock()
+	s.pending = make(map[string]bool)
+	s.mutex.Unlock()
+}
+
+// Stops copying writes back to the primary.
+func (s *fallbackStorage) Close() {
+	close(s.stop)
+}
+
+// Deletes the keys one at a time, so that deletions fall back as Del's do.
+func (s *fallbackStorage) delMulti(keys []string) ([]string, error) {
+	return delEach(s, keys)
+}
+
+func (s *fallbackStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+func (s *fallbackStorage) reportStats(st *Stats) {
+	s.mutex.Lock()
+	st.FallbackPending = len(s.pending)
+	s.mutex.Unlock()
+}
+
+// Returns a storage that uses primary, and secondary whenever an operation on
+// primary fails, e.g. a memory storage standing in for Redis during a
+// maintenance window. Writes that went to the secondary are copied back to the
+// primary in the background once it is available again. Only primaries that
+// report their errors (see CheckedStorage) ever fall back. The primary's lock
+// is used for Lock and Unlock, so a primary with a distributed lock should be
+// wrapped in a BreakerStorage for writes not to wait on it while it's down.
+func FallbackStorage(primary, secondary Storage) *fallbackStorage {
+	s := &fallbackStorage{
+		Storage:   primary,
+		secondary: secondary,
+		pending:   make(map[string]bool),
+		stop:      make(chan bool),
+	}
+	go s.runRepairs()
+	return s
+}
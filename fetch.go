@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Matches, with errors.Is, the errors of loaders cached by Fetch and GetFresh
+// (see SetFailureTTL).
+var ErrCachedFailure = errors.New("cached failure")
+
+// The error of a loader, cached in place of the value. Get returns it as the
+// value of the key. Since it can't be encoded, it's only cached by storages
+// that keep values as they are (see failureKeeper).
+type cachedFailure struct {
+	err error
+}
+
+func (f cachedFailure) Error() string {
+	return "cached failure: " + f.err.Error()
+}
+
+// Returns the loader's error.
+func (f cachedFailure) Unwrap() error {
+	return f.err
+}
+
+func (f cachedFailure) Is(target error) bool {
+	return target == ErrCachedFailure
+}
+
+// Implemented by storages that keep values without encoding them, and so can
+// cache the errors of loaders.
+type failureKeeper interface {
+	keepsFailures()
+}
+
+func (s *memoryStorage) keepsFailures() {}
+
+// Caches the errors of the loaders of Fetch and GetFresh for d, so that a
+// failing source isn't called on every read: until the error expires, Fetch
+// returns it, wrapped in an error matching ErrCachedFailure, without calling
+// its loader, and Get returns that error as the value. Zero, the default,
+// means errors aren't cached. Errors are only cached on MemoryStorage: other
+// storages encode values, which would lose the error or make it read back as
+// an ordinary value.
+func (c *cache) SetFailureTTL(d time.Duration) {
+	atomic.StoreInt64(&c.failureTTL, int64(d))
+}
+
+// A call to a Fetch loader, shared by the concurrent calls for its key.
+type fetchCall struct {
+	done  chan bool
+	fresh bool // started by GetFresh
+	value interface{}
+	err   error
+}
+
+// Returns the value of k, loading it with loader and setting it with the
+// expiration d and refresh deadline rd if it isn't cached. Concurrent calls
+// for a missing key share a single call to loader, whose duration is recorded
+// as the cost of the value (see SetWithCost). If loader fails, its error is
+// returned, and cached only if SetFailureTTL was called.
+func (c *cache) Fetch(k string, loader func() (interface{}, error), d time.Duration, rd time.Duration) (interface{}, error) {
+	if v, found := c.Get(k); found {
+		return fetched(v)
+	}
+	return c.load(k, loader, d, rd, false)
+}
+
+// Like Fetch, but always calls loader and replaces the cached value, e.g. when
+// a user asks for fresh data. Other readers keep getting the cached value
+// until it's replaced, rather than all missing and loading it as after a
+// Delete, and Fetch calls for k wait for the new value. Concurrent GetFresh
+// calls share a call to loader, but don't wait for one started by Fetch
+// before they were called.
+func (c *cache) GetFresh(k string, loader func() (interface{}, error), d time.Duration, rd time.Duration) (interface{}, error) {
+	return c.load(k, loader, d, rd, true)
+}
+
+// Like Fetch, but returns when ctx is done instead of waiting for loader. If
+// the cached item has reached its refresh deadline, or has expired but is
+// still in the storage, loader is called to replace it, and its stale value
+// is returned if loader doesn't return before ctx is done, or fails; the call
+// goes on in the background and sets the new value once it returns. Without a
+// stale value, ctx's error is returned. loader isn't given ctx, since it's
+// meant to finish anyway.
+func (c *cache) FetchWithDeadline(ctx context.Context, k string, loader func() (interface{}, error), d time.Duration, rd time.Duration) (interface{}, error) {
+	c.storage.RLock()
+	item, found := c.storage.Get(k)
+	c.storage.RUnlock()
+	stale := found && (item.Expired() || (item.RefreshDeadline > 0 && timeNow().UnixNano() > item.RefreshDeadline))
+	if found && !stale {
+		return fetched(c.readValue(k, item.Object))
+	}
+	type result struct {
+		v   interface{}
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		v, err := c.load(k, loader, d, rd, stale)
+		results <- result{v, err}
+	}()
+	select {
+	case r := <-results:
+		if r.err == nil || !stale {
+			return r.v, r.err
+		}
+		log.Errorf("error refreshing %s : %s", k, r.err)
+	case <-ctx.Done():
+		if !stale {
+			return nil, ctx.Err()
+		}
+	}
+	return fetched(c.readValue(k, item.Object))
+}
+
+func (c *cache) load(k string, loader func() (interface{}, error), d time.Duration, rd time.Duration, fresh bool) (interface{}, error) {
+	if call, found := c.fetch(k, fresh); found {
+		<-call.done
+		return call.value, call.err
+	}
+	// The value may have been set by a call that finished after the caller
+	// missed. The storage is read without fetchesMutex, so that loads of
+	// other keys don't wait for it.
+	if !fresh {
+		if v, found := c.Get(k); found {
+			return fetched(v)
+		}
+	}
+	c.fetchesMutex.Lock()
+	if call, found := c.fetches[k]; found && (call.fresh || !fresh) {
+		c.fetchesMutex.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	// A call started by Fetch is replaced, so that its older value isn't set
+	// over this one; its callers still get it.
+	call := &fetchCall{done: make(chan bool), fresh: fresh}
+	if c.fetches == nil {
+		c.fetches = make(map[string]*fetchCall)
+	}
+	c.fetches[k] = call
+	c.fetchesMutex.Unlock()
+	// If loader panics, the callers waiting for it get an error and the next
+	// call for k loads it again; the panic goes on in this caller.
+	defer func() {
+		r := recover()
+		if r != nil {
+			call.value, call.err = nil, fmt.Errorf("panic loading %s : %v", k, r)
+		}
+		c.fetchesMutex.Lock()
+		if c.fetches[k] == call {
+			delete(c.fetches, k)
+		}
+		c.fetchesMutex.Unlock()
+		close(call.done)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	start := time.Now()
+	call.value, call.err = loader()
+	cost := time.Since(start)
+	// The call stays in fetches while its value is set, so that calls for k
+	// keep waiting for it rather than loading it again.
+	c.fetchesMutex.Lock()
+	replaced := c.fetches[k] != call
+	c.fetchesMutex.Unlock()
+	if replaced {
+		return call.value, call.err
+	}
+	if call.err == nil {
+		c.SetWithCost(k, call.value, d, rd, cost)
+	} else if ttl := time.Duration(atomic.LoadInt64(&c.failureTTL)); ttl > 0 {
+		if _, ok := c.storage.(failureKeeper); ok {
+			c.store(k, cachedFailure{call.err}, ttl, NoRefreshDeadline)
+		}
+	}
+	return call.value, call.err
+}
+
+// Returns the call loading k that a call for k should wait for, if any: any
+// call if fresh is false, and only a call loading a fresh value otherwise.
+func (c *cache) fetch(k string, fresh bool) (*fetchCall, bool) {
+	c.fetchesMutex.Lock()
+	defer c.fetchesMutex.Unlock()
+	call, found := c.fetches[k]
+	return call, found && (call.fresh || !fresh)
+}
+
+// Returns the value read by Fetch, or the loader's error if it's cached.
+func fetched(v interface{}) (interface{}, error) {
+	if f, ok := v.(cachedFailure); ok {
+		return nil, f
+	}
+	return v, nil
+}
+
+// Returns the values of the given keys that have an item, by key, as Get
+// returns them. Missing and expired keys are left out of the result.
+func (c *cache) GetMulti(keys []string) map[string]interface{} {
+	values := make(map[string]interface{}, len(keys))
+	for _, k := range keys {
+		if _, seen := values[k]; seen {
+			continue
+		}
+		if v, found := c.Get(k); found {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// Returns the values of the given keys, loading the missing ones with a single
+// call to loader, which is given the missing keys (each once) and returns the
+// values it found. The loaded values are set with the expiration d and
+// refresh deadline rd; keys loader doesn't return a value for are left out of
+// the result and not cached. If loader fails, the cached values are returned
+// along with its error.
+func (c *cache) FetchMulti(keys []string, loader func(missing []string) (map[string]interface{}, error), d time.Duration, rd time.Duration) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(keys))
+	var missing []string
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if v, found := c.Get(k); found {
+			values[k] = v
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+	loaded, err := loader(missing)
+	if err != nil {
+		return values, err
+	}
+	for _, k := range missing {
+		if v, found := loaded[k]; found {
+			c.Set(k, v, d, rd)
+			values[k] = v
+		}
+	}
+	return values, nil
+}
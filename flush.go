@@ -0,0 +1,145 @@
+package cache
+
+import (
+	redis "gopkg.in/redis.v4"
+)
+
+// Implemented by storages that can tell how many items a flush deleted.
+type countingFlusher interface {
+	flushCount() int
+}
+
+// Implemented by storages that can delete their items without making the
+// caller wait for them to be freed. The returned channel receives the number
+// of items deleted once they are all gone.
+type asyncFlusher interface {
+	flushAsync() <-chan int
+}
+
+// Delete all items from the cache. Returns the number of items deleted, or -1
+// if the storage can't tell (only the memory, slab and Redis storages can).
+func (c *cache) Flush() int {
+	n := -1
+	if f, ok := c.storage.(countingFlusher); ok {
+		n = f.flushCount()
+	} else {
+		c.storage.Flush()
+	}
+	c.flushed()
+	return n
+}
+
+// Like Flush, but returns before the items are freed: the memory storages swap
+// in empty maps and leave the old ones to the garbage collector, and Redis
+// deletes the keys with UNLINK from a goroutine, so that flushing millions of
+// items doesn't stall the caller. Other storages are flushed from a goroutine.
+// The returned channel receives the number of items deleted (or -1, as for
+// Flush) once they are all gone. On Redis, items set before then may be
+// deleted too.
+func (c *cache) FlushAsync() <-chan int {
+	f, ok := c.storage.(asyncFlusher)
+	if !ok {
+		done := make(chan int, 1)
+		go func() {
+			done <- c.Flush()
+		}()
+		return done
+	}
+	done := f.flushAsync()
+	c.flushed()
+	return done
+}
+
+// Forgets everything the cache knows about its items once the storage has been
+// flushed, and tells the other instances.
+func (c *cache) flushed() {
+	c.forgetItems()
+	c.invalidate(invalidation{Flush: true})
+}
+
+// Forgets everything the cache knows about its items, e.g. once the storage
+// has been flushed by another instance.
+func (c *cache) forgetItems() {
+	c.resetQuotas()
+	c.resetPins()
+	c.resetChecksums()
+	c.resetETags()
+	c.resetCosts()
+	c.resetNamespaceGenerations()
+	c.resetTombstones()
+}
+
+func (s *memoryStorage) flushCount() int {
+	s.Lock()
+	n := len(s.items)
+	s.reset()
+	s.Unlock()
+	return n
+}
+
+// Swapping the maps is all a flush of a memory storage has to do, so there is
+// nothing left to wait for.
+func (s *memoryStorage) flushAsync() <-chan int {
+	done := make(chan int, 1)
+	done <- s.flushCount()
+	return done
+}
+
+func (s *slabStorage) flushCount() int {
+	s.Lock()
+	n := s.count()
+	s.reset()
+	s.Unlock()
+	return n
+}
+
+func (s *slabStorage) flushAsync() <-chan int {
+	done := make(chan int, 1)
+	done <- s.flushCount()
+	return done
+}
+
+func (s *redisStorage) flushCount() int {
+	return s.flushWith(s.redisClient.Del)
+}
+
+func (s *redisStorage) flushAsync() <-chan int {
+	done := make(chan int, 1)
+	go func() {
+		done <- s.flushWith(s.unlink)
+	}()
+	return done
+}
+
+// Deletes keys like DEL, but frees their values in a background thread of the
+// server (Redis 4.0 or later).
+func (s *redisStorage) unlink(keys ...string) *redis.IntCmd {
+	args := make([]interface{}, 1+len(keys))
+	args[0] = "unlink"
+	for i, k := range keys {
+		args[1+i] = k
+	}
+	cmd := redis.NewIntCmd(args...)
+	s.redisClient.Process(cmd)
+	return cmd
+}
+
+func (s *shardedRedisStorage) flushCount() int {
+	n := 0
+	for _, node := range s.nodes {
+		n += node.flushCount()
+	}
+	return n
+}
+
+func (s *shardedRedisStorage) flushAsync() <-chan int {
+	done := make(chan int, 1)
+	go func() {
+		n := 0
+		for _, node := range s.nodes {
+			n += <-node.flushAsync()
+		}
+		done <- n
+	}()
+	return done
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// The number of items expiring, and reaching their refresh deadline, in each
+// of the upcoming time buckets, as returned by ExpirationForecast.
+type Forecast struct {
+	// When the first bucket starts, and how long each bucket is.
+	Start       time.Time
+	BucketWidth time.Duration
+	// Number of items expiring in each bucket.
+	Expirations []int
+	// Number of items reaching their refresh deadline in each bucket,
+	// before they expire.
+	Refreshes []int
+	// Number of items expiring after the last bucket, and that never expire.
+	Later int
+	Never int
+}
+
+// Implemented by storages that can list the deadlines of their items
+// without decoding their values.
+type deadlineScanner interface {
+	// Calls fn with the expiration and refresh deadline of every item.
+	// Called with the read lock held.
+	scanDeadlines(fn func(e, rd int64))
+}
+
+// Returns how many of the items that haven't expired yet expire, and reach
+// their refresh deadline, in each of buckets equal buckets covering the next
+// window, e.g. to see the upcoming waves of misses and refreshes and spread
+// them out with SetRefreshSkew. Items expiring after the window are counted in
+// Later, and items that never expire in Never. Storages that can't list their items'
+// deadlines directly have every item read, which is slow on remote storages;
+// storages that can't list their keys return an error.
+func (c *cache) ExpirationForecast(window time.Duration, buckets int) (Forecast, error) {
+	if buckets < 1 {
+		buckets = 1
+	}
+	now := timeNow()
+	f := Forecast{
+		Start:       now,
+		BucketWidth: window / time.Duration(buckets),
+		Expirations: make([]int, buckets),
+		Refreshes:   make([]int, buckets),
+	}
+	start, end := now.UnixNano(), now.Add(window).UnixNano()
+	bucket := func(t int64) int {
+		if f.BucketWidth <= 0 || t < start || t >= end {
+			return -1
+		}
+		i := int((t - start) / int64(f.BucketWidth))
+		if i >= buckets {
+			i = buckets - 1
+		}
+		return i
+	}
+	count := func(e, rd int64) {
+		if e > 0 && e < start {
+			return
+		}
+		if rd > 0 && (e == 0 || rd < e) {
+			if i := bucket(rd); i >= 0 {
+				f.Refreshes[i]++
+			}
+		}
+		if e == 0 {
+			f.Never++
+		} else if i := bucket(e); i >= 0 {
+			f.Expirations[i]++
+		} else {
+			f.Later++
+		}
+	}
+	c.storage.RLock()
+	defer c.storage.RUnlock()
+	if ds, ok := deadlineScannerOf(c.storage); ok {
+		ds.scanDeadlines(count)
+		return f, nil
+	}
+	ks, ok := keyScannerOf(c.storage)
+	if !ok {
+		return Forecast{}, newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	var keys []string
+	if err := ks.scanKeys("", func(k string) {
+		keys = append(keys, k)
+	}); err != nil {
+		return Forecast{}, err
+	}
+	for _, k := range keys {
+		item, found, err := tryGet(c.storage, k)
+		if err != nil {
+			return Forecast{}, err
+		}
+		if found {
+			count(item.Expiration, item.RefreshDeadline)
+		}
+	}
+	return f, nil
+}
+
+// Returns the storage s is or wraps that can list its items' deadlines, if
+// any. Storages that change keys, like HashedKeysStorage, don't matter here.
+func deadlineScannerOf(s Storage) (deadlineScanner, bool) {
+	return storageAs[deadlineScanner](s)
+}
+
+func (s *memoryStorage) scanDeadlines(fn func(e, rd int64)) {
+	for _, item := range s.items {
+		fn(item.Expiration, item.RefreshDeadline)
+	}
+}
+
+func (s *slabStorage) scanDeadlines(fn func(e, rd int64)) {
+	s.each(func(b []byte) {
+		fn(int64(binary.LittleEndian.Uint64(b[0:])), int64(binary.LittleEndian.Uint64(b[8:])))
+	})
+}
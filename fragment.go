@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The prefix of the keys rendered fragments are cached under, followed by the
+// template name and a hash of the data.
+const FragmentKeyPrefix = "fragment"
+
+// A set of templates fragments are rendered with, such as a *template.Template
+// of html/template or text/template.
+type FragmentTemplate interface {
+	ExecuteTemplate(w io.Writer, name string, data interface{}) error
+}
+
+// Returns the template name of t rendered with data, caching the output for ttl
+// (which is interpreted as the expiration of SetBytes) under a key made of the
+// name and a hash of data's JSON, and its strong ETag. The data must be
+// encodable as JSON, and everything the output depends on must be in it.
+// Renders that fail aren't cached.
+func (c *cache) RenderFragment(t FragmentTemplate, name string, data interface{}, ttl time.Duration) ([]byte, string, error) {
+	k, err := fragmentKey(name, data)
+	if err != nil {
+		return nil, "", err
+	}
+	b, err := c.renderFragment(k, t, name, data, ttl)
+	if err != nil {
+		return nil, "", err
+	}
+	tag, found := c.ETag(k)
+	if !found {
+		tag = computeETag(b)
+	}
+	return b, tag, nil
+}
+
+// Writes the fragment RenderFragment returns to w, with its ETag header, or
+// answers 304 Not Modified if r's If-None-Match header has the ETag. When
+// ETags are enabled (see SetETags), a fragment the client already has isn't
+// even read from the storage. Returns the error rendering the fragment, in
+// which case nothing is written.
+func (c *cache) ServeFragment(w http.ResponseWriter, r *http.Request, t FragmentTemplate, name string, data interface{}, ttl time.Duration) error {
+	k, err := fragmentKey(name, data)
+	if err != nil {
+		return err
+	}
+	if tag, found := c.ETag(k); found && etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.Header().Set("ETag", tag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	b, tag, err := c.RenderFragment(t, name, data, ttl)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (c *cache) renderFragment(k string, t FragmentTemplate, name string, data interface{}, ttl time.Duration) ([]byte, error) {
+	if b, found := c.GetBytes(k); found {
+		return b, nil
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, err
+	}
+	c.SetBytes(k, buf.Bytes(), ttl, NoRefreshDeadline)
+	return buf.Bytes(), nil
+}
+
+func fragmentKey(name string, data interface{}) (string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", newError(ErrInvalidValue, "Invalid data for fragment %s : %s", name, err)
+	}
+	sum := sha256.Sum256(b)
+	return K(FragmentKeyPrefix, name, hex.EncodeToString(sum[:])).String(), nil
+}
+
+// Returns whether the If-None-Match header value header lists tag, or is *.
+// Weak ETags match their strong counterparts, as RFC 7232 specifies for
+// If-None-Match.
+func etagMatches(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
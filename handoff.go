@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Number of items copied under one read lock during a handoff.
+const handoffBatchSize = 256
+
+// An item sent during a handoff.
+type handoffEntry struct {
+	Key             string
+	Object          interface{}
+	Expiration      int64
+	RefreshDeadline int64
+	CreatedAt       int64
+	Cost            time.Duration
+	Metadata        map[string]string
+}
+
+// Listens on the unix socket at path and sends the cache's unexpired items to
+// every process calling ConnectHandoff with the same path, e.g. the new
+// process started by a zero-downtime deploy, so that it starts with a warm
+// cache. Values are sent with gob, so their types must be registered with
+// gob.Register, as must be done in the receiving process. The socket file is
+// replaced if it exists. Close the returned listener once the new process has
+// connected.
+func (c *cache) HandoffListener(path string) (net.Listener, error) {
+	if _, ok := keyScannerOf(c.storage); !ok {
+		return nil, newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := c.sendHandoff(conn); err != nil {
+					log.Errorf("error handing off the cache : %s", err)
+				}
+			}()
+		}
+	}()
+	return l, nil
+}
+
+func (c *cache) sendHandoff(w io.Writer) error {
+	ks, _ := keyScannerOf(c.storage)
+	var keys []string
+	c.storage.RLock()
+	err := ks.scanKeys("", func(k string) {
+		keys = append(keys, k)
+	})
+	c.storage.RUnlock()
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(w)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > handoffBatchSize {
+			batch = batch[:handoffBatchSize]
+		}
+		keys = keys[len(batch):]
+		entries := make([]handoffEntry, 0, len(batch))
+		c.storage.RLock()
+		for _, k := range batch {
+			if item, found := c.storage.Get(k); found && !item.Expired() {
+				entries = append(entries, handoffEntry{k, item.Object, item.Expiration, item.RefreshDeadline, item.CreatedAt, item.Cost, item.Metadata})
+			}
+		}
+		c.storage.RUnlock()
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Receives the items of the process listening with HandoffListener on the
+// unix socket at path, and adds them to the cache, replacing existing items,
+// as Set would: items rejected by the validator (see SetValidator) or the
+// admission policy are skipped, and the others count against their
+// namespace's quota. Items keep the time they were created at. Gives up after
+// timeout. Returns the number of items added, which are kept even if the
+// handoff fails halfway.
+func (c *cache) ConnectHandoff(path string, timeout time.Duration) (int, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	dec := gob.NewDecoder(conn)
+	n := 0
+	for {
+		var e handoffEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if err := c.validate(e.Key, e.Object); err != nil {
+			log.Errorf("error receiving %s : %s", e.Key, err)
+			continue
+		}
+		if e.CreatedAt == 0 {
+			e.CreatedAt = timeNow().UnixNano()
+		}
+		item := Item{
+			Object:          e.Object,
+			Expiration:      e.Expiration,
+			RefreshDeadline: e.RefreshDeadline,
+			CreatedAt:       e.CreatedAt,
+			Cost:            e.Cost,
+			Metadata:        e.Metadata,
+		}
+		c.storage.Lock()
+		if c.admit(e.Key) {
+			c.storage.Set(e.Key, item)
+			c.written(e.Key, item)
+			n++
+		}
+		c.storage.Unlock()
+	}
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"database/sql"
+	"encoding/binary"
+)
+
+// Implemented by storages that can tell whether a key has an item that hasn't
+// expired without reading and decoding its value.
+type presenceChecker interface {
+	has(key string) (bool, error)
+}
+
+// Returns true if k has an item that hasn't expired, including one whose value
+// is nil. Storages that decode values (such as Redis and the slab storage)
+// check for the key without decoding its value. Unlike Get, the check isn't
+// counted as an access and doesn't queue a refresh. Storage errors are
+// reported as false.
+func (c *cache) Has(k string) bool {
+	if c.bypassReads() {
+		return false
+	}
+	c.storage.RLock()
+	defer c.storage.RUnlock()
+	return storageHas(c.storage, k)
+}
+
+func storageHas(s Storage, k string) bool {
+	if pc, ok := s.(presenceChecker); ok {
+		found, err := pc.has(k)
+		return err == nil && found
+	}
+	item, found, err := tryGet(s, k)
+	return err == nil && found && !item.Expired()
+}
+
+func (s *slabStorage) has(key string) (bool, error) {
+	b, found := s.entry(key)
+	if !found {
+		return false, nil
+	}
+	e := int64(binary.LittleEndian.Uint64(b[0:]))
+	return e == 0 || timeNow().UnixNano() <= e, nil
+}
+
+// Items are stored with the TTL of their expiration, so Redis deletes them
+// once they expire.
+func (s *redisStorage) has(key string) (bool, error) {
+	return s.redisClient.Exists(s.key(key)).Result()
+}
+
+func (s *shardedRedisStorage) has(key string) (bool, error) {
+	n := s.node(key)
+	if n == nil {
+		return false, errNoHealthyNode
+	}
+	return n.has(key)
+}
+
+func (s *sqliteStorage) has(key string) (bool, error) {
+	var e int64
+	err := s.db.QueryRow(`SELECT expiration FROM go_cache_items WHERE key = ?`, key).Scan(&e)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return e == 0 || timeNow().UnixNano() <= e, nil
+}
+
+func (s *tieredStorage) has(key string) (bool, error) {
+	s.l1.RLock()
+	found := storageHas(s.l1, key)
+	s.l1.RUnlock()
+	if found {
+		return true, nil
+	}
+	if pc, ok := s.Storage.(presenceChecker); ok {
+		return pc.has(key)
+	}
+	item, found, err := tryGet(s.Storage, key)
+	return found && !item.Expired(), err
+}
@@ -0,0 +1,281 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+const (
+	// Keys longer than this are hashed by HashedKeysStorage unless
+	// HashKeysOptions.MaxKeyLen is set. It's memcached's key length limit.
+	DefaultMaxKeyLen = 250
+	// Hashed keys start with this prefix, followed by the hex encoded SHA-256
+	// of the original key.
+	HashedKeyPrefix = "sha256:"
+	// The original of a hashed key is kept in its item's metadata under this
+	// name, when HashKeysOptions.KeepOriginal is set.
+	OriginalKeyMetadata = "go_cache_original_key"
+)
+
+// Settings for HashedKeysStorage. The zero value gives the defaults.
+type HashKeysOptions struct {
+	// Keys longer than this many bytes are hashed. Defaults to
+	// DefaultMaxKeyLen.
+	MaxKeyLen int
+	// Also keep the original of every hashed key in its item's metadata, so
+	// that OriginalKey can tell what a hashed key stands for, and that Keys,
+	// DeletePrefix and OnExpire see the original keys. Only the storages that
+	// keep metadata (the memory and Redis storages) can keep it. Get leaves
+	// it out of the metadata it returns.
+	KeepOriginal bool
+}
+
+type hashedKeysStorage struct {
+	Storage
+	opts HashKeysOptions
+	// The originals of the hashed keys that are pinned, so that the storage
+	// can tell which ones it has deleted.
+	pinnedMutex sync.Mutex
+	pinned      map[string]string
+}
+
+// Returns the key the storage stores k under.
+func (s *hashedKeysStorage) hashKey(k string) string {
+	if len(k) <= s.opts.MaxKeyLen {
+		return k
+	}
+	sum := sha256.Sum256([]byte(k))
+	return HashedKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// Returns the item to store for key under h, with the original key in its
+// metadata if it's kept.
+func (s *hashedKeysStorage) withOriginal(key, h string, item Item) Item {
+	if !s.opts.KeepOriginal || h == key {
+		return item
+	}
+	m := make(map[string]string, len(item.Metadata)+1)
+	for name, v := range item.Metadata {
+		m[name] = v
+	}
+	m[OriginalKeyMetadata] = key
+	item.Metadata = m
+	return item
+}
+
+// Returns item without the original key in its metadata.
+func withoutOriginal(item Item) Item {
+	if _, kept := item.Metadata[OriginalKeyMetadata]; !kept {
+		return item
+	}
+	m := make(map[string]string, len(item.Metadata)-1)
+	for name, v := range item.Metadata {
+		if name != OriginalKeyMetadata {
+			m[name] = v
+		}
+	}
+	if len(m) == 0 {
+		m = nil
+	}
+	item.Metadata = m
+	return item
+}
+
+func (s *hashedKeysStorage) Get(key string) (Item, bool) {
+	item, found := s.Storage.Get(s.hashKey(key))
+	return withoutOriginal(item), found
+}
+
+func (s *hashedKeysStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found := s.Storage.GetObject(s.hashKey(key), o)
+	return withoutOriginal(item), found
+}
+
+func (s *hashedKeysStorage) Set(key string, item Item) {
+	h := s.hashKey(key)
+	s.Storage.Set(h, s.withOriginal(key, h, item))
+}
+
+func (s *hashedKeysStorage) Del(key string) {
+	s.Storage.Del(s.hashKey(key))
+}
+
+func (s *hashedKeysStorage) TryGet(key string) (Item, bool, error) {
+	item, found, err := tryGet(s.Storage, s.hashKey(key))
+	return withoutOriginal(item), found, err
+}
+
+func (s *hashedKeysStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	item, found, err := tryGetObject(s.Storage, s.hashKey(key), o)
+	return withoutOriginal(item), found, err
+}
+
+func (s *hashedKeysStorage) TrySet(key string, item Item) error {
+	h := s.hashKey(key)
+	return trySet(s.Storage, h, s.withOriginal(key, h, item))
+}
+
+func (s *hashedKeysStorage) TryDel(key string) error {
+	return tryDel(s.Storage, s.hashKey(key))
+}
+
+// Returns the original of a hashed key, if it's been kept (see
+// HashKeysOptions.KeepOriginal) and its item hasn't been deleted.
+func (s *hashedKeysStorage) OriginalKey(hashed string) (string, bool) {
+	s.RLock()
+	item, found := s.Storage.Get(hashed)
+	s.RUnlock()
+	if !found || item.Expired() {
+		return "", false
+	}
+	k, kept := item.Metadata[OriginalKeyMetadata]
+	return k, kept
+}
+
+// Returns the key whose item the wrapped storage stores under k, given the
+// item if it's known: its original key if it's been kept, or k itself if
+// reading k gives that item. Keys hashed without their original being kept
+// can't be read, and are left out.
+func (s *hashedKeysStorage) ownKey(k string, item Item) (string, bool) {
+	if original, kept := item.Metadata[OriginalKeyMetadata]; kept {
+		return original, true
+	}
+	s.pinnedMutex.Lock()
+	original, pinned := s.pinned[k]
+	s.pinnedMutex.Unlock()
+	if pinned {
+		return original, true
+	}
+	return k, s.hashKey(k) == k
+}
+
+// Lists the keys items are read with: hashed keys are listed by their
+// original if it's been kept, and left out if it hasn't and they can't be
+// read as they are.
+func (s *hashedKeysStorage) scanKeys(prefix string, fn func(string)) error {
+	ks, ok := keyScannerOf(s.Storage)
+	if !ok {
+		return newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	// Hashed keys don't start with the prefix of their original, so they
+	// are all looked at, once the scan is over so that the wrapped storage
+	// isn't read during it.
+	hashed := make(map[string]bool)
+	collect := func(k string) {
+		if strings.HasPrefix(k, HashedKeyPrefix) {
+			hashed[k] = true
+		} else {
+			fn(k)
+		}
+	}
+	if err := ks.scanKeys(prefix, collect); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(HashedKeyPrefix, prefix) {
+		if err := ks.scanKeys(HashedKeyPrefix, collect); err != nil {
+			return err
+		}
+	}
+	for h := range hashed {
+		item, found := s.Storage.Get(h)
+		if !found {
+			continue
+		}
+		if k, ok := s.ownKey(h, item); ok && strings.HasPrefix(k, prefix) {
+			fn(k)
+		}
+	}
+	return nil
+}
+
+func (s *hashedKeysStorage) pageKeys(pattern string, cursor uint64, count int) ([]string, uint64, error) {
+	return pageScannedKeys(s, pattern, cursor, count)
+}
+
+func (s *hashedKeysStorage) pin(key string) {
+	ps, ok := pinnableStorageOf(s.Storage)
+	if !ok {
+		return
+	}
+	h := s.hashKey(key)
+	if h != key {
+		s.pinnedMutex.Lock()
+		if s.pinned == nil {
+			s.pinned = make(map[string]string)
+		}
+		s.pinned[h] = key
+		s.pinnedMutex.Unlock()
+	}
+	ps.pin(h)
+}
+
+func (s *hashedKeysStorage) unpin(key string) {
+	ps, ok := pinnableStorageOf(s.Storage)
+	if !ok {
+		return
+	}
+	h := s.hashKey(key)
+	s.pinnedMutex.Lock()
+	delete(s.pinned, h)
+	s.pinnedMutex.Unlock()
+	ps.unpin(h)
+}
+
+func (s *hashedKeysStorage) setUnpinHandler(fn func([]string)) {
+	if ps, ok := pinnableStorageOf(s.Storage); ok {
+		ps.setUnpinHandler(func(keys []string) {
+			var own []string
+			for _, h := range keys {
+				if k, ok := s.ownKey(h, Item{}); ok {
+					own = append(own, k)
+				}
+			}
+			if len(own) > 0 {
+				fn(own)
+			}
+		})
+	}
+}
+
+// Reports deleted items under the keys they are read with, as scanKeys lists
+// them. The Redis storages don't report the items' metadata, so their hashed
+// keys are reported by their original only while pinned.
+func (s *hashedKeysStorage) setExpireHandler(fn func(string, Item)) {
+	if n, ok := expiryNotifierOf(s.Storage); ok {
+		n.setExpireHandler(func(h string, item Item) {
+			if k, ok := s.ownKey(h, item); ok {
+				fn(k, withoutOriginal(item))
+			}
+		})
+	}
+}
+
+// The wrapped storage's keys can't be turned back into the keys items are
+// read with, so warming a tier from it isn't supported.
+func (s *hashedKeysStorage) loadMatching(pattern string, limit int, fn func(key string, item Item)) error {
+	return newError(ErrNotSupported, "Warming with pattern %s is not supported by this storage", pattern)
+}
+
+// Deletes the hashed keys, in one operation if the wrapped storage can.
+func (s *hashedKeysStorage) delMulti(keys []string) ([]string, error) {
+	return delMultiAs(s.Storage, keys, s.hashKey)
+}
+
+func (s *hashedKeysStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// Returns a storage that stores the items of s under the SHA-256 of their key
+// when it's longer than MaxKeyLen, e.g. to keep keys built from full URLs
+// within the limits of remote backends. Shorter keys are left as is.
+func HashedKeysStorage(s Storage, o HashKeysOptions) *hashedKeysStorage {
+	if o.MaxKeyLen < 1 {
+		o.MaxKeyLen = DefaultMaxKeyLen
+	}
+	return &hashedKeysStorage{
+		Storage: s,
+		opts:    o,
+	}
+}
@@ -0,0 +1,274 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Headers carrying an item's expiration and refresh deadline, as Unix times
+// in nanoseconds, in the requests and responses of an HTTP storage.
+const (
+	HTTPExpirationHeader      = "X-Cache-Expiration"
+	HTTPRefreshDeadlineHeader = "X-Cache-Refresh-Deadline"
+)
+
+// Optional settings for an HTTP storage.
+type HTTPOptions struct {
+	// The client requests are sent with. Defaults to a client with a
+	// Timeout.
+	Client *http.Client
+	// How long a request may take, when Client isn't set. Defaults to 1
+	// second.
+	Timeout time.Duration
+	// Called with every request before it's sent, e.g. to add credentials.
+	// The request isn't sent if it returns an error.
+	Authorize func(*http.Request) error
+}
+
+// Returns an Authorize function adding a bearer token to requests.
+func BearerToken(token string) func(*http.Request) error {
+	return func(r *http.Request) error {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+}
+
+type httpStorage struct {
+	baseURL    string
+	client     *http.Client
+	authorize  func(*http.Request) error
+	marshaller *jsonCodec
+	mutex      sync.Mutex
+}
+
+// Sends a request for the given path under the base URL.
+func (s *httpStorage) do(method, path string, body []byte, header http.Header) (*http.Response, error) {
+	if body == nil {
+		return s.send(method, path, nil, 0, header)
+	}
+	return s.send(method, path, bytes.NewReader(body), int64(len(body)), header)
+}
+
+// Like do, but with a body of size bytes (or of unknown size if negative)
+// read from r.
+func (s *httpStorage) send(method, path string, r io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil && size >= 0 {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.authorize != nil {
+		if err := s.authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	return s.client.Do(req)
+}
+
+func keyPath(k string) string {
+	return "/keys/" + url.PathEscape(k)
+}
+
+func (s *httpStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *httpStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *httpStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *httpStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *httpStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+// Decodes the JSON body into o, or, if o is nil, into maps, slices, strings,
+// float64s and bools. A 404 response is a miss.
+func (s *httpStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	resp, err := s.do("GET", keyPath(key), nil, nil)
+	if err != nil {
+		return Item{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return Item{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Item{}, false, fmt.Errorf("Unexpected status %s getting %s", resp.Status, key)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Item{}, false, err
+	}
+	v, err := s.marshaller.DecodeValue(b, o)
+	if err != nil {
+		return Item{}, false, err
+	}
+	item := Item{Object: v}
+	item.Expiration, _ = strconv.ParseInt(resp.Header.Get(HTTPExpirationHeader), 10, 64)
+	item.RefreshDeadline, _ = strconv.ParseInt(resp.Header.Get(HTTPRefreshDeadlineHeader), 10, 64)
+	return item, true, nil
+}
+
+func (s *httpStorage) TrySet(key string, item Item) error {
+	b, err := s.marshaller.Marshal(item.Object)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(HTTPExpirationHeader, strconv.FormatInt(item.Expiration, 10))
+	header.Set(HTTPRefreshDeadlineHeader, strconv.FormatInt(item.RefreshDeadline, 10))
+	resp, err := s.do("PUT", keyPath(key), b, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected status %s setting %s", resp.Status, key)
+	}
+	return nil
+}
+
+// Sends the bytes read from r as the body of the PUT, with the
+// application/octet-stream content type.
+func (s *httpStorage) SetReader(key string, r io.Reader, size int64, e, rd int64) error {
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set(HTTPExpirationHeader, strconv.FormatInt(e, 10))
+	header.Set(HTTPRefreshDeadlineHeader, strconv.FormatInt(rd, 10))
+	resp, err := s.send("PUT", keyPath(key), r, size, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected status %s setting %s", resp.Status, key)
+	}
+	return nil
+}
+
+// Returns the body of the GET response, which is subject to the client's
+// timeout like the rest of the request.
+func (s *httpStorage) GetReader(key string) (io.ReadCloser, int64, int64, bool, error) {
+	resp, err := s.do("GET", keyPath(key), nil, nil)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, 0, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, 0, false, fmt.Errorf("Unexpected status %s getting %s", resp.Status, key)
+	}
+	e, _ := strconv.ParseInt(resp.Header.Get(HTTPExpirationHeader), 10, 64)
+	rd, _ := strconv.ParseInt(resp.Header.Get(HTTPRefreshDeadlineHeader), 10, 64)
+	return resp.Body, e, rd, true, nil
+}
+
+// Deleting a missing key isn't an error.
+func (s *httpStorage) TryDel(key string) error {
+	resp, err := s.do("DELETE", keyPath(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Unexpected status %s deleting %s", resp.Status, key)
+	}
+	return nil
+}
+
+// Sends DELETE /keys.
+func (s *httpStorage) Flush() {
+	resp, err := s.do("DELETE", "/keys", nil, nil)
+	if err != nil {
+		log.Errorf("error flushing : %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Errorf("error flushing : unexpected status %s", resp.Status)
+	}
+}
+
+// Lock only excludes other goroutines in this process.
+func (s *httpStorage) Lock() {
+	s.mutex.Lock()
+}
+
+func (s *httpStorage) Unlock() {
+	s.mutex.Unlock()
+}
+
+func (s *httpStorage) RLock() {
+	// nothing to do
+}
+
+func (s *httpStorage) RUnlock() {
+	// nothing to do
+}
+
+func (s *httpStorage) Type() int {
+	return STORAGE_TYPE_REMOTE
+}
+
+func (s *httpStorage) reportStats(st *Stats) {
+	s.marshaller.reportStats(st)
+}
+
+// Returns a storage that keeps items in a cache service with a REST API
+// under baseURL: GET, PUT and DELETE on /keys/{key} (with the key path
+// escaped) read, write and delete an item, and DELETE on /keys deletes them
+// all. Values are sent as JSON bodies, and expirations and refresh deadlines
+// in the HTTPExpirationHeader and HTTPRefreshDeadlineHeader headers; values
+// set with SetReader are streamed as application/octet-stream bodies. The
+// service is expected to expire items itself.
+func HTTPStorage(baseURL string, o HTTPOptions) *httpStorage {
+	client := o.Client
+	if client == nil {
+		timeout := o.Timeout
+		if timeout <= 0 {
+			timeout = time.Second
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+	return &httpStorage{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		client:     client,
+		authorize:  o.Authorize,
+		marshaller: newJSONCodec(),
+	}
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Returns an item with its metadata, for debugging and admin tools: when it
+// was set and, if the storage tracks access, when it was last read and how
+// many times. Unlike Get, expired items that haven't been deleted yet are
+// returned too (see Item.Expired), and the read isn't counted as an access.
+func (c *cache) InspectItem(k string) (Item, bool) {
+	c.storage.RLock()
+	item, found := c.storage.Get(k)
+	if found {
+		if t, ok := c.storage.(accessTracker); ok {
+			t.inspect(k, &item)
+		}
+	}
+	c.storage.RUnlock()
+	return item, found
+}
+
+// The document returned by DebugDump.
+type itemDump struct {
+	Key             string      `json:"key"`
+	Type            string      `json:"type"`
+	Value           interface{} `json:"value"`
+	Expiration      *time.Time  `json:"expiration,omitempty"`
+	Expired         bool        `json:"expired"`
+	RefreshDeadline *time.Time  `json:"refresh_deadline,omitempty"`
+	RefreshDue      bool        `json:"refresh_due"`
+	CreatedAt       *time.Time  `json:"created_at,omitempty"`
+	LastAccess      *time.Time  `json:"last_access,omitempty"`
+	HitCount        int64       `json:"hit_count"`
+	Cost            string      `json:"cost,omitempty"`
+	Pinned          bool        `json:"pinned"`
+	Source          string      `json:"source"`
+	// Set with SetWithMetadata.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Returns the Unix nanosecond time t, or nil if it is 0.
+func dumpTime(t int64) *time.Time {
+	if t == 0 {
+		return nil
+	}
+	tm := time.Unix(0, t).UTC()
+	return &tm
+}
+
+// Returns a JSON document describing the item of k, for debugging a single item
+// from admin tools: its value and type, its absolute expiration and refresh
+// deadline, when it was set and last read and how many times (if the storage
+// keeps them, see InspectItem), whether it's pinned, the storage (or tier of a
+// TieredStorage) it was found in, and its metadata (see SetWithMetadata).
+// Values that can't be encoded as JSON are formatted with %#v. Like
+// InspectItem, expired items that haven't been deleted yet are dumped too.
+// Returns an error matching ErrNotFound if there is no item for k.
+func (c *cache) DebugDump(k string) ([]byte, error) {
+	c.storage.RLock()
+	var item Item
+	var found bool
+	source := SourceStorage
+	var err error
+	if sr, ok := c.storage.(sourceReader); ok {
+		item, found, source, err = sr.getWithSource(k)
+	} else {
+		item, found, err = tryGet(c.storage, k)
+	}
+	if found {
+		if t, ok := c.storage.(accessTracker); ok {
+			t.inspect(k, &item)
+		}
+	}
+	c.storage.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ErrNotFound, "Item %s not found", k)
+	}
+	d := itemDump{
+		Key:             k,
+		Type:            fmt.Sprintf("%T", item.Object),
+		Value:           item.Object,
+		Expiration:      dumpTime(item.Expiration),
+		Expired:         item.Expired(),
+		RefreshDeadline: dumpTime(item.RefreshDeadline),
+		RefreshDue:      item.RefreshDeadline > 0 && timeNow().UnixNano() > item.RefreshDeadline,
+		CreatedAt:       dumpTime(item.CreatedAt),
+		LastAccess:      dumpTime(item.LastAccess),
+		HitCount:        item.HitCount,
+		Pinned:          c.pinned(k),
+		Source:          source.String(),
+		Metadata:        item.Metadata,
+	}
+	if item.Cost > 0 {
+		d.Cost = item.Cost.String()
+	}
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		d.Value = fmt.Sprintf("%#v", item.Object)
+		b, err = json.MarshalIndent(d, "", "  ")
+	}
+	return b, err
+}
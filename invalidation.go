@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A message bus broadcasting deletions between the instances of a cache,
+// e.g. processes that each keep the same data in a memory storage. Adapters
+// for NATS and Kafka are in the invalidation subpackages, and
+// RedisInvalidationBus uses Redis pub/sub.
+type InvalidationBus interface {
+	// Sends msg to every instance subscribed to the bus, possibly including
+	// this one.
+	Publish(msg []byte) error
+	// Calls handler with every message published on the bus, until Close.
+	Subscribe(handler func(msg []byte)) error
+	Close() error
+}
+
+// A deletion broadcast on an invalidation bus.
+type invalidation struct {
+	Origin string `json:"origin"` // the instance that published it
+	Key    string `json:"key,omitempty"`
+	Flush  bool   `json:"flush,omitempty"`
+	// The keys deleted by DeleteMulti.
+	Keys []string `json:"keys,omitempty"`
+	// A namespace invalidated with InvalidateNamespace, and its new
+	// generation.
+	Namespace  string `json:"namespace,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+	// When it was published, in Unix nanoseconds (see SetTombstones).
+	Time int64 `json:"time,omitempty"`
+}
+
+type invalidationBus struct {
+	bus    InvalidationBus
+	origin string
+}
+
+// Broadcasts the cache's Deletes and Flushes on bus, and applies the ones
+// other instances broadcast to the cache's storage, so that instances caching
+// the same data in memory don't keep serving values deleted elsewhere.
+func (c *cache) UseInvalidationBus(bus InvalidationBus) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	b := &invalidationBus{bus: bus, origin: hex.EncodeToString(id)}
+	err := bus.Subscribe(func(msg []byte) {
+		var inv invalidation
+		if err := json.Unmarshal(msg, &inv); err != nil {
+			log.Errorf("error decoding invalidation : %s", err)
+			return
+		}
+		if inv.Origin == b.origin {
+			return
+		}
+		if inv.Flush {
+			c.storage.Flush()
+			c.forgetItems()
+			return
+		}
+		if inv.Namespace != "" {
+			c.namespaceInvalidated(inv.Namespace, inv.Generation)
+			return
+		}
+		c.storage.Lock()
+		if inv.Keys != nil {
+			for _, k := range inv.Keys {
+				c.deleteInvalidated(k, inv.Time)
+			}
+		} else {
+			c.deleteInvalidated(inv.Key, inv.Time)
+		}
+		c.storage.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+	c.bus.Store(b)
+	return nil
+}
+
+// Broadcasts a deletion, if the cache uses an invalidation bus.
+func (c *cache) invalidate(inv invalidation) {
+	b, _ := c.bus.Load().(*invalidationBus)
+	if b == nil {
+		return
+	}
+	inv.Origin = b.origin
+	inv.Time = timeNow().UnixNano()
+	msg, _ := json.Marshal(inv)
+	if err := b.bus.Publish(msg); err != nil {
+		log.Errorf("error publishing invalidation : %s", err)
+	}
+}
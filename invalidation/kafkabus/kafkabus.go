@@ -0,0 +1,74 @@
+//go:build kafka
+
+// Package kafkabus broadcasts a cache's invalidations over a Kafka topic (see
+// cache.InvalidationBus). It's only built with the "kafka" build tag, so that
+// the cache package doesn't depend on the Kafka client.
+package kafkabus
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/segmentio/kafka-go"
+)
+
+type bus struct {
+	brokers []string
+	topic   string
+	writer  *kafka.Writer
+	reader  *kafka.Reader
+	cancel  context.CancelFunc
+}
+
+// Returns an invalidation bus using topic on the given brokers. Every
+// instance must see every message, so the topic is read without a consumer
+// group, from its first partition and starting at the latest offset: the
+// topic should have a single partition.
+func New(brokers []string, topic string) *bus {
+	return &bus{
+		brokers: brokers,
+		topic:   topic,
+		writer: &kafka.Writer{
+			Addr:  kafka.TCP(brokers...),
+			Topic: topic,
+		},
+	}
+}
+
+func (b *bus) Publish(msg []byte) error {
+	return b.writer.WriteMessages(context.Background(), kafka.Message{Value: msg})
+}
+
+func (b *bus) Subscribe(handler func([]byte)) error {
+	b.reader = kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     b.brokers,
+		Topic:       b.topic,
+		StartOffset: kafka.LastOffset,
+	})
+	if err := b.reader.SetOffset(kafka.LastOffset); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go func() {
+		for {
+			m, err := b.reader.ReadMessage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("error reading invalidation : %s", err)
+				}
+				return
+			}
+			handler(m.Value)
+		}
+	}()
+	return nil
+}
+
+func (b *bus) Close() error {
+	if b.cancel != nil {
+		b.cancel()
+		b.reader.Close()
+	}
+	return b.writer.Close()
+}
@@ -0,0 +1,47 @@
+//go:build nats
+
+// Package natsbus broadcasts a cache's invalidations over NATS (see
+// cache.InvalidationBus). It's only built with the "nats" build tag, so that
+// the cache package doesn't depend on the NATS client.
+package natsbus
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+type bus struct {
+	conn    *nats.Conn
+	subject string
+	sub     *nats.Subscription
+}
+
+// Returns an invalidation bus publishing on subject over conn. Closing the
+// bus unsubscribes, but leaves conn open.
+func New(conn *nats.Conn, subject string) *bus {
+	return &bus{
+		conn:    conn,
+		subject: subject,
+	}
+}
+
+func (b *bus) Publish(msg []byte) error {
+	return b.conn.Publish(b.subject, msg)
+}
+
+func (b *bus) Subscribe(handler func([]byte)) error {
+	sub, err := b.conn.Subscribe(b.subject, func(m *nats.Msg) {
+		handler(m.Data)
+	})
+	if err != nil {
+		return err
+	}
+	b.sub = sub
+	return nil
+}
+
+func (b *bus) Close() error {
+	if b.sub == nil {
+		return nil
+	}
+	return b.sub.Unsubscribe()
+}
@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Refreshes keys every interval, starting now, whether or not they are read:
+// each key is queued for the OnRefreshNeeded function like a key that has
+// reached its refresh deadline, so that values expensive to compute are
+// always in the cache before they're needed. Keys already queued or being
+// refreshed are skipped. Returns a function that stops refreshing the keys.
+func (c *cache) KeepFresh(keys []string, interval time.Duration) (stop func()) {
+	keys = append([]string(nil), keys...)
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, k := range keys {
+				c.queueRefresh(k)
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
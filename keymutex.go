@@ -0,0 +1,18 @@
+package cache
+
+import (
+	"sync"
+)
+
+// Number of mutexes KeyMutex hands out. Keys are spread over them by hash, so
+// two keys share a mutex with a probability of 1 in keyMutexStripes.
+const keyMutexStripes = 256
+
+// Returns a mutex for k, so that goroutines about to compute the value of a
+// key can take turns: the first one computes and sets it, and the others find
+// it in the cache once they get the lock. The same mutex is always returned
+// for a key, but unrelated keys can share one, so it must not be held while
+// taking the mutex of another key.
+func (c *cache) KeyMutex(k string) sync.Locker {
+	return &c.keyMutexes[hashRingKey(k)%keyMutexStripes]
+}
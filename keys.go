@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A structured cache key, made of parts joined by NamespaceSeparator. Parts
+// are escaped, so two different keys never produce the same string.
+type Key []string
+
+// Escapes the separator (and the escape character) in a key part.
+var keyPartEscaper = strings.NewReplacer(`\`, `\\`, NamespaceSeparator, `\`+NamespaceSeparator)
+
+// Returns the key made of the given parts, each formatted with fmt.Sprint,
+// e.g. K("user", 42, "profile") is "user:42:profile".
+func K(parts ...interface{}) Key {
+	k := make(Key, len(parts))
+	for i, p := range parts {
+		k[i] = fmt.Sprint(p)
+	}
+	return k
+}
+
+// Returns the key with more parts appended.
+func (k Key) With(parts ...interface{}) Key {
+	return append(k[:len(k):len(k)], K(parts...)...)
+}
+
+// Returns the canonical string of the key, used to store its item.
+func (k Key) String() string {
+	escaped := make([]string, len(k))
+	for i, p := range k {
+		escaped[i] = keyPartEscaper.Replace(p)
+	}
+	return strings.Join(escaped, NamespaceSeparator)
+}
+
+// Returns the prefix shared by the key and every key built from it with
+// With, e.g. for DeletePrefix.
+func (k Key) Prefix() string {
+	return k.String() + NamespaceSeparator
+}
+
+// Implemented by storages that can list their keys.
+type keyScanner interface {
+	// Calls fn with every key starting with prefix, expired or not. Called
+	// with the lock held; fn must not modify the storage.
+	scanKeys(prefix string, fn func(string)) error
+}
+
+// Returns the storage s is or wraps that can list its keys, if any.
+func keyScannerOf(s Storage) (keyScanner, bool) {
+	return storageAs[keyScanner](s)
+}
+
+// Deletes every item whose key starts with prefix, e.g. K("user", 42).Prefix()
+// to invalidate everything cached for a user. Returns the number of items
+// deleted. Storages that change keys, such as HashedKeysStorage, are listed
+// with the keys they store, so hashed keys are not matched.
+func (c *cache) DeletePrefix(prefix string) (int, error) {
+	ks, ok := keyScannerOf(c.storage)
+	if !ok {
+		return 0, newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	var keys []string
+	if err := ks.scanKeys(prefix, func(k string) {
+		keys = append(keys, k)
+	}); err != nil {
+		return 0, err
+	}
+	for i, k := range keys {
+		if err := c.tryDelete(k); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Deletes every item for which pred returns true, expired or not, e.g. the
+// items created before a deploy. With dryRun, nothing is deleted. Returns the
+// number of items that matched.
+func (c *cache) FlushWhere(pred func(key string, item Item) bool, dryRun bool) (int, error) {
+	ks, ok := keyScannerOf(c.storage)
+	if !ok {
+		return 0, newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	var keys []string
+	if err := ks.scanKeys("", func(k string) {
+		keys = append(keys, k)
+	}); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		item, found, err := tryGet(c.storage, k)
+		if err != nil {
+			return n, err
+		}
+		if !found || !pred(k, item) {
+			continue
+		}
+		if !dryRun {
+			if err := c.tryDelete(k); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+)
+
+// A per-key count that TopKeys can sort by.
+type Metric int
+
+const (
+	MetricHits Metric = iota
+	MetricMisses
+	MetricRefreshes
+	MetricBytes // bytes read with GetBytes
+	metricCount
+)
+
+// Approximate counts of a key, as returned by TopKeys. Counts can be too
+// high when keys collide, but are never too low.
+type KeyStat struct {
+	Key       string
+	Hits      int64
+	Misses    int64
+	Refreshes int64
+	Bytes     int64
+}
+
+// Number of counters per row of the sketches counting key accesses.
+const keyStatsWidth = 1 << 14
+
+// A count-min sketch like frequencySketch, with wide counters that are never
+// aged, for totals.
+type countSketch struct {
+	rows [sketchDepth][]int64
+	mask uint64
+}
+
+func newCountSketch(width int) *countSketch {
+	s := &countSketch{mask: uint64(width - 1)}
+	for i := range s.rows {
+		s.rows[i] = make([]int64, width)
+	}
+	return s
+}
+
+// Adds n to the count of k and returns its new estimate.
+func (s *countSketch) add(k string, n int64) int64 {
+	h1, h2 := sketchHashes(k)
+	var min int64 = -1
+	for i := range s.rows {
+		j := (h1 + uint64(i)*h2) & s.mask
+		s.rows[i][j] += n
+		if min < 0 || s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+	return min
+}
+
+func (s *countSketch) estimate(k string) int64 {
+	h1, h2 := sketchHashes(k)
+	var min int64 = -1
+	for i := range s.rows {
+		if c := s.rows[i][(h1+uint64(i)*h2)&s.mask]; min < 0 || c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// The sketches, and for every metric the keys with the highest estimates
+// seen so far.
+type keyStats struct {
+	mutex      sync.Mutex
+	capacity   int
+	sketches   [metricCount]*countSketch
+	candidates [metricCount]map[string]int64
+}
+
+func (ks *keyStats) add(k string, m Metric, n int64) {
+	ks.mutex.Lock()
+	est := ks.sketches[m].add(k, n)
+	top := ks.candidates[m]
+	if _, found := top[k]; found || len(top) < ks.capacity {
+		top[k] = est
+	} else {
+		// Replace the candidate with the lowest estimate if k is now above it.
+		minKey, min := "", int64(-1)
+		for ck, c := range top {
+			if min < 0 || c < min {
+				minKey, min = ck, c
+			}
+		}
+		if est > min {
+			delete(top, minKey)
+			top[k] = est
+		}
+	}
+	ks.mutex.Unlock()
+}
+
+// Starts counting the hits, misses, refreshes and bytes read of every key, in
+// a fixed amount of memory, for TopKeys. Up to capacity keys with the highest
+// counts are remembered for each metric, so TopKeys can return up to that
+// many keys. Counting adds a lock and a few hashes to every read.
+func (c *cache) TrackKeyStats(capacity int) {
+	if capacity < 1 {
+		capacity = 100
+	}
+	ks := &keyStats{capacity: capacity}
+	for m := range ks.sketches {
+		ks.sketches[m] = newCountSketch(keyStatsWidth)
+		ks.candidates[m] = make(map[string]int64)
+	}
+	c.keyStats.Store(ks)
+}
+
+func (c *cache) countKey(k string, m Metric, n int64) {
+	if ks, ok := c.keyStats.Load().(*keyStats); ok {
+		ks.add(k, m, n)
+	}
+	if ps, _ := c.prefixStats.Load().(*prefixStats); ps != nil {
+		ps.add(k, m, n)
+	}
+	if m == MetricHits {
+		if a, ok := c.adaptiveTTL.Load().(*adaptiveTTL); ok {
+			a.hits.add(k)
+		}
+	}
+}
+
+// Returns the n keys with the highest count of metric by, highest first,
+// with their approximate counts. Returns nil unless TrackKeyStats was called.
+func (c *cache) TopKeys(n int, by Metric) []KeyStat {
+	ks, ok := c.keyStats.Load().(*keyStats)
+	if !ok || by < 0 || by >= metricCount {
+		return nil
+	}
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	stats := make([]KeyStat, 0, len(ks.candidates[by]))
+	for k := range ks.candidates[by] {
+		stats = append(stats, KeyStat{
+			Key:       k,
+			Hits:      ks.sketches[MetricHits].estimate(k),
+			Misses:    ks.sketches[MetricMisses].estimate(k),
+			Refreshes: ks.sketches[MetricRefreshes].estimate(k),
+			Bytes:     ks.sketches[MetricBytes].estimate(k),
+		})
+	}
+	value := func(s KeyStat) int64 {
+		return [...]int64{s.Hits, s.Misses, s.Refreshes, s.Bytes}[by]
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if vi, vj := value(stats[i]), value(stats[j]); vi != vj {
+			return vi > vj
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
@@ -1,13 +1,21 @@
 package cache
 
 import (
+	"math"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	STORAGE_TYPE_MEMORY = iota
 	STORAGE_TYPE_REDIS
+	STORAGE_TYPE_SLAB
+	// Storages backed by another service or a database. They get a janitor
+	// if they need one.
+	STORAGE_TYPE_REMOTE
 )
 
 type Storage interface {
@@ -24,14 +32,122 @@ type Storage interface {
 	RUnlock()
 }
 
+// Implemented by storages whose expired items are deleted by the janitor.
+type cleanableStorage interface {
+	DeleteExpired()
+}
+
+// Implemented by storages that record when and how often items are read.
+type accessTracker interface {
+	// Records a read of key. Called with the read lock held.
+	touch(key string)
+	// Fills in the access metadata of item.
+	inspect(key string, item *Item)
+}
+
+// Optional settings for a memory storage. The zero value gives the defaults
+// used by MemoryStorage.
+type MemoryOptions struct {
+	// Record when each item was last read and how many times it has been
+	// read, for InspectItem. Costs an allocation per Set and two atomic
+	// writes per Get.
+	TrackAccess bool
+	// Evict items that haven't been read for this long, regardless of their
+	// expiration time, so that keys read once don't stay for their whole
+	// lifetime. Idle items are treated as missing, and deleted by the
+	// janitor. Implies TrackAccess. Zero means items are never evicted for
+	// being idle.
+	MaxIdle time.Duration
+	// Evict items when there are more than this many, choosing them with
+	// Eviction. Zero means there is no limit.
+	MaxItems int
+	// How the items to evict are chosen when MaxItems is reached.
+	Eviction EvictionPolicy
+	// The number of items compared with EvictionSampled; higher values evict
+	// better candidates at the cost of slower writes. Defaults to
+	// DefaultEvictionSamples.
+	EvictionSamples int
+	// How much the cost of producing an item (see SetWithCost) keeps it from
+	// being evicted by EvictionSampled: its last read (or its expiration, if
+	// access isn't tracked) counts as if it were CostWeight times its cost
+	// later, so that with a weight of 60 an item that took 2s to produce is
+	// kept over cheap items read up to 2 minutes after it. Zero means costs
+	// are ignored.
+	CostWeight float64
+	// The maximum number of items the janitor examines per run, so that a run
+	// holds the write lock for a bounded time. Items are examined in random
+	// order, so every item is eventually examined. Zero means all items are
+	// examined on every run.
+	JanitorMaxScan int
+	// The longest the janitor holds the write lock at a time. A run examines
+	// items in batches, releasing the lock between them, so that writers
+	// never wait for a whole run. Since each batch starts at a random item,
+	// some items may not be examined before the next run. Zero means the lock
+	// is held for the whole run.
+	JanitorMaxLockHold time.Duration
+	// The number of items to make room for up front, so that the map holding
+	// them doesn't have to grow, which copies it with the write lock held,
+	// while the storage is filled. Flush makes room for them again. For a
+	// ShardedCache, give each shard's storage its share of the items.
+	InitialCapacity int
+}
+
+// Access metadata of an item. Updated atomically, since reads only hold the
+// read lock.
+type itemAccess struct {
+	createdAt  int64
+	storedAt   int64
+	lastAccess int64
+	hits       int64
+}
+
+// Returns true if the item hasn't been read (or set, if it's never been read)
+// since before now - maxIdle.
+func (a *itemAccess) idle(now int64, maxIdle time.Duration) bool {
+	last := atomic.LoadInt64(&a.lastAccess)
+	if last == 0 {
+		last = a.storedAt
+	}
+	return now-last > int64(maxIdle)
+}
+
 type memoryStorage struct {
 	items   map[string]Item
-	mutex   sync.RWMutex
-	janitor *janitor
+	access  map[string]*itemAccess // nil unless access is tracked
+	maxIdle time.Duration
+	lru     *segmentedLRU // nil unless evicting with EvictionSegmentedLRU
+	// Set when evicting with EvictionSampled.
+	maxItems   int
+	samples    int
+	costWeight float64
+	evicted    int64           // updated atomically, since Stats holds no lock
+	pinned     map[string]bool // never evicted, see Pin
+
+	// The number of items the map was created for, and an estimate of the
+	// number it has room for, doubled whenever it's reached.
+	initialCapacity int
+	capacity        int
+	growths         int64 // updated atomically
+	maxGrowthPause  int64 // a time.Duration, updated atomically
+
+	onExpire func(string, Item)
+	expired  []expiredItem // deleted by the janitor, for onExpire
+	onUnpin  func([]string)
+	unpinned []string // pinned keys deleted by the janitor, for onUnpin
+
+	janitorMaxScan     int
+	janitorMaxLockHold time.Duration
+	janitor            janitorMetrics
+	mutex              sync.RWMutex
 }
 
 func (s *memoryStorage) Get(key string) (Item, bool) {
 	item, found := s.items[key]
+	if found && s.maxIdle > 0 && !s.pinned[key] {
+		if a := s.access[key]; a != nil && a.idle(timeNow().UnixNano(), s.maxIdle) {
+			return Item{}, false
+		}
+	}
 	return item, found
 }
 func (s *memoryStorage) GetObject(key string, o interface{}) (Item, bool) {
@@ -39,30 +155,258 @@ func (s *memoryStorage) GetObject(key string, o interface{}) (Item, bool) {
 }
 
 func (s *memoryStorage) Set(key string, item Item) {
+	if len(s.items) < s.capacity {
+		s.items[key] = item
+	} else {
+		s.grow(key, item)
+	}
+	if s.lru != nil {
+		if !s.pinned[key] {
+			for _, k := range s.lru.add(key) {
+				s.evictNotify(k)
+			}
+		}
+	} else if s.samples > 0 {
+		for len(s.items) > s.maxItems {
+			victim := s.sampleVictim(key)
+			if victim == "" {
+				break
+			}
+			s.evictNotify(victim)
+		}
+	}
+	if s.access != nil {
+		// Items rewritten in place (e.g. by Increment) keep their counters.
+		if a, found := s.access[key]; !found || a.createdAt != item.CreatedAt {
+			s.access[key] = &itemAccess{
+				createdAt: item.CreatedAt,
+				storedAt:  timeNow().UnixNano(),
+			}
+		}
+	}
+}
+
+// Stores an item when the map may have to grow to make room for it, timing
+// how long that takes.
+func (s *memoryStorage) grow(key string, item Item) {
+	start := time.Now()
+	_, found := s.items[key]
 	s.items[key] = item
+	if found {
+		return
+	}
+	pause := int64(time.Since(start))
+	if s.capacity < 8 {
+		s.capacity = 8
+	} else {
+		s.capacity *= 2
+	}
+	atomic.AddInt64(&s.growths, 1)
+	if pause > atomic.LoadInt64(&s.maxGrowthPause) {
+		atomic.StoreInt64(&s.maxGrowthPause, pause)
+	}
 }
 
 func (s *memoryStorage) Del(key string) {
+	s.evict(key)
+	if s.lru != nil {
+		s.lru.del(key)
+	}
+}
+
+// Returns the best item to evict among a few random ones other than key:
+// the least recently read or set one if access is tracked, and the one
+// expiring soonest (items that never expire last) otherwise, with expensive
+// items counted as more recent (see MemoryOptions.CostWeight). Map iteration
+// order is random, so the first samples keys are used.
+func (s *memoryStorage) sampleVictim(key string) string {
+	victim := ""
+	best := int64(math.MaxInt64)
+	n := 0
+	for k, item := range s.items {
+		if k == key || s.pinned[k] {
+			continue
+		}
+		score := item.Expiration
+		if s.access != nil {
+			a := s.access[k]
+			if score = atomic.LoadInt64(&a.lastAccess); score == 0 {
+				score = a.storedAt
+			}
+		} else if score == 0 {
+			score = math.MaxInt64
+		}
+		if s.costWeight > 0 && item.Cost > 0 {
+			if credit := int64(float64(item.Cost) * s.costWeight); score < math.MaxInt64-credit {
+				score += credit
+			} else {
+				score = math.MaxInt64
+			}
+		}
+		if victim == "" || score < best {
+			victim, best = k, score
+		}
+		if n++; n == s.samples {
+			break
+		}
+	}
+	return victim
+}
+
+// Evicts an item to make room for another. Set is called with the lock held,
+// so onExpire is called in a new goroutine.
+func (s *memoryStorage) evictNotify(key string) {
+	if s.onExpire != nil {
+		go s.onExpire(key, s.items[key])
+	}
+	s.evict(key)
+	atomic.AddInt64(&s.evicted, 1)
+}
+
+func (s *memoryStorage) setExpireHandler(fn func(string, Item)) {
+	s.onExpire = fn
+}
+
+// An item deleted by the janitor.
+type expiredItem struct {
+	key  string
+	item Item
+}
+
+// Deletes an item the eviction policy no longer tracks.
+func (s *memoryStorage) evict(key string) {
 	delete(s.items, key)
+	if s.access != nil {
+		delete(s.access, key)
+	}
 }
 
+func (s *memoryStorage) touch(key string) {
+	if s.lru != nil {
+		s.lru.touch(key)
+	}
+	if s.access == nil {
+		return
+	}
+	if a, found := s.access[key]; found {
+		atomic.StoreInt64(&a.lastAccess, timeNow().UnixNano())
+		atomic.AddInt64(&a.hits, 1)
+	}
+}
+
+func (s *memoryStorage) inspect(key string, item *Item) {
+	if s.access == nil {
+		return
+	}
+	if a, found := s.access[key]; found {
+		item.LastAccess = atomic.LoadInt64(&a.lastAccess)
+		item.HitCount = atomic.LoadInt64(&a.hits)
+	}
+}
+
+// How many items the janitor examines between checks of how long it has held
+// the lock.
+const janitorCheckEvery = 128
+
 func (s *memoryStorage) DeleteExpired() {
-	now := time.Now().UnixNano()
+	start := time.Now()
+	now := timeNow().UnixNano()
+	deleted, scanned := 0, 0
+	var maxHold time.Duration
 	s.Lock()
+	toScan := len(s.items)
+	if s.janitorMaxScan > 0 && s.janitorMaxScan < toScan {
+		toScan = s.janitorMaxScan
+	}
+	for {
+		locked := time.Now()
+		n, d := s.deleteExpiredBatch(now, locked, toScan-scanned)
+		scanned += n
+		deleted += d
+		if hold := time.Since(locked); hold > maxHold {
+			maxHold = hold
+		}
+		if scanned >= toScan || n == 0 {
+			break
+		}
+		s.Unlock()
+		runtime.Gosched()
+		s.Lock()
+	}
+	expired, onExpire := s.expired, s.onExpire
+	unpinned, onUnpin := s.unpinned, s.onUnpin
+	s.expired, s.unpinned = nil, nil
+	s.Unlock()
+	s.janitor.record(deleted, time.Since(start), maxHold)
+	for _, e := range expired {
+		onExpire(e.key, e.item)
+	}
+	if len(unpinned) > 0 {
+		onUnpin(unpinned)
+	}
+}
+
+// Examines up to max items, or as many as it can until janitorMaxLockHold has
+// passed since locked, and deletes the expired and idle ones. Returns the
+// number of items examined and deleted. Called with the lock held.
+func (s *memoryStorage) deleteExpiredBatch(now int64, locked time.Time, max int) (int, int) {
+	n, deleted := 0, 0
 	for k, v := range s.items {
-		if v.Expiration > 0 && now > v.Expiration {
+		if n == max {
+			break
+		}
+		if s.janitorMaxLockHold > 0 && n > 0 && n%janitorCheckEvery == 0 && time.Since(locked) > s.janitorMaxLockHold {
+			break
+		}
+		n++
+		if (v.Expiration > 0 && now > v.Expiration) || (s.maxIdle > 0 && !s.pinned[k] && s.access[k].idle(now, s.maxIdle)) {
+			if s.onExpire != nil {
+				s.expired = append(s.expired, expiredItem{k, v})
+			}
+			if s.pinned[k] && s.onUnpin != nil {
+				s.unpinned = append(s.unpinned, k)
+			}
 			s.Del(k)
+			deleted++
 		}
 	}
-	s.Unlock()
+	return n, deleted
+}
+
+func (s *memoryStorage) scanKeys(prefix string, fn func(string)) error {
+	for k := range s.items {
+		if strings.HasPrefix(k, prefix) {
+			fn(k)
+		}
+	}
+	return nil
 }
 
 func (s *memoryStorage) Flush() {
 	s.Lock()
-	s.items = map[string]Item{}
+	s.reset()
 	s.Unlock()
 }
 
+// Replaces the maps with empty ones. Called with the storage locked.
+func (s *memoryStorage) reset() {
+	s.items = make(map[string]Item, s.initialCapacity)
+	s.capacity = s.initialCapacity
+	if s.access != nil {
+		s.access = make(map[string]*itemAccess, s.initialCapacity)
+	}
+	if s.lru != nil {
+		s.lru.flush()
+	}
+}
+
+func (s *memoryStorage) reportStats(st *Stats) {
+	st.Evictions = atomic.LoadInt64(&s.evicted)
+	st.MapGrowths = atomic.LoadInt64(&s.growths)
+	st.MapGrowthMaxPause = time.Duration(atomic.LoadInt64(&s.maxGrowthPause))
+	s.janitor.report(st)
+}
+
 func (s *memoryStorage) Lock() {
 	s.mutex.Lock()
 }
@@ -82,8 +426,37 @@ func (s *memoryStorage) Type() int {
 }
 
 func MemoryStorage() *memoryStorage {
+	return MemoryStorageWithOptions(MemoryOptions{})
+}
+
+// Similar to MemoryStorage, but configured with the given options.
+func MemoryStorageWithOptions(o MemoryOptions) *memoryStorage {
+	if o.InitialCapacity < 0 {
+		o.InitialCapacity = 0
+	}
 	mem := memoryStorage{
-		items:make(map[string]Item),
+		items:           make(map[string]Item, o.InitialCapacity),
+		initialCapacity: o.InitialCapacity,
+		capacity:        o.InitialCapacity,
+	}
+	if o.TrackAccess || o.MaxIdle > 0 {
+		mem.access = make(map[string]*itemAccess, o.InitialCapacity)
+	}
+	mem.maxIdle = o.MaxIdle
+	mem.janitorMaxScan = o.JanitorMaxScan
+	mem.janitorMaxLockHold = o.JanitorMaxLockHold
+	if o.MaxItems > 0 {
+		switch o.Eviction {
+		case EvictionSampled:
+			mem.maxItems = o.MaxItems
+			mem.samples = o.EvictionSamples
+			mem.costWeight = o.CostWeight
+			if mem.samples < 1 {
+				mem.samples = DefaultEvictionSamples
+			}
+		default:
+			mem.lru = newSegmentedLRU(o.MaxItems)
+		}
 	}
 	return &mem
 }
@@ -93,8 +466,41 @@ type janitor struct {
 	stop     chan bool
 }
 
-func (j *janitor) Run(s *memoryStorage) {
-	j.stop = make(chan bool)
+// What the janitor's runs cost, for Stats.
+type janitorMetrics struct {
+	mutex        sync.Mutex
+	runs         int64
+	deleted      int64
+	lastDuration time.Duration
+	lastLockHold time.Duration
+	maxLockHold  time.Duration
+}
+
+// Records a run that deleted the given number of items, took d and held the
+// write lock for lockHold.
+func (m *janitorMetrics) record(deleted int, d, lockHold time.Duration) {
+	m.mutex.Lock()
+	m.runs++
+	m.deleted += int64(deleted)
+	m.lastDuration = d
+	m.lastLockHold = lockHold
+	if lockHold > m.maxLockHold {
+		m.maxLockHold = lockHold
+	}
+	m.mutex.Unlock()
+}
+
+func (m *janitorMetrics) report(st *Stats) {
+	m.mutex.Lock()
+	st.JanitorRuns = m.runs
+	st.JanitorDeleted = m.deleted
+	st.JanitorLastDuration = m.lastDuration
+	st.JanitorLastLockHold = m.lastLockHold
+	st.JanitorMaxLockHold = m.maxLockHold
+	m.mutex.Unlock()
+}
+
+func (j *janitor) Run(s cleanableStorage) {
 	ticker := time.NewTicker(j.Interval)
 	for {
 		select {
@@ -107,14 +513,15 @@ func (j *janitor) Run(s *memoryStorage) {
 	}
 }
 
-func stopJanitor(s *memoryStorage) {
-	s.janitor.stop <- true
+func stopJanitor(j *janitor) {
+	j.stop <- true
 }
 
-func runJanitor(s *memoryStorage, ci time.Duration) {
+func runJanitor(s cleanableStorage, ci time.Duration) *janitor {
 	j := &janitor{
 		Interval: ci,
+		stop:     make(chan bool),
 	}
-	s.janitor = j
 	go j.Run(s)
-}
\ No newline at end of file
+	return j
+}
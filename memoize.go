@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"time"
+)
+
+// Returns x as a T, if it's a T or a *T (as decoded by storages that decode
+// values into a destination, e.g. Redis).
+func asType[T any](x interface{}) (T, bool) {
+	switch x := x.(type) {
+	case T:
+		return x, true
+	case *T:
+		if x != nil {
+			return *x, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// Returns fn wrapped so that its results are cached in c under the key keyFn
+// returns for the argument, for ttl (which is interpreted as the expiration
+// of Set). Concurrent calls with the same key that miss share a single call
+// to fn (see Fetch), and errors aren't cached unless SetFailureTTL was called.
+// Functions of several arguments can be memoized with a struct argument.
+func Memoize[A, R any](c *Cache, keyFn func(A) string, ttl time.Duration, fn func(A) (R, error)) func(A) (R, error) {
+	return func(arg A) (R, error) {
+		return fetchAs(c, keyFn(arg), ttl, func() (R, error) {
+			return fn(arg)
+		})
+	}
+}
+
+// Returns the value of k as an R, calling fn to produce it on a miss (see
+// Fetch) and caching it for ttl.
+func fetchAs[R any](c *Cache, k string, ttl time.Duration, fn func() (R, error)) (R, error) {
+	var r R
+	if x, found := c.GetObject(k, new(R)); found {
+		if v, ok := asType[R](x); ok {
+			return v, nil
+		}
+	}
+	x, err := c.Fetch(k, func() (interface{}, error) {
+		return fn()
+	}, ttl, NoRefreshDeadline)
+	if err != nil {
+		return r, err
+	}
+	if v, ok := asType[R](x); ok {
+		return v, nil
+	}
+	// Set by another caller, and read back undecoded by Fetch.
+	if x, found := c.GetObject(k, new(R)); found {
+		if v, ok := asType[R](x); ok {
+			return v, nil
+		}
+	}
+	return fn()
+}
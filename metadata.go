@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Marks the metadata of an item encoded by a Redis storage (see
+// SetWithMetadata), which JSON values never start with. The metadata is
+// encoded as a URL query, which never contains the | separating it from the
+// rest of the item.
+const metadataMarker = "@"
+
+// Like Set, but attaches meta to the item, e.g. where its value came from,
+// the trace ID of the request that produced it or the version of the program
+// that set it, for InspectItem and DebugDump to return when tracking down
+// where a stale value came from. The metadata is kept with the value by the
+// memory and Redis storages, and replaced (or dropped) when the item is set
+// again. The map must not be modified afterwards.
+func (c *cache) SetWithMetadata(k string, x interface{}, d time.Duration, rd time.Duration, meta map[string]string) {
+	if err := c.validate(k, x); err != nil {
+		log.Errorf("error setting %s : %s", k, err)
+		return
+	}
+	if c.bypassWrites() {
+		c.Delete(k)
+		return
+	}
+	item := c.newItem(k, x, d, rd)
+	item.Metadata = meta
+	c.storage.Lock()
+	if !c.admit(k) {
+		c.storage.Unlock()
+		return
+	}
+	c.storage.Set(k, item)
+	c.written(k, item)
+	c.storage.Unlock()
+}
+
+// Returns the metadata of an item as a Redis storage encodes it, or "" if it
+// has none.
+func encodeMetadata(meta map[string]string) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	values := make(url.Values, len(meta))
+	for k, v := range meta {
+		values.Set(k, v)
+	}
+	return metadataMarker + values.Encode() + "|"
+}
+
+// Splits the encoded metadata off the start of value, if it has any.
+func decodeMetadata(value string) (map[string]string, string) {
+	if len(value) == 0 || value[:1] != metadataMarker {
+		return nil, value
+	}
+	var encoded string
+	for i := 0; i < len(value); i++ {
+		if value[i] == '|' {
+			encoded, value = value[len(metadataMarker):i], value[i+1:]
+			break
+		}
+	}
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		log.Errorf("error decoding metadata : %s", err)
+		return nil, value
+	}
+	meta := make(map[string]string, len(values))
+	for k := range values {
+		meta[k] = values.Get(k)
+	}
+	return meta, value
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// What the cache does when it finds that a value was modified after it was
+// set (see SetMutationCheck).
+type MutationCheck int32
+
+const (
+	MutationCheckOff MutationCheck = iota
+	MutationCheckLog
+	MutationCheckPanic
+)
+
+// The checksum of a value when it was set, and the address of the data it
+// refers to, if any, to tell it from another value set without the cache
+// seeing it (e.g. by another process).
+type valueChecksum struct {
+	addr uintptr
+	sum  uint64
+}
+
+type mutationChecker struct {
+	mutex sync.Mutex
+	sums  map[string]valueChecksum
+}
+
+// Makes the cache checksum the values set (through the cache) that can be
+// modified in place, such as pointers, maps and slices, and check on every
+// Get, GetObject and GetDetailed that they haven't changed, logging the key
+// or panicking if one has, to find the callers that modify cached values
+// (see also SetCopyOnRead). Meant for debugging: checksumming walks the whole
+// value on every write and read. Values are only checked once set after the
+// check is enabled.
+func (c *cache) SetMutationCheck(m MutationCheck) {
+	c.mutations.mutex.Lock()
+	if m == MutationCheckOff || c.mutations.sums == nil {
+		c.mutations.sums = make(map[string]valueChecksum)
+	}
+	c.mutations.mutex.Unlock()
+	atomic.StoreInt32(&c.mutationCheck, int32(m))
+}
+
+func (c *cache) mutationCheckMode() MutationCheck {
+	return MutationCheck(atomic.LoadInt32(&c.mutationCheck))
+}
+
+// Returns the checksum of x, and false if x can't be modified in place.
+func checksumOf(x interface{}) (valueChecksum, bool) {
+	if x == nil {
+		return valueChecksum{}, false
+	}
+	v := reflect.ValueOf(x)
+	var addr uintptr
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		addr = v.Pointer()
+	case reflect.Struct, reflect.Array:
+	default:
+		return valueChecksum{}, false
+	}
+	h := fnv.New64a()
+	hashValue(h, v, 0, map[uintptr]bool{})
+	return valueChecksum{addr, h.Sum64()}, true
+}
+
+// Records the checksum of the value set for k.
+func (c *cache) recordChecksum(k string, x interface{}) {
+	if c.mutationCheckMode() == MutationCheckOff {
+		return
+	}
+	sum, ok := checksumOf(x)
+	c.mutations.mutex.Lock()
+	if ok {
+		c.mutations.sums[k] = sum
+	} else {
+		delete(c.mutations.sums, k)
+	}
+	c.mutations.mutex.Unlock()
+}
+
+func (c *cache) forgetChecksum(k string) {
+	if c.mutationCheckMode() == MutationCheckOff {
+		return
+	}
+	c.mutations.mutex.Lock()
+	delete(c.mutations.sums, k)
+	c.mutations.mutex.Unlock()
+}
+
+func (c *cache) resetChecksums() {
+	c.mutations.mutex.Lock()
+	c.mutations.sums = make(map[string]valueChecksum)
+	c.mutations.mutex.Unlock()
+}
+
+// Reports x, read for k, if it has changed since it was set.
+func (c *cache) checkMutation(k string, x interface{}) {
+	mode := c.mutationCheckMode()
+	if mode == MutationCheckOff {
+		return
+	}
+	sum, ok := checksumOf(x)
+	if !ok {
+		return
+	}
+	c.mutations.mutex.Lock()
+	old, found := c.mutations.sums[k]
+	c.mutations.sums[k] = sum
+	c.mutations.mutex.Unlock()
+	if !found || old.addr != sum.addr || old.sum == sum.sum {
+		return
+	}
+	if mode == MutationCheckPanic {
+		log.Panicf("value of %s was modified after it was set", k)
+	}
+	log.Errorf("value of %s was modified after it was set", k)
+}
+
+// Hashes the contents of v, following pointers up to maxSizeDepth levels, like
+// valueSize.
+func hashValue(h hash.Hash64, v reflect.Value, depth int, seen map[uintptr]bool) {
+	var b [8]byte
+	write := func(n uint64) {
+		binary.LittleEndian.PutUint64(b[:], n)
+		h.Write(b[:])
+	}
+	if !v.IsValid() {
+		write(0)
+		return
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			write(1)
+		} else {
+			write(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		write(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		write(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		write(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		write(math.Float64bits(real(v.Complex())))
+		write(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		write(uint64(v.Len()))
+		h.Write([]byte(v.String()))
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			write(0)
+			return
+		}
+		if v.Kind() == reflect.Ptr {
+			if seen[v.Pointer()] || depth >= maxSizeDepth {
+				write(uint64(v.Pointer()))
+				return
+			}
+			seen[v.Pointer()] = true
+		}
+		write(1)
+		hashValue(h, v.Elem(), depth+1, seen)
+	case reflect.Slice, reflect.Array:
+		write(uint64(v.Len()))
+		if depth >= maxSizeDepth {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i), depth+1, seen)
+		}
+	case reflect.Map:
+		write(uint64(v.Len()))
+		if depth >= maxSizeDepth {
+			return
+		}
+		// Entries are visited in random order, so their hashes are summed.
+		var sum uint64
+		iter := v.MapRange()
+		for iter.Next() {
+			eh := fnv.New64a()
+			hashValue(eh, iter.Key(), depth+1, seen)
+			hashValue(eh, iter.Value(), depth+1, seen)
+			sum += eh.Sum64()
+		}
+		write(sum)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			hashValue(h, v.Field(i), depth+1, seen)
+		}
+	default:
+		// Funcs, channels and unsafe pointers are compared by address.
+		write(uint64(v.Pointer()))
+	}
+}
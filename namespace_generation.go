@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	redis "gopkg.in/redis.v4"
+)
+
+// How long an instance uses the generation of a namespace it has read from a
+// Redis storage before reading it again, so that namespaces invalidated by
+// instances that don't share an invalidation bus with it are seen within that
+// time.
+const NamespaceGenerationTTL = time.Second
+
+// Implemented by storages shared by several processes that can keep the
+// generations of namespaces outside the items' keys, e.g. the Redis storages.
+type generationCounter interface {
+	// Returns the generation of ns, or 0 if it has never been bumped.
+	generation(ns string) (int64, error)
+	// Bumps the generation of ns and returns the new one.
+	bumpGeneration(ns string) (int64, error)
+}
+
+// Returns the storage s is or wraps that can keep generations, if any.
+func generationCounterOf(s Storage) (generationCounter, bool) {
+	return storageAs[generationCounter](s)
+}
+
+// The generations of the namespaces known to the cache.
+type namespaceGenerations struct {
+	mutex sync.Mutex
+	gens  map[string]namespaceGeneration
+}
+
+type namespaceGeneration struct {
+	gen    int64
+	readAt time.Time
+}
+
+// Invalidates every item set in namespace ns through a TypedView at once, by
+// bumping the generation of the namespace, which is part of the keys its
+// items are stored under: the items of older generations can't be read
+// anymore, and are deleted by the storage when they expire, so they should
+// be set with an expiration. Generations aren't items, so they can't be
+// evicted or overwritten by a key of the namespace. On Redis the generation
+// is kept in a key of its own outside the items' keys, so that every instance
+// sharing the server sees the new generation, right away if it shares the
+// cache's invalidation bus (see UseInvalidationBus) and within
+// NamespaceGenerationTTL otherwise; with other storages each instance keeps
+// it in memory, and instances sharing the bus get the new generation from
+// it. Returns the error writing the storage.
+func (c *cache) InvalidateNamespace(ns string) error {
+	var gen int64
+	gc, shared := generationCounterOf(c.storage)
+	if shared {
+		var err error
+		if gen, err = gc.bumpGeneration(ns); err != nil {
+			return err
+		}
+	}
+	c.namespaceGens.mutex.Lock()
+	if !shared {
+		gen = c.namespaceGens.gens[ns].gen + 1
+	}
+	c.setNamespaceGeneration(ns, gen)
+	c.namespaceGens.mutex.Unlock()
+	c.invalidate(invalidation{Namespace: ns, Generation: gen})
+	return nil
+}
+
+// Records gen as the generation of ns. Called with namespaceGens.mutex held.
+func (c *cache) setNamespaceGeneration(ns string, gen int64) {
+	if c.namespaceGens.gens == nil {
+		c.namespaceGens.gens = make(map[string]namespaceGeneration)
+	}
+	c.namespaceGens.gens[ns] = namespaceGeneration{gen, timeNow()}
+}
+
+// Returns the key k of namespace ns is stored under: namespacedKey(ns, k) as
+// long as the namespace hasn't been invalidated, and then with the namespace's
+// generation between ns and k.
+func (c *cache) versionedKey(ns, k string) string {
+	gen := c.namespaceGeneration(ns)
+	if gen == 0 {
+		return namespacedKey(ns, k)
+	}
+	return namespacedKey(ns, "~"+strconv.FormatInt(gen, 10)+NamespaceSeparator+k)
+}
+
+// Returns the generation of ns, read from the storage if it keeps them and
+// it hasn't been for NamespaceGenerationTTL.
+func (c *cache) namespaceGeneration(ns string) int64 {
+	c.namespaceGens.mutex.Lock()
+	g, found := c.namespaceGens.gens[ns]
+	c.namespaceGens.mutex.Unlock()
+	gc, shared := generationCounterOf(c.storage)
+	if !shared || (found && timeNow().Sub(g.readAt) < NamespaceGenerationTTL) {
+		return g.gen
+	}
+	gen, err := gc.generation(ns)
+	if err != nil {
+		// Keep using the last generation read until the storage is back.
+		return g.gen
+	}
+	c.namespaceGens.mutex.Lock()
+	c.setNamespaceGeneration(ns, gen)
+	c.namespaceGens.mutex.Unlock()
+	return gen
+}
+
+// Applies the invalidation of ns by another instance, which bumped its
+// generation to gen: the generation is read again from the storage on next
+// use if the storage keeps them, and is otherwise gen, unless the cache has
+// seen a later one.
+func (c *cache) namespaceInvalidated(ns string, gen int64) {
+	c.namespaceGens.mutex.Lock()
+	defer c.namespaceGens.mutex.Unlock()
+	if _, shared := generationCounterOf(c.storage); shared {
+		delete(c.namespaceGens.gens, ns)
+	} else if gen > c.namespaceGens.gens[ns].gen {
+		c.setNamespaceGeneration(ns, gen)
+	}
+}
+
+func (c *cache) resetNamespaceGenerations() {
+	c.namespaceGens.mutex.Lock()
+	c.namespaceGens.gens = nil
+	c.namespaceGens.mutex.Unlock()
+}
+
+func (s *redisStorage) generation(ns string) (int64, error) {
+	gen, err := s.redisClient.Get(s.internalKey("generation", ns)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return gen, err
+}
+
+func (s *redisStorage) bumpGeneration(ns string) (int64, error) {
+	return s.redisClient.Incr(s.internalKey("generation", ns)).Result()
+}
+
+func (s *shardedRedisStorage) generation(ns string) (int64, error) {
+	node := s.node(ns)
+	if node == nil {
+		return 0, errNoHealthyNode
+	}
+	return node.generation(ns)
+}
+
+func (s *shardedRedisStorage) bumpGeneration(ns string) (int64, error) {
+	node := s.node(ns)
+	if node == nil {
+		return 0, errNoHealthyNode
+	}
+	return node.bumpGeneration(ns)
+}
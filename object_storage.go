@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Returned by ObjectStore.Get for objects that don't exist.
+var ErrObjectNotFound = errors.New("Object not found")
+
+// An object store, such as an S3 or GCS bucket, adapted for ObjectStorage.
+// Metadata is a small set of string pairs stored with each object, e.g. as
+// S3 user metadata or GCS custom metadata.
+type ObjectStore interface {
+	Put(name string, body []byte, metadata map[string]string) error
+	// Returns ErrObjectNotFound if there is no such object.
+	Get(name string) ([]byte, map[string]string, error)
+	// Returns the metadata of the object without downloading its body,
+	// e.g. with a HEAD request. Returns ErrObjectNotFound if there is no
+	// such object.
+	Stat(name string) (map[string]string, error)
+	// Deleting an object that doesn't exist isn't an error.
+	Delete(name string) error
+	// Returns the names of the objects starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// Implemented by object stores that can upload and download objects as
+// streams, so that ObjectStorage's SetReader and GetReader don't hold whole
+// objects in memory.
+type ObjectStreamStore interface {
+	ObjectStore
+	// Uploads the size bytes read from r, or all of them if size is
+	// negative.
+	PutReader(name string, r io.Reader, size int64, metadata map[string]string) error
+	// Returns ErrObjectNotFound if there is no such object.
+	GetReader(name string) (io.ReadCloser, map[string]string, error)
+}
+
+// Metadata keys of the objects written by ObjectStorage.
+const (
+	objectExpirationKey      = "cache-expiration"
+	objectRefreshDeadlineKey = "cache-refresh-deadline"
+	objectEncodingKey        = "cache-encoding"
+)
+
+type objectStorage struct {
+	store      ObjectStore
+	prefix     string
+	marshaller *jsonCodec
+	mutex      sync.Mutex
+}
+
+func (s *objectStorage) name(k string) string {
+	return s.prefix + k
+}
+
+func (s *objectStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *objectStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *objectStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *objectStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *objectStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+// Reads the object, which is missing once it has expired even if it hasn't
+// been deleted yet. Values stored as bytes are returned as []byte; others are
+// decoded from JSON into o, or, if o is nil, into maps, slices, strings,
+// float64s and bools.
+func (s *objectStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	b, item, found, err := s.read(key)
+	if !found || err != nil {
+		return Item{}, false, err
+	}
+	if _, raw := item.Object.([]byte); raw {
+		item.Object = b
+		return item, true, nil
+	}
+	if item.Object, err = s.marshaller.DecodeValue(b, o); err != nil {
+		return Item{}, false, err
+	}
+	return item, true, nil
+}
+
+// Returns the body of the object for key and the item's metadata, with a
+// []byte Object if it was stored as bytes.
+func (s *objectStorage) read(key string) ([]byte, Item, bool, error) {
+	b, meta, err := s.store.Get(s.name(key))
+	if err == ErrObjectNotFound {
+		return nil, Item{}, false, nil
+	} else if err != nil {
+		return nil, Item{}, false, err
+	}
+	item, found := metadataItem(meta)
+	if !found {
+		return nil, Item{}, false, nil
+	}
+	if meta[objectEncodingKey] == "bytes" {
+		item.Object = b
+	}
+	return b, item, true, nil
+}
+
+// Returns the item described by the metadata of an object, or false if it
+// has expired. The object is left to DeleteExpired: deleting it here could
+// delete the object another instance has just written in its place.
+func metadataItem(meta map[string]string) (Item, bool) {
+	var item Item
+	item.Expiration, _ = strconv.ParseInt(meta[objectExpirationKey], 10, 64)
+	item.RefreshDeadline, _ = strconv.ParseInt(meta[objectRefreshDeadlineKey], 10, 64)
+	if item.Expired() {
+		return Item{}, false
+	}
+	return item, true
+}
+
+func objectMetadata(e, rd int64, encoding string) map[string]string {
+	return map[string]string{
+		objectExpirationKey:      strconv.FormatInt(e, 10),
+		objectRefreshDeadlineKey: strconv.FormatInt(rd, 10),
+		objectEncodingKey:        encoding,
+	}
+}
+
+func (s *objectStorage) write(key string, b []byte, e, rd int64, encoding string) error {
+	return s.store.Put(s.name(key), b, objectMetadata(e, rd, encoding))
+}
+
+// Stores []byte values as is, and others as JSON.
+func (s *objectStorage) TrySet(key string, item Item) error {
+	if b, ok := item.Object.([]byte); ok {
+		return s.write(key, b, item.Expiration, item.RefreshDeadline, "bytes")
+	}
+	b, err := s.marshaller.Marshal(item.Object)
+	if err != nil {
+		return err
+	}
+	return s.write(key, b, item.Expiration, item.RefreshDeadline, "json")
+}
+
+func (s *objectStorage) TryDel(key string) error {
+	return s.store.Delete(s.name(key))
+}
+
+func (s *objectStorage) SetBytes(key string, b []byte, e, rd int64) {
+	if err := s.write(key, b, e, rd, "bytes"); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+// Items set with Set aren't returned as bytes, as for the other storages.
+func (s *objectStorage) GetBytes(key string) ([]byte, int64, int64, bool) {
+	b, e, rd, found, err := s.tryGetBytes(key)
+	if err != nil && !errors.Is(err, ErrWrongType) {
+		log.Errorf("error getting %s : %s", key, err)
+	}
+	return b, e, rd, found
+}
+
+// Like GetBytes, but returns an error wrapping ErrWrongType if the object for
+// key wasn't stored as bytes.
+func (s *objectStorage) tryGetBytes(key string) ([]byte, int64, int64, bool, error) {
+	b, item, found, err := s.read(key)
+	if !found || err != nil {
+		return nil, 0, 0, false, err
+	}
+	if _, raw := item.Object.([]byte); !raw {
+		return nil, 0, 0, false, newError(ErrWrongType, "The value for %s was not set as bytes", key)
+	}
+	return b, item.Expiration, item.RefreshDeadline, true, nil
+}
+
+// Streams the value to the store if it's an ObjectStreamStore, and otherwise
+// reads it into memory first. The value is stored as bytes.
+func (s *objectStorage) SetReader(key string, r io.Reader, size int64, e, rd int64) error {
+	if ss, ok := s.store.(ObjectStreamStore); ok {
+		return ss.PutReader(s.name(key), r, size, objectMetadata(e, rd, "bytes"))
+	}
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.write(key, b, e, rd, "bytes")
+}
+
+func (s *objectStorage) GetReader(key string) (io.ReadCloser, int64, int64, bool, error) {
+	ss, ok := s.store.(ObjectStreamStore)
+	if !ok {
+		b, item, found, err := s.read(key)
+		if !found || err != nil {
+			return nil, 0, 0, false, err
+		}
+		return io.NopCloser(bytes.NewReader(b)), item.Expiration, item.RefreshDeadline, true, nil
+	}
+	rc, meta, err := ss.GetReader(s.name(key))
+	if err == ErrObjectNotFound {
+		return nil, 0, 0, false, nil
+	} else if err != nil {
+		return nil, 0, 0, false, err
+	}
+	item, found := metadataItem(meta)
+	if !found {
+		rc.Close()
+		return nil, 0, 0, false, nil
+	}
+	return rc, item.Expiration, item.RefreshDeadline, true, nil
+}
+
+// Deletes every object under the storage's prefix.
+func (s *objectStorage) Flush() {
+	names, err := s.store.List(s.prefix)
+	if err != nil {
+		log.Errorf("error listing objects to flush : %s", err)
+		return
+	}
+	for _, n := range names {
+		if err := s.store.Delete(n); err != nil {
+			log.Errorf("error deleting objects to flush : %s", err)
+			return
+		}
+	}
+}
+
+// Deletes the expired objects under the storage's prefix. Run by the janitor
+// when the cache has a cleanup interval; each object's metadata has to be
+// fetched (with Stat, so the bodies aren't downloaded), so the interval should
+// be long.
+func (s *objectStorage) DeleteExpired() {
+	names, err := s.store.List(s.prefix)
+	if err != nil {
+		log.Errorf("error listing objects : %s", err)
+		return
+	}
+	now := timeNow().UnixNano()
+	for _, n := range names {
+		meta, err := s.store.Stat(n)
+		if err != nil {
+			continue
+		}
+		if e, _ := strconv.ParseInt(meta[objectExpirationKey], 10, 64); e > 0 && now > e {
+			s.store.Delete(n)
+		}
+	}
+}
+
+// Lock only excludes other goroutines in this process.
+func (s *objectStorage) Lock() {
+	s.mutex.Lock()
+}
+
+func (s *objectStorage) Unlock() {
+	s.mutex.Unlock()
+}
+
+func (s *objectStorage) RLock() {
+	// nothing to do
+}
+
+func (s *objectStorage) RUnlock() {
+	// nothing to do
+}
+
+func (s *objectStorage) Type() int {
+	return STORAGE_TYPE_REMOTE
+}
+
+func (s *objectStorage) reportStats(st *Stats) {
+	s.marshaller.reportStats(st)
+}
+
+// Returns a storage that keeps each item in an object named prefix + key, for
+// large items that live for hours, like compiled reports. Expirations are
+// kept in the objects' metadata: expired objects are missing when they are
+// read, and deleted by the janitor. Every read is a request to the object
+// store, so hot items are best also cached in memory.
+func ObjectStorage(store ObjectStore, prefix string) *objectStorage {
+	return &objectStorage{
+		store:      store,
+		prefix:     prefix,
+		marshaller: newJSONCodec(),
+	}
+}
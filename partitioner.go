@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maps keys to the shards of a sharded storage: keys with the same hash are
+// always stored on the same shard, so related keys can be kept together, e.g.
+// to be written in one transaction (see Txn).
+type Partitioner interface {
+	Hash(k string) uint32
+}
+
+type xxhashPartitioner struct{}
+
+func (xxhashPartitioner) Hash(k string) uint32 {
+	return uint32(xxhash64(k))
+}
+
+type fnvPartitioner struct{}
+
+func (fnvPartitioner) Hash(k string) uint32 {
+	return hashRingKey(k)
+}
+
+// The partitioner used unless another one is set: hashes the whole key with
+// xxHash64.
+var DefaultPartitioner Partitioner = xxhashPartitioner{}
+
+// Hashes the whole key with FNV-1a, which DefaultPartitioner used before
+// xxHash. Keeps the keys of an existing sharded Redis storage on their
+// servers.
+var FNVPartitioner Partitioner = fnvPartitioner{}
+
+type hashTagPartitioner struct {
+	Partitioner
+}
+
+func (p hashTagPartitioner) Hash(k string) uint32 {
+	if i := strings.IndexByte(k, '{'); i >= 0 {
+		if j := strings.IndexByte(k[i+1:], '}'); j > 0 {
+			k = k[i+1 : i+1+j]
+		}
+	}
+	return p.Partitioner.Hash(k)
+}
+
+// Returns a partitioner that only hashes the part of a key between the first
+// { and the following }, like Redis Cluster's hash tags, so that
+// "{user:123}:profile" and "{user:123}:cart" are on the same shard. Keys
+// without a tag are hashed whole. Hashes with p, or DefaultPartitioner if p
+// is nil.
+func HashTagPartitioner(p Partitioner) Partitioner {
+	if p == nil {
+		p = DefaultPartitioner
+	}
+	return hashTagPartitioner{p}
+}
+
+type prefixPartitioner struct {
+	Partitioner
+	sep   string
+	parts int
+}
+
+func (p prefixPartitioner) Hash(k string) uint32 {
+	end := 0
+	for n := 0; n < p.parts; n++ {
+		i := strings.Index(k[end:], p.sep)
+		if i < 0 {
+			end = len(k)
+			break
+		}
+		end += i + len(p.sep)
+	}
+	return p.Partitioner.Hash(strings.TrimSuffix(k[:end], p.sep))
+}
+
+// Returns a partitioner that only hashes the first parts components of a key
+// separated by sep, so that with ":" and 2 all the "user:123:*" keys are on
+// the same shard. Hashes with p, or DefaultPartitioner if p is nil.
+func PrefixPartitioner(sep string, parts int, p Partitioner) Partitioner {
+	if sep == "" || parts < 1 {
+		panic(fmt.Sprintf("Invalid prefix partitioner %q, %d", sep, parts))
+	}
+	if p == nil {
+		p = DefaultPartitioner
+	}
+	return prefixPartitioner{p, sep, parts}
+}
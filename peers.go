@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The path under which peers serve each other's requests, unless
+// PeerOptions.BasePath is set.
+const DefaultPeerBasePath = "/_gocache/"
+
+// Settings for Peers.
+type PeerOptions struct {
+	// The base URL other peers reach this instance at, e.g.
+	// "http://10.0.0.1:8080". Must be in the peer list to own any keys.
+	Self string
+	// The path the peers' handlers are mounted at. Defaults to
+	// DefaultPeerBasePath.
+	BasePath string
+	// The client used to fetch values from peers. Defaults to a client with
+	// a 1 second timeout.
+	Client *http.Client
+	// How long values loaded by their owner are cached. Defaults to the
+	// cache's default expiration.
+	Expiration time.Duration
+	// Values fetched from another peer this many times within HotKeyWindow
+	// are also cached locally, for HotKeyExpiration, so that hot keys don't
+	// all hit their owner. Zero means values are never replicated.
+	HotKeyThreshold  int
+	HotKeyWindow     time.Duration
+	HotKeyExpiration time.Duration
+	// Returns the current peer list, including Self. Called every
+	// DiscoverInterval (defaults to 10 seconds); if nil, the peers are only
+	// set with SetPeers.
+	Discover         func() ([]string, error)
+	DiscoverInterval time.Duration
+}
+
+// A call loading a key, shared by the concurrent requests for it.
+type peerCall struct {
+	done  chan bool
+	value []byte
+	err   error
+}
+
+type peerGroup struct {
+	c       *Cache
+	loader  func(key string) ([]byte, error)
+	opts    PeerOptions
+	mutex   sync.RWMutex // guards peers and ring
+	peers   []string
+	ring    *hashRing
+	calls   map[string]*peerCall
+	callsMu sync.Mutex
+	hotKeys *frequencySketch
+	stop    chan bool
+}
+
+// Returns a group of cache instances sharing the work of loading values:
+// each key is owned by one peer, found by consistent hashing, which loads it
+// with loader and caches it in c. Peers fetch the keys they don't own from
+// their owner over HTTP, so the group must be served at BasePath (see
+// ServeHTTP). Concurrent loads of the same key are done once.
+func Peers(c *Cache, loader func(key string) ([]byte, error), o PeerOptions) *peerGroup {
+	if o.BasePath == "" {
+		o.BasePath = DefaultPeerBasePath
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: time.Second}
+	}
+	if o.Expiration == 0 {
+		o.Expiration = DefaultExpiration
+	}
+	if o.DiscoverInterval <= 0 {
+		o.DiscoverInterval = 10 * time.Second
+	}
+	p := &peerGroup{
+		c:      c,
+		loader: loader,
+		opts:   o,
+		ring:   newHashRing(nil, nil),
+		calls:  make(map[string]*peerCall),
+		stop:   make(chan bool),
+	}
+	if o.HotKeyThreshold > 0 {
+		p.hotKeys = newFrequencySketch(doorkeeperWidth, o.HotKeyWindow)
+	}
+	if o.Discover != nil {
+		p.discover()
+		go p.runDiscovery()
+	}
+	return p
+}
+
+// Sets the base URLs of the peers in the group, including this instance.
+func (p *peerGroup) SetPeers(peers ...string) {
+	live := make([]bool, len(peers))
+	for i := range live {
+		live[i] = true
+	}
+	ring := newHashRing(peers, live)
+	p.mutex.Lock()
+	p.peers = append([]string(nil), peers...)
+	p.ring = ring
+	p.mutex.Unlock()
+}
+
+func (p *peerGroup) discover() {
+	peers, err := p.opts.Discover()
+	if err != nil {
+		log.Errorf("error discovering peers : %s", err)
+		return
+	}
+	p.SetPeers(peers...)
+}
+
+func (p *peerGroup) runDiscovery() {
+	ticker := time.NewTicker(p.opts.DiscoverInterval)
+	for {
+		select {
+		case <-ticker.C:
+			p.discover()
+		case <-p.stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// Stops discovering peers.
+func (p *peerGroup) Close() {
+	close(p.stop)
+}
+
+// Returns the base URL of the peer owning k, or "" if this instance owns it
+// (or there are no peers).
+func (p *peerGroup) owner(k string) string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	i := p.ring.get(k)
+	if i < 0 || p.peers[i] == p.opts.Self {
+		return ""
+	}
+	return p.peers[i]
+}
+
+// Returns the value of k: from the local cache, from the peer owning it, or
+// loaded, if this instance owns it or its owner can't be reached.
+func (p *peerGroup) Get(k string) ([]byte, error) {
+	if b, found := p.c.GetBytes(k); found {
+		return b, nil
+	}
+	return p.do(k, func() ([]byte, error) {
+		if owner := p.owner(k); owner != "" {
+			b, err := p.fetch(owner, k)
+			if err == nil {
+				if p.hotKeys != nil && p.hotKeys.add(k) >= p.opts.HotKeyThreshold {
+					p.c.SetBytes(k, b, p.opts.HotKeyExpiration, NoRefreshDeadline)
+				}
+				return b, nil
+			}
+			log.Errorf("error fetching %s from %s : %s", k, owner, err)
+		}
+		return p.load(k)
+	})
+}
+
+// Loads k and caches it, as its owner.
+func (p *peerGroup) load(k string) ([]byte, error) {
+	b, err := p.loader(k)
+	if err != nil {
+		return nil, err
+	}
+	p.c.SetBytes(k, b, p.opts.Expiration, NoRefreshDeadline)
+	return b, nil
+}
+
+// Calls fn, unless a call for k is already running, in which case its result
+// is waited for and returned instead.
+func (p *peerGroup) do(k string, fn func() ([]byte, error)) ([]byte, error) {
+	p.callsMu.Lock()
+	if call, found := p.calls[k]; found {
+		p.callsMu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &peerCall{done: make(chan bool)}
+	p.calls[k] = call
+	p.callsMu.Unlock()
+	// Deferred so that if fn panics, the waiting callers get an error and the
+	// next call for k calls fn again.
+	defer func() {
+		r := recover()
+		if r != nil {
+			call.value, call.err = nil, fmt.Errorf("panic loading %s : %v", k, r)
+		}
+		p.callsMu.Lock()
+		delete(p.calls, k)
+		p.callsMu.Unlock()
+		close(call.done)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err
+}
+
+func (p *peerGroup) fetch(peer, k string) ([]byte, error) {
+	resp, err := p.opts.Client.Get(strings.TrimSuffix(peer, "/") + p.opts.BasePath + url.PathEscape(k))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Serves the keys this instance owns to the other peers: GET BasePath + the
+// escaped key returns its value, loading it if needed.
+func (p *peerGroup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, p.opts.BasePath) {
+		http.NotFound(w, r)
+		return
+	}
+	k := strings.TrimPrefix(r.URL.Path, p.opts.BasePath)
+	b, found := p.c.GetBytes(k)
+	if !found {
+		var err error
+		if b, err = p.do(k, func() ([]byte, error) { return p.load(k) }); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
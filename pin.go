@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// Returned by Pin when pinning the item would take the pinned items over the
+// limit set with SetMaxPinnedBytes. The item isn't pinned.
+var ErrPinLimit = errors.New("pinned items limit reached")
+
+// Implemented by storages that can evict items, to keep pinned items from
+// being evicted.
+type pinnableStorage interface {
+	pin(key string)
+	unpin(key string)
+	// Sets the function called with the pinned keys whose items the storage
+	// has deleted by itself, e.g. because they expired. Called with the lock
+	// held; fn is called without it.
+	setUnpinHandler(fn func(keys []string))
+}
+
+// Returns the storage s is or wraps that evicts items, if any. Decorators that
+// store items under other keys than their own pass pins on to the storage they
+// wrap, so they only count if it evicts items.
+func pinnableStorageOf(s Storage) (pinnableStorage, bool) {
+	ps, ok := storageAs[pinnableStorage](s)
+	if w, wraps := ps.(wrappedStorage); ok && wraps {
+		if _, ok := pinnableStorageOf(w.Unwrap()); !ok {
+			return nil, false
+		}
+	}
+	return ps, ok
+}
+
+// The pinned keys, and the size of their items when they were pinned.
+type pins struct {
+	mutex    sync.Mutex
+	keys     map[string]int64
+	bytes    int64
+	maxBytes int64
+}
+
+// Sets the most bytes the pinned items can take, as estimated by
+// EstimatedSize when they are pinned. Zero, the default, means there is no
+// limit. Items already pinned stay pinned.
+func (c *cache) SetMaxPinnedBytes(n int64) {
+	c.pins.mutex.Lock()
+	c.pins.maxBytes = n
+	c.pins.mutex.Unlock()
+}
+
+// Pins the item of k, so that it's never evicted to make room for other items
+// (MemoryOptions.MaxItems and MaxIdle) or to stay within a namespace's quota
+// (SetNamespaceQuota). It still expires, and is still deleted by Delete, which
+// unpins it. The key stays pinned when the item is replaced. Returns an error
+// if there is no item for k, or ErrPinLimit if pinning it would take the
+// pinned items over the limit set with SetMaxPinnedBytes.
+func (c *cache) Pin(k string) error {
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	item, found := c.storage.Get(k)
+	if !found || item.Expired() {
+		return newError(ErrNotFound, "Item %s not found", k)
+	}
+	size := int64(len(k)) + itemOverhead + valueSize(reflect.ValueOf(item.Object), 0, map[uintptr]bool{})
+	c.pins.mutex.Lock()
+	if old, pinned := c.pins.keys[k]; pinned {
+		c.pins.bytes -= old
+	}
+	if c.pins.maxBytes > 0 && c.pins.bytes+size > c.pins.maxBytes {
+		if old, pinned := c.pins.keys[k]; pinned {
+			c.pins.bytes += old
+		}
+		c.pins.mutex.Unlock()
+		return ErrPinLimit
+	}
+	if c.pins.keys == nil {
+		c.pins.keys = make(map[string]int64)
+	}
+	c.pins.keys[k] = size
+	c.pins.bytes += size
+	c.pins.mutex.Unlock()
+	if ps, ok := pinnableStorageOf(c.storage); ok {
+		ps.setUnpinHandler(c.pinsDeleted)
+		ps.pin(k)
+	}
+	c.releaseQuota(k)
+	return nil
+}
+
+// Unpins the keys whose items the storage has deleted, so that they no
+// longer count against SetMaxPinnedBytes, unless they've been set again
+// since.
+func (c *cache) pinsDeleted(keys []string) {
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	for _, k := range keys {
+		if _, found := c.storage.Get(k); !found {
+			c.unpin(k)
+		}
+	}
+}
+
+// Unpins the item of k, which can then be evicted again.
+func (c *cache) Unpin(k string) {
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	if !c.unpin(k) {
+		return
+	}
+	if item, found := c.storage.Get(k); found {
+		c.chargeQuota(k, item.Object)
+	}
+}
+
+// Forgets that k is pinned, and returns whether it was. Called with the
+// storage locked.
+func (c *cache) unpin(k string) bool {
+	c.pins.mutex.Lock()
+	size, pinned := c.pins.keys[k]
+	if pinned {
+		delete(c.pins.keys, k)
+		c.pins.bytes -= size
+	}
+	c.pins.mutex.Unlock()
+	if pinned {
+		if ps, ok := pinnableStorageOf(c.storage); ok {
+			ps.unpin(k)
+		}
+	}
+	return pinned
+}
+
+// Returns whether k is pinned.
+func (c *cache) pinned(k string) bool {
+	c.pins.mutex.Lock()
+	_, pinned := c.pins.keys[k]
+	c.pins.mutex.Unlock()
+	return pinned
+}
+
+// Unpins all the keys. Called when the cache is flushed.
+func (c *cache) resetPins() {
+	c.pins.mutex.Lock()
+	keys := c.pins.keys
+	c.pins.keys = nil
+	c.pins.bytes = 0
+	c.pins.mutex.Unlock()
+	if ps, ok := pinnableStorageOf(c.storage); ok {
+		c.storage.Lock()
+		for k := range keys {
+			ps.unpin(k)
+		}
+		c.storage.Unlock()
+	}
+}
+
+func (c *cache) reportPins(st *Stats) {
+	c.pins.mutex.Lock()
+	st.PinnedItems = len(c.pins.keys)
+	st.PinnedBytes = c.pins.bytes
+	c.pins.mutex.Unlock()
+}
+
+// Pinned items aren't tracked by the eviction policy, so they're never chosen
+// as victims.
+func (s *memoryStorage) pin(key string) {
+	if s.pinned == nil {
+		s.pinned = make(map[string]bool)
+	}
+	s.pinned[key] = true
+	if s.lru != nil {
+		s.lru.del(key)
+	}
+}
+
+// Pinned items are never evicted, so only the janitor deletes them.
+func (s *memoryStorage) setUnpinHandler(fn func([]string)) {
+	s.onUnpin = fn
+}
+
+func (s *memoryStorage) unpin(key string) {
+	if !s.pinned[key] {
+		return
+	}
+	delete(s.pinned, key)
+	if _, found := s.items[key]; found && s.lru != nil {
+		for _, k := range s.lru.add(key) {
+			s.evictNotify(k)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// The counts of the keys starting with a prefix, in Stats.Prefixes.
+type PrefixStat struct {
+	Hits      int64
+	Misses    int64
+	Refreshes int64
+	Bytes     int64 // bytes read with GetBytes
+}
+
+// The prefixes, longest first, and their counts, updated atomically.
+type prefixStats struct {
+	prefixes []string
+	counts   [][metricCount]int64
+}
+
+// Starts counting the hits, misses, refreshes and bytes read of the keys
+// starting with each of the given prefixes, e.g. of each subsystem sharing
+// the cache, for Stats.Prefixes. A key is counted for the longest prefix it
+// starts with, if any. Replaces the prefixes of a previous call, resetting
+// their counts; no prefixes stops counting.
+func (c *cache) TrackPrefixStats(prefixes ...string) {
+	if len(prefixes) == 0 {
+		c.prefixStats.Store((*prefixStats)(nil))
+		return
+	}
+	ps := &prefixStats{prefixes: append([]string(nil), prefixes...)}
+	sort.Slice(ps.prefixes, func(i, j int) bool {
+		return len(ps.prefixes[i]) > len(ps.prefixes[j])
+	})
+	ps.counts = make([][metricCount]int64, len(ps.prefixes))
+	c.prefixStats.Store(ps)
+}
+
+func (ps *prefixStats) add(k string, m Metric, n int64) {
+	for i, p := range ps.prefixes {
+		if strings.HasPrefix(k, p) {
+			atomic.AddInt64(&ps.counts[i][m], n)
+			return
+		}
+	}
+}
+
+func (ps *prefixStats) reportStats(st *Stats) {
+	st.Prefixes = make(map[string]PrefixStat, len(ps.prefixes))
+	for i, p := range ps.prefixes {
+		st.Prefixes[p] = PrefixStat{
+			Hits:      atomic.LoadInt64(&ps.counts[i][MetricHits]),
+			Misses:    atomic.LoadInt64(&ps.counts[i][MetricMisses]),
+			Refreshes: atomic.LoadInt64(&ps.counts[i][MetricRefreshes]),
+			Bytes:     atomic.LoadInt64(&ps.counts[i][MetricBytes]),
+		}
+	}
+}
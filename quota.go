@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"container/list"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Limits on the items of a namespace (see TypedView). A limit of 0 or less
+// doesn't apply.
+type NamespaceQuota struct {
+	// The most items the namespace can hold.
+	MaxItems int
+	// The most bytes the namespace's items can take, as estimated by
+	// EstimatedSize.
+	MaxBytes int64
+}
+
+// The items set in a namespace, oldest first.
+type namespaceUsage struct {
+	quota   NamespaceQuota
+	mutex   sync.Mutex
+	order   *list.List // of *namespaceEntry
+	entries map[string]*list.Element
+	bytes   int64
+	evicted int64
+}
+
+type namespaceEntry struct {
+	key  string
+	size int64
+}
+
+// Sets the quota of namespace ns, so that setting an item in it evicts its
+// oldest items (in the order they were set) once it holds more than
+// q.MaxItems items or q.MaxBytes bytes, without evicting the items of other
+// namespaces. Pinned items (see Pin) aren't counted. A key is in the longest
+// namespace with a quota it starts with, followed by NamespaceSeparator. Only
+// the writes made through the cache are counted: items deleted by the storage
+// itself (when they expire, or to stay within MemoryOptions.MaxItems) are
+// counted until they are the oldest of their namespace. A zero quota removes
+// the namespace's quota.
+func (c *cache) SetNamespaceQuota(ns string, q NamespaceQuota) {
+	c.quotasMutex.Lock()
+	defer c.quotasMutex.Unlock()
+	old, _ := c.quotas.Load().(map[string]*namespaceUsage)
+	quotas := make(map[string]*namespaceUsage, len(old)+1)
+	for name, u := range old {
+		quotas[name] = u
+	}
+	if q.MaxItems <= 0 && q.MaxBytes <= 0 {
+		delete(quotas, ns)
+	} else if u, ok := quotas[ns]; ok {
+		u.mutex.Lock()
+		u.quota = q
+		u.mutex.Unlock()
+	} else {
+		quotas[ns] = &namespaceUsage{
+			quota:   q,
+			order:   list.New(),
+			entries: make(map[string]*list.Element),
+		}
+	}
+	c.quotas.Store(quotas)
+}
+
+// Returns the number of items and bytes counted against the quota of
+// namespace ns, and the number of items evicted to stay within it.
+func (c *cache) NamespaceUsage(ns string) (items int, bytes int64, evicted int64) {
+	quotas, _ := c.quotas.Load().(map[string]*namespaceUsage)
+	u, ok := quotas[ns]
+	if !ok {
+		return 0, 0, 0
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.order.Len(), u.bytes, u.evicted
+}
+
+// Returns the usage of the namespace with a quota k is in, if any.
+func (c *cache) namespaceUsageOf(k string) *namespaceUsage {
+	quotas, _ := c.quotas.Load().(map[string]*namespaceUsage)
+	if len(quotas) == 0 {
+		return nil
+	}
+	var usage *namespaceUsage
+	longest := -1
+	for ns, u := range quotas {
+		if len(ns) > longest && strings.HasPrefix(k, ns+NamespaceSeparator) {
+			usage, longest = u, len(ns)
+		}
+	}
+	return usage
+}
+
+// Counts the item of k just set to x against its namespace's quota, and evicts
+// the namespace's oldest items while it's over the quota. Must be called with
+// the storage locked.
+func (c *cache) chargeQuota(k string, x interface{}) {
+	u := c.namespaceUsageOf(k)
+	if u == nil || c.pinned(k) {
+		return
+	}
+	u.mutex.Lock()
+	var size int64
+	if u.quota.MaxBytes > 0 {
+		size = int64(len(k)) + itemOverhead + valueSize(reflect.ValueOf(x), 0, map[uintptr]bool{})
+	}
+	if el, ok := u.entries[k]; ok {
+		e := el.Value.(*namespaceEntry)
+		u.bytes += size - e.size
+		e.size = size
+		u.order.MoveToBack(el)
+	} else {
+		u.entries[k] = u.order.PushBack(&namespaceEntry{key: k, size: size})
+		u.bytes += size
+	}
+	// The item just set is kept even if it alone is over the quota.
+	var evicted []string
+	for u.order.Len() > 1 && u.over() {
+		e := u.order.Remove(u.order.Front()).(*namespaceEntry)
+		delete(u.entries, e.key)
+		u.bytes -= e.size
+		if _, found := c.storage.Get(e.key); found {
+			evicted = append(evicted, e.key)
+			u.evicted++
+		}
+	}
+	u.mutex.Unlock()
+	// Deleted once the usage is unlocked, since delete releases the quota.
+	for _, ek := range evicted {
+		c.delete(ek)
+	}
+}
+
+func (u *namespaceUsage) over() bool {
+	return (u.quota.MaxItems > 0 && u.order.Len() > u.quota.MaxItems) ||
+		(u.quota.MaxBytes > 0 && u.bytes > u.quota.MaxBytes)
+}
+
+// Stops counting the item of k against its namespace's quota.
+func (c *cache) releaseQuota(k string) {
+	u := c.namespaceUsageOf(k)
+	if u == nil {
+		return
+	}
+	u.mutex.Lock()
+	if el, ok := u.entries[k]; ok {
+		u.bytes -= el.Value.(*namespaceEntry).size
+		u.order.Remove(el)
+		delete(u.entries, k)
+	}
+	u.mutex.Unlock()
+}
+
+// Stops counting any item against the namespaces' quotas.
+func (c *cache) resetQuotas() {
+	quotas, _ := c.quotas.Load().(map[string]*namespaceUsage)
+	for _, u := range quotas {
+		u.mutex.Lock()
+		u.order.Init()
+		u.entries = make(map[string]*list.Element)
+		u.bytes = 0
+		u.mutex.Unlock()
+	}
+}
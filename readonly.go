@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"io"
+	"time"
+)
+
+// ReadOnlyCache is the subset of the cache's methods that can never modify or
+// flush its contents. It can be handed to components that only need to read
+// from a shared cache.
+type ReadOnlyCache interface {
+	// Get an item from the cache. Returns the item or nil, and a bool
+	// indicating whether the key was found.
+	Get(k string) (interface{}, bool)
+	// Get an item from the cache, decoding it into o if the storage needs a
+	// destination (e.g. Redis). Returns the item or nil, and a bool
+	// indicating whether the key was found.
+	GetObject(k string, o interface{}) (interface{}, bool)
+	// Returns the values of the given keys that have an item, by key.
+	GetMulti(keys []string) map[string]interface{}
+	// Get a []byte value set with SetBytes.
+	GetBytes(k string) ([]byte, bool)
+	// Get a string value from the cache.
+	GetString(k string) (string, bool)
+	// Get a reader of a value set with SetReader, which the caller must
+	// close.
+	GetReader(k string) (io.ReadCloser, bool)
+	// Like Get, but also returns how fresh the value is.
+	GetDetailed(k string) (interface{}, Meta, bool)
+	// Returns true if k has an item that hasn't expired.
+	Has(k string) bool
+	// Same as Has.
+	Exists(k string) bool
+	// Returns how long until the item of k expires, and whether it was
+	// found.
+	TTL(k string) (time.Duration, bool)
+	// Returns the ETag of the value last set for k.
+	ETag(k string) (string, bool)
+	// Returns a page of the keys matching pattern.
+	Keys(pattern string, cursor uint64, count int) ([]string, uint64, error)
+	// Returns how many items expire and reach their refresh deadline in each
+	// bucket of the coming window.
+	ExpirationForecast(window time.Duration, buckets int) (Forecast, error)
+	// Returns the number of items and an estimate of their size in bytes.
+	EstimatedSize() (int, int64)
+	// Returns the usage of the quota of namespace ns.
+	NamespaceUsage(ns string) (items int, bytes int64, evicted int64)
+	// Returns a snapshot of the cache's statistics.
+	Stats() Stats
+	// Returns an item with its metadata, without counting it as an access.
+	InspectItem(k string) (Item, bool)
+	// Returns the item of k and what the cache knows about it, as JSON.
+	DebugDump(k string) ([]byte, error)
+}
+
+// The cache itself has every method of its read-only view.
+var _ ReadOnlyCache = (*Cache)(nil)
+
+// readOnlyCache wraps the cache instead of returning it directly so that the
+// view can't be type asserted back to a *Cache.
+type readOnlyCache struct {
+	c *cache
+}
+
+var _ ReadOnlyCache = readOnlyCache{}
+
+func (r readOnlyCache) Get(k string) (interface{}, bool) {
+	return r.c.Get(k)
+}
+
+func (r readOnlyCache) GetObject(k string, o interface{}) (interface{}, bool) {
+	return r.c.GetObject(k, o)
+}
+
+func (r readOnlyCache) GetMulti(keys []string) map[string]interface{} {
+	return r.c.GetMulti(keys)
+}
+
+func (r readOnlyCache) GetBytes(k string) ([]byte, bool) {
+	return r.c.GetBytes(k)
+}
+
+func (r readOnlyCache) GetString(k string) (string, bool) {
+	return r.c.GetString(k)
+}
+
+func (r readOnlyCache) GetReader(k string) (io.ReadCloser, bool) {
+	return r.c.GetReader(k)
+}
+
+func (r readOnlyCache) GetDetailed(k string) (interface{}, Meta, bool) {
+	return r.c.GetDetailed(k)
+}
+
+func (r readOnlyCache) Has(k string) bool {
+	return r.c.Has(k)
+}
+
+func (r readOnlyCache) Exists(k string) bool {
+	return r.c.Exists(k)
+}
+
+func (r readOnlyCache) TTL(k string) (time.Duration, bool) {
+	return r.c.TTL(k)
+}
+
+func (r readOnlyCache) ETag(k string) (string, bool) {
+	return r.c.ETag(k)
+}
+
+func (r readOnlyCache) Keys(pattern string, cursor uint64, count int) ([]string, uint64, error) {
+	return r.c.Keys(pattern, cursor, count)
+}
+
+func (r readOnlyCache) ExpirationForecast(window time.Duration, buckets int) (Forecast, error) {
+	return r.c.ExpirationForecast(window, buckets)
+}
+
+func (r readOnlyCache) EstimatedSize() (int, int64) {
+	return r.c.EstimatedSize()
+}
+
+func (r readOnlyCache) NamespaceUsage(ns string) (items int, bytes int64, evicted int64) {
+	return r.c.NamespaceUsage(ns)
+}
+
+func (r readOnlyCache) Stats() Stats {
+	return r.c.Stats()
+}
+
+func (r readOnlyCache) InspectItem(k string) (Item, bool) {
+	return r.c.InspectItem(k)
+}
+
+func (r readOnlyCache) DebugDump(k string) ([]byte, error) {
+	return r.c.DebugDump(k)
+}
+
+// Returns a read-only view of the cache. The view shares the cache's storage,
+// so changes made through the cache are visible through the view, but the
+// view itself has no methods that set, delete or flush items.
+func (c *Cache) ReadOnly() ReadOnlyCache {
+	return readOnlyCache{c.cache}
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"sync"
+
+	redis "gopkg.in/redis.v4"
+)
+
+// Implemented by storages that can run Lua scripts, i.e. the Redis storages.
+type scriptRunner interface {
+	runScript(script *redis.Script, keys []string, args []interface{}) (interface{}, error)
+}
+
+// Returns the storage s is or wraps that can run Lua scripts, if any.
+func scriptRunnerOf(s Storage) (scriptRunner, bool) {
+	return storageAs[scriptRunner](s)
+}
+
+// The scripts run by RedisEval, by source.
+var redisScripts sync.Map // of *redis.Script
+
+// Runs the Lua script on the Redis server of the cache's storage, with the
+// cache keys in keys given to it as KEYS, under the storage's prefix, and args
+// as ARGV, and returns its reply as redis.v4 does (int64, string, []interface{}
+// or nil). Each script is sent once and then run by its SHA1 with EVALSHA. It
+// sees items as the storage encodes them: the expiration and refresh deadline
+// in Unix nanoseconds (0 for none), then the JSON value, separated by |, e.g.
+// "0|0|42", with the item's metadata (see SetWithMetadata) and the name of the
+// value's type, if it was registered with RegisterType, between them; values
+// set with SetBytes have = followed by the bytes in place of that. Scripts
+// that set items must keep to that encoding, and to the keys they were given;
+// the cache's lock isn't taken, so a script should do its work in one go. With
+// ShardedRedisStorage, the keys must all be on the same server. Returns an
+// error if the storage isn't a Redis storage.
+func (c *cache) RedisEval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	sr, ok := scriptRunnerOf(c.storage)
+	if !ok {
+		return nil, newError(ErrNotSupported, "Lua scripts are not supported by this storage")
+	}
+	s, found := redisScripts.Load(script)
+	if !found {
+		s, _ = redisScripts.LoadOrStore(script, redis.NewScript(script))
+	}
+	return sr.runScript(s.(*redis.Script), keys, args)
+}
+
+func (s *redisStorage) runScript(script *redis.Script, keys []string, args []interface{}) (interface{}, error) {
+	redisKeys := make([]string, len(keys))
+	for i, k := range keys {
+		redisKeys[i] = s.key(k)
+	}
+	res, err := script.Run(s.redisClient, redisKeys, args...).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (s *shardedRedisStorage) runScript(script *redis.Script, keys []string, args []interface{}) (interface{}, error) {
+	var node *redisStorage
+	if len(keys) == 0 {
+		node = s.node("")
+	}
+	for _, k := range keys {
+		n := s.node(k)
+		if n == nil {
+			return nil, errNoHealthyNode
+		}
+		if node != nil && n != node {
+			return nil, newError(ErrNotSupported, "Keys %v are on different Redis servers", keys)
+		}
+		node = n
+	}
+	if node == nil {
+		return nil, errNoHealthyNode
+	}
+	return node.runScript(script, keys, args)
+}
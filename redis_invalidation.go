@@ -0,0 +1,63 @@
+package cache
+
+import (
+	log "github.com/Sirupsen/logrus"
+	redis "gopkg.in/redis.v4"
+)
+
+type redisInvalidationBus struct {
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+	closed  chan bool
+}
+
+func (b *redisInvalidationBus) Publish(msg []byte) error {
+	return b.client.Publish(b.channel, string(msg)).Err()
+}
+
+func (b *redisInvalidationBus) Subscribe(handler func([]byte)) error {
+	pubsub, err := b.client.Subscribe(b.channel)
+	if err != nil {
+		return err
+	}
+	b.pubsub = pubsub
+	go func() {
+		for {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				// Network errors are retried by ReceiveMessage, so the
+				// subscription is closed or unusable.
+				select {
+				case <-b.closed:
+				default:
+					log.Errorf("error receiving invalidation : %s", err)
+				}
+				return
+			}
+			handler([]byte(msg.Payload))
+		}
+	}()
+	return nil
+}
+
+func (b *redisInvalidationBus) Close() error {
+	close(b.closed)
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	return b.client.Close()
+}
+
+// Returns an invalidation bus using the given Redis pub/sub channel.
+func RedisInvalidationBus(addr string, pass string, db int, channel string) InvalidationBus {
+	return &redisInvalidationBus{
+		client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: pass,
+			DB:       db,
+		}),
+		channel: channel,
+		closed:  make(chan bool),
+	}
+}
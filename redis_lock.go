@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	lock "github.com/bsm/redis-lock"
+	redis "gopkg.in/redis.v4"
+)
+
+const (
+	// The default time after which the distributed lock expires on the Redis
+	// server if the process holding it stops renewing it.
+	DefaultRedisLockTTL = 5 * time.Second
+	// How often Lock retries while waiting for another process to release
+	// the distributed lock.
+	redisLockRetry = 50 * time.Millisecond
+)
+
+// A mutex shared by every process using the same Redis key. The lock is held
+// with a TTL so that it's released if its holder dies, and is renewed in the
+// background for as long as it's held. If renewal fails the lock is
+// reacquired, and onError is called so the loss doesn't go unnoticed.
+type redisLock struct {
+	mutex   sync.Mutex // serializes holders within this process
+	lock    distributedLock
+	key     string
+	ttl     time.Duration
+	onError func(error)
+	stop    chan bool
+	done    chan bool
+}
+
+// What a redisLock holds the lock on the server with: a *lock.Lock, unless a
+// test replaces it.
+type distributedLock interface {
+	// Obtains the lock, or refreshes its TTL if it's already held.
+	Lock() (bool, error)
+	Unlock() error
+	IsLocked() bool
+}
+
+func newRedisLock(client *redis.Client, key string, ttl, wait time.Duration, onError func(error)) *redisLock {
+	if ttl <= 0 {
+		ttl = DefaultRedisLockTTL
+	}
+	if wait <= 0 {
+		wait = ttl
+	}
+	if onError == nil {
+		onError = func(err error) {
+			log.Errorf("ERROR: %s", err)
+		}
+	}
+	return &redisLock{
+		lock: lock.NewLock(client, key, &lock.LockOptions{
+			LockTimeout: ttl,
+			WaitTimeout: wait,
+			WaitRetry:   redisLockRetry,
+		}),
+		key:     key,
+		ttl:     ttl,
+		onError: onError,
+	}
+}
+
+// Obtains the lock, waiting for other processes to release it. If it can't be
+// obtained in time the error is reported and the caller proceeds without it.
+func (l *redisLock) Lock() {
+	l.mutex.Lock()
+	ok, err := l.lock.Lock()
+	if err != nil {
+		l.onError(fmt.Errorf("could not obtain lock %s: %s", l.key, err))
+	} else if !ok {
+		l.onError(fmt.Errorf("could not obtain lock %s: held by another process", l.key))
+	}
+	l.stop = make(chan bool)
+	l.done = make(chan bool)
+	go l.renew(l.stop, l.done)
+}
+
+func (l *redisLock) renew(stop, done chan bool) {
+	ticker := time.NewTicker(l.ttl / 2)
+	for {
+		select {
+		case <-ticker.C:
+			// Lock refreshes the TTL if the lock is still ours, and tries to
+			// reacquire it otherwise.
+			ok, err := l.lock.Lock()
+			if err != nil {
+				l.onError(fmt.Errorf("could not renew lock %s: %s", l.key, err))
+			} else if !ok {
+				l.onError(fmt.Errorf("lost lock %s to another process", l.key))
+			}
+		case <-stop:
+			ticker.Stop()
+			close(done)
+			return
+		}
+	}
+}
+
+func (l *redisLock) Unlock() {
+	close(l.stop)
+	<-l.done
+	if l.lock.IsLocked() {
+		if err := l.lock.Unlock(); err != nil {
+			l.onError(fmt.Errorf("could not release lock %s: %s", l.key, err))
+		}
+	}
+	l.mutex.Unlock()
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	redis "gopkg.in/redis.v4"
+)
+
+// How long to wait before receiving again after a keyspace notification
+// couldn't be received.
+const redisNotificationRetry = time.Second
+
+// Subscribes to the server's keyspace notifications for the keys that expired
+// or were evicted (because of maxmemory), and calls fn with those under the
+// storage's prefix. By then Redis has deleted the value, so fn gets an empty
+// Item. Notifications must be enabled on the server, e.g. with
+// "CONFIG SET notify-keyspace-events Exe"; Redis only sends them to the
+// subscribers connected at the time, so items expiring while the connection
+// is down are missed.
+func (s *redisStorage) setExpireHandler(fn func(string, Item)) {
+	s.closeNotifications()
+	channels := []string{
+		fmt.Sprintf("__keyevent@%d__:expired", s.db),
+		fmt.Sprintf("__keyevent@%d__:evicted", s.db),
+	}
+	pubsub, err := s.redisClient.Subscribe(channels...)
+	if err != nil {
+		log.Errorf("error subscribing to keyspace notifications : %s", err)
+		return
+	}
+	s.pubsub = pubsub
+	s.stopNotifications = make(chan bool)
+	go s.receiveNotifications(pubsub, s.stopNotifications, fn)
+}
+
+// Calls fn with the keys in the notifications received on pubsub, until stop
+// is closed. ReceiveMessage reconnects and resubscribes after network errors.
+func (s *redisStorage) receiveNotifications(pubsub *redis.PubSub, stop chan bool, fn func(string, Item)) {
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			log.Errorf("error receiving keyspace notification : %s", err)
+			time.Sleep(redisNotificationRetry)
+			continue
+		}
+		if strings.HasPrefix(msg.Payload, s.prefix) {
+			fn(strings.TrimPrefix(msg.Payload, s.prefix), Item{})
+		}
+	}
+}
+
+// Unsubscribes from keyspace notifications, if subscribed.
+func (s *redisStorage) closeNotifications() {
+	if s.pubsub == nil {
+		return
+	}
+	close(s.stopNotifications)
+	s.pubsub.Close()
+	s.pubsub = nil
+}
+
+func (s *shardedRedisStorage) setExpireHandler(fn func(string, Item)) {
+	for _, n := range s.nodes {
+		n.setExpireHandler(fn)
+	}
+}
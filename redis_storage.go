@@ -1,59 +1,268 @@
 package cache
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
-	"bytes"
+	"sync"
 	"time"
 
-	redis "gopkg.in/redis.v4"
 	log "github.com/Sirupsen/logrus"
-	lock "github.com/bsm/redis-lock"
-	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	redis "gopkg.in/redis.v4"
 )
 
+// Number of keys requested per SCAN and deleted per DEL when flushing.
+const redisFlushBatchSize = 1000
+
 type redisStorage struct {
 	redisClient *redis.Client
-	marshaller  *runtime.JSONPb
-	lock        *lock.Lock
+	marshaller  *jsonCodec
+	lock        *redisLock
+	mutex       sync.Mutex // used instead of lock when locking is disabled
+	prefix      string
+	db          int
+	// Set once keyspace notifications are subscribed to.
+	pubsub            *redis.PubSub
+	stopNotifications chan bool
+}
+
+// Optional settings for a Redis storage. The zero value gives the defaults
+// used by RedisStorage.
+type RedisOptions struct {
+	// How long the distributed lock taken by Lock lives on the Redis server
+	// without being renewed. While held, the lock is renewed every LockTTL/2.
+	// Defaults to DefaultRedisLockTTL.
+	LockTTL time.Duration
+	// How long Lock waits for another process to release the lock. Defaults
+	// to LockTTL.
+	LockWait time.Duration
+	// Called when the distributed lock can't be obtained, renewed or
+	// released, i.e. when other processes may be running locked sections at
+	// the same time. Defaults to logging the error.
+	OnLockError func(error)
+	// Don't take the distributed lock at all. Lock then only excludes other
+	// goroutines in this process, so Add, Replace, Increment etc. are no
+	// longer atomic across processes sharing the database, but Sets don't
+	// pay for the lock's round trips. Get, Set and Delete are single Redis
+	// commands and remain atomic.
+	DisableLock bool
+	// How often ShardedRedisStorage pings its servers to find unhealthy ones.
+	// Defaults to DefaultHealthCheckInterval.
+	HealthCheckInterval time.Duration
+	// How ShardedRedisStorage assigns keys to its servers. Defaults to
+	// DefaultPartitioner.
+	Partitioner Partitioner
+}
+
+// Returns the Redis key under which the cache key k is stored.
+func (s *redisStorage) key(k string) string {
+	return s.prefix + k
+}
+
+// The Redis storages keep their own state (their lock, refresh leases, quota
+// counters and token buckets) under keys made of this prefix, the kind of
+// state, a colon and the storage's prefix. Storages refuse a prefix that
+// overlaps it, so that no item key can collide with their state, scans and
+// Keys never list it and Flush leaves it alone.
+const redisInternalKeyPrefix = "go_cache_"
+
+// Returns the Redis key under which the storage keeps its state of the given
+// kind for name, outside the keys of its items.
+func (s *redisStorage) internalKey(kind, name string) string {
+	return redisInternalKeyPrefix + kind + ":" + s.prefix + name
 }
 
 func (s *redisStorage) Get(key string) (Item, bool) {
-	res, err := s.redisClient.Get(key).Result()
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *redisStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *redisStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *redisStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *redisStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+func (s *redisStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	res, err := s.redisClient.Get(s.key(key)).Result()
+	if err == redis.Nil {
+		return Item{}, false, nil
+	} else if err != nil {
+		return Item{}, false, err
+	}
+
+	item, err := s.unmarshal(res, o)
 	if err != nil {
-		return Item{}, false
+		return Item{}, false, err
 	}
+	return item, true, nil
+}
 
-	return s.UnMarshal(res, nil), true
+func (s *redisStorage) TrySet(key string, item Item) error {
+	return s.redisClient.Set(s.key(key), s.Marshal(item), time.Unix(0, item.Expiration).Sub(timeNow())).Err()
 }
 
-func (s *redisStorage) GetObject(key string, o interface{}) (Item, bool) {
-	res, err := s.redisClient.Get(key).Result()
+func (s *redisStorage) TryDel(key string) error {
+	return s.redisClient.Del(s.key(key)).Err()
+}
+
+// Values stored by SetBytes have this after their expiration and refresh
+// deadline, which no JSON value starts with, so that Get and GetBytes can tell
+// them from items.
+const redisBytesMarker = "="
+
+// Stores b after the expiration, the refresh deadline and redisBytesMarker,
+// without encoding it.
+func (s *redisStorage) SetBytes(key string, b []byte, e, rd int64) {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%d|%d|%s", e, rd, redisBytesMarker))
+	buf.Write(b)
+	err := s.redisClient.Set(s.key(key), buf.Bytes(), time.Unix(0, e).Sub(timeNow())).Err()
 	if err != nil {
-		return Item{}, false
+		log.Errorf("error setting %s : %s", key, err)
 	}
+}
 
-	return s.UnMarshal(res, o), true
+// Items set with Set aren't returned as bytes, as for the other storages.
+func (s *redisStorage) GetBytes(key string) ([]byte, int64, int64, bool) {
+	b, e, rd, found, err := s.tryGetBytes(key)
+	if err != nil && !errors.Is(err, ErrWrongType) {
+		log.Errorf("error getting %s : %s", key, err)
+	}
+	return b, e, rd, found
 }
 
-func (s *redisStorage) Set(key string, item Item) {
-	s.redisClient.Set(key, s.Marshal(item), time.Unix(0, item.Expiration).Sub(time.Now()))
+// Like GetBytes, but returns an error wrapping ErrWrongType if the value of
+// key wasn't set with SetBytes.
+func (s *redisStorage) tryGetBytes(key string) ([]byte, int64, int64, bool, error) {
+	res, err := s.redisClient.Get(s.key(key)).Bytes()
+	if err == redis.Nil {
+		return nil, 0, 0, false, nil
+	} else if err != nil {
+		return nil, 0, 0, false, err
+	}
+	parts := bytes.SplitN(res, []byte("|"), 3)
+	if len(parts) != 3 || !bytes.HasPrefix(parts[2], []byte(redisBytesMarker)) {
+		return nil, 0, 0, false, newError(ErrWrongType, "The value for %s was not set as bytes", key)
+	}
+	e, _ := strconv.ParseInt(string(parts[0]), 10, 64)
+	rd, _ := strconv.ParseInt(string(parts[1]), 10, 64)
+	return parts[2][len(redisBytesMarker):], e, rd, true, nil
 }
 
-func (s *redisStorage) Del(key string) {
-	s.redisClient.Del(key)
+// Appends to the key only if it holds bytes, since APPEND on a missing key
+// would create a value without the expiration and refresh deadline header, and
+// appending to an item would corrupt its JSON. The header is at most 42 bytes
+// long.
+var redisAppendScript = redis.NewScript(`
+local header = redis.call("getrange", KEYS[1], 0, 63)
+if string.find(header, "^[^|]*|[^|]*|" .. ARGV[2]) then
+	return redis.call("append", KEYS[1], ARGV[1])
+end
+return -1
+`)
+
+// Appends b to a value stored by SetBytes using APPEND. The value comes last
+// in the stored string, so the header is left untouched.
+func (s *redisStorage) AppendBytes(key string, b []byte) bool {
+	n, err := redisAppendScript.Run(s.redisClient, []string{s.key(key)}, b, redisBytesMarker).Result()
+	if err != nil {
+		log.Errorf("error appending to %s : %s", key, err)
+		return false
+	}
+	return n != int64(-1)
 }
 
+// Deletes every key under the storage's prefix. Keys are found with SCAN and
+// deleted in batches, so other applications' keys in the same database are
+// left alone and the server is never blocked by a single huge command.
 func (s *redisStorage) Flush() {
-	s.redisClient.FlushDb()
+	s.flushWith(s.redisClient.Del)
+}
+
+// Deletes every key under the storage's prefix with del, and returns the
+// number of keys deleted.
+func (s *redisStorage) flushWith(del func(keys ...string) *redis.IntCmd) int {
+	var cursor uint64
+	deleted := 0
+	for {
+		keys, next, err := s.redisClient.Scan(cursor, s.scanPattern(""), redisFlushBatchSize).Result()
+		if err != nil {
+			log.Errorf("error scanning keys to flush : %s", err)
+			return deleted
+		}
+		if len(keys) > 0 {
+			n, err := del(keys...).Result()
+			if err != nil {
+				log.Errorf("error deleting keys to flush : %s", err)
+				return deleted
+			}
+			deleted += int(n)
+		}
+		if next == 0 {
+			return deleted
+		}
+		cursor = next
+	}
+}
+
+// Escapes the characters SCAN's MATCH patterns treat specially.
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// Returns the MATCH pattern of the keys of the items whose key starts with
+// prefix, escaped so that a storage prefix such as "app[1]:" only matches
+// itself.
+func (s *redisStorage) scanPattern(prefix string) string {
+	return redisPatternEscaper.Replace(s.key(prefix)) + "*"
+}
+
+func (s *redisStorage) scanKeys(prefix string, fn func(string)) error {
+	var cursor uint64
+	for {
+		keys, next, err := s.redisClient.Scan(cursor, s.scanPattern(prefix), redisFlushBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			fn(strings.TrimPrefix(k, s.prefix))
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
 }
 
 func (s *redisStorage) Lock() {
+	if s.lock == nil {
+		s.mutex.Lock()
+		return
+	}
 	s.lock.Lock()
 }
 
 func (s *redisStorage) Unlock() {
+	if s.lock == nil {
+		s.mutex.Unlock()
+		return
+	}
 	s.lock.Unlock()
 }
 
@@ -69,6 +278,10 @@ func (s *redisStorage) Type() int {
 	return STORAGE_TYPE_REDIS
 }
 
+func (s *redisStorage) reportStats(st *Stats) {
+	s.marshaller.reportStats(st)
+}
+
 func (s *redisStorage) Marshal(m Item) string {
 	res, err := s.marshaller.Marshal(m.Object)
 	if err != nil {
@@ -76,26 +289,81 @@ func (s *redisStorage) Marshal(m Item) string {
 	}
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("%d|%d|", m.Expiration, m.RefreshDeadline))
+	buf.WriteString(encodeMetadata(m.Metadata))
+	if name, found := registeredName(m.Object); found {
+		buf.WriteString(typeTagMarker + name + "|")
+	}
 	buf.Write(res)
 	out := buf.String()
 	return out
 }
 
 func (s *redisStorage) UnMarshal(m string, o interface{}) Item {
+	item, err := s.unmarshal(m, o)
+	if err != nil {
+		log.Errorf("error unmarshaling : %s", err)
+	}
+	return item
+}
+
+// Like UnMarshal, but returns an error wrapping ErrWrongType if m isn't an
+// item, e.g. a value another application set under the storage's prefix, or
+// its value can't be decoded, e.g. into o.
+func (s *redisStorage) unmarshal(m string, o interface{}) (Item, error) {
 	var item Item
 	res := strings.SplitN(m, "|", 3)
+	if len(res) != 3 {
+		return Item{}, newError(ErrWrongType, "Value %.32q is not an item", m)
+	}
+	if strings.HasPrefix(res[2], redisBytesMarker) {
+		return Item{}, newError(ErrWrongType, "Value %.32q was set as bytes", m)
+	}
 	item.Expiration, _ = strconv.ParseInt(res[0], 10, 64)
 	item.RefreshDeadline, _ = strconv.ParseInt(res[1], 10, 64)
 
-	err := s.marshaller.NewDecoder(strings.NewReader(res[2])).Decode(o)
+	// Without a value to decode into (e.g. for Get), decode the JSON value
+	// into a value of its registered type (see RegisterType), or into maps,
+	// slices, strings, float64s and bools.
+	item.Metadata, res[2] = decodeMetadata(res[2])
+	value := res[2]
+	result := func() interface{} { return o }
+	if strings.HasPrefix(value, typeTagMarker) {
+		var name string
+		if i := strings.Index(value, "|"); i > 0 {
+			name, value = value[len(typeTagMarker):i], value[i+1:]
+		}
+		if o == nil {
+			o, result, _ = registeredValue(name)
+		}
+	}
+	v, err := s.marshaller.DecodeValue([]byte(value), o)
 	if err != nil {
-		log.Errorf("error unmarshaling : %s", err)
+		return Item{}, newError(ErrWrongType, "Value %.32q can't be decoded: %s", m, err)
 	}
-	item.Object = o
-	return item
+	if v != nil && o != nil {
+		v = result()
+	}
+	item.Object = v
+	return item, nil
+}
+
+// Returns a storage that keeps items in the given Redis database. Every key is
+// stored under prefix, which must not be empty: it keeps the cache's keys
+// apart from other applications sharing the database, and Flush only deletes
+// keys under it. It must not overlap the keys the storage keeps its own state
+// under, which start with go_cache_.
+func RedisStorage(addr string, pass string, db int, prefix string) *redisStorage {
+	return RedisStorageWithOptions(addr, pass, db, prefix, RedisOptions{})
 }
 
-func RedisStorage(addr string, pass string, db int) *redisStorage {
+// Similar to RedisStorage, but configured with the given options.
+func RedisStorageWithOptions(addr string, pass string, db int, prefix string, o RedisOptions) *redisStorage {
+	if prefix == "" {
+		panic("Redis storage requires a key prefix")
+	}
+	if strings.HasPrefix(prefix, redisInternalKeyPrefix) || strings.HasPrefix(redisInternalKeyPrefix, prefix) {
+		panic("Redis storage key prefix overlaps " + redisInternalKeyPrefix)
+	}
 	opts := &redis.Options{
 		Addr:     addr,
 		Password: pass,
@@ -108,17 +376,14 @@ func RedisStorage(addr string, pass string, db int) *redisStorage {
 		log.Errorf("failed to initialize DataCollector redisClient: %s", err)
 	}
 
-	lock, err := lock.ObtainLock(client, "go_cache_lock", nil)
-	if err != nil {
-		log.Errorf("ERROR: %s\n", err.Error())
-	} else if lock == nil {
-		log.Errorf("ERROR: could not obtain lock")
-	}
-
 	red := redisStorage{
-		redisClient:client,
-		lock:lock,
-		marshaller:&runtime.JSONPb{OrigName: true},
+		redisClient: client,
+		marshaller:  newJSONCodec(),
+		prefix:      prefix,
+		db:          db,
+	}
+	if !o.DisableLock {
+		red.lock = newRedisLock(client, red.internalKey("lock", ""), o.LockTTL, o.LockWait, o.OnLockError)
 	}
 
 	return &red
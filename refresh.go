@@ -0,0 +1,301 @@
+package cache
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long a refresh worker above RefreshPoolOptions.MinWorkers waits for a
+// key before exiting, unless another timeout is set.
+const DefaultRefreshIdleTimeout = time.Minute
+
+// How urgently a key is refreshed when the refresh workers can't keep up:
+// queued keys of a higher priority are always refreshed first.
+type RefreshPriority int
+
+const (
+	RefreshPriorityNormal RefreshPriority = iota
+	RefreshPriorityHigh
+	RefreshPriorityLow
+)
+
+type refreshPriorityRule struct {
+	pattern  string
+	priority RefreshPriority
+}
+
+// Sets the refresh priority of the keys matching pattern, either a key or a
+// prefix followed by "*". Keys matching several patterns get the priority of
+// the longest one; keys matching none have RefreshPriorityNormal, or
+// RefreshPriorityHigh if their value is expensive (see
+// SetRefreshCostThreshold).
+func (c *cache) SetRefreshPriority(pattern string, p RefreshPriority) {
+	c.refreshPrioritiesMutex.Lock()
+	defer c.refreshPrioritiesMutex.Unlock()
+	old, _ := c.refreshPriorities.Load().([]refreshPriorityRule)
+	rules := make([]refreshPriorityRule, 0, len(old)+1)
+	for _, r := range old {
+		if r.pattern != pattern {
+			rules = append(rules, r)
+		}
+	}
+	c.refreshPriorities.Store(append(rules, refreshPriorityRule{pattern, p}))
+}
+
+func (c *cache) refreshPriority(k string) RefreshPriority {
+	rules, _ := c.refreshPriorities.Load().([]refreshPriorityRule)
+	p, longest := RefreshPriorityNormal, -1
+	for _, r := range rules {
+		if len(r.pattern) > longest && matchKeyPattern(r.pattern, k) {
+			p, longest = r.priority, len(r.pattern)
+		}
+	}
+	if longest < 0 && c.expensive(k) {
+		return RefreshPriorityHigh
+	}
+	return p
+}
+
+type refreshSkew struct {
+	instance string
+	max      time.Duration
+}
+
+// Delays the refreshes done by this instance by a duration between 0 and max
+// that depends on instance and on the key, so that the instances sharing a
+// storage don't all refresh a key as soon as its deadline is reached: the one
+// with the shortest delay usually refreshes it before the others are due.
+// instance must be different for every instance, e.g. its hostname. A max of
+// zero disables the delay.
+func (c *cache) SetRefreshSkew(instance string, max time.Duration) {
+	c.refreshSkew.Store(refreshSkew{instance, max})
+}
+
+// Returns true if the item of k, whose refresh deadline is rd, should be
+// refreshed by this instance.
+func (c *cache) refreshDue(k string, rd int64) bool {
+	now := timeNow().UnixNano()
+	if now <= rd {
+		return false
+	}
+	if sk, ok := c.refreshSkew.Load().(refreshSkew); ok && sk.max > 0 {
+		return now > rd+int64(slabHash(sk.instance+"\x00"+k)%uint64(sk.max))
+	}
+	return true
+}
+
+// Settings for the pool of workers calling the OnRefreshNeeded function.
+type RefreshPoolOptions struct {
+	// Number of workers kept running even when there is nothing to refresh.
+	MinWorkers int
+	// Number of workers the pool grows to while keys are waiting to be
+	// refreshed. Set to MinWorkers if it is less.
+	MaxWorkers int
+	// How long a worker above MinWorkers waits for a key before exiting.
+	// Defaults to DefaultRefreshIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// The refresh workers. Starts with the refreshWorkerCount given to New as both
+// its minimum and maximum size.
+type refreshPool struct {
+	mutex       sync.Mutex // guards the fields below but queued
+	min         int
+	max         int
+	idleTimeout time.Duration
+	workers     int
+	idle        int   // workers waiting for a key
+	queued      int64 // keys waiting for a worker, updated atomically
+	panics      int64 // updated atomically
+	skipped     int64 // updated atomically
+}
+
+// Sets how many workers call the OnRefreshNeeded function, so that the pool
+// can grow while refreshes are queued and shrink back when it's idle.
+func (c *cache) SetRefreshPool(o RefreshPoolOptions) {
+	if o.MinWorkers < 0 {
+		o.MinWorkers = 0
+	}
+	if o.MaxWorkers < o.MinWorkers {
+		o.MaxWorkers = o.MinWorkers
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = DefaultRefreshIdleTimeout
+	}
+	p := &c.refresh
+	p.mutex.Lock()
+	p.min, p.max, p.idleTimeout = o.MinWorkers, o.MaxWorkers, o.IdleTimeout
+	p.mutex.Unlock()
+	p.spawn(c)
+}
+
+// Starts the workers needed to reach the pool's minimum size, and one more if
+// keys are waiting and no worker is idle.
+func (p *refreshPool) spawn(c *cache) {
+	p.mutex.Lock()
+	for p.workers < p.min || (p.workers < p.max && int(atomic.LoadInt64(&p.queued)) > p.idle) {
+		p.workers++
+		go c.refreshWorker()
+	}
+	p.mutex.Unlock()
+}
+
+// Queues k for a refresh worker, in the queue of its priority, or for Advance
+// if the cache is deterministic.
+func (c *cache) enqueueRefresh(k string) {
+	c.refreshStarted(k)
+	atomic.AddInt64(&c.refresh.queued, 1)
+	if c.deferRefresh(k) {
+		return
+	}
+	c.refresh.spawn(c)
+	queue := c.refreshKeys
+	switch c.refreshPriority(k) {
+	case RefreshPriorityHigh:
+		queue = c.refreshHigh
+	case RefreshPriorityLow:
+		queue = c.refreshLow
+	}
+	go func() {
+		queue <- k
+	}()
+}
+
+// Returns the next key to refresh, taking the keys of higher priority first,
+// and false if none came before timeout.
+func (c *cache) nextRefresh(timeout <-chan time.Time) (string, bool) {
+	select {
+	case k := <-c.refreshHigh:
+		return k, true
+	default:
+	}
+	select {
+	case k := <-c.refreshHigh:
+		return k, true
+	case k := <-c.refreshKeys:
+		return k, true
+	default:
+	}
+	select {
+	case k := <-c.refreshHigh:
+		return k, true
+	case k := <-c.refreshKeys:
+		return k, true
+	case k := <-c.refreshLow:
+		return k, true
+	case <-timeout:
+		return "", false
+	}
+}
+
+func (c *cache) refreshWorker() {
+	p := &c.refresh
+	var timer *time.Timer
+	for {
+		p.mutex.Lock()
+		p.idle++
+		var timeout <-chan time.Time
+		if p.workers > p.min && p.idleTimeout > 0 {
+			if timer == nil {
+				timer = time.NewTimer(p.idleTimeout)
+			} else {
+				timer.Reset(p.idleTimeout)
+			}
+			timeout = timer.C
+		}
+		p.mutex.Unlock()
+		if k, ok := c.nextRefresh(timeout); ok {
+			p.mutex.Lock()
+			p.idle--
+			p.mutex.Unlock()
+			atomic.AddInt64(&p.queued, -1)
+			if timeout != nil && !timer.Stop() {
+				<-timer.C
+			}
+			c.refreshKey(k)
+			continue
+		}
+		// A key queued as the timeout fired found this worker idle and
+		// started no other, so the worker only exits once the queued keys
+		// are left to others.
+		p.mutex.Lock()
+		p.idle--
+		if p.workers > p.min && int(atomic.LoadInt64(&p.queued)) <= p.idle {
+			p.workers--
+			p.mutex.Unlock()
+			return
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// Calls the OnRefreshNeeded function for k, unless another process holds its
+// refresh lease, recovering from its panics so that the worker keeps running.
+// The key can be queued again once the refresh cooldown has passed.
+func (c *cache) refreshKey(k string) {
+	if c.onRefreshNeeded != nil && c.holdsRefreshLease(k) {
+		c.countKey(k, MetricRefreshes, 1)
+		c.callRefresh(k)
+	}
+	c.refreshFinished(k)
+	if d := time.Duration(atomic.LoadInt64(&c.refreshCooldown)); d > 0 {
+		time.AfterFunc(d, func() {
+			c.refreshDone(k)
+		})
+		return
+	}
+	c.refreshDone(k)
+}
+
+func (c *cache) callRefresh(k string) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&c.refresh.panics, 1)
+			err, ok := r.(error)
+			if !ok {
+				err = fmt.Errorf("%v", r)
+			}
+			if h, ok := c.refreshErrorHandler.Load().(func(string, error)); ok {
+				h(k, err)
+			} else {
+				log.Errorf("error refreshing %s : %s\n%s", k, err, debug.Stack())
+			}
+		}
+	}()
+	c.onRefreshNeeded(k)
+}
+
+// Sets a function that is called with the key and the recovered value (as an
+// error) when the OnRefreshNeeded function panics, instead of logging it.
+func (c *cache) OnRefreshError(fn func(k string, err error)) {
+	c.refreshErrorHandler.Store(fn)
+}
+
+func (c *cache) refreshDone(k string) {
+	c.refreshConcurrencyMutex.Lock()
+	delete(c.refreshConcurrencyMap, k)
+	c.refreshConcurrencyMutex.Unlock()
+}
+
+// Sets how long after a key has been refreshed it can't be queued for a
+// refresh again, even if its refresh deadline is still in the past, e.g.
+// because the OnRefreshNeeded function failed to set it. Zero (the default)
+// means it can be queued again right away.
+func (c *cache) SetRefreshCooldown(d time.Duration) {
+	atomic.StoreInt64(&c.refreshCooldown, int64(d))
+}
+
+func (p *refreshPool) reportStats(st *Stats) {
+	p.mutex.Lock()
+	st.RefreshWorkers = p.workers
+	st.RefreshBusyWorkers = p.workers - p.idle
+	p.mutex.Unlock()
+	st.RefreshQueueDepth = atomic.LoadInt64(&p.queued)
+	st.RefreshPanics = atomic.LoadInt64(&p.panics)
+	st.RefreshSkipped = atomic.LoadInt64(&p.skipped)
+}
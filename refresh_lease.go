@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	redis "gopkg.in/redis.v4"
+)
+
+// The name of the lease taken when RefreshLeaseOptions.Global is set.
+const globalRefreshLease = "refresh-leader"
+
+// Settings for SetRefreshLease.
+type RefreshLeaseOptions struct {
+	// How long a lease is held once taken. For per-key leases, this is also
+	// how long the other instances skip refreshing the key.
+	TTL time.Duration
+	// Take a single lease, renewed by its holder on every refresh, instead of
+	// one per key, so that a single instance refreshes every key.
+	Global bool
+}
+
+// Implemented by storages shared by several processes that can grant one of
+// them a lease, e.g. the Redis storages. Returns true if the lease is held by
+// owner: it was free and is now taken for ttl, or owner held it already and
+// it's been renewed.
+type refreshLeaser interface {
+	leaseRefresh(name, owner string, ttl time.Duration) (bool, error)
+}
+
+// Returns the storage s is or wraps that can grant leases, if any.
+func refreshLeaserOf(s Storage) (refreshLeaser, bool) {
+	return storageAs[refreshLeaser](s)
+}
+
+type refreshLease struct {
+	leaser refreshLeaser
+	owner  string
+	opts   RefreshLeaseOptions
+}
+
+// Makes the processes sharing the cache's storage take a lease before calling
+// their OnRefreshNeeded function, and skip the refresh if another process
+// holds it, so that a key due for a refresh is refreshed once rather than by
+// every process reading it. Returns an error if the storage can't grant
+// leases. A TTL of zero stops taking leases.
+func (c *cache) SetRefreshLease(o RefreshLeaseOptions) error {
+	if o.TTL <= 0 {
+		c.refreshLease.Store((*refreshLease)(nil))
+		return nil
+	}
+	leaser, ok := refreshLeaserOf(c.storage)
+	if !ok {
+		return newError(ErrNotSupported, "Storage doesn't support refresh leases")
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	c.refreshLease.Store(&refreshLease{leaser: leaser, owner: hex.EncodeToString(id), opts: o})
+	return nil
+}
+
+// Returns true if this process should refresh k. Refreshes go ahead when the
+// lease can't be checked, since refreshing twice is better than not at all.
+func (c *cache) holdsRefreshLease(k string) bool {
+	l, _ := c.refreshLease.Load().(*refreshLease)
+	if l == nil {
+		return true
+	}
+	name := k
+	if l.opts.Global {
+		name = globalRefreshLease
+	}
+	ok, err := l.leaser.leaseRefresh(name, l.owner, l.opts.TTL)
+	if err != nil {
+		log.Errorf("error leasing refresh of %s : %s", k, err)
+		return true
+	}
+	if !ok {
+		atomic.AddInt64(&c.refresh.skipped, 1)
+	}
+	return ok
+}
+
+// Takes the lease if it's free, or renews it if owner holds it, atomically.
+var redisLeaseScript = redis.NewScript(`
+local v = redis.call("GET", KEYS[1])
+if not v then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if v == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+func (s *redisStorage) leaseRefresh(name, owner string, ttl time.Duration) (bool, error) {
+	res, err := redisLeaseScript.Run(s.redisClient, []string{s.internalKey("lease", name)}, owner, int64(ttl/time.Millisecond)).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.(int64)
+	return n == 1, nil
+}
+
+func (s *shardedRedisStorage) leaseRefresh(name, owner string, ttl time.Duration) (bool, error) {
+	node := s.node(name)
+	if node == nil {
+		return false, errNoHealthyNode
+	}
+	return node.leaseRefresh(name, owner, ttl)
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Marks the type tag of a value encoded by a Redis storage, which JSON values
+// never start with.
+const typeTagMarker = "#"
+
+// The types registered with RegisterType.
+var registry struct {
+	mutex sync.RWMutex
+	names map[reflect.Type]string
+	news  map[string]func() interface{}
+}
+
+// Registers the type of the values new returns under name, so that the Redis
+// storages record name alongside the values of that type they store, and Get
+// decodes them into a value returned by new instead of into maps. new
+// usually returns a pointer, e.g. func() interface{} { return &User{} }, and
+// is then called for every value decoded; only values of exactly that type are
+// tagged. Every process sharing the storage must register the same names.
+// Panics if name is empty or contains '|', or if name or the type are already
+// registered.
+func RegisterType(name string, new func() interface{}) {
+	if name == "" || strings.Contains(name, "|") {
+		panic("invalid type name " + name)
+	}
+	t := reflect.TypeOf(new())
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, found := registry.news[name]; found {
+		panic("type name " + name + " registered twice")
+	}
+	if _, found := registry.names[t]; found {
+		panic("type " + t.String() + " registered twice")
+	}
+	if registry.names == nil {
+		registry.names = make(map[reflect.Type]string)
+		registry.news = make(map[string]func() interface{})
+	}
+	registry.names[t] = name
+	registry.news[name] = new
+}
+
+// Returns the name x's type is registered under, if any.
+func registeredName(x interface{}) (string, bool) {
+	if x == nil {
+		return "", false
+	}
+	registry.mutex.RLock()
+	name, found := registry.names[reflect.TypeOf(x)]
+	registry.mutex.RUnlock()
+	return name, found
+}
+
+// Returns a new value to decode a value of the type registered under name
+// into, and a func returning the decoded value.
+func registeredValue(name string) (interface{}, func() interface{}, bool) {
+	registry.mutex.RLock()
+	new, found := registry.news[name]
+	registry.mutex.RUnlock()
+	if !found {
+		return nil, nil, false
+	}
+	v := new()
+	if reflect.TypeOf(v).Kind() == reflect.Ptr {
+		return v, func() interface{} { return v }, true
+	}
+	p := reflect.New(reflect.TypeOf(v))
+	return p.Interface(), func() interface{} { return p.Elem().Interface() }, true
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+)
+
+// Implemented by storages that can move an item to another key in a single
+// operation. Returns false if oldKey has no item.
+type renamer interface {
+	rename(oldKey, newKey string) (bool, error)
+}
+
+// Moves the item of oldKey to newKey, replacing any item newKey has, with its
+// expiration and refresh deadline. Uses RENAME on Redis, so other processes
+// never see both keys or neither. Returns an error matching ErrNotFound if
+// oldKey has no item.
+func (c *cache) Rename(oldKey, newKey string) error {
+	if oldKey == newKey {
+		return nil
+	}
+	c.storage.Lock()
+	err := c.rename(oldKey, newKey)
+	c.storage.Unlock()
+	if err != nil {
+		return err
+	}
+	c.invalidate(invalidation{Key: oldKey})
+	c.invalidate(invalidation{Key: newKey})
+	return nil
+}
+
+// Called with the storage locked.
+func (c *cache) rename(oldKey, newKey string) error {
+	if r, ok := c.storage.(renamer); ok {
+		found, err := r.rename(oldKey, newKey)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return newError(ErrNotFound, "Item %s not found", oldKey)
+		}
+		c.reread(newKey)
+	} else {
+		item, found, err := tryGet(c.storage, oldKey)
+		if err != nil {
+			return err
+		}
+		if !found || item.Expired() {
+			return newError(ErrNotFound, "Item %s not found", oldKey)
+		}
+		if err := trySet(c.storage, newKey, item); err != nil {
+			return err
+		}
+		if err := tryDel(c.storage, oldKey); err != nil {
+			return err
+		}
+		c.written(newKey, item)
+	}
+	c.removed(oldKey)
+	c.unpin(oldKey)
+	return nil
+}
+
+// Renames every item whose key starts with prefixOld to the same key starting
+// with prefixNew instead, e.g. when changing the cache's key schema. Items
+// are renamed one at a time, so the cache stays usable while they are:
+// readers see each item under one of its keys. Returns the number of items
+// renamed.
+func (c *cache) Migrate(prefixOld, prefixNew string) (int, error) {
+	ks, ok := keyScannerOf(c.storage)
+	if !ok {
+		return 0, newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	c.storage.RLock()
+	var keys []string
+	err := ks.scanKeys(prefixOld, func(k string) {
+		keys = append(keys, k)
+	})
+	c.storage.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		err := c.Rename(k, prefixNew+strings.TrimPrefix(k, prefixOld))
+		if err == nil {
+			n++
+		} else if !errors.Is(err, ErrNotFound) {
+			// Items deleted or expired since they were listed are skipped.
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// RENAME keeps the key's TTL.
+func (s *redisStorage) rename(oldKey, newKey string) (bool, error) {
+	err := s.redisClient.Rename(s.key(oldKey), s.key(newKey)).Err()
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Settings for RetryStorage. The zero value gives the defaults.
+type RetryOptions struct {
+	// Total number of times an operation is tried. Defaults to 3.
+	Attempts int
+	// How long to wait before the first retry. The wait doubles after every
+	// further failure. Defaults to 10 milliseconds.
+	Backoff time.Duration
+	// The longest wait between two attempts. Defaults to 1 second.
+	MaxBackoff time.Duration
+	// Reports whether an operation that failed with the given error should be
+	// tried again. Defaults to IsTransientError.
+	Retryable func(error) bool
+}
+
+// Returns true if err is likely to go away if the operation is simply tried
+// again: dropped connections, network timeouts, and Redis servers that are
+// loading their dataset or failing over.
+func IsTransientError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	for _, prefix := range []string{"LOADING", "READONLY", "MASTERDOWN", "TRYAGAIN"} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type retryStorage struct {
+	Storage
+	opts RetryOptions
+}
+
+// Calls op until it succeeds, fails with an error that isn't retryable, or
+// runs out of attempts, and returns its last error.
+func (s *retryStorage) retry(op func() error) error {
+	wait := s.opts.Backoff
+	err := op()
+	for i := 1; i < s.opts.Attempts && err != nil && s.opts.Retryable(err); i++ {
+		time.Sleep(wait)
+		if wait *= 2; wait > s.opts.MaxBackoff {
+			wait = s.opts.MaxBackoff
+		}
+		err = op()
+	}
+	return err
+}
+
+func (s *retryStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *retryStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *retryStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *retryStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *retryStorage) TryGet(key string) (item Item, found bool, err error) {
+	err = s.retry(func() (err error) {
+		item, found, err = tryGet(s.Storage, key)
+		return
+	})
+	return
+}
+
+func (s *retryStorage) TryGetObject(key string, o interface{}) (item Item, found bool, err error) {
+	err = s.retry(func() (err error) {
+		item, found, err = tryGetObject(s.Storage, key, o)
+		return
+	})
+	return
+}
+
+func (s *retryStorage) TrySet(key string, item Item) error {
+	return s.retry(func() error {
+		return trySet(s.Storage, key, item)
+	})
+}
+
+func (s *retryStorage) TryDel(key string) error {
+	return s.retry(func() error {
+		return tryDel(s.Storage, key)
+	})
+}
+
+func (s *retryStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// Returns a storage that retries the failed reads, writes and deletes of s
+// with exponential backoff. Only storages that report their errors (see
+// CheckedStorage), such as the Redis storages, can actually fail; the others
+// are passed through untouched.
+func RetryStorage(s Storage, o RetryOptions) *retryStorage {
+	if o.Attempts <= 0 {
+		o.Attempts = 3
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 10 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Second
+	}
+	if o.Retryable == nil {
+		o.Retryable = IsTransientError
+	}
+	return &retryStorage{
+		Storage: s,
+		opts:    o,
+	}
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Implemented by storages that can list their keys a page at a time on their
+// own, e.g. with Redis's SCAN.
+type keyPager interface {
+	pageKeys(pattern string, cursor uint64, count int) ([]string, uint64, error)
+}
+
+// Returns the storage s is or wraps that can page through its keys, if any.
+func keyPagerOf(s Storage) (keyPager, bool) {
+	return storageAs[keyPager](s)
+}
+
+// Returns a page of the keys matching pattern, starting at cursor (0 for the
+// first page), and the cursor of the next page, which is 0 once every key has
+// been returned. The pattern is a glob as understood by Redis: * matches any
+// sequence of characters, ? any single character, [abc] and [a-z] a character
+// of the set, and \ escapes the next character. Like Redis's SCAN COUNT, count
+// is a hint: a page may hold more or fewer keys, and can be empty before the
+// last one. A key present for the whole iteration is returned at least once;
+// keys set or deleted in the meantime may or may not be. Expired items not
+// deleted yet may be listed.
+//
+// Redis storages use SCAN, never KEYS. Other storages that can list their keys
+// go through all of them for the first page, holding the storage's read lock,
+// so writers wait for that one pass; the matching keys are kept, and the
+// following pages are read from them without going through the storage again.
+func (c *cache) Keys(pattern string, cursor uint64, count int) ([]string, uint64, error) {
+	if count < 1 {
+		count = 10
+	}
+	if kp, ok := keyPagerOf(c.storage); ok {
+		return kp.pageKeys(pattern, cursor, count)
+	}
+	ks, ok := keyScannerOf(c.storage)
+	if !ok {
+		return nil, 0, newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	c.storage.RLock()
+	defer c.storage.RUnlock()
+	return pageScannedKeys(ks, pattern, cursor, count)
+}
+
+// How long the keys listed for a Keys iteration are kept after its last page
+// was asked for.
+const keySnapshotTTL = 5 * time.Minute
+
+// The keys matching a pattern that a storage listed for the first page of an
+// iteration, from which the following pages are served.
+type keySnapshot struct {
+	ks      keyScanner
+	pattern string
+	keys    []string
+	used    time.Time
+}
+
+var (
+	keySnapshotsMutex sync.Mutex
+	keySnapshots      = map[uint32]*keySnapshot{}
+	lastKeySnapshot   uint32
+)
+
+// Pages through the keys of a storage that can only list all of them. The
+// first page lists the matching keys once and keeps them; the cursor holds
+// the id of that snapshot in its upper half and the offset of the next page
+// in the lower one, so the following pages cost only their own keys. A
+// cursor whose snapshot is gone, e.g. because it wasn't used for
+// keySnapshotTTL, starts over with a new one, which still returns every key
+// present for the whole iteration at least once.
+func pageScannedKeys(ks keyScanner, pattern string, cursor uint64, count int) ([]string, uint64, error) {
+	id, offset := uint32(cursor>>32), int(uint32(cursor))
+	now := timeNow()
+	keySnapshotsMutex.Lock()
+	for i, snap := range keySnapshots {
+		if now.Sub(snap.used) > keySnapshotTTL {
+			delete(keySnapshots, i)
+		}
+	}
+	snap := keySnapshots[id]
+	if snap != nil && (snap.ks != ks || snap.pattern != pattern || offset > len(snap.keys)) {
+		snap = nil
+	}
+	keySnapshotsMutex.Unlock()
+	if snap == nil {
+		var keys []string
+		err := ks.scanKeys(globPrefix(pattern), func(k string) {
+			if globMatch(pattern, k) {
+				keys = append(keys, k)
+			}
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(keys) <= count {
+			return keys, 0, nil
+		}
+		snap, offset = &keySnapshot{ks: ks, pattern: pattern, keys: keys, used: now}, 0
+		keySnapshotsMutex.Lock()
+		for lastKeySnapshot++; lastKeySnapshot == 0 || keySnapshots[lastKeySnapshot] != nil; lastKeySnapshot++ {
+		}
+		id = lastKeySnapshot
+		keySnapshots[id] = snap
+		keySnapshotsMutex.Unlock()
+	}
+	end := offset + count
+	keySnapshotsMutex.Lock()
+	defer keySnapshotsMutex.Unlock()
+	if end >= len(snap.keys) {
+		delete(keySnapshots, id)
+		return append([]string(nil), snap.keys[offset:]...), 0, nil
+	}
+	snap.used = now
+	return append([]string(nil), snap.keys[offset:end]...), uint64(id)<<32 | uint64(end), nil
+}
+
+// Returns the literal part of pattern before its first special character.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// Returns whether s matches the glob pattern, with the same rules as Redis.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest := globClass(pattern[1:], s[0])
+			if !matched {
+				return false
+			}
+			s = s[1:]
+			pattern = rest
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// Returns whether c is in the character class at the start of pattern (just
+// after its [), and the rest of the pattern after the class.
+func globClass(pattern string, c byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		pattern = pattern[1:]
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi = pattern[1]
+			if hi == '\\' && len(pattern) > 2 {
+				hi = pattern[2]
+				pattern = pattern[1:]
+			}
+			pattern = pattern[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != not, pattern
+}
+
+// Uses SCAN with the storage's prefix prepended to the pattern, so only this
+// storage's keys are listed, and the server is never blocked as it would be
+// by KEYS. The cursor is Redis's own.
+func (s *redisStorage) pageKeys(pattern string, cursor uint64, count int) ([]string, uint64, error) {
+	keys, next, err := s.redisClient.Scan(cursor, redisPatternEscaper.Replace(s.prefix)+pattern, int64(count)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, s.prefix)
+	}
+	return keys, next, nil
+}
@@ -0,0 +1,268 @@
+// Package server exposes a cache over the memcached text protocol, so that
+// programs in other languages can share a Go process's cache.
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	cache "github.com/rooholam/go-cache"
+)
+
+const (
+	// Expiration times above this many seconds are Unix timestamps rather
+	// than durations, as in memcached.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+	// The largest value accepted by set, add and replace.
+	maxValueSize = 1 << 20
+	// Reported by the version command.
+	version = "go-cache"
+)
+
+// A memcached text protocol server backed by a cache. Values are stored as
+// bytes with SetBytes, so Go code can read them with GetBytes, and the items
+// set by Go code with SetBytes can be read by memcached clients. Flags are not stored: get always returns 0. The
+// supported commands are get, gets (without CAS), set, add, replace, delete,
+// incr, decr, touch, flush_all, version and quit.
+type Server struct {
+	c *cache.Cache
+	// Makes add, replace, incr and decr atomic for the server's clients. Go
+	// code changing the same keys at the same time may still interleave with
+	// them.
+	mutex sync.Mutex
+}
+
+// Returns a server for c.
+func New(c *cache.Cache) *Server {
+	return &Server{c: c}
+}
+
+// Listens on the TCP address addr and serves connections until listening
+// fails.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serves the connections accepted on l, each in its own goroutine, until
+// Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("error reading memcached command : %s", err)
+			}
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else if fields[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := s.handle(fields, r, w); err != nil {
+			log.Errorf("error serving memcached command : %s", err)
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Converts a memcached expiration time to a duration for the cache.
+func expiration(exptime int64) time.Duration {
+	switch {
+	case exptime == 0:
+		return cache.NoExpiration
+	case exptime < 0:
+		// Expired right away; one nanosecond, since 0 is the default.
+		return time.Nanosecond
+	case exptime > maxRelativeExptime:
+		if d := time.Unix(exptime, 0).Sub(time.Now()); d > 0 {
+			return d
+		}
+		return time.Nanosecond
+	}
+	return time.Duration(exptime) * time.Second
+}
+
+// Returns the time left until the item expires, for writes that keep it.
+func remaining(item cache.Item) time.Duration {
+	if item.Expiration == 0 {
+		return cache.NoExpiration
+	}
+	if d := time.Unix(0, item.Expiration).Sub(time.Now()); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
+
+// Handles one command. Returns an error only if the connection must be
+// closed, e.g. because of a truncated value.
+func (s *Server) handle(fields []string, r *bufio.Reader, w *bufio.Writer) error {
+	noreply := len(fields) > 1 && fields[len(fields)-1] == "noreply"
+	if noreply {
+		fields = fields[:len(fields)-1]
+	}
+	reply := func(msg string) {
+		if !noreply {
+			fmt.Fprint(w, msg+"\r\n")
+		}
+	}
+	switch cmd := fields[0]; cmd {
+	case "get", "gets":
+		for _, k := range fields[1:] {
+			if b, found := s.c.GetBytes(k); found {
+				fmt.Fprintf(w, "VALUE %s 0 %d", k, len(b))
+				if cmd == "gets" {
+					fmt.Fprint(w, " 0")
+				}
+				fmt.Fprint(w, "\r\n")
+				w.Write(b)
+				fmt.Fprint(w, "\r\n")
+			}
+		}
+		fmt.Fprint(w, "END\r\n")
+	case "set", "add", "replace":
+		if len(fields) != 5 {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+		exptime, err1 := strconv.ParseInt(fields[3], 10, 64)
+		n, err2 := strconv.Atoi(fields[4])
+		if err1 != nil || err2 != nil || n < 0 || n > maxValueSize {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		if string(b[n:]) != "\r\n" {
+			reply("CLIENT_ERROR bad data chunk")
+			return nil
+		}
+		if cmd == "set" {
+			s.c.SetBytes(fields[1], b[:n], expiration(exptime), cache.NoRefreshDeadline)
+			reply("STORED")
+			return nil
+		}
+		reply(s.store(fields[1], b[:n], expiration(exptime), cmd == "replace"))
+	case "delete":
+		if len(fields) != 2 {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+		if _, found := s.c.GetBytes(fields[1]); !found {
+			reply("NOT_FOUND")
+			return nil
+		}
+		s.c.Delete(fields[1])
+		reply("DELETED")
+	case "incr", "decr":
+		if len(fields) != 3 {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+		delta, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid numeric delta argument")
+			return nil
+		}
+		reply(s.incr(fields[1], delta, cmd == "decr"))
+	case "touch":
+		if len(fields) != 3 {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+		exptime, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR bad command line format")
+			return nil
+		}
+		b, found := s.c.GetBytes(fields[1])
+		if !found {
+			reply("NOT_FOUND")
+			return nil
+		}
+		s.c.SetBytes(fields[1], append([]byte(nil), b...), expiration(exptime), cache.NoRefreshDeadline)
+		reply("TOUCHED")
+	case "flush_all":
+		s.c.Flush()
+		reply("OK")
+	case "version":
+		fmt.Fprint(w, "VERSION "+version+"\r\n")
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return nil
+}
+
+// Sets b for k if k already exists (for replace) or doesn't (for add), with
+// the check and the set atomic for the server's clients. Returns the reply to
+// send.
+func (s *Server) store(k string, b []byte, d time.Duration, replace bool) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, found := s.c.GetBytes(k); found != replace {
+		return "NOT_STORED"
+	}
+	s.c.SetBytes(k, b, d, cache.NoRefreshDeadline)
+	return "STORED"
+}
+
+// Adds delta to (or, with decr, subtracts it from) the decimal value of k,
+// keeping its expiration. As in memcached, decr stops at 0 and incr wraps
+// around. Returns the reply to send.
+func (s *Server) incr(k string, delta uint64, decr bool) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, found := s.c.GetBytes(k)
+	if !found {
+		return "NOT_FOUND"
+	}
+	v, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	}
+	switch {
+	case !decr:
+		v += delta
+	case delta > v:
+		v = 0
+	default:
+		v -= delta
+	}
+	d := cache.NoExpiration
+	if item, found := s.c.InspectItem(k); found {
+		d = remaining(item)
+	}
+	res := strconv.FormatUint(v, 10)
+	s.c.SetBytes(k, []byte(res), d, cache.NoRefreshDeadline)
+	return res
+}
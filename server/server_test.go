@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+
+	cache "github.com/rooholam/go-cache"
+)
+
+func TestServer(t *testing.T) {
+	c := cache.New(cache.DefaultExpiration, 0, 0, cache.MemoryStorage())
+	s := New(c)
+	client, conn := net.Pipe()
+	go s.serveConn(conn)
+	defer client.Close()
+	r := bufio.NewReader(client)
+	exchange := func(cmd string, want ...string) {
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range want {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != w+"\r\n" {
+				t.Errorf("%q: got %q, want %q", cmd, line, w)
+			}
+		}
+	}
+	exchange("set foo 0 0 3\r\nbar\r\n", "STORED")
+	exchange("get foo missing\r\n", "VALUE foo 0 3", "bar", "END")
+	if b, found := c.GetBytes("foo"); !found || string(b) != "bar" {
+		t.Error("value set over memcached was not stored as bytes:", b)
+	}
+	exchange("add foo 0 0 1\r\nx\r\n", "NOT_STORED")
+	exchange("set n 0 0 1\r\n9\r\n", "STORED")
+	exchange("incr n 3\r\n", "12")
+	exchange("decr n 20\r\n", "0")
+	exchange("delete foo\r\n", "DELETED")
+	exchange("delete foo\r\n", "NOT_FOUND")
+	exchange("bogus\r\n", "ERROR")
+}
+
+func TestServerConcurrentAdd(t *testing.T) {
+	c := cache.New(cache.DefaultExpiration, 0, 0, cache.MemoryStorage())
+	s := New(c)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	stored := 0
+	for i := 0; i < 20; i++ {
+		client, conn := net.Pipe()
+		go s.serveConn(conn)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			if _, err := client.Write([]byte("add foo 0 0 1\r\nx\r\n")); err != nil {
+				t.Error(err)
+				return
+			}
+			line, err := bufio.NewReader(client).ReadString('\n')
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if line == "STORED\r\n" {
+				mutex.Lock()
+				stored++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if stored != 1 {
+		t.Errorf("%d concurrent adds of the same key stored, want 1", stored)
+	}
+}
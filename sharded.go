@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"time"
+)
+
+// A cache split into several independent caches, each with its own storage
+// and lock, so that goroutines using different keys don't wait for each
+// other. Keys are assigned to the shards by DefaultPartitioner.
+type ShardedCache struct {
+	shards    []*Cache
+	partition Partitioner
+}
+
+// Returns a cache made of n shards, each created as by New with a storage
+// returned by storage, e.g. MemoryStorage. Whether more shards help depends on
+// the number of goroutines and on the mix of reads and writes; the
+// BenchmarkShardedCache benchmarks compare shard counts.
+func NewSharded(n int, defaultExpiration, cleanupInterval time.Duration, refreshWorkerCount int, storage func() Storage) *ShardedCache {
+	if n < 1 {
+		n = 1
+	}
+	sc := &ShardedCache{
+		shards:    make([]*Cache, n),
+		partition: DefaultPartitioner,
+	}
+	for i := range sc.shards {
+		sc.shards[i] = New(defaultExpiration, cleanupInterval, refreshWorkerCount, storage())
+	}
+	return sc
+}
+
+// Returns the shard storing k.
+func (sc *ShardedCache) Shard(k string) *Cache {
+	return sc.shards[sc.partition.Hash(k)%uint32(len(sc.shards))]
+}
+
+// Get an item from the cache, as for Cache.Get.
+func (sc *ShardedCache) Get(k string) (interface{}, bool) {
+	return sc.Shard(k).Get(k)
+}
+
+// Add an item to the cache, replacing any existing item, as for Cache.Set.
+func (sc *ShardedCache) Set(k string, x interface{}, d time.Duration, rd time.Duration) {
+	sc.Shard(k).Set(k, x, d, rd)
+}
+
+// Add an item to the cache only if it doesn't exist, as for Cache.Add.
+func (sc *ShardedCache) Add(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	return sc.Shard(k).Add(k, x, d, rd)
+}
+
+// Set a new value for the key only if it exists, as for Cache.Replace.
+func (sc *ShardedCache) Replace(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	return sc.Shard(k).Replace(k, x, d, rd)
+}
+
+// Delete an item from the cache.
+func (sc *ShardedCache) Delete(k string) {
+	sc.Shard(k).Delete(k)
+}
+
+// Delete all items from every shard. Returns the number of items deleted, or
+// -1 if a shard's storage can't tell.
+func (sc *ShardedCache) Flush() int {
+	total := 0
+	for _, c := range sc.shards {
+		n := c.Flush()
+		if n < 0 || total < 0 {
+			total = -1
+		} else {
+			total += n
+		}
+	}
+	return total
+}
+
+// Flushes every shard with FlushAsync. The returned channel receives the total
+// number of items deleted, as for Flush, once every shard is done.
+func (sc *ShardedCache) FlushAsync() <-chan int {
+	shards := make([]<-chan int, len(sc.shards))
+	for i, c := range sc.shards {
+		shards[i] = c.FlushAsync()
+	}
+	done := make(chan int, 1)
+	go func() {
+		total := 0
+		for _, ch := range shards {
+			n := <-ch
+			if n < 0 || total < 0 {
+				total = -1
+			} else {
+				total += n
+			}
+		}
+		done <- total
+	}()
+	return done
+}
@@ -0,0 +1,285 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// How often a sharded Redis storage pings its nodes by default.
+	DefaultHealthCheckInterval = time.Second
+	// Number of points each node gets on the hash ring. More points spread
+	// keys more evenly at the cost of a bigger ring.
+	hashRingReplicas = 160
+)
+
+var errNoHealthyNode error = &kindError{ErrStorageUnavailable, "no healthy Redis node"}
+
+// A consistent hash ring mapping keys to node indexes. Only the nodes marked
+// as live get points on the ring, so the keys of a failed node are spread
+// over the remaining ones while all other keys stay where they are.
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]int
+}
+
+func hashRingKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newHashRing(names []string, live []bool) *hashRing {
+	r := &hashRing{
+		owners: make(map[uint32]int),
+	}
+	for i, name := range names {
+		if !live[i] {
+			continue
+		}
+		for j := 0; j < hashRingReplicas; j++ {
+			h := hashRingKey(strconv.Itoa(j) + "-" + name)
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = i
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Sort(uint32Slice(r.hashes))
+	return r
+}
+
+// Returns the index of the node owning k, or -1 if no node is live.
+func (r *hashRing) get(k string) int {
+	return r.getHash(hashRingKey(k))
+}
+
+// Returns the index of the node owning the keys with hash h, or -1 if no node
+// is live.
+func (r *hashRing) getHash(h uint32) int {
+	if len(r.hashes) == 0 {
+		return -1
+	}
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+type uint32Slice []uint32
+
+func (p uint32Slice) Len() int           { return len(p) }
+func (p uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type shardedRedisStorage struct {
+	addrs      []string
+	nodes      []*redisStorage
+	live       []bool
+	ring       *hashRing
+	ringMutex  sync.RWMutex
+	partition  Partitioner
+	lock       *redisLock
+	mutex      sync.Mutex // used instead of lock when locking is disabled
+	stopHealth chan bool
+}
+
+// Returns the node owning k, or nil if no node is currently healthy.
+func (s *shardedRedisStorage) node(k string) *redisStorage {
+	s.ringMutex.RLock()
+	i := s.ring.getHash(s.partition.Hash(k))
+	s.ringMutex.RUnlock()
+	if i < 0 {
+		return nil
+	}
+	return s.nodes[i]
+}
+
+func (s *shardedRedisStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *shardedRedisStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *shardedRedisStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *shardedRedisStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *shardedRedisStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+func (s *shardedRedisStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	n := s.node(key)
+	if n == nil {
+		return Item{}, false, errNoHealthyNode
+	}
+	return n.TryGetObject(key, o)
+}
+
+func (s *shardedRedisStorage) TrySet(key string, item Item) error {
+	n := s.node(key)
+	if n == nil {
+		return errNoHealthyNode
+	}
+	return n.TrySet(key, item)
+}
+
+func (s *shardedRedisStorage) TryDel(key string) error {
+	n := s.node(key)
+	if n == nil {
+		return errNoHealthyNode
+	}
+	return n.TryDel(key)
+}
+
+// Flushes every node, including unhealthy ones, so that keys written before a
+// node failed don't reappear once it recovers.
+func (s *shardedRedisStorage) Flush() {
+	for _, n := range s.nodes {
+		n.Flush()
+	}
+}
+
+func (s *shardedRedisStorage) Lock() {
+	if s.lock == nil {
+		s.mutex.Lock()
+		return
+	}
+	s.lock.Lock()
+}
+
+func (s *shardedRedisStorage) Unlock() {
+	if s.lock == nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.lock.Unlock()
+}
+
+func (s *shardedRedisStorage) RLock() {
+	// nothing to do
+}
+
+func (s *shardedRedisStorage) RUnlock() {
+	// nothing to do
+}
+
+func (s *shardedRedisStorage) Type() int {
+	return STORAGE_TYPE_REDIS
+}
+
+// Adds up the metrics of the nodes.
+func (s *shardedRedisStorage) reportStats(st *Stats) {
+	for _, node := range s.nodes {
+		node.reportStats(st)
+	}
+}
+
+// Pings every node and takes the ones that don't answer off the ring until
+// they do. A node that answers again is flushed before it's put back, since
+// the writes and deletes of its keys went to other nodes in the meantime:
+// its keys are then misses, as they were while it was down.
+func (s *shardedRedisStorage) checkHealth() {
+	changed := false
+	live := make([]bool, len(s.nodes))
+	for i, n := range s.nodes {
+		live[i] = n.redisClient.Ping().Err() == nil
+		if live[i] != s.live[i] {
+			changed = true
+			if live[i] {
+				log.Infof("Redis node %s is healthy again, flushing it", s.addrs[i])
+				n.Flush()
+			} else {
+				log.Errorf("Redis node %s is unhealthy, removing it from the ring", s.addrs[i])
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	ring := newHashRing(s.addrs, live)
+	s.ringMutex.Lock()
+	s.live = live
+	s.ring = ring
+	s.ringMutex.Unlock()
+}
+
+func (s *shardedRedisStorage) runHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			s.checkHealth()
+		case <-s.stopHealth:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// Stops the storage's health checks and keyspace notification subscriptions.
+func (s *shardedRedisStorage) Close() {
+	close(s.stopHealth)
+	for _, n := range s.nodes {
+		n.closeNotifications()
+	}
+}
+
+// Returns a storage that distributes keys over several standalone Redis
+// servers using consistent hashing. Each server is pinged every
+// HealthCheckInterval; while a server is unhealthy its keys are served by the
+// remaining servers (as misses, until they are set again), and all other keys
+// stay where they are. Keys are assigned to servers by o.Partitioner. Every
+// key is stored under prefix, as for RedisStorage. The distributed lock,
+// unless disabled, is held on the first server for every key, so while that
+// server is down Lock fails (see RedisOptions.OnLockError) and locked
+// sections of different processes may overlap.
+func ShardedRedisStorage(addrs []string, pass string, db int, prefix string, o RedisOptions) *shardedRedisStorage {
+	if len(addrs) == 0 {
+		panic("Sharded Redis storage requires at least one address")
+	}
+	s := &shardedRedisStorage{
+		addrs:      addrs,
+		nodes:      make([]*redisStorage, len(addrs)),
+		live:       make([]bool, len(addrs)),
+		partition:  o.Partitioner,
+		stopHealth: make(chan bool),
+	}
+	if s.partition == nil {
+		s.partition = DefaultPartitioner
+	}
+	for i, addr := range addrs {
+		s.nodes[i] = RedisStorageWithOptions(addr, pass, db, prefix, RedisOptions{DisableLock: true})
+		s.live[i] = true
+	}
+	s.ring = newHashRing(addrs, s.live)
+	if !o.DisableLock {
+		s.lock = newRedisLock(s.nodes[0].redisClient, s.nodes[0].internalKey("lock", ""), o.LockTTL, o.LockWait, o.OnLockError)
+	}
+	interval := o.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	go s.runHealthChecks(interval)
+	return s
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestXXHash64(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	} {
+		if h := xxhash64(s); h != want {
+			t.Errorf("xxhash64(%q) = %x, want %x", s, h, want)
+		}
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	sc := NewSharded(8, DefaultExpiration, 0, 0, func() Storage { return MemoryStorage() })
+	for i := 0; i < 100; i++ {
+		sc.Set("key"+strconv.Itoa(i), i, DefaultExpiration, NoRefreshDeadline)
+	}
+	used := map[*Cache]bool{}
+	for i := 0; i < 100; i++ {
+		k := "key" + strconv.Itoa(i)
+		if x, found := sc.Get(k); !found || x.(int) != i {
+			t.Error("wrong value for", k, x)
+		}
+		used[sc.Shard(k)] = true
+	}
+	if len(used) != 8 {
+		t.Error("keys weren't spread over the shards:", len(used))
+	}
+	if err := sc.Add("key1", 1, DefaultExpiration, NoRefreshDeadline); err == nil {
+		t.Error("Add replaced an existing key")
+	}
+	sc.Delete("key1")
+	sc.Flush()
+	if _, found := sc.Get("key2"); found {
+		t.Error("key found after Flush")
+	}
+}
+
+func benchmarkPartitioner(b *testing.B, p Partitioner) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "user:" + strconv.Itoa(i) + ":profile"
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Hash(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkPartitionerXXHash(b *testing.B) {
+	benchmarkPartitioner(b, DefaultPartitioner)
+}
+
+func BenchmarkPartitionerFNV(b *testing.B) {
+	benchmarkPartitioner(b, FNVPartitioner)
+}
+
+func BenchmarkShardedCacheGetManyConcurrentExpiring(b *testing.B) {
+	benchmarkShardedCacheGetManyConcurrent(b, 20, 5*time.Minute)
+}
+
+func BenchmarkShardedCacheGetManyConcurrentNotExpiring(b *testing.B) {
+	benchmarkShardedCacheGetManyConcurrent(b, 20, NoExpiration)
+}
+
+// Compares shard counts for a mixed workload, e.g. with
+// go test -bench BenchmarkShardedCacheShards -cpu 8
+func BenchmarkShardedCacheShards(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8, 16, 32, 64, 128, 256} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			sc := NewSharded(n, NoExpiration, 0, 0, func() Storage { return MemoryStorage() })
+			for i := 0; i < 1000; i++ {
+				sc.Set("foo"+strconv.Itoa(i), "bar", DefaultExpiration, NoRefreshDeadline)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					k := "foo" + strconv.Itoa(i%1000)
+					if i%10 == 0 {
+						sc.Set(k, "bar", DefaultExpiration, NoRefreshDeadline)
+					} else {
+						sc.Get(k)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func benchmarkShardedCacheGetManyConcurrent(b *testing.B, shards int, exp time.Duration) {
+	// This is the same as BenchmarkCacheGetManyConcurrent in cache_test.go,
+	// but with the keys spread over several shards.
+	b.StopTimer()
+	n := 10000
+	sc := NewSharded(shards, exp, 0, 0, func() Storage { return MemoryStorage() })
+	keys := make([]string, n)
+	for i := 0; i < n; i++ {
+		k := "foo" + strconv.Itoa(i)
+		keys[i] = k
+		sc.Set(k, "bar", DefaultExpiration, NoRefreshDeadline)
+	}
+	each := b.N / n
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	for _, v := range keys {
+		go func() {
+			for j := 0; j < each; j++ {
+				sc.Get(v)
+			}
+			wg.Done()
+		}()
+	}
+	b.StartTimer()
+	wg.Wait()
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// Number of items whose values EstimatedSize measures. The size of the
+	// others is extrapolated from them.
+	sizeSampleCount = 1000
+	// What an item costs besides its key and value: its Item struct and its
+	// share of the map's buckets.
+	itemOverhead = int64(unsafe.Sizeof(Item{})) + 16
+	// How deep EstimatedSize follows pointers, slices and maps in values.
+	maxSizeDepth = 8
+)
+
+// Implemented by storages that can estimate how much memory they use. Returns
+// the number of items and their approximate size in bytes, measuring up to
+// sample values. Called with the read lock held.
+type sizeEstimator interface {
+	estimateSize(sample int) (int, int64)
+}
+
+func (s *memoryStorage) estimateSize(sample int) (int, int64) {
+	var n int
+	var total int64
+	// Map iteration order is random, so the first items are a fair sample.
+	for k, item := range s.items {
+		if n == sample {
+			break
+		}
+		total += int64(len(k)) + itemOverhead + valueSize(reflect.ValueOf(item.Object), 0, map[uintptr]bool{})
+		n++
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return len(s.items), total * int64(len(s.items)) / int64(n)
+}
+
+func (s *slabStorage) estimateSize(sample int) (int, int64) {
+	n := 0
+	for _, slab := range s.slabs {
+		n += cap(slab)
+	}
+	return s.count(), int64(n) + int64(s.count())*int64(unsafe.Sizeof(slabEntry{})+8)
+}
+
+// Returns the approximate number of bytes taken by v and what it points to.
+// Memory shared between values is counted for each of them.
+func valueSize(v reflect.Value, depth int, seen map[uintptr]bool) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+	size := int64(v.Type().Size())
+	if depth >= maxSizeDepth {
+		return size
+	}
+	switch v.Kind() {
+	case reflect.String:
+		size += int64(v.Len())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			break
+		}
+		if v.Kind() == reflect.Ptr {
+			if seen[v.Pointer()] {
+				break
+			}
+			seen[v.Pointer()] = true
+		}
+		size += valueSize(v.Elem(), depth+1, seen)
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		size += int64(v.Cap()) * int64(elem.Size())
+		if elem.Kind() != reflect.Uint8 {
+			for i := 0; i < v.Len(); i++ {
+				size += valueSize(v.Index(i), depth+1, seen) - int64(elem.Size())
+			}
+		}
+	case reflect.Array:
+		size = 0
+		for i := 0; i < v.Len(); i++ {
+			size += valueSize(v.Index(i), depth+1, seen)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			size += valueSize(iter.Key(), depth+1, seen) + valueSize(iter.Value(), depth+1, seen)
+		}
+	case reflect.Struct:
+		size = 0
+		for i := 0; i < v.NumField(); i++ {
+			size += valueSize(v.Field(i), depth+1, seen)
+		}
+	}
+	return size
+}
+
+// Returns the number of items in the cache, including the expired ones not
+// deleted yet, and an estimate of the memory they take in bytes: the values of
+// a sample of items are measured, following pointers, and the total is
+// extrapolated. Storages that don't keep items in memory are measured through
+// their keys and values when they can list keys, and report 0, 0 otherwise.
+func (c *cache) EstimatedSize() (int, int64) {
+	c.storage.RLock()
+	defer c.storage.RUnlock()
+	if e, ok := storageAs[sizeEstimator](c.storage); ok {
+		return e.estimateSize(sizeSampleCount)
+	}
+	ks, ok := keyScannerOf(c.storage)
+	if !ok {
+		return 0, 0
+	}
+	var n, sampled int
+	var total int64
+	ks.scanKeys("", func(k string) {
+		n++
+		if sampled == sizeSampleCount {
+			return
+		}
+		if item, found := c.storage.Get(k); found {
+			total += int64(len(k)) + itemOverhead + valueSize(reflect.ValueOf(item.Object), 0, map[uintptr]bool{})
+			sampled++
+		}
+	})
+	if sampled == 0 {
+		return n, 0
+	}
+	return n, total * int64(n) / int64(sampled)
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Number of rows, i.e. of independent counters per key, in a frequency sketch.
+const sketchDepth = 4
+
+// A count-min sketch estimating how often keys have been seen recently, in a
+// fixed amount of memory. Estimates can be too high (when keys collide in
+// every row) but never too low. Every window all counters are halved, so
+// that keys that used to be frequent are eventually forgotten.
+type frequencySketch struct {
+	mutex     sync.Mutex
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	window    time.Duration
+	lastReset time.Time
+}
+
+// Returns a sketch with width counters per row, rounded up to a power of two.
+func newFrequencySketch(width int, window time.Duration) *frequencySketch {
+	w := 1
+	for w < width {
+		w <<= 1
+	}
+	s := &frequencySketch{
+		mask:      uint64(w - 1),
+		window:    window,
+		lastReset: timeNow(),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+// Returns the two hashes the index of k in each row is derived from.
+func sketchHashes(k string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(k))
+	sum := h.Sum64()
+	return sum, sum>>32 | 1
+}
+
+// Records an occurrence of k and returns its new estimated count.
+func (s *frequencySketch) add(k string) int {
+	h1, h2 := sketchHashes(k)
+	s.mutex.Lock()
+	s.age()
+	min := uint8(255)
+	for i := range s.rows {
+		c := &s.rows[i][(h1+uint64(i)*h2)&s.mask]
+		if *c < 255 {
+			*c++
+		}
+		if *c < min {
+			min = *c
+		}
+	}
+	s.mutex.Unlock()
+	return int(min)
+}
+
+// Returns the estimated count of k.
+func (s *frequencySketch) estimate(k string) int {
+	h1, h2 := sketchHashes(k)
+	s.mutex.Lock()
+	s.age()
+	min := uint8(255)
+	for i := range s.rows {
+		if c := s.rows[i][(h1+uint64(i)*h2)&s.mask]; c < min {
+			min = c
+		}
+	}
+	s.mutex.Unlock()
+	return int(min)
+}
+
+// Halves every counter once per window. Called with the mutex held.
+func (s *frequencySketch) age() {
+	if s.window <= 0 || timeNow().Sub(s.lastReset) < s.window {
+		return
+	}
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.lastReset = timeNow()
+}
@@ -0,0 +1,389 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// The default size of the byte slabs a slab storage stores its items in.
+	DefaultSlabSize = 4 << 20
+	// Every entry in a slab starts with the item's expiration and refresh
+	// deadline, the lengths of its key and encoded value, and how the value
+	// is encoded.
+	slabHeaderSize = 8 + 8 + 4 + 4 + 1
+)
+
+// How the value of a slab entry is encoded.
+const (
+	slabValueGob = iota
+	slabValueBytes
+)
+
+// Where an entry is in the slabs. Contains no pointers, so that the garbage
+// collector doesn't have to scan the index.
+type slabEntry struct {
+	slab   uint32
+	offset uint32
+	length uint32
+}
+
+// The value of an item is wrapped so that gob records its concrete type.
+type slabValue struct {
+	V interface{}
+}
+
+type slabStorage struct {
+	index map[uint64]slabEntry
+	// The entries of keys whose hash is taken in index by another key. Nil
+	// until two keys collide.
+	collisions map[string]slabEntry
+	hash       func(string) uint64 // slabHash, unless a test makes keys collide
+	slabs      [][]byte
+	live       []int // bytes of live entries in each slab
+	current    int   // the slab new entries are appended to
+	slabSize   int
+	garbage    int // bytes of deleted entries not reclaimed yet
+	janitor    janitorMetrics
+	mutex      sync.RWMutex
+}
+
+func slabHash(k string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(k))
+	return h.Sum64()
+}
+
+// Returns where the entry stored for k is, if any. Two keys can have the same
+// hash, so the key of the entry indexed under k's hash is compared with k;
+// the entries of the keys it collides with are in collisions.
+func (s *slabStorage) lookup(k string) (slabEntry, bool) {
+	if e, found := s.index[s.hash(k)]; found && s.hasKey(e, k) {
+		return e, true
+	}
+	e, found := s.collisions[k]
+	return e, found
+}
+
+// Returns the entry stored for k, if any.
+func (s *slabStorage) entry(k string) ([]byte, bool) {
+	e, found := s.lookup(k)
+	if !found {
+		return nil, false
+	}
+	return s.bytes(e), true
+}
+
+func (s *slabStorage) bytes(e slabEntry) []byte {
+	return s.slabs[e.slab][e.offset : e.offset+e.length]
+}
+
+func (s *slabStorage) hasKey(e slabEntry, k string) bool {
+	b := s.bytes(e)
+	return string(b[slabHeaderSize:slabHeaderSize+binary.LittleEndian.Uint32(b[16:])]) == k
+}
+
+// Calls fn with every entry.
+func (s *slabStorage) each(fn func(b []byte)) {
+	for _, e := range s.index {
+		fn(s.bytes(e))
+	}
+	for _, e := range s.collisions {
+		fn(s.bytes(e))
+	}
+}
+
+// Returns the number of entries.
+func (s *slabStorage) count() int {
+	return len(s.index) + len(s.collisions)
+}
+
+func (s *slabStorage) Get(key string) (Item, bool) {
+	b, found := s.entry(key)
+	if !found {
+		return Item{}, false
+	}
+	item := Item{
+		Expiration:      int64(binary.LittleEndian.Uint64(b[0:])),
+		RefreshDeadline: int64(binary.LittleEndian.Uint64(b[8:])),
+	}
+	kl := binary.LittleEndian.Uint32(b[16:])
+	if b[24] == slabValueBytes {
+		item.Object = slabBytes(b[slabHeaderSize+kl:])
+		return item, true
+	}
+	var v slabValue
+	if err := gob.NewDecoder(bytes.NewReader(b[slabHeaderSize+kl:])).Decode(&v); err != nil {
+		log.Errorf("error decoding %s : %s", key, err)
+		return Item{}, false
+	}
+	item.Object = v.V
+	return item, true
+}
+
+// Returns a value stored as bytes. Entries are never overwritten once
+// appended to a slab, but the capacity is capped so that appending to the
+// returned slice can't write into the next entry.
+func slabBytes(b []byte) []byte {
+	return b[:len(b):len(b)]
+}
+
+// Items are decoded into new values of the type they were set with, so o is
+// not needed.
+func (s *slabStorage) GetObject(key string, o interface{}) (Item, bool) {
+	return s.Get(key)
+}
+
+// Stores the item's value encoded with gob. Values whose concrete type isn't
+// a basic type must have been registered with gob.Register; items that can't
+// be encoded are not stored.
+func (s *slabStorage) Set(key string, item Item) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&slabValue{item.Object}); err != nil {
+		log.Errorf("error encoding %s : %s", key, err)
+		return
+	}
+	s.setEntry(key, item.Expiration, item.RefreshDeadline, slabValueGob, buf.Bytes())
+}
+
+// Stores b as is, without encoding it.
+func (s *slabStorage) SetBytes(key string, b []byte, e, rd int64) {
+	s.setEntry(key, e, rd, slabValueBytes, b)
+}
+
+// Returns the bytes stored by SetBytes without copying them. The returned
+// slice must not be modified.
+func (s *slabStorage) GetBytes(key string) ([]byte, int64, int64, bool) {
+	b, found := s.entry(key)
+	if !found || b[24] != slabValueBytes {
+		return nil, 0, 0, false
+	}
+	kl := binary.LittleEndian.Uint32(b[16:])
+	return slabBytes(b[slabHeaderSize+kl:]), int64(binary.LittleEndian.Uint64(b[0:])), int64(binary.LittleEndian.Uint64(b[8:])), true
+}
+
+func (s *slabStorage) setEntry(key string, e, rd int64, encoding byte, v []byte) {
+	b := make([]byte, slabHeaderSize+len(key)+len(v))
+	binary.LittleEndian.PutUint64(b[0:], uint64(e))
+	binary.LittleEndian.PutUint64(b[8:], uint64(rd))
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(v)))
+	b[24] = encoding
+	copy(b[slabHeaderSize:], key)
+	copy(b[slabHeaderSize+len(key):], v)
+
+	s.put(key, b)
+	if s.garbage > s.slabSize && s.garbage > s.liveBytes() {
+		s.compact(0)
+	}
+}
+
+// Appends the entry b of key, replacing the one it had. A key that collided
+// keeps its entry in collisions, even once the other key is deleted, so that
+// it is never indexed twice.
+func (s *slabStorage) put(key string, b []byte) {
+	if old, found := s.collisions[key]; found {
+		s.release(old)
+		s.collisions[key] = s.append(b)
+		return
+	}
+	h := s.hash(key)
+	old, found := s.index[h]
+	if found && !s.hasKey(old, key) {
+		if s.collisions == nil {
+			s.collisions = make(map[string]slabEntry)
+		}
+		s.collisions[key] = s.append(b)
+		return
+	}
+	if found {
+		s.release(old)
+	}
+	s.index[h] = s.append(b)
+}
+
+// Copies b to the end of the current slab, starting a new slab if it doesn't
+// fit. Entries bigger than the slab size get a slab of their own.
+func (s *slabStorage) append(b []byte) slabEntry {
+	cur := s.slabs[s.current]
+	if len(cur)+len(b) > cap(cur) {
+		size := s.slabSize
+		if len(b) > size {
+			size = len(b)
+		}
+		s.current = s.newSlab(size)
+		cur = s.slabs[s.current]
+	}
+	e := slabEntry{
+		slab:   uint32(s.current),
+		offset: uint32(len(cur)),
+		length: uint32(len(b)),
+	}
+	s.slabs[s.current] = append(cur, b...)
+	s.live[s.current] += len(b)
+	return e
+}
+
+// Returns the index of a new empty slab, reusing a freed slot if possible.
+func (s *slabStorage) newSlab(size int) int {
+	for i, slab := range s.slabs {
+		if slab == nil {
+			s.slabs[i] = make([]byte, 0, size)
+			return i
+		}
+	}
+	s.slabs = append(s.slabs, make([]byte, 0, size))
+	s.live = append(s.live, 0)
+	return len(s.slabs) - 1
+}
+
+// Marks an entry as garbage, freeing its slab once nothing in it is live.
+func (s *slabStorage) release(e slabEntry) {
+	s.live[e.slab] -= int(e.length)
+	s.garbage += int(e.length)
+	if s.live[e.slab] == 0 && int(e.slab) != s.current {
+		s.garbage -= len(s.slabs[e.slab])
+		s.slabs[e.slab] = nil
+	}
+}
+
+func (s *slabStorage) liveBytes() int {
+	n := 0
+	for _, l := range s.live {
+		n += l
+	}
+	return n
+}
+
+// Copies the live entries into new slabs, dropping the entries that expired
+// before now (if now is not 0), so that the space taken by garbage is
+// returned to the runtime.
+func (s *slabStorage) compact(now int64) {
+	old := s.slabs
+	oldIndex, oldCollisions := s.index, s.collisions
+	s.index = make(map[uint64]slabEntry, len(oldIndex))
+	s.collisions = nil
+	s.slabs = nil
+	s.live = nil
+	s.garbage = 0
+	s.current = s.newSlab(s.slabSize)
+	live := func(e slabEntry) ([]byte, bool) {
+		b := old[e.slab][e.offset : e.offset+e.length]
+		exp := int64(binary.LittleEndian.Uint64(b))
+		return b, now == 0 || exp == 0 || now <= exp
+	}
+	for h, e := range oldIndex {
+		if b, ok := live(e); ok {
+			s.index[h] = s.append(b)
+		}
+	}
+	for k, e := range oldCollisions {
+		if b, ok := live(e); ok {
+			if s.collisions == nil {
+				s.collisions = make(map[string]slabEntry)
+			}
+			s.collisions[k] = s.append(b)
+		}
+	}
+}
+
+func (s *slabStorage) Del(key string) {
+	if e, found := s.collisions[key]; found {
+		s.release(e)
+		delete(s.collisions, key)
+		return
+	}
+	h := s.hash(key)
+	if e, found := s.index[h]; found && s.hasKey(e, key) {
+		s.release(e)
+		delete(s.index, h)
+	}
+}
+
+// Deletes the expired items and compacts the slabs.
+func (s *slabStorage) DeleteExpired() {
+	start := time.Now()
+	s.Lock()
+	locked := time.Now()
+	n := s.count()
+	s.compact(timeNow().UnixNano())
+	deleted := n - s.count()
+	s.Unlock()
+	s.janitor.record(deleted, time.Since(start), time.Since(locked))
+}
+
+func (s *slabStorage) reportStats(st *Stats) {
+	s.janitor.report(st)
+}
+
+func (s *slabStorage) scanKeys(prefix string, fn func(string)) error {
+	s.each(func(b []byte) {
+		k := string(b[slabHeaderSize : slabHeaderSize+binary.LittleEndian.Uint32(b[16:])])
+		if strings.HasPrefix(k, prefix) {
+			fn(k)
+		}
+	})
+	return nil
+}
+
+func (s *slabStorage) Flush() {
+	s.Lock()
+	s.reset()
+	s.Unlock()
+}
+
+// Drops the index and the slabs. Called with the storage locked.
+func (s *slabStorage) reset() {
+	s.index = make(map[uint64]slabEntry)
+	s.collisions = nil
+	s.slabs = nil
+	s.live = nil
+	s.garbage = 0
+	s.current = s.newSlab(s.slabSize)
+}
+
+func (s *slabStorage) Lock() {
+	s.mutex.Lock()
+}
+
+func (s *slabStorage) Unlock() {
+	s.mutex.Unlock()
+}
+
+func (s *slabStorage) RLock() {
+	s.mutex.RLock()
+}
+
+func (s *slabStorage) RUnlock() {
+	s.mutex.RUnlock()
+}
+
+func (s *slabStorage) Type() int {
+	return STORAGE_TYPE_SLAB
+}
+
+// Returns an in-memory storage that keeps items encoded in large byte slabs
+// (of slabSize bytes, or DefaultSlabSize if it is less than one) instead of as
+// Go values, so that millions of items don't have to be scanned by the
+// garbage collector. Values are encoded with gob on Set and decoded on every
+// Get, so Get returns a copy rather than the value that was set; non-basic
+// value types must be registered with gob.Register.
+func SlabStorage(slabSize int) *slabStorage {
+	if slabSize < 1 {
+		slabSize = DefaultSlabSize
+	}
+	s := &slabStorage{
+		index:    make(map[uint64]slabEntry),
+		hash:     slabHash,
+		slabSize: slabSize,
+	}
+	s.current = s.newSlab(slabSize)
+	return s
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// How a memory storage with a MaxItems limit picks the items to evict.
+type EvictionPolicy int
+
+const (
+	// Segmented LRU: new items go to a probation segment, and move to a
+	// protected segment when they are read again. Items are evicted from the
+	// probation segment first, so that a scan reading many keys once doesn't
+	// evict the items that are read repeatedly.
+	EvictionSegmentedLRU EvictionPolicy = iota
+	// Sampling: a few random items are compared and the best candidate is
+	// evicted, i.e. the least recently read one if access is tracked, and the
+	// one expiring soonest otherwise. Approximate, but needs no per-item
+	// bookkeeping beyond what MemoryOptions already asks for.
+	EvictionSampled
+)
+
+// The number of items compared to pick one to evict with EvictionSampled, if
+// MemoryOptions.EvictionSamples isn't set.
+const DefaultEvictionSamples = 5
+
+// Share of the items that can be in the protected segment of a segmented LRU.
+const slruProtectedRatio = 0.8
+
+type slruEntry struct {
+	key       string
+	protected bool
+}
+
+// The recency lists of a segmented LRU. Has its own mutex, since reads only
+// hold the storage's read lock.
+type segmentedLRU struct {
+	mutex        sync.Mutex
+	probation    *list.List
+	protected    *list.List
+	elements     map[string]*list.Element
+	maxItems     int
+	maxProtected int
+}
+
+func newSegmentedLRU(maxItems int) *segmentedLRU {
+	maxProtected := int(float64(maxItems) * slruProtectedRatio)
+	if maxProtected >= maxItems {
+		maxProtected = maxItems - 1
+	}
+	return &segmentedLRU{
+		probation:    list.New(),
+		protected:    list.New(),
+		elements:     make(map[string]*list.Element),
+		maxItems:     maxItems,
+		maxProtected: maxProtected,
+	}
+}
+
+// Records that key was stored, and returns the keys to evict to stay within
+// maxItems. Keys that are already present keep their position.
+func (l *segmentedLRU) add(key string) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, found := l.elements[key]; found {
+		return nil
+	}
+	l.elements[key] = l.probation.PushFront(&slruEntry{key: key})
+	var evicted []string
+	for len(l.elements) > l.maxItems {
+		victim := l.probation.Back()
+		if victim == nil {
+			victim = l.protected.Back()
+		}
+		evicted = append(evicted, l.remove(victim))
+	}
+	return evicted
+}
+
+// Records a read of key, promoting it to the protected segment.
+func (l *segmentedLRU) touch(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	e, found := l.elements[key]
+	if !found {
+		return
+	}
+	entry := e.Value.(*slruEntry)
+	if entry.protected {
+		l.protected.MoveToFront(e)
+		return
+	}
+	l.probation.Remove(e)
+	entry.protected = true
+	l.elements[key] = l.protected.PushFront(entry)
+	// Demote the least recently used protected items back to probation.
+	for l.protected.Len() > l.maxProtected {
+		old := l.protected.Back()
+		oldEntry := l.protected.Remove(old).(*slruEntry)
+		oldEntry.protected = false
+		l.elements[oldEntry.key] = l.probation.PushFront(oldEntry)
+	}
+}
+
+func (l *segmentedLRU) del(key string) {
+	l.mutex.Lock()
+	if e, found := l.elements[key]; found {
+		l.remove(e)
+	}
+	l.mutex.Unlock()
+}
+
+// Removes an element from its segment and returns its key. Called with the
+// mutex held.
+func (l *segmentedLRU) remove(e *list.Element) string {
+	entry := e.Value.(*slruEntry)
+	if entry.protected {
+		l.protected.Remove(e)
+	} else {
+		l.probation.Remove(e)
+	}
+	delete(l.elements, entry.key)
+	return entry.key
+}
+
+func (l *segmentedLRU) flush() {
+	l.mutex.Lock()
+	l.probation.Init()
+	l.protected.Init()
+	l.elements = make(map[string]*list.Element)
+	l.mutex.Unlock()
+}
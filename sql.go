@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The prefix of the keys query results are cached under by QueryMaps and
+// QueryStructs.
+const SQLKeyPrefix = "sql"
+
+// What QueryMaps and QueryStructs run queries with, e.g. a *sql.DB or a
+// *sql.Tx.
+type SQLQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Returns the rows of query, run with args, as maps from column names to
+// values, caching them in c for ttl (which is interpreted as the expiration of
+// Set) under a key made of a hash of the query, the args and the generations
+// of tables (see InvalidateTable). []byte values are returned as strings, so
+// that the rows are read back the same from storages that encode them as
+// JSON; those return numbers as float64s. Concurrent calls that miss share a
+// single query (see Fetch).
+func QueryMaps(c *Cache, db SQLQueryer, tables []string, ttl time.Duration, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	k, err := c.sqlKey(tables, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fetchAs(c, k, ttl, func() ([]map[string]interface{}, error) {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		columns, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		result := []map[string]interface{}{}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return nil, err
+			}
+			row := make(map[string]interface{}, len(columns))
+			for i, col := range columns {
+				if b, ok := values[i].([]byte); ok {
+					values[i] = string(b)
+				}
+				row[col] = values[i]
+			}
+			result = append(result, row)
+		}
+		return result, rows.Err()
+	})
+}
+
+// Like QueryMaps, but scans the rows into values of the struct type T. A
+// column is scanned into the field whose db tag is the column's name, or
+// whose name matches it ignoring case and underscores (e.g. UserID for
+// user_id); columns without a field are skipped.
+func QueryStructs[T any](c *Cache, db SQLQueryer, tables []string, ttl time.Duration, query string, args ...interface{}) ([]T, error) {
+	k, err := c.sqlKey(tables, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fetchAs(c, k, ttl, func() ([]T, error) {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		columns, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		var zero T
+		fields := sqlFields(reflect.TypeOf(zero), columns)
+		result := []T{}
+		for rows.Next() {
+			var v T
+			rv := reflect.ValueOf(&v).Elem()
+			dest := make([]interface{}, len(columns))
+			for i, f := range fields {
+				if f == nil {
+					dest[i] = new(interface{})
+				} else {
+					dest[i] = rv.FieldByIndex(f).Addr().Interface()
+				}
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+		return result, rows.Err()
+	})
+}
+
+// Invalidates every query result cached by QueryMaps and QueryStructs with
+// table among their tables, for instance after writing to it, by bumping the
+// table's generation as InvalidateNamespace does.
+func (c *cache) InvalidateTable(table string) error {
+	return c.InvalidateNamespace(sqlTableNamespace(table))
+}
+
+func sqlTableNamespace(table string) string {
+	return K(SQLKeyPrefix, "table", table).String()
+}
+
+// Returns the key the results of query run with args are cached under, which
+// changes whenever one of tables is invalidated.
+func (c *cache) sqlKey(tables []string, query string, args []interface{}) (string, error) {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "", newError(ErrInvalidValue, "Invalid arguments for query %s : %s", query, err)
+	}
+	h := sha256.New()
+	h.Write([]byte(query))
+	h.Write([]byte{0})
+	h.Write(b)
+	sorted := append([]string(nil), tables...)
+	sort.Strings(sorted)
+	for _, t := range sorted {
+		h.Write([]byte{0})
+		h.Write([]byte(t + "=" + strconv.FormatInt(c.namespaceGeneration(sqlTableNamespace(t)), 10)))
+	}
+	return K(SQLKeyPrefix, hex.EncodeToString(h.Sum(nil))).String(), nil
+}
+
+// Returns the index of the field of struct type t each column is scanned
+// into, or nil for the columns without one.
+func sqlFields(t reflect.Type, columns []string) [][]int {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Replace(s, "_", "", -1))
+	}
+	byName := make(map[string][]int)
+	byTag := make(map[string][]int)
+	if t != nil && t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if tag := f.Tag.Get("db"); tag != "" && tag != "-" {
+				byTag[tag] = f.Index
+			} else if tag != "-" {
+				byName[normalize(f.Name)] = f.Index
+			}
+		}
+	}
+	fields := make([][]int, len(columns))
+	for i, col := range columns {
+		if f, ok := byTag[col]; ok {
+			fields[i] = f
+		} else {
+			fields[i] = byName[normalize(col)]
+		}
+	}
+	return fields
+}
@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"database/sql"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The database/sql driver SQLiteStorage opens its database with. A driver
+// registering this name, such as github.com/mattn/go-sqlite3, must be linked
+// into the program.
+const SQLiteDriver = "sqlite3"
+
+// How values are stored in the encoding column of the items table.
+const (
+	sqlValueJSON  = "json"
+	sqlValueBytes = "bytes"
+)
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS go_cache_items (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		encoding TEXT NOT NULL,
+		expiration INTEGER NOT NULL,
+		refresh_deadline INTEGER NOT NULL
+	)`,
+	// Lets the janitor find expired items without scanning the table.
+	`CREATE INDEX IF NOT EXISTS go_cache_items_expiration ON go_cache_items (expiration) WHERE expiration > 0`,
+}
+
+type sqliteStorage struct {
+	db         *sql.DB
+	marshaller *jsonCodec
+	mutex      sync.Mutex
+}
+
+func (s *sqliteStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *sqliteStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *sqliteStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *sqliteStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *sqliteStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+// Values stored as bytes are returned as []byte; others are decoded from JSON
+// into o, or, if o is nil, into maps, slices, strings, float64s and bools.
+func (s *sqliteStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	var b []byte
+	var encoding string
+	var item Item
+	err := s.db.QueryRow(`SELECT value, encoding, expiration, refresh_deadline FROM go_cache_items WHERE key = ?`, key).
+		Scan(&b, &encoding, &item.Expiration, &item.RefreshDeadline)
+	if err == sql.ErrNoRows {
+		return Item{}, false, nil
+	} else if err != nil {
+		return Item{}, false, err
+	}
+	if encoding == sqlValueBytes {
+		item.Object = b
+		return item, true, nil
+	}
+	if item.Object, err = s.marshaller.DecodeValue(b, o); err != nil {
+		return Item{}, false, err
+	}
+	return item, true, nil
+}
+
+func (s *sqliteStorage) write(key string, b []byte, encoding string, e, rd int64) error {
+	// A nil []byte would be stored as NULL, and is read back empty anyway.
+	if b == nil {
+		b = []byte{}
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO go_cache_items (key, value, encoding, expiration, refresh_deadline) VALUES (?, ?, ?, ?, ?)`,
+		key, b, encoding, e, rd)
+	return err
+}
+
+// Stores []byte values as is, and others as JSON.
+func (s *sqliteStorage) TrySet(key string, item Item) error {
+	if b, ok := item.Object.([]byte); ok {
+		return s.write(key, b, sqlValueBytes, item.Expiration, item.RefreshDeadline)
+	}
+	b, err := s.marshaller.Marshal(item.Object)
+	if err != nil {
+		return err
+	}
+	return s.write(key, b, sqlValueJSON, item.Expiration, item.RefreshDeadline)
+}
+
+func (s *sqliteStorage) TryDel(key string) error {
+	_, err := s.db.Exec(`DELETE FROM go_cache_items WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteStorage) SetBytes(key string, b []byte, e, rd int64) {
+	if err := s.write(key, b, sqlValueBytes, e, rd); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *sqliteStorage) GetBytes(key string) ([]byte, int64, int64, bool) {
+	item, found, err := s.TryGet(key)
+	if err != nil {
+		log.Errorf("error getting %s : %s", key, err)
+		return nil, 0, 0, false
+	}
+	b, ok := item.Object.([]byte)
+	if !found || !ok {
+		return nil, 0, 0, false
+	}
+	return b, item.Expiration, item.RefreshDeadline, true
+}
+
+func (s *sqliteStorage) Flush() {
+	if _, err := s.db.Exec(`DELETE FROM go_cache_items`); err != nil {
+		log.Errorf("error flushing : %s", err)
+	}
+}
+
+// Deletes the expired items, found through the expiration index.
+func (s *sqliteStorage) DeleteExpired() {
+	_, err := s.db.Exec(`DELETE FROM go_cache_items WHERE expiration > 0 AND expiration < ?`, timeNow().UnixNano())
+	if err != nil {
+		log.Errorf("error deleting expired items : %s", err)
+	}
+}
+
+// The keys starting with prefix are the range from prefix to its successor,
+// which SQLite reads from the primary key's index instead of scanning the
+// table.
+func (s *sqliteStorage) scanKeys(prefix string, fn func(string)) error {
+	var rows *sql.Rows
+	var err error
+	if end, ok := prefixSuccessor(prefix); ok {
+		rows, err = s.db.Query(`SELECT key FROM go_cache_items WHERE key >= ? AND key < ?`, prefix, end)
+	} else {
+		rows, err = s.db.Query(`SELECT key FROM go_cache_items WHERE key >= ?`, prefix)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return err
+		}
+		fn(k)
+	}
+	return rows.Err()
+}
+
+// Lock only excludes other goroutines in this process.
+func (s *sqliteStorage) Lock() {
+	s.mutex.Lock()
+}
+
+func (s *sqliteStorage) Unlock() {
+	s.mutex.Unlock()
+}
+
+func (s *sqliteStorage) RLock() {
+	// nothing to do
+}
+
+func (s *sqliteStorage) RUnlock() {
+	// nothing to do
+}
+
+func (s *sqliteStorage) Type() int {
+	return STORAGE_TYPE_REMOTE
+}
+
+func (s *sqliteStorage) reportStats(st *Stats) {
+	s.marshaller.reportStats(st)
+}
+
+// Closes the database.
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
+
+// Returns a storage that keeps items in the go_cache_items table of the
+// SQLite database at path, creating it if needed, so that they survive
+// restarts. Expired items are deleted by the janitor. The program must link
+// an SQLite driver registered as SQLiteDriver.
+func SQLiteStorage(path string) *sqliteStorage {
+	db, err := sql.Open(SQLiteDriver, path)
+	if err != nil {
+		panic("SQLite storage requires a driver registered as " + SQLiteDriver)
+	}
+	// SQLite allows a single writer; more connections would only fail with
+	// "database is locked".
+	db.SetMaxOpenConns(1)
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Errorf("error creating the SQLite schema : %s", err)
+		}
+	}
+	return &sqliteStorage{
+		db:         db,
+		marshaller: newJSONCodec(),
+	}
+}
+
+// Returns the smallest string greater than every string starting with prefix,
+// in byte order, or false if there is none (prefix is empty or only 0xff
+// bytes).
+func prefixSuccessor(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"time"
+)
+
+// A snapshot of the cache's counters and of the state of its storage. Fields
+// that don't apply to the cache's storage are left at their zero value.
+type Stats struct {
+	// State of the storage's circuit breaker (see BreakerStorage): one of
+	// BreakerClosed, BreakerOpen or BreakerHalfOpen.
+	BreakerState string
+	// Number of times the circuit breaker has opened.
+	BreakerTrips int64
+	// Number of keys written to the secondary storage of a FallbackStorage
+	// that haven't been copied back to the primary yet.
+	FallbackPending int
+	// Number of items a memory storage has evicted to stay within MaxItems.
+	Evictions int64
+	// Estimated number of times the map holding a memory storage's items
+	// has grown (see MemoryOptions.InitialCapacity), and the longest a write
+	// that may have grown it took. Go doesn't tell when a map grows, so the
+	// storage assumes it does whenever the number of items reaches an
+	// estimate of the map's room, which then doubles; this is a guide for
+	// sizing the map, not an exact count.
+	MapGrowths        int64
+	MapGrowthMaxPause time.Duration
+	// Number of times the janitor has deleted expired items, and the number
+	// of items it has deleted.
+	JanitorRuns    int64
+	JanitorDeleted int64
+	// How long the janitor's last run took, including waiting for the write
+	// lock, and the longest it held the lock at a time.
+	JanitorLastDuration time.Duration
+	JanitorLastLockHold time.Duration
+	// The longest time a janitor run has held the write lock.
+	JanitorMaxLockHold time.Duration
+	// Number of writes queued by SetAsync that haven't been applied yet, and
+	// the number that failed or were dropped because the queue was full.
+	AsyncPending int64
+	AsyncFailed  int64
+	AsyncDropped int64
+	// Number of writes a CoalescingStorage has replaced with a later write to
+	// the same key before applying them.
+	CoalescedWrites int64
+	// Number of keys waiting to be refreshed, and the number of refresh
+	// workers running and of those calling the OnRefreshNeeded function.
+	RefreshQueueDepth  int64
+	RefreshWorkers     int
+	RefreshBusyWorkers int
+	// Number of times the OnRefreshNeeded function has panicked.
+	RefreshPanics int64
+	// Number of refreshes skipped because another process held the lease.
+	RefreshSkipped int64
+	// Number of values the storage has encoded and decoded (e.g. to and from
+	// JSON for Redis), their total size in bytes, and the total time spent.
+	Encodes      int64
+	EncodedBytes int64
+	EncodeTime   time.Duration
+	Decodes      int64
+	DecodedBytes int64
+	DecodeTime   time.Duration
+	// The size of the biggest value encoded, and the number of values in each
+	// size bucket of EncodedSizeBounds.
+	MaxEncodedSize int64
+	EncodedSizes   []int64
+	// Number of items pinned with Pin, and their size when they were pinned.
+	PinnedItems int
+	PinnedBytes int64
+	// The counts of the prefixes given to TrackPrefixStats.
+	Prefixes map[string]PrefixStat
+	// Whether the cache is bypassed, by SetBypass or AutoBypass.
+	Bypassed bool
+}
+
+// Implemented by storages that contribute to the cache's Stats.
+type statsReporter interface {
+	reportStats(*Stats)
+}
+
+// Returns a snapshot of the cache's statistics.
+func (c *cache) Stats() Stats {
+	var st Stats
+	s := c.storage
+	for {
+		if r, ok := s.(statsReporter); ok {
+			r.reportStats(&st)
+		}
+		w, ok := s.(wrappedStorage)
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+	if w, ok := c.async.Load().(*asyncWriter); ok {
+		w.reportStats(&st)
+	}
+	c.refresh.reportStats(&st)
+	c.reportPins(&st)
+	if ps, _ := c.prefixStats.Load().(*prefixStats); ps != nil {
+		ps.reportStats(&st)
+	}
+	st.Bypassed = c.bypassWrites()
+	return st
+}
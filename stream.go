@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Implemented by storages that can store a value read from an io.Reader, and
+// read it back, without holding all of it in memory.
+type StreamStorage interface {
+	// Stores the size bytes read from r (or all of them if size is
+	// negative) as the value of key.
+	SetReader(key string, r io.Reader, size int64, expiration, refreshDeadline int64) error
+	// Returns a reader of the value stored by SetReader, which the caller
+	// must close.
+	GetReader(key string) (rc io.ReadCloser, expiration, refreshDeadline int64, found bool, err error)
+}
+
+// Add a value read from r to the cache, replacing any existing item, for large
+// payloads like generated documents. size is the number of bytes r holds, or
+// -1 if unknown. Durations are interpreted as for Set. If the storage supports
+// it (see StreamStorage) the value is streamed to the storage without being
+// held in memory, and must then be read with GetReader; otherwise it's read
+// into memory and set with SetBytes, and can be read with GetBytes too. Only
+// values read into memory are checked by the validator (see SetValidator);
+// both are subject to the admission policy. Returns the error reading r,
+// validating the value or writing the storage.
+func (c *cache) SetReader(k string, r io.Reader, size int64, d time.Duration, rd time.Duration) error {
+	if c.bypassWrites() {
+		c.Delete(k)
+		return nil
+	}
+	ss, ok := c.storage.(StreamStorage)
+	if !ok {
+		var buf bytes.Buffer
+		if size > 0 {
+			buf.Grow(int(size))
+			r = io.LimitReader(r, size)
+		}
+		if _, err := buf.ReadFrom(r); err != nil {
+			return err
+		}
+		if err := c.validate(k, buf.Bytes()); err != nil {
+			return err
+		}
+		c.SetBytes(k, buf.Bytes(), d, rd)
+		return nil
+	}
+	c.storage.Lock()
+	admitted := c.admit(k)
+	c.storage.Unlock()
+	if !admitted {
+		return nil
+	}
+	item := c.newItem(k, nil, d, rd)
+	// The storage isn't locked while the value is streamed, so that other
+	// writes don't wait for it.
+	if err := ss.SetReader(k, r, size, item.Expiration, item.RefreshDeadline); err != nil {
+		return err
+	}
+	c.storage.Lock()
+	c.written(k, item)
+	c.storage.Unlock()
+	return nil
+}
+
+// Get a reader of a value set with SetReader, which the caller must close.
+// Returns nil and false if the key wasn't found.
+func (c *cache) GetReader(k string) (io.ReadCloser, bool) {
+	ss, ok := c.storage.(StreamStorage)
+	if !ok {
+		b, found := c.GetBytes(k)
+		if !found {
+			return nil, false
+		}
+		return io.NopCloser(bytes.NewReader(b)), true
+	}
+	if c.bypassReads() {
+		return nil, false
+	}
+	rc, e, rd, found, err := ss.GetReader(k)
+	if err != nil {
+		log.Errorf("error getting %s : %s", k, err)
+	}
+	if err != nil || !found {
+		c.countKey(k, MetricMisses, 1)
+		return nil, false
+	}
+	if e > 0 && timeNow().UnixNano() > e {
+		rc.Close()
+		c.countKey(k, MetricMisses, 1)
+		return nil, false
+	}
+	if rd > 0 && c.refreshDue(k, rd) {
+		c.queueRefresh(k)
+	}
+	c.countKey(k, MetricHits, 1)
+	return rc, true
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"time"
+)
+
+// Implemented by storages that can append to a value stored with SetBytes in
+// a single operation.
+type bytesAppender interface {
+	// Appends b to the value of key and returns true, or returns false if
+	// key doesn't exist.
+	AppendBytes(key string, b []byte) bool
+}
+
+// Add a string value to the cache, replacing any existing item. Durations are
+// interpreted as for Set. On storages that support it (see BytesStorage) the
+// string is stored as raw bytes.
+func (c *cache) SetString(k string, s string, d time.Duration, rd time.Duration) {
+	if _, ok := c.storage.(BytesStorage); ok {
+		c.SetBytes(k, []byte(s), d, rd)
+		return
+	}
+	c.Set(k, s, d, rd)
+}
+
+// Get a string value from the cache. Returns the value or "", and a bool
+// indicating whether the key was found and holds a string.
+func (c *cache) GetString(k string) (string, bool) {
+	if _, ok := c.storage.(BytesStorage); ok {
+		b, found := c.GetBytes(k)
+		return string(b), found
+	}
+	x, found := c.Get(k)
+	if !found {
+		return "", false
+	}
+	s, ok := x.(string)
+	return s, ok
+}
+
+// Append s to a string value set with SetString, keeping its expiration time
+// and refresh deadline. Returns an error if the item was not found or is not a
+// string.
+func (c *cache) AppendString(k string, s string) error {
+	c.storage.Lock()
+	if a, ok := c.storage.(bytesAppender); ok {
+		var err error
+		if a.AppendBytes(k, []byte(s)) {
+			c.reread(k)
+		} else {
+			err = c.appendError(k)
+		}
+		c.storage.Unlock()
+		return err
+	}
+	if bs, ok := c.storage.(BytesStorage); ok {
+		b, e, rd, found := bs.GetBytes(k)
+		if !found || (e > 0 && timeNow().UnixNano() > e) {
+			err := c.appendError(k)
+			c.storage.Unlock()
+			return err
+		}
+		nb := make([]byte, 0, len(b)+len(s))
+		nb = append(append(nb, b...), s...)
+		bs.SetBytes(k, nb, e, rd)
+		c.written(k, Item{Object: nb, Expiration: e, RefreshDeadline: rd})
+		c.storage.Unlock()
+		return nil
+	}
+	v, found := c.storage.Get(k)
+	if !found || v.Expired() {
+		c.storage.Unlock()
+		return newError(ErrNotFound, "Item %s not found", k)
+	}
+	rv, ok := v.Object.(string)
+	if !ok {
+		c.storage.Unlock()
+		return newError(ErrWrongType, "The value for %s is not a string", k)
+	}
+	v.Object = rv + s
+	c.storage.Set(k, v)
+	c.written(k, v)
+	c.storage.Unlock()
+	return nil
+}
+
+// Returns the error of AppendString for k, which holds no bytes to append to:
+// ErrWrongType if it holds another value, ErrNotFound otherwise. Called with
+// the storage lock held.
+func (c *cache) appendError(k string) error {
+	if item, found, _ := tryGet(c.storage, k); found && !item.Expired() {
+		return newError(ErrWrongType, "The value for %s is not a string", k)
+	}
+	return newError(ErrNotFound, "Item %s not found", k)
+}
@@ -0,0 +1,269 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Number of keys WarmL1FromL2 reads from the remote tier at a time.
+const warmBatchSize = 100
+
+// Settings for TieredStorage.
+type TieredOptions struct {
+	// The longest an item read from the remote tier is kept in memory, so
+	// that changes made by other processes are seen within L1TTL. Zero
+	// keeps items in memory until they expire.
+	L1TTL time.Duration
+}
+
+type tieredStorage struct {
+	Storage // the remote tier
+	l1      Storage
+	opts    TieredOptions
+}
+
+// Implemented by remote storages that can read many items in a few round
+// trips. Calls fn with up to limit (if positive) items whose keys match the
+// glob pattern.
+type bulkLoader interface {
+	loadMatching(pattern string, limit int, fn func(key string, item Item)) error
+}
+
+// Returns the storage s is or wraps that can read many items at once, if any.
+func bulkLoaderOf(s Storage) (bulkLoader, bool) {
+	return storageAs[bulkLoader](s)
+}
+
+func (s *tieredStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, nil)
+	return item, found
+}
+
+func (s *tieredStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *tieredStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *tieredStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+func (s *tieredStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+func (s *tieredStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	s.l1.RLock()
+	item, found := s.l1.Get(key)
+	s.l1.RUnlock()
+	if found && !item.Expired() {
+		return item, true, nil
+	}
+	var err error
+	if o == nil {
+		item, found, err = tryGet(s.Storage, key)
+	} else {
+		item, found, err = tryGetObject(s.Storage, key, o)
+	}
+	if err == nil && found {
+		s.setL1Decoded(key, item, o)
+	}
+	return item, found, err
+}
+
+// Copies an item read from the remote tier to memory. If it was decoded into
+// o, which belongs to the caller, a copy of o is kept instead (see GobCopy),
+// or nothing if it can't be copied.
+func (s *tieredStorage) setL1Decoded(key string, item Item, o interface{}) {
+	if o != nil && item.Object == o {
+		v, err := GobCopy(o)
+		if err != nil {
+			return
+		}
+		item.Object = v
+	}
+	s.setL1(key, item)
+}
+
+// Like TryGet, but also returns which tier the item was found in.
+func (s *tieredStorage) getWithSource(key string) (Item, bool, Source, error) {
+	s.l1.RLock()
+	item, found := s.l1.Get(key)
+	s.l1.RUnlock()
+	if found && !item.Expired() {
+		return item, true, SourceL1, nil
+	}
+	item, found, err := tryGet(s.Storage, key)
+	if err == nil && found {
+		s.setL1(key, item)
+	}
+	return item, found, SourceL2, err
+}
+
+func (s *tieredStorage) TrySet(key string, item Item) error {
+	if err := trySet(s.Storage, key, item); err != nil {
+		return err
+	}
+	s.setL1(key, item)
+	return nil
+}
+
+// Deletes the item from the remote tier first, so that a concurrent read
+// can't copy it back to memory once it's been deleted there.
+func (s *tieredStorage) TryDel(key string) error {
+	err := tryDel(s.Storage, key)
+	s.l1.Lock()
+	s.l1.Del(key)
+	s.l1.Unlock()
+	return err
+}
+
+// Copies item to memory, expiring it after L1TTL at the latest.
+func (s *tieredStorage) setL1(key string, item Item) {
+	if s.opts.L1TTL > 0 {
+		if max := timeNow().Add(s.opts.L1TTL).UnixNano(); item.Expiration == 0 || item.Expiration > max {
+			item.Expiration = max
+		}
+	}
+	s.l1.Lock()
+	s.l1.Set(key, item)
+	s.l1.Unlock()
+}
+
+func (s *tieredStorage) Flush() {
+	s.l1.Flush()
+	s.Storage.Flush()
+}
+
+// Deletes the expired items from memory, and from the remote tier if it needs
+// a janitor too.
+func (s *tieredStorage) DeleteExpired() {
+	if cs, ok := cleanableStorageOf(s.l1); ok {
+		cs.DeleteExpired()
+	}
+	if cs, ok := cleanableStorageOf(s.Storage); ok {
+		cs.DeleteExpired()
+	}
+}
+
+// The memory tier gets a janitor whatever the type of the remote tier.
+func (s *tieredStorage) Type() int {
+	return STORAGE_TYPE_REMOTE
+}
+
+// Deletes the keys one at a time, so that they're deleted from every tier.
+func (s *tieredStorage) delMulti(keys []string) ([]string, error) {
+	return delEach(s, keys)
+}
+
+func (s *tieredStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// Copies up to limit (if positive) items whose keys match the glob pattern
+// from the remote tier into memory, e.g. at startup so that a new process
+// doesn't send all its first reads to the remote tier. Returns the number of
+// items copied. Uses bulk reads if the remote tier supports them (like the
+// Redis storage), and otherwise only supports patterns that are a prefix
+// followed by "*".
+func (s *tieredStorage) WarmL1FromL2(pattern string, limit int) (int, error) {
+	n := 0
+	load := func(key string, item Item) {
+		if !item.Expired() {
+			s.setL1(key, item)
+			n++
+		}
+	}
+	if bl, ok := bulkLoaderOf(s.Storage); ok {
+		err := bl.loadMatching(pattern, limit, load)
+		return n, err
+	}
+	ks, ok := keyScannerOf(s.Storage)
+	if !ok || strings.IndexAny(strings.TrimSuffix(pattern, "*"), "*?[") >= 0 {
+		return 0, newError(ErrNotSupported, "Warming with pattern %s is not supported by this storage", pattern)
+	}
+	var keys []string
+	err := ks.scanKeys(strings.TrimSuffix(pattern, "*"), func(k string) {
+		if limit <= 0 || len(keys) < limit {
+			keys = append(keys, k)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		item, found, err := tryGet(s.Storage, k)
+		if err != nil {
+			return n, err
+		}
+		if found {
+			load(k, item)
+		}
+	}
+	return n, nil
+}
+
+// Returns a storage keeping the items of remote, e.g. a Redis storage, in
+// memory too: reads are served from memory when possible and copied there
+// otherwise, and writes go to both. Other processes' writes to remote are
+// only seen once the copy in memory expires (see TieredOptions.L1TTL).
+func TieredStorage(remote Storage, o TieredOptions) *tieredStorage {
+	return &tieredStorage{
+		Storage: remote,
+		l1:      MemoryStorage(),
+		opts:    o,
+	}
+}
+
+// Reads the matching keys found by SCAN with MGET, a batch at a time.
+func (s *redisStorage) loadMatching(pattern string, limit int, fn func(key string, item Item)) error {
+	var cursor uint64
+	n := 0
+	for {
+		keys, next, err := s.redisClient.Scan(cursor, redisPatternEscaper.Replace(s.prefix)+pattern, warmBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		if limit > 0 && n+len(keys) > limit {
+			keys = keys[:limit-n]
+		}
+		if len(keys) > 0 {
+			values, err := s.redisClient.MGet(keys...).Result()
+			if err != nil {
+				return err
+			}
+			for i, v := range values {
+				str, ok := v.(string)
+				if !ok {
+					continue
+				}
+				item, err := s.unmarshal(str, nil)
+				if errors.Is(err, ErrWrongType) {
+					// Set as bytes, which GetBytes reads from Redis anyway,
+					// or not decodable.
+					continue
+				} else if err != nil {
+					log.Errorf("error loading %s : %s", keys[i], err)
+					continue
+				}
+				fn(strings.TrimPrefix(keys[i], s.prefix), item)
+				n++
+			}
+		}
+		if next == 0 || (limit > 0 && n >= limit) {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The timeout of the operations TimeoutStorage bounds, unless TimeoutOptions
+// sets another one.
+const DefaultOperationTimeout = time.Second
+
+// The error returned by operations that didn't complete in time. It is a
+// net.Error, so IsTransientError reports it as transient, and it counts as a
+// failure for BreakerStorage. It wraps ErrStorageUnavailable.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "operation timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+func (timeoutError) Unwrap() error   { return ErrStorageUnavailable }
+
+// Settings for TimeoutStorage. Durations that are zero are set to
+// DefaultOperationTimeout; negative durations disable the timeout.
+type TimeoutOptions struct {
+	Get time.Duration
+	Set time.Duration
+	Del time.Duration
+}
+
+type timeoutStorage struct {
+	Storage
+	opts TimeoutOptions
+}
+
+// Runs op, giving up after timeout. op keeps running in the background once
+// it is given up on, since nothing can interrupt a call that doesn't take a
+// context; its result is then discarded.
+func withTimeout(timeout time.Duration, op func() error) error {
+	if timeout < 0 {
+		return op()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+func (s *timeoutStorage) Get(key string) (Item, bool) {
+	item, found, _ := s.TryGet(key)
+	return item, found
+}
+
+func (s *timeoutStorage) GetObject(key string, o interface{}) (Item, bool) {
+	item, found, _ := s.TryGetObject(key, o)
+	return item, found
+}
+
+func (s *timeoutStorage) Set(key string, item Item) {
+	if err := s.TrySet(key, item); err != nil {
+		log.Errorf("error setting %s : %s", key, err)
+	}
+}
+
+func (s *timeoutStorage) Del(key string) {
+	if err := s.TryDel(key); err != nil {
+		log.Errorf("error deleting %s : %s", key, err)
+	}
+}
+
+// The results are passed through a channel so that an operation finishing
+// after its timeout doesn't write to the returned values.
+func (s *timeoutStorage) TryGet(key string) (Item, bool, error) {
+	return s.TryGetObject(key, nil)
+}
+
+// The value is decoded into a new value of o's type, copied into o only if it
+// arrives in time, so that a read finishing after its timeout doesn't write
+// to o while the caller uses it.
+func (s *timeoutStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	type result struct {
+		item  Item
+		found bool
+	}
+	dest := o
+	ov := reflect.ValueOf(o)
+	if ov.Kind() == reflect.Ptr && !ov.IsNil() {
+		dest = reflect.New(ov.Elem().Type()).Interface()
+	}
+	results := make(chan result, 1)
+	err := withTimeout(s.opts.Get, func() error {
+		var item Item
+		var found bool
+		var err error
+		if dest == nil {
+			item, found, err = tryGet(s.Storage, key)
+		} else {
+			item, found, err = tryGetObject(s.Storage, key, dest)
+		}
+		results <- result{item, found}
+		return err
+	})
+	if err == ErrTimeout {
+		log.Errorf("error getting %s : %s", key, err)
+		return Item{}, false, err
+	}
+	r := <-results
+	if dest != o && r.item.Object == dest {
+		ov.Elem().Set(reflect.ValueOf(dest).Elem())
+		r.item.Object = o
+	}
+	return r.item, r.found, err
+}
+
+func (s *timeoutStorage) TrySet(key string, item Item) error {
+	return withTimeout(s.opts.Set, func() error {
+		return trySet(s.Storage, key, item)
+	})
+}
+
+func (s *timeoutStorage) TryDel(key string) error {
+	return withTimeout(s.opts.Del, func() error {
+		return tryDel(s.Storage, key)
+	})
+}
+
+func (s *timeoutStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// Returns a storage that fails the reads, writes and deletes of s that take
+// longer than the timeouts in o with ErrTimeout, even when the client of s
+// doesn't support deadlines, so that a hung connection doesn't block the
+// caller forever. Operations that time out are left running in the
+// background. Lock and Unlock are not bounded.
+func TimeoutStorage(s Storage, o TimeoutOptions) *timeoutStorage {
+	for _, d := range []*time.Duration{&o.Get, &o.Set, &o.Del} {
+		if *d == 0 {
+			*d = DefaultOperationTimeout
+		}
+	}
+	return &timeoutStorage{
+		Storage: s,
+		opts:    o,
+	}
+}
+
+// Like Get, but gives up after timeout, returning ErrTimeout. Overrides the
+// timeout of a TimeoutStorage for this call when it is shorter.
+func (c *cache) GetWithTimeout(k string, timeout time.Duration) (interface{}, bool, error) {
+	type result struct {
+		x     interface{}
+		found bool
+	}
+	results := make(chan result, 1)
+	err := withTimeout(timeout, func() error {
+		x, found := c.Get(k)
+		results <- result{x, found}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	r := <-results
+	return r.x, r.found, nil
+}
+
+// Like Set, but gives up after timeout, returning ErrTimeout. The item may
+// still be set once the call has returned.
+func (c *cache) SetWithTimeout(k string, x interface{}, d time.Duration, rd time.Duration, timeout time.Duration) error {
+	if err := c.validate(k, x); err != nil {
+		return err
+	}
+	return withTimeout(timeout, func() error {
+		c.store(k, x, d, rd)
+		return nil
+	})
+}
+
+// Like Delete, but gives up after timeout, returning ErrTimeout. The item may
+// still be deleted once the call has returned.
+func (c *cache) DeleteWithTimeout(k string, timeout time.Duration) error {
+	return withTimeout(timeout, func() error {
+		c.Delete(k)
+		return nil
+	})
+}
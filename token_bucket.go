@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	redis "gopkg.in/redis.v4"
+)
+
+// Implemented by storages shared by several processes that can update token
+// buckets atomically on the server, e.g. the Redis storages.
+type tokenTaker interface {
+	takeToken(key string, rate float64, burst int64, now time.Time) (bool, time.Duration, error)
+}
+
+// Returns the storage s is or wraps that can update token buckets, if any.
+func tokenTakerOf(s Storage) (tokenTaker, bool) {
+	return storageAs[tokenTaker](s)
+}
+
+// The token buckets of a cache whose storage can't update them, by key.
+type tokenBuckets struct {
+	mutex   sync.Mutex
+	buckets map[string]tokenBucket
+	swept   int // the number of buckets after the last sweep
+}
+
+// The state of a token bucket: the tokens it held at updated, and when it is
+// full again, in Unix nanoseconds.
+type tokenBucket struct {
+	tokens  float64
+	updated int64
+	full    int64
+}
+
+// Takes a token from the bucket of key, which holds up to burst tokens and is
+// refilled with rate tokens per second, starting full. Returns true if there
+// was a token, or false and how long until there is one. Unlike the windows
+// of ConsumeQuota, the bucket never lets more than burst requests through at
+// once, even across window boundaries. On Redis the bucket is kept in a hash
+// of its own, updated atomically by a script, so that every process sharing
+// the server takes from the same bucket (with their clocks in sync); with
+// other storages each process keeps its buckets in memory. Buckets aren't
+// items, as for ConsumeQuota, and are deleted once full again. Storage errors
+// are logged and reported as an empty bucket.
+func (c *cache) TakeToken(key string, rate float64, burst int64) (bool, time.Duration) {
+	if rate <= 0 || burst < 1 {
+		return false, 0
+	}
+	now := timeNow()
+	var ok bool
+	var wait time.Duration
+	var err error
+	if tt, found := tokenTakerOf(c.storage); found {
+		ok, wait, err = tt.takeToken(key, rate, burst, now)
+	} else {
+		ok, wait, err = c.takeToken(key, rate, burst, now)
+	}
+	if err != nil {
+		log.Errorf("error taking token from %s : %s", key, err)
+		return false, 0
+	}
+	return ok, wait
+}
+
+// Full buckets are swept whenever their number has doubled since the last
+// sweep, as tombstones are.
+func (c *cache) takeToken(key string, rate float64, burst int64, now time.Time) (bool, time.Duration, error) {
+	t := &c.tokenBuckets
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	b := tokenBucket{tokens: float64(burst), updated: now.UnixNano()}
+	if old, found := t.buckets[key]; found {
+		b.tokens = math.Min(float64(burst), old.tokens+rate*now.Sub(time.Unix(0, old.updated)).Seconds())
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))).UnixNano()
+	if t.buckets == nil {
+		t.buckets = make(map[string]tokenBucket)
+	}
+	t.buckets[key] = b
+	if len(t.buckets) > 2*t.swept+64 {
+		for k, b := range t.buckets {
+			if now.UnixNano() >= b.full {
+				delete(t.buckets, k)
+			}
+		}
+		t.swept = len(t.buckets)
+	}
+	return true, 0, nil
+}
+
+// Refills the bucket KEYS[1] (fields tokens and updated, in milliseconds) at
+// ARGV[1] tokens per second up to ARGV[2] tokens as of ARGV[3], and takes a
+// token. Returns 1 and 0 if there was one, or 0 and the milliseconds until
+// there is one.
+var redisTokenBucketScript = redis.NewScript(`
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1])
+if tokens == nil then
+	tokens = burst
+else
+	local elapsed = math.max(0, now - tonumber(state[2]))
+	tokens = math.min(burst, tokens + elapsed * rate / 1000)
+end
+if tokens < 1 then
+	return {0, math.ceil((1 - tokens) * 1000 / rate)}
+end
+tokens = tokens - 1
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "updated", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) * 1000 / rate))
+return {1, 0}
+`)
+
+func (s *redisStorage) takeToken(key string, rate float64, burst int64, now time.Time) (bool, time.Duration, error) {
+	res, err := redisTokenBucketScript.Run(s.redisClient, []string{s.internalKey("bucket", key)}, rate, burst, now.UnixNano()/int64(time.Millisecond)).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return false, 0, newError(ErrWrongType, "Unexpected reply %v for token bucket %s", res, key)
+	}
+	ok, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return ok == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+func (s *shardedRedisStorage) takeToken(key string, rate float64, burst int64, now time.Time) (bool, time.Duration, error) {
+	node := s.node(key)
+	if node == nil {
+		return false, 0, errNoHealthyNode
+	}
+	return node.takeToken(key, rate, burst, now)
+}
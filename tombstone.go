@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// The deletions recorded once enabled with SetTombstones, by key, in Unix
+// nanoseconds.
+type tombstones struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	deleted map[string]int64 // nil when disabled
+	swept   int              // the number of tombstones after the last sweep
+}
+
+// Makes the cache record a tombstone, the key and the time it was deleted,
+// whenever an item is deleted through it (by Delete, DeleteMulti, a
+// transaction, Rename or an invalidation from another instance), and keep it
+// for ttl or until the key is set again. Tombstone tells a key that was
+// deleted from one that never existed, and deletions received from an
+// invalidation bus (see UseInvalidationBus) are only applied to items set
+// before them, so that a deletion delivered late doesn't delete the newer
+// value set since. Comparing times across processes relies on their clocks
+// being in sync. A ttl of zero or less stops recording tombstones and forgets
+// the ones recorded. Flush forgets them too.
+func (c *cache) SetTombstones(ttl time.Duration) {
+	c.tombstones.mutex.Lock()
+	c.tombstones.ttl = ttl
+	if ttl <= 0 {
+		c.tombstones.deleted = nil
+	} else if c.tombstones.deleted == nil {
+		c.tombstones.deleted = make(map[string]int64)
+	}
+	c.tombstones.mutex.Unlock()
+}
+
+// Returns when the item of k was deleted, if tombstones are enabled (see
+// SetTombstones) and k has been deleted within their TTL without being set
+// again since.
+func (c *cache) Tombstone(k string) (time.Time, bool) {
+	c.tombstones.mutex.Lock()
+	at, found := c.tombstones.deleted[k]
+	ttl := c.tombstones.ttl
+	c.tombstones.mutex.Unlock()
+	if !found || timeNow().UnixNano() > at+int64(ttl) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, at), true
+}
+
+// Returns whether tombstones are enabled.
+func (c *cache) tombstonesEnabled() bool {
+	c.tombstones.mutex.Lock()
+	defer c.tombstones.mutex.Unlock()
+	return c.tombstones.deleted != nil
+}
+
+// Records that k was deleted at the Unix nanosecond time at. Expired
+// tombstones are swept whenever their number has doubled since the last
+// sweep.
+func (c *cache) recordTombstone(k string, at int64) {
+	t := &c.tombstones
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.deleted == nil {
+		return
+	}
+	t.deleted[k] = at
+	if len(t.deleted) > 2*t.swept+64 {
+		now := timeNow().UnixNano()
+		for k, at := range t.deleted {
+			if now > at+int64(t.ttl) {
+				delete(t.deleted, k)
+			}
+		}
+		t.swept = len(t.deleted)
+	}
+}
+
+func (c *cache) forgetTombstone(k string) {
+	c.tombstones.mutex.Lock()
+	delete(c.tombstones.deleted, k)
+	c.tombstones.mutex.Unlock()
+}
+
+func (c *cache) resetTombstones() {
+	c.tombstones.mutex.Lock()
+	if c.tombstones.deleted != nil {
+		c.tombstones.deleted = make(map[string]int64)
+		c.tombstones.swept = 0
+	}
+	c.tombstones.mutex.Unlock()
+}
+
+// Deletes the item of k for a deletion received from another instance at the
+// Unix nanosecond time at, unless tombstones are enabled and the item was set
+// after that. Called with the storage locked.
+// The tombstone records the time of the deletion rather than when it was
+// received, unless k was deleted here later than that.
+func (c *cache) deleteInvalidated(k string, at int64) {
+	if at <= 0 || !c.tombstonesEnabled() {
+		c.delete(k)
+		return
+	}
+	if item, found := c.storage.Get(k); found && item.CreatedAt > at {
+		return
+	}
+	prev, hadTombstone := c.Tombstone(k)
+	c.delete(k)
+	if hadTombstone && prev.UnixNano() > at {
+		at = prev.UnixNano()
+	}
+	c.recordTombstone(k, at)
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// The prefix of the keys Transport caches responses under, followed by
+	// the request's URL.
+	TransportKeyPrefix = "http:"
+	// Responses with a bigger body are passed through without being cached.
+	TransportMaxBodySize = 10 << 20
+)
+
+type transport struct {
+	c    *Cache
+	base http.RoundTripper
+}
+
+// Returns an http.RoundTripper, for an http.Client's Transport, that sends
+// requests with http.DefaultTransport and caches the responses to GET
+// requests in c, following the basics of RFC 7234: a response is cached if it
+// has a cacheable status (200, 203, 300, 301, 404 or 410) and a freshness
+// lifetime given by the s-maxage or max-age directive of its Cache-Control
+// header or by its Expires header, and neither the request nor the response
+// has no-store, the response no-cache or private, the request an
+// Authorization header or the response a Vary header. Cached responses are
+// served until they are no longer fresh, with their Age header updated. A
+// response with stale-if-error=N is kept N seconds longer, and served (with a
+// 110 Warning) when the server can't be reached or answers with a 5xx error.
+// A request with no-cache or max-age=0 always goes to the server. Responses
+// are stored as bytes (see SetBytes), so any storage can keep them.
+func Transport(c *Cache) *transport {
+	return &transport{c: c, base: http.DefaultTransport}
+}
+
+// Sets the RoundTripper requests are sent with, instead of
+// http.DefaultTransport.
+func (t *transport) SetBase(rt http.RoundTripper) {
+	t.base = rt
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return t.base.RoundTrip(req)
+	}
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return t.base.RoundTrip(req)
+	}
+	key := TransportKeyPrefix + req.URL.String()
+	_, noCache := reqCC["no-cache"]
+	noCache = noCache || reqCC["max-age"] == "0"
+
+	var stale *http.Response
+	if b, found := t.c.GetBytes(key); found && len(b) > 8 {
+		freshUntil := int64(binary.LittleEndian.Uint64(b))
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[8:])), req)
+		if err != nil {
+			log.Errorf("error decoding cached response for %s : %s", key, err)
+		} else if !noCache && timeNow().UnixNano() <= freshUntil {
+			setAge(resp)
+			return resp, nil
+		} else {
+			stale = resp
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if stale != nil && (err != nil || resp.StatusCode >= 500) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		setAge(stale)
+		stale.Header.Add("Warning", `110 - "Response is Stale"`)
+		return stale, nil
+	}
+	if stale != nil {
+		stale.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	fresh, keep := cacheLifetimes(resp)
+	if fresh <= 0 || resp.ContentLength > TransportMaxBodySize {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, TransportMaxBodySize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > TransportMaxBodySize {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if resp.Header.Get("Date") == "" {
+		resp.Header.Set("Date", timeNow().UTC().Format(http.TimeFormat))
+	}
+	dump, err := httputil.DumpResponse(resp, true)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("error encoding response for %s : %s", key, err)
+		return resp, nil
+	}
+	b := make([]byte, 8+len(dump))
+	binary.LittleEndian.PutUint64(b, uint64(timeNow().Add(fresh).UnixNano()))
+	copy(b[8:], dump)
+	t.c.SetBytes(key, b, fresh+keep, NoRefreshDeadline)
+	return resp, nil
+}
+
+// Closes the original body of a response whose body was partly read.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Returns how long a response stays fresh, taking its Age into account, and
+// how much longer it can be served when the server fails, or a zero freshness
+// if it can't be cached.
+func cacheLifetimes(resp *http.Response) (fresh, keep time.Duration) {
+	switch resp.StatusCode {
+	case 200, 203, 300, 301, 404, 410:
+	default:
+		return 0, 0
+	}
+	if resp.Header.Get("Vary") != "" {
+		return 0, 0
+	}
+	cc := parseCacheControl(resp.Header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return 0, 0
+		}
+	}
+	if v, ok := cc["s-maxage"]; ok {
+		fresh = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		fresh = parseSeconds(v)
+	} else if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = timeNow()
+		}
+		fresh = expires.Sub(date)
+	}
+	fresh -= parseSeconds(resp.Header.Get("Age"))
+	if v, ok := cc["stale-if-error"]; ok {
+		keep = parseSeconds(v)
+	}
+	return fresh, keep
+}
+
+// Returns the directives of the Cache-Control header, lowercased, with their
+// unquoted values.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h["Cache-Control"] {
+		for _, d := range strings.Split(line, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+// Returns a number of seconds as a duration, or 0 if s isn't one.
+func parseSeconds(s string) time.Duration {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Sets the Age header of a cached response from its Date header.
+func setAge(resp *http.Response) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	age := timeNow().Sub(date)
+	if age < 0 {
+		age = 0
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
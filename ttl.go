@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"time"
+)
+
+// Add an item to the cache, replacing any existing item, that is served until
+// its hard TTL, but should be refreshed (see OnRefreshNeeded) once its soft
+// TTL has passed; in between, the stale value is served while it's being
+// refreshed. soft is a refresh deadline and hard an expiration, so they
+// accept DefaultRefreshDeadline or NoRefreshDeadline, and DefaultExpiration or
+// NoExpiration, respectively. Returns an error, setting nothing, if soft is
+// after hard.
+func (c *cache) SetWithTTLs(k string, x interface{}, soft, hard time.Duration) error {
+	if err := c.checkTTLs(soft, hard); err != nil {
+		return err
+	}
+	if err := c.validate(k, x); err != nil {
+		return err
+	}
+	c.store(k, x, hard, soft)
+	return nil
+}
+
+func (c *cache) checkTTLs(soft, hard time.Duration) error {
+	if soft == DefaultRefreshDeadline {
+		soft = c.defaultRefreshDeadline
+	}
+	if soft < 0 && soft != NoRefreshDeadline {
+		return newError(ErrInvalidDuration, "Invalid refresh deadline %s", soft)
+	}
+	if hard < 0 && hard != NoExpiration {
+		return newError(ErrInvalidDuration, "Invalid expiration %s", hard)
+	}
+	if hard == DefaultExpiration {
+		hard = c.defaultExpiration
+	}
+	if hard > 0 && soft > hard {
+		return newError(ErrInvalidDuration, "Refresh deadline %s is after expiration %s", soft, hard)
+	}
+	return nil
+}
+
+// Returns an error if the expiration d and refresh deadline rd given to Set,
+// Add or Replace don't make sense together: negative durations other than
+// NoExpiration and NoRefreshDeadline, a refresh deadline after the
+// expiration, or a refresh deadline with the default expiration of a cache
+// whose items don't expire by default, which is usually a forgotten
+// expiration.
+func (c *cache) checkDurations(d, rd time.Duration) error {
+	if err := c.checkTTLs(rd, d); err != nil {
+		return err
+	}
+	if rd == DefaultRefreshDeadline {
+		rd = c.defaultRefreshDeadline
+	}
+	if d == DefaultExpiration && c.defaultExpiration < 0 && rd > 0 {
+		return newError(ErrInvalidDuration, "Refresh deadline %s set without an expiration", rd)
+	}
+	return nil
+}
+
+// Like Set, but returns an error instead of setting the item if d and rd
+// don't make sense together (see SetWithTTLs), or if the storage fails to
+// write it (see CheckedStorage).
+func (c *cache) SetChecked(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	if err := c.checkDurations(d, rd); err != nil {
+		return err
+	}
+	if err := c.validate(k, x); err != nil {
+		return err
+	}
+	if c.bypassWrites() {
+		c.Delete(k)
+		return nil
+	}
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	if !c.admit(k) {
+		return nil
+	}
+	item := c.newItem(k, x, d, rd)
+	if err := trySet(c.storage, k, item); err != nil {
+		return err
+	}
+	c.written(k, item)
+	return nil
+}
+
+// Like Add, but also returns an error if d and rd don't make sense together.
+func (c *cache) AddChecked(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	if err := c.checkDurations(d, rd); err != nil {
+		return err
+	}
+	return c.Add(k, x, d, rd)
+}
+
+// Like Replace, but also returns an error if d and rd don't make sense
+// together.
+func (c *cache) ReplaceChecked(k string, x interface{}, d time.Duration, rd time.Duration) error {
+	if err := c.checkDurations(d, rd); err != nil {
+		return err
+	}
+	return c.Replace(k, x, d, rd)
+}
+
+// Sets the refresh deadline used for items set with DefaultRefreshDeadline.
+// Should be called before the cache is used.
+func (c *cache) SetDefaultRefreshDeadline(rd time.Duration) {
+	if rd == DefaultRefreshDeadline {
+		rd = NoRefreshDeadline
+	}
+	c.defaultRefreshDeadline = rd
+}
+
+// Returns how long until the item of k expires, NoExpiration if it never
+// does, and whether k has an item that hasn't expired. Unlike Get, the read
+// isn't counted as an access and doesn't queue a refresh.
+func (c *cache) TTL(k string) (time.Duration, bool) {
+	item, found := c.InspectItem(k)
+	if !found || item.Expired() {
+		return 0, false
+	}
+	if item.Expiration == 0 {
+		return NoExpiration, true
+	}
+	return time.Duration(item.Expiration - timeNow().UnixNano()), true
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"time"
+
+	redis "gopkg.in/redis.v4"
+)
+
+// The operations available inside a transaction started with Txn. Writes are
+// only applied when the transaction commits, but are seen by the
+// transaction's own reads.
+type Txn interface {
+	Get(k string) (interface{}, bool)
+	Set(k string, x interface{}, d time.Duration, rd time.Duration)
+	Delete(k string)
+}
+
+// A write made in a transaction.
+type txnOp struct {
+	key  string
+	item Item
+	del  bool
+}
+
+// Implemented by storages that can apply several writes atomically.
+type txnStorage interface {
+	// Applies ops, or none of them if it fails. Called with the lock held.
+	commitTxn(ops []txnOp) error
+}
+
+type txn struct {
+	c       *cache
+	ops     []txnOp
+	pending map[string]int // index of each key's last write in ops
+	err     error          // the first value rejected by the validator
+}
+
+func (t *txn) Get(k string) (interface{}, bool) {
+	if i, found := t.pending[k]; found {
+		if t.ops[i].del {
+			return nil, false
+		}
+		return t.ops[i].item.Object, true
+	}
+	return t.c.get(k)
+}
+
+func (t *txn) Set(k string, x interface{}, d time.Duration, rd time.Duration) {
+	if err := t.c.validate(k, x); err != nil {
+		if t.err == nil {
+			t.err = err
+		}
+		return
+	}
+	if t.c.bypassWrites() || !t.c.admits(k) {
+		t.Delete(k)
+		return
+	}
+	t.write(txnOp{key: k, item: t.c.newItem(k, x, d, rd)})
+}
+
+func (t *txn) Delete(k string) {
+	t.write(txnOp{key: k, del: true})
+}
+
+func (t *txn) write(op txnOp) {
+	t.pending[op.key] = len(t.ops)
+	t.ops = append(t.ops, op)
+}
+
+// Runs fn with the storage locked, and then applies the writes it made, unless
+// it returns an error. Other goroutines, and other processes for storages with
+// a distributed lock, don't see the writes until they are all applied:
+// memory storages apply them while still holding the lock, and Redis
+// storages in a single MULTI/EXEC transaction. Other storages apply them one
+// by one, so readers that don't take the lock may see some of them before the
+// others. Returns the error returned by fn or by the commit. If the validator
+// (see SetValidator) rejects a value set in the transaction, none of the
+// writes are applied and its error is returned. As with Set, a value set while
+// writes are bypassed (see SetBypass) or for a key the admission policy
+// rejects deletes the key instead.
+func (c *cache) Txn(fn func(tx Txn) error) error {
+	c.storage.Lock()
+	defer c.storage.Unlock()
+	t := &txn{c: c, pending: make(map[string]int)}
+	if err := fn(t); err != nil {
+		return err
+	}
+	if t.err != nil {
+		return t.err
+	}
+	if ts, ok := c.storage.(txnStorage); ok {
+		if err := ts.commitTxn(t.ops); err != nil {
+			return err
+		}
+		for _, op := range t.ops {
+			if op.del {
+				c.removed(op.key)
+				c.unpin(op.key)
+			} else {
+				c.written(op.key, op.item)
+			}
+		}
+		return nil
+	}
+	for _, op := range t.ops {
+		var err error
+		if op.del {
+			err = c.tryDelete(op.key)
+		} else if err = trySet(c.storage, op.key, op.item); err == nil {
+			c.written(op.key, op.item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStorage) commitTxn(ops []txnOp) error {
+	return s.redisClient.Watch(func(tx *redis.Tx) error {
+		_, err := tx.MultiExec(func() error {
+			for _, op := range ops {
+				if op.del {
+					tx.Del(s.key(op.key))
+				} else {
+					tx.Set(s.key(op.key), s.Marshal(op.item), time.Unix(0, op.item.Expiration).Sub(timeNow()))
+				}
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// Commits the transaction on the node owning its keys. Fails if they are on
+// different nodes; a Partitioner can keep the keys written together on the
+// same node.
+func (s *shardedRedisStorage) commitTxn(ops []txnOp) error {
+	var node *redisStorage
+	for _, op := range ops {
+		n := s.node(op.key)
+		if n == nil {
+			return errNoHealthyNode
+		}
+		if node != nil && n != node {
+			return newError(ErrNotSupported, "Keys %s and %s of the transaction are on different shards", ops[0].key, op.key)
+		}
+		node = n
+	}
+	if node == nil {
+		return nil
+	}
+	return node.commitTxn(ops)
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"time"
+)
+
+// Separates a namespace from the keys in it.
+const NamespaceSeparator = ":"
+
+// Returns the key under which k is stored in namespace ns.
+func namespacedKey(ns, k string) string {
+	return ns + NamespaceSeparator + k
+}
+
+// A type-safe view of the items of one type in a namespace of a cache. Views
+// with different namespaces share the cache's storage without their keys
+// colliding.
+type TypedView[T any] struct {
+	c         *Cache
+	namespace string
+}
+
+// Returns a view of the items of type T in the given namespace of c. Keys
+// passed to the view are stored as namespace + NamespaceSeparator + key, with
+// the namespace's generation in between once it has been invalidated (see
+// InvalidateNamespace).
+func Typed[T any](c *Cache, namespace string) *TypedView[T] {
+	return &TypedView[T]{
+		c:         c,
+		namespace: namespace,
+	}
+}
+
+// Returns the namespace of the view.
+func (v *TypedView[T]) Namespace() string {
+	return v.namespace
+}
+
+// Get an item from the view. Returns the item or the zero value of T, and a
+// bool indicating whether the key was found and holds a T.
+func (v *TypedView[T]) Get(k string) (T, bool) {
+	var zero T
+	// Storages that decode values (e.g. Redis) need a destination; the
+	// others return the value that was set.
+	x, found := v.c.GetObject(v.c.versionedKey(v.namespace, k), new(T))
+	if !found {
+		return zero, false
+	}
+	return asType[T](x)
+}
+
+// Add an item to the view, replacing any existing item. Durations are
+// interpreted as for Cache.Set.
+func (v *TypedView[T]) Set(k string, x T, d time.Duration, rd time.Duration) {
+	v.c.Set(v.c.versionedKey(v.namespace, k), x, d, rd)
+}
+
+// Add an item to the view only if an item doesn't already exist for the
+// given key, or if the existing item has expired. Returns an error otherwise.
+func (v *TypedView[T]) Add(k string, x T, d time.Duration, rd time.Duration) error {
+	return v.c.Add(v.c.versionedKey(v.namespace, k), x, d, rd)
+}
+
+// Set a new value for the key only if it already exists, and the existing
+// item hasn't expired. Returns an error otherwise.
+func (v *TypedView[T]) Replace(k string, x T, d time.Duration, rd time.Duration) error {
+	return v.c.Replace(v.c.versionedKey(v.namespace, k), x, d, rd)
+}
+
+// Delete an item from the view. Does nothing if the key is not in the view.
+func (v *TypedView[T]) Delete(k string) {
+	v.c.Delete(v.c.versionedKey(v.namespace, k))
+}
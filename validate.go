@@ -0,0 +1,27 @@
+package cache
+
+// Sets an (optional) function that every value set is checked with (with Set,
+// Add, Replace, SetIf, SetBytes, SetAsync, transactions, handoffs and the
+// like), to keep values that break the invariants their readers rely on, such
+// as a nil required field or the wrong type for a namespace, out of the
+// cache. When f returns an error the value isn't set, and any existing item
+// is left as it is: the methods that return an error return one wrapping
+// ErrInvalidValue, and Set, which doesn't, logs it. Values SetReader streams
+// to a StreamStorage aren't checked, since they're never held in memory. f
+// must be safe to call concurrently, and must not use the cache: it's called
+// with the storage locked in transactions.
+func (c *cache) SetValidator(f func(key string, v interface{}) error) {
+	c.validator.Store(f)
+}
+
+// Returns an error if the validator rejects x as the value of k.
+func (c *cache) validate(k string, x interface{}) error {
+	f, _ := c.validator.Load().(func(string, interface{}) error)
+	if f == nil {
+		return nil
+	}
+	if err := f(k, x); err != nil {
+		return newError(ErrInvalidValue, "Invalid value for %s : %s", k, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"strings"
+)
+
+// The keys of a VersionedKeysStorage start with this marker, followed by the
+// version and NamespaceSeparator.
+const VersionKeyMarker = "~v"
+
+type versionedKeysStorage struct {
+	Storage
+	prefix string
+}
+
+// Returns the key the storage stores k under.
+func (s *versionedKeysStorage) versionKey(k string) string {
+	return s.prefix + k
+}
+
+func (s *versionedKeysStorage) Get(key string) (Item, bool) {
+	return s.Storage.Get(s.versionKey(key))
+}
+
+func (s *versionedKeysStorage) GetObject(key string, o interface{}) (Item, bool) {
+	return s.Storage.GetObject(s.versionKey(key), o)
+}
+
+func (s *versionedKeysStorage) Set(key string, item Item) {
+	s.Storage.Set(s.versionKey(key), item)
+}
+
+func (s *versionedKeysStorage) Del(key string) {
+	s.Storage.Del(s.versionKey(key))
+}
+
+func (s *versionedKeysStorage) TryGet(key string) (Item, bool, error) {
+	return tryGet(s.Storage, s.versionKey(key))
+}
+
+func (s *versionedKeysStorage) TryGetObject(key string, o interface{}) (Item, bool, error) {
+	return tryGetObject(s.Storage, s.versionKey(key), o)
+}
+
+func (s *versionedKeysStorage) TrySet(key string, item Item) error {
+	return trySet(s.Storage, s.versionKey(key), item)
+}
+
+func (s *versionedKeysStorage) TryDel(key string) error {
+	return tryDel(s.Storage, s.versionKey(key))
+}
+
+// Lists the keys of the current version only, without their version.
+func (s *versionedKeysStorage) scanKeys(prefix string, fn func(string)) error {
+	ks, ok := keyScannerOf(s.Storage)
+	if !ok {
+		return newError(ErrNotSupported, "Listing keys is not supported by this storage")
+	}
+	return ks.scanKeys(s.prefix+prefix, func(k string) {
+		fn(strings.TrimPrefix(k, s.prefix))
+	})
+}
+
+func (s *versionedKeysStorage) pageKeys(pattern string, cursor uint64, count int) ([]string, uint64, error) {
+	kp, ok := keyPagerOf(s.Storage)
+	if !ok {
+		return pageScannedKeys(s, pattern, cursor, count)
+	}
+	keys, next, err := kp.pageKeys(redisPatternEscaper.Replace(s.prefix)+pattern, cursor, count)
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, s.prefix)
+	}
+	return keys, next, err
+}
+
+func (s *versionedKeysStorage) loadMatching(pattern string, limit int, fn func(key string, item Item)) error {
+	bl, ok := bulkLoaderOf(s.Storage)
+	if !ok {
+		return newError(ErrNotSupported, "Warming with pattern %s is not supported by this storage", pattern)
+	}
+	return bl.loadMatching(redisPatternEscaper.Replace(s.prefix)+pattern, limit, func(key string, item Item) {
+		fn(strings.TrimPrefix(key, s.prefix), item)
+	})
+}
+
+// Returns the keys of the current version among keys, without their version.
+func (s *versionedKeysStorage) ownKeys(keys []string) []string {
+	var own []string
+	for _, k := range keys {
+		if strings.HasPrefix(k, s.prefix) {
+			own = append(own, strings.TrimPrefix(k, s.prefix))
+		}
+	}
+	return own
+}
+
+func (s *versionedKeysStorage) pin(key string) {
+	if ps, ok := pinnableStorageOf(s.Storage); ok {
+		ps.pin(s.versionKey(key))
+	}
+}
+
+func (s *versionedKeysStorage) unpin(key string) {
+	if ps, ok := pinnableStorageOf(s.Storage); ok {
+		ps.unpin(s.versionKey(key))
+	}
+}
+
+func (s *versionedKeysStorage) setUnpinHandler(fn func([]string)) {
+	if ps, ok := pinnableStorageOf(s.Storage); ok {
+		ps.setUnpinHandler(func(keys []string) {
+			if own := s.ownKeys(keys); len(own) > 0 {
+				fn(own)
+			}
+		})
+	}
+}
+
+// Reports the deleted items of the current version only, without their
+// version.
+func (s *versionedKeysStorage) setExpireHandler(fn func(string, Item)) {
+	if n, ok := expiryNotifierOf(s.Storage); ok {
+		n.setExpireHandler(func(k string, item Item) {
+			if strings.HasPrefix(k, s.prefix) {
+				fn(strings.TrimPrefix(k, s.prefix), item)
+			}
+		})
+	}
+}
+
+// Deletes the keys of the current version, in one operation if the wrapped
+// storage can.
+func (s *versionedKeysStorage) delMulti(keys []string) ([]string, error) {
+	return delMultiAs(s.Storage, keys, s.versionKey)
+}
+
+func (s *versionedKeysStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// Returns a storage that stores the items of s under keys starting with
+// version, e.g. the version of the program, so that a new deploy starts with
+// an empty cache without flushing anything: the items set by the previous
+// version are no longer read, and are deleted by the storage when they
+// expire, so they should be set with an expiration. Other programs sharing
+// the storage, such as other tenants of a Redis server, keep their items.
+// Keys are stored as VersionKeyMarker, version and NamespaceSeparator
+// followed by the key, and listed (e.g. by Keys and DeletePrefix) without
+// their version.
+func VersionedKeysStorage(s Storage, version string) *versionedKeysStorage {
+	return &versionedKeysStorage{
+		Storage: s,
+		prefix:  VersionKeyMarker + version + NamespaceSeparator,
+	}
+}
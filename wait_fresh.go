@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"context"
+)
+
+// Like Get, but if the item of k is being refreshed, by a refresh worker (see
+// OnRefreshNeeded) or by Fetch or GetFresh, waits for the refresh to finish
+// and returns the new value, e.g. for reads that must see the value refreshed
+// after an invalidation. Returns the value Get returned, which may be stale,
+// if ctx is done first. A Get reaching the item's refresh deadline queues the
+// refresh, so the first reader past the deadline waits too.
+func (c *cache) GetWaitFresh(ctx context.Context, k string) (interface{}, bool) {
+	v, found := c.Get(k)
+	done := c.refreshing(k)
+	if done == nil {
+		return v, found
+	}
+	select {
+	case <-done:
+		return c.Get(k)
+	case <-ctx.Done():
+		return v, found
+	}
+}
+
+// Returns a channel closed once the refresh of k in progress is done, or nil
+// if k isn't being refreshed.
+func (c *cache) refreshing(k string) <-chan bool {
+	c.fetchesMutex.Lock()
+	call, found := c.fetches[k]
+	c.fetchesMutex.Unlock()
+	if found {
+		return call.done
+	}
+	c.refreshWaitsMutex.Lock()
+	defer c.refreshWaitsMutex.Unlock()
+	if done, found := c.refreshWaits[k]; found {
+		return done
+	}
+	return nil
+}
+
+// Records that k has been queued for a refresh.
+func (c *cache) refreshStarted(k string) {
+	c.refreshWaitsMutex.Lock()
+	if c.refreshWaits == nil {
+		c.refreshWaits = make(map[string]chan bool)
+	}
+	if _, found := c.refreshWaits[k]; !found {
+		c.refreshWaits[k] = make(chan bool)
+	}
+	c.refreshWaitsMutex.Unlock()
+}
+
+// Wakes up the readers waiting for the refresh of k.
+func (c *cache) refreshFinished(k string) {
+	c.refreshWaitsMutex.Lock()
+	if done, found := c.refreshWaits[k]; found {
+		close(done)
+		delete(c.refreshWaits, k)
+	}
+	c.refreshWaitsMutex.Unlock()
+}